@@ -0,0 +1,334 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/state"
+)
+
+// Outcome of the build of one image of a batch
+type batchItem struct {
+	Image string `json:"image"`
+	*buildResult
+	Error string `json:"error,omitempty"`
+	err   error
+}
+
+// Read the image URIs of a batch, one per line, skipping empty lines and # comments. "-" reads stdin.
+func readImageList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var imageUrls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		imageUrls = append(imageUrls, line)
+	}
+	return imageUrls, scanner.Err()
+}
+
+// The images of one shard of a batch split across shardCount parallel jobs. Images are assigned by a hash
+// of their URI, so each image belongs to the same shard whatever the order or the other lines of the list.
+func shardImages(imageUrls []string, shardIndex int, shardCount int) []string {
+	var shard []string
+	for _, imageUrl := range imageUrls {
+		h := fnv.New32a()
+		h.Write([]byte(imageUrl))
+		if int(h.Sum32()%uint32(shardCount)) == shardIndex {
+			shard = append(shard, imageUrl)
+		}
+	}
+	return shard
+}
+
+// Build the SOCI indices of many images one after the other.
+// Layers shared by the images, e.g. base image layers, are indexed once: their ztocs are kept in memory
+// for the rest of the run (in front of the -ztoc-cache, if any) and the layers aren't downloaded again.
+// The work directory of each image is removed before the next one, so disk usage doesn't grow with the batch,
+// and the ztocs kept in memory are capped by memoryCacheSize (0 means no limit).
+// Images already done according to the progress (if not nil) are skipped and the outcome of each built image is recorded in it.
+// Each image has its own deadline derived from ctx. Once ctx is done, e.g. on SIGTERM, the remaining images are neither
+// built nor recorded, so a resumed batch builds them.
+func buildImages(ctx context.Context, imageUrls []string, opts buildOptions, memoryCacheSize int64, progress *batchProgress) []batchItem {
+	runCache := cache.Cache(cache.NewMemoryCache(memoryCacheSize))
+	if opts.ztocCache != nil {
+		runCache = cache.NewTiered(runCache, opts.ztocCache)
+	}
+	opts.ztocCache = runCache
+
+	items := make([]batchItem, 0, len(imageUrls))
+	for i, imageUrl := range imageUrls {
+		if ctx.Err() != nil {
+			log.Warn(ctx, fmt.Sprintf("Stopping the batch, %d of %d images weren't built: %v", len(imageUrls)-i, len(imageUrls), context.Cause(ctx)))
+			break
+		}
+		if entry, ok := progress.done(imageUrl); ok {
+			items = append(items, batchItem{Image: imageUrl, buildResult: &buildResult{Message: SkipDoneMessage, ImageDigest: entry.ImageDigest}})
+			continue
+		}
+		imageCtx, cancel := withCommandDeadline(ctx)
+		result, err := handleRequest(imageCtx, imageUrl, opts)
+		cancel()
+
+		item := batchItem{Image: imageUrl, buildResult: result}
+		if item.buildResult == nil {
+			item.buildResult = &buildResult{}
+		}
+		if err != nil {
+			item.Error = err.Error()
+			item.err = err
+		}
+		if err := progress.record(item, err); err != nil {
+			// without the record the image is only built again when the batch is resumed
+			log.Warn(context.Background(), fmt.Sprintf("Couldn't record the progress of %s: %v", imageUrl, err))
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// The outcome of an image of a batch recorded in the progress file
+type progressEntry struct {
+	Image       string `json:"image"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// one of the state store statuses, failed images are built again when the batch is resumed
+	Status string `json:"status"`
+}
+
+// batchProgress records which images of a batch are done in a file of JSON lines,
+// so an interrupted batch of thousands of images resumes where it left off
+type batchProgress struct {
+	file    *os.File
+	entries map[string]progressEntry
+}
+
+// Open the progress file of a batch, creating it if it doesn't exist yet
+func openBatchProgress(path string) (*batchProgress, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	progress := &batchProgress{file: file, entries: map[string]progressEntry{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry progressEntry
+		// a line cut off by the interruption is ignored, the image is built again
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			progress.entries[entry.Image] = entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// end a cut off line, otherwise it would swallow the next record
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte("\n"))
+		}
+	}
+	return progress, nil
+}
+
+// The recorded outcome of an image if it doesn't need to be built again
+func (p *batchProgress) done(imageUrl string) (progressEntry, bool) {
+	if p == nil {
+		return progressEntry{}, false
+	}
+	entry, ok := p.entries[imageUrl]
+	return entry, ok && entry.Status != state.StatusFailed
+}
+
+// Append the outcome of an image to the progress file
+func (p *batchProgress) record(item batchItem, err error) error {
+	if p == nil {
+		return nil
+	}
+	entry := progressEntry{Image: item.Image, ImageDigest: item.ImageDigest, Status: buildStatus(item.Message, err)}
+	p.entries[entry.Image] = entry
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	_, writeErr := p.file.Write(append(line, '\n'))
+	return writeErr
+}
+
+func (p *batchProgress) Close() error {
+	return p.file.Close()
+}
+
+// Whether any image of the batch failed
+func batchFailed(items []batchItem) bool {
+	for _, item := range items {
+		if item.Error != "" || item.Message == PlatformsFailedMessage {
+			return true
+		}
+	}
+	return false
+}
+
+// Format the outcomes of a batch as text or JSON
+func formatBatch(items []batchItem, output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(items, "", "  ")
+		return string(out), err
+	}
+
+	var lines []string
+	for _, item := range items {
+		out, err := item.format(output)
+		if err != nil {
+			return "", err
+		}
+		line := item.Image + ": " + out
+		if item.Error != "" {
+			line += ": " + item.Error
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Totals of a batch, printed after the outcomes of the images and written to the -summary-file
+type batchSummary struct {
+	Images int `json:"images"`
+	// images whose SOCI indices were built, pushed or not
+	Built int `json:"built"`
+	// skipped and failed images by the message of their outcome, e.g. the stage that failed
+	Skipped    map[string]int `json:"skipped,omitempty"`
+	Failed     map[string]int `json:"failed,omitempty"`
+	PulledSize int64          `json:"pulledSize"`
+	PushedSize int64          `json:"pushedSize"`
+	DurationMs int64          `json:"durationMs"`
+}
+
+// Count the outcomes of the images of a batch that took duration
+func summarizeBatch(items []batchItem, duration time.Duration) batchSummary {
+	summary := batchSummary{Images: len(items), Skipped: map[string]int{}, Failed: map[string]int{}, DurationMs: duration.Milliseconds()}
+	for _, item := range items {
+		reason := item.Message
+		if reason == "" {
+			// the build failed before it had a result
+			reason = item.Error
+		}
+		switch buildStatus(item.Message, item.err) {
+		case state.StatusPushed, state.StatusBuilt:
+			summary.Built++
+		case state.StatusFailed:
+			summary.Failed[reason]++
+		default:
+			summary.Skipped[reason]++
+		}
+		summary.PulledSize += item.PulledSize
+		summary.PushedSize += item.PushedSize
+	}
+	return summary
+}
+
+// The total of the counts
+func countAll(counts map[string]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// Format the summary of a batch as text, json or markdown. The markdown summary adds a table of the outcome
+// of each image, e.g. to paste it into a pull request or post it to a chat.
+func formatSummary(summary batchSummary, items []batchItem, format string) (string, error) {
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(summary, "", "  ")
+		return string(out), err
+	case "markdown":
+		return summary.markdown(items), nil
+	}
+	return summary.format(), nil
+}
+
+// Format the summary as a line of totals followed by the skipped and failed images by reason
+func (s batchSummary) format() string {
+	lines := []string{fmt.Sprintf("%d images in %s: %d built, %d skipped, %d failed, pulled %s, pushed %s",
+		s.Images, time.Duration(s.DurationMs)*time.Millisecond, s.Built, countAll(s.Skipped), countAll(s.Failed), size.Format(s.PulledSize), size.Format(s.PushedSize))}
+	lines = append(lines, formatCounts("skipped", s.Skipped)...)
+	lines = append(lines, formatCounts("failed", s.Failed)...)
+	return strings.Join(lines, "\n")
+}
+
+// One line per reason, the most frequent first
+func formatCounts(outcome string, counts map[string]int) []string {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	var lines []string
+	for _, reason := range reasons {
+		lines = append(lines, fmt.Sprintf("  %s %d: %s", outcome, counts[reason], reason))
+	}
+	return lines
+}
+
+// Format the totals as a paragraph and the outcomes of the images as a markdown table
+func (s batchSummary) markdown(items []batchItem) string {
+	lines := []string{
+		fmt.Sprintf("**%d images** in %s: %d built, %d skipped, %d failed, pulled %s, pushed %s",
+			s.Images, time.Duration(s.DurationMs)*time.Millisecond, s.Built, countAll(s.Skipped), countAll(s.Failed), size.Format(s.PulledSize), size.Format(s.PushedSize)),
+		"",
+		"| Image | Outcome | SOCI index | Pulled | Pushed |",
+		"| --- | --- | --- | --- | --- |",
+	}
+	for _, item := range items {
+		outcome := item.Message
+		if item.Error != "" {
+			outcome += ": " + item.Error
+		}
+		var indexDigests []string
+		for _, indexDigest := range item.indexDigests() {
+			indexDigests = append(indexDigests, "`"+indexDigest+"`")
+		}
+		lines = append(lines, fmt.Sprintf("| `%s` | %s | %s | %s | %s |", item.Image, markdownCell(outcome),
+			strings.Join(indexDigests, "<br>"), size.Format(item.PulledSize), size.Format(item.PushedSize)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Escape the text of a markdown table cell, which can't contain pipes or line breaks
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.Join(strings.Fields(text), " ")
+}
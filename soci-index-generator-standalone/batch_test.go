@@ -0,0 +1,204 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadImageList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.txt")
+	content := "# production images\n123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:latest\n\n  123456789012.dkr.ecr.eu-west-1.amazonaws.com/worker:1.0  \n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write the image list: %v", err)
+	}
+
+	imageUrls, err := readImageList(path)
+	if err != nil {
+		t.Fatalf("Failed to read the image list: %v", err)
+	}
+	expected := []string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:latest",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/worker:1.0",
+	}
+	if !reflect.DeepEqual(imageUrls, expected) {
+		t.Fatalf("Expected %v but got %v", expected, imageUrls)
+	}
+}
+
+func TestFormatBatch(t *testing.T) {
+	items := []batchItem{
+		{Image: "registry/app:latest", buildResult: &buildResult{Message: BuildAndPushSuccessMessage}},
+		{Image: "registry/worker:1.0", buildResult: &buildResult{Message: "Image pull error"}, Error: errors.New("not found").Error()},
+	}
+	out, err := formatBatch(items, "text")
+	if err != nil {
+		t.Fatalf("Failed to format the batch: %v", err)
+	}
+	expected := "registry/app:latest: " + BuildAndPushSuccessMessage + "\nregistry/worker:1.0: Image pull error: not found"
+	if out != expected {
+		t.Fatalf("Expected\n%s\nbut got\n%s", expected, out)
+	}
+	if !batchFailed(items) || batchFailed(items[:1]) {
+		t.Fatalf("Expected only the batch with a failed image to fail")
+	}
+}
+
+func TestBatchProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	progress, err := openBatchProgress(path)
+	if err != nil {
+		t.Fatalf("Failed to open the progress file: %v", err)
+	}
+	progress.record(batchItem{Image: "registry/app:latest", buildResult: &buildResult{Message: BuildAndPushSuccessMessage, ImageDigest: "sha256:1234"}}, nil)
+	progress.record(batchItem{Image: "registry/worker:1.0", buildResult: &buildResult{}}, errors.New("not found"))
+	progress.Close()
+
+	// a line cut off by an interruption
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"image":"registry/api:2.0","sta`)
+	f.Close()
+
+	progress, err = openBatchProgress(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen the progress file: %v", err)
+	}
+	if entry, ok := progress.done("registry/app:latest"); !ok || entry.ImageDigest != "sha256:1234" {
+		t.Fatalf("Expected the pushed image to be done but got %+v", entry)
+	}
+	if _, ok := progress.done("registry/worker:1.0"); ok {
+		t.Fatalf("Expected the failed image to be built again")
+	}
+	if _, ok := progress.done("registry/api:2.0"); ok {
+		t.Fatalf("Expected the image of the cut off line to be built again")
+	}
+
+	// records after the cut off line are read back
+	progress.record(batchItem{Image: "registry/api:2.0", buildResult: &buildResult{Message: BuildAndPushSuccessMessage}}, nil)
+	progress.Close()
+	progress, err = openBatchProgress(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen the progress file: %v", err)
+	}
+	if _, ok := progress.done("registry/api:2.0"); !ok {
+		t.Fatalf("Expected the image recorded after the cut off line to be done")
+	}
+	progress.Close()
+}
+
+func TestBuildImagesInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	progress, err := openBatchProgress(path)
+	if err != nil {
+		t.Fatalf("Failed to open the progress file: %v", err)
+	}
+	defer progress.Close()
+
+	// e.g. SIGTERM before the batch got to the images
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	items := buildImages(ctx, []string{"registry/app:latest", "registry/worker:1.0"}, buildOptions{}, 0, progress)
+	if len(items) != 0 {
+		t.Fatalf("Expected no images of the interrupted batch to be built but got %+v", items)
+	}
+	if recorded, _ := os.ReadFile(path); len(recorded) != 0 {
+		t.Fatalf("Expected no images of the interrupted batch to be recorded but got %s", recorded)
+	}
+}
+
+func TestShardImages(t *testing.T) {
+	var imageUrls []string
+	for i := range 100 {
+		imageUrls = append(imageUrls, fmt.Sprintf("registry/app-%d:latest", i))
+	}
+	seen := map[string]int{}
+	for shardIndex := range 3 {
+		shard := shardImages(imageUrls, shardIndex, 3)
+		if len(shard) == 0 {
+			t.Fatalf("Expected images in shard %d", shardIndex)
+		}
+		for _, imageUrl := range shard {
+			seen[imageUrl]++
+		}
+	}
+	for _, imageUrl := range imageUrls {
+		if seen[imageUrl] != 1 {
+			t.Fatalf("Expected %s in exactly one shard but it is in %d", imageUrl, seen[imageUrl])
+		}
+	}
+
+	// the shard of an image doesn't depend on the rest of the list
+	shard := shardImages(imageUrls, 1, 3)
+	if other := shardImages(append([]string{shard[0]}, "registry/other:latest"), 1, 3); len(other) == 0 || other[0] != shard[0] {
+		t.Fatalf("Expected %s to stay in shard 1", shard[0])
+	}
+}
+
+func TestSummarizeBatch(t *testing.T) {
+	items := []batchItem{
+		{Image: "registry/app:latest", buildResult: &buildResult{Message: BuildAndPushSuccessMessage, PulledSize: 3 << 20, PushedSize: 1 << 20}},
+		{Image: "registry/app:1.0", buildResult: &buildResult{Message: SkipAlreadyIndexedMessage}},
+		{Image: "registry/base:latest", buildResult: &buildResult{Message: SkipTooSmallMessage}},
+		{Image: "registry/tiny:latest", buildResult: &buildResult{Message: SkipTooSmallMessage}},
+		{Image: "registry/worker:1.0", buildResult: &buildResult{Message: "Image pull error"}, Error: "not found", err: errors.New("not found")},
+		{Image: "registry/multi:1.0", buildResult: &buildResult{Message: PlatformsFailedMessage, PulledSize: 1 << 20}},
+	}
+	summary := summarizeBatch(items, 90*time.Second)
+
+	expected := batchSummary{
+		Images:     6,
+		Built:      1,
+		Skipped:    map[string]int{SkipAlreadyIndexedMessage: 1, SkipTooSmallMessage: 2},
+		Failed:     map[string]int{"Image pull error": 1, PlatformsFailedMessage: 1},
+		PulledSize: 4 << 20,
+		PushedSize: 1 << 20,
+		DurationMs: 90000,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, summary)
+	}
+
+	lines := strings.Split(summary.format(), "\n")
+	if lines[0] != "6 images in 1m30s: 1 built, 3 skipped, 2 failed, pulled 4MiB, pushed 1MiB" {
+		t.Fatalf("Unexpected totals line %q", lines[0])
+	}
+	if lines[1] != "  skipped 2: "+SkipTooSmallMessage {
+		t.Fatalf("Expected the most frequent reason first but got %q", lines[1])
+	}
+}
+
+func TestFormatSummaryMarkdown(t *testing.T) {
+	items := []batchItem{
+		{Image: "registry/app:latest", buildResult: &buildResult{
+			Message:    BuildAndPushSuccessMessage,
+			Platforms:  []platformResult{{Platform: "linux/amd64", IndexDigest: "sha256:abc"}},
+			PulledSize: 2 << 20,
+			PushedSize: 4 << 10,
+		}},
+		{Image: "registry/worker:1.0", buildResult: &buildResult{Message: "Image pull error"}, Error: "unexpected | response", err: errors.New("unexpected | response")},
+	}
+	out, err := formatSummary(summarizeBatch(items, time.Minute), items, "markdown")
+	if err != nil {
+		t.Fatalf("Failed to format the summary: %v", err)
+	}
+	expected := strings.Join([]string{
+		"**2 images** in 1m0s: 1 built, 0 skipped, 1 failed, pulled 2MiB, pushed 4KiB",
+		"",
+		"| Image | Outcome | SOCI index | Pulled | Pushed |",
+		"| --- | --- | --- | --- | --- |",
+		"| `registry/app:latest` | " + BuildAndPushSuccessMessage + " | `sha256:abc` | 2MiB | 4KiB |",
+		"| `registry/worker:1.0` | Image pull error: unexpected \\| response |  | 0B | 0B |",
+	}, "\n")
+	if out != expected {
+		t.Fatalf("Expected\n%s\nbut got\n%s", expected, out)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// Whether an image has SOCI indices, for deploy gates that refuse unindexed images
+type checkResult struct {
+	ImageDigest string `json:"imageDigest"`
+	// whether every checked manifest of the image has at least one SOCI index
+	Indexed   bool            `json:"indexed"`
+	Manifests []manifestCheck `json:"manifests"`
+}
+
+// The SOCI indices referring to one manifest of the image
+type manifestCheck struct {
+	ManifestDigest string   `json:"manifestDigest,omitempty"`
+	Platform       string   `json:"platform,omitempty"`
+	IndexDigests   []string `json:"indexDigests,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// Check whether an image has SOCI indices. The SOCI indices of a multi-platform image refer to its platform
+// manifests, so each of them (or those of the given platforms) must have one. Attestation manifests are skipped.
+func checkIndexed(ctx context.Context, imageUrl string, opts buildOptions) (*checkResult, error) {
+	registryHost, repo, reference := parseImageUrl(imageUrl)
+
+	ctx = context.WithValue(ctx, "RegistryURL", registryHost)
+	reference = imageReference(ctx, reference, opts)
+
+	registry, err := registryutils.Init(ctx, registryHost, opts.registryOptions...)
+	if err != nil {
+		return nil, err
+	}
+	desc, content, err := registry.FetchManifest(ctx, repo, reference)
+	if err != nil {
+		return nil, err
+	}
+	result := &checkResult{ImageDigest: desc.Digest.String()}
+
+	var manifestDescs []ocispec.Descriptor
+	if isImageIndex(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, err
+		}
+		for _, manifestDesc := range index.Manifests {
+			if images.IsManifestType(manifestDesc.MediaType) && (manifestDesc.Platform == nil || manifestDesc.Platform.OS != "unknown") {
+				manifestDescs = append(manifestDescs, manifestDesc)
+			}
+		}
+	} else {
+		manifestDescs = append(manifestDescs, desc)
+	}
+
+	checked := manifestDescs
+	if len(opts.platforms) > 0 {
+		checked = nil
+		for _, platform := range opts.platforms {
+			manifestDesc, ok := matchPlatform(manifestDescs, platform)
+			if !ok {
+				result.Manifests = append(result.Manifests, manifestCheck{Platform: platforms.Format(platform), Error: "no manifest for the platform in the image"})
+				continue
+			}
+			checked = append(checked, manifestDesc)
+		}
+	}
+
+	for _, manifestDesc := range checked {
+		check := manifestCheck{ManifestDigest: manifestDesc.Digest.String()}
+		if manifestDesc.Platform != nil {
+			check.Platform = platforms.Format(*manifestDesc.Platform)
+		}
+		indices, err := registry.SociIndices(ctx, repo, manifestDesc)
+		if err != nil {
+			return nil, fmt.Errorf("listing SOCI indices of %s: %w", manifestDesc.Digest, err)
+		}
+		for _, index := range indices {
+			check.IndexDigests = append(check.IndexDigests, index.Digest.String())
+		}
+		result.Manifests = append(result.Manifests, check)
+	}
+
+	result.Indexed = len(result.Manifests) > 0
+	for _, check := range result.Manifests {
+		if len(check.IndexDigests) == 0 {
+			result.Indexed = false
+		}
+	}
+	return result, nil
+}
+
+// Format the check for the given output format, text or json
+func (r *checkResult) format(output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		return string(out), err
+	}
+
+	status := "not indexed"
+	if r.Indexed {
+		status = "indexed"
+	}
+	lines := []string{fmt.Sprintf("Image %s %s", r.ImageDigest, status)}
+	for _, check := range r.Manifests {
+		name := strings.TrimSpace(check.Platform + " " + check.ManifestDigest)
+		switch {
+		case check.Error != "":
+			lines = append(lines, fmt.Sprintf("  %s: %s", name, check.Error))
+		case len(check.IndexDigests) == 0:
+			lines = append(lines, fmt.Sprintf("  %s: no SOCI index", name))
+		default:
+			lines = append(lines, fmt.Sprintf("  %s: SOCI index %s", name, strings.Join(check.IndexDigests, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,42 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+func TestCheckIndexed(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+	imageUri := testRegistry.ImageURI("test-repository", "latest")
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	result, err := checkIndexed(ctx, imageUri, opts)
+	if err != nil {
+		t.Fatalf("Check failed %v", err)
+	}
+	if result.Indexed || result.ImageDigest != image.Digest.String() || len(result.Manifests) != 1 {
+		t.Fatalf("Expected the image not to be indexed but got %+v", result)
+	}
+
+	resp, err := handleRequest(ctx, imageUri, opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	result, err = checkIndexed(ctx, imageUri, opts)
+	if err != nil {
+		t.Fatalf("Check failed %v", err)
+	}
+	if !result.Indexed || len(result.Manifests[0].IndexDigests) != 1 || result.Manifests[0].IndexDigests[0] != resp.Platforms[0].IndexDigest {
+		t.Fatalf("Expected the image to be indexed by %s but got %+v", resp.Platforms[0].IndexDigest, result)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+)
+
+const (
+	// Prefix of the work directories of builds, see createTempDir
+	tempDirPrefix = "soci-index-builder"
+	// file in the work directory of a build that the build touches while it runs
+	tempDirLockName  = ".lock"
+	tempDirHeartbeat = time.Minute
+	// a lock that wasn't touched for longer is left by a build that crashed or was killed
+	tempDirStaleAfter = 5 * tempDirHeartbeat
+	// work directories without a lock, e.g. of earlier versions, are abandoned when nothing was written to them for longer
+	abandonedTempDirAge = 6 * time.Hour
+)
+
+// Prefixes of the work directories of earlier versions, which created them in /tmp
+var legacyTempDirPrefixes = []string{"soci-lambda"}
+
+// Work directories removed from a work directory
+type tempDirCleanup struct {
+	Removed   int
+	FreedSize int64
+}
+
+// Lock the work directory of a build, the lock is touched until the context is done or the directory is removed
+func lockTempDir(ctx context.Context, dir string) error {
+	lockFile := filepath.Join(dir, tempDirLockName)
+	host, _ := os.Hostname()
+	if err := os.WriteFile(lockFile, []byte(fmt.Sprintf("pid %d on %s\n", os.Getpid(), host)), 0644); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(tempDirHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if err := os.Chtimes(lockFile, now, now); err != nil {
+					// the build is done and removed its directory
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Remove the work directories of builds in workDir left behind by crashed or killed runs: those whose lock
+// wasn't touched for tempDirStaleAfter, and those without a lock that nothing was written to for longer than olderThan.
+// Directories of other tools in workDir aren't touched.
+func removeAbandonedTempDirs(ctx context.Context, workDir string, olderThan time.Duration) (tempDirCleanup, error) {
+	var cleanup tempDirCleanup
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return cleanup, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isTempDirName(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(workDir, entry.Name())
+		size, modifiedAt, err := treeUsage(dir)
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't read the work directory %s: %v", dir, err))
+			continue
+		}
+		abandoned := time.Since(modifiedAt) >= olderThan
+		if lock, err := os.Stat(filepath.Join(dir, tempDirLockName)); err == nil {
+			// the build running in the directory touches its lock, whatever it writes
+			modifiedAt = lock.ModTime()
+			abandoned = time.Since(modifiedAt) >= tempDirStaleAfter
+		}
+		if !abandoned {
+			continue
+		}
+		log.Info(ctx, fmt.Sprintf("Removing the abandoned work directory %s, last used at %s", dir, modifiedAt.Format(time.RFC3339)))
+		if err := os.RemoveAll(dir); err != nil {
+			return cleanup, err
+		}
+		cleanup.Removed++
+		cleanup.FreedSize += size
+	}
+	return cleanup, nil
+}
+
+// Remove the abandoned work directories of earlier runs before building, e.g. in a warm Lambda environment
+// or on a long-lived host. Failing to remove them doesn't keep the build from running.
+func removeAbandonedAtStartup(workDir string) {
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
+	ctx := context.Background()
+	cleanup, err := removeAbandonedTempDirs(ctx, workDir, abandonedTempDirAge)
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't remove the abandoned work directories in %s: %v", workDir, err))
+	}
+	if cleanup.Removed > 0 {
+		log.Info(ctx, fmt.Sprintf("Removed %d abandoned work directories (%s) from %s", cleanup.Removed, size.Format(cleanup.FreedSize), workDir))
+	}
+}
+
+// Whether a directory name is that of a work directory of a build, of this or an earlier version
+func isTempDirName(name string) bool {
+	for _, prefix := range append([]string{tempDirPrefix}, legacyTempDirPrefixes...) {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The total size of the files in a directory tree and the last time anything in it was modified
+func treeUsage(dir string) (int64, time.Time, error) {
+	var size int64
+	var modifiedAt time.Time
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modifiedAt) {
+			modifiedAt = info.ModTime()
+		}
+		return nil
+	})
+	return size, modifiedAt, err
+}
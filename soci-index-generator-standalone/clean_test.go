@@ -0,0 +1,85 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveAbandonedTempDirs(t *testing.T) {
+	workDir := t.TempDir()
+	abandonedAt := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"soci-index-builder123", "soci-lambda456", "soci-index-builder789", "other-tool"} {
+		dir := filepath.Join(workDir, name)
+		if err := os.MkdirAll(filepath.Join(dir, "store"), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "store", "blob"), make([]byte, 1024), 0644); err != nil {
+			t.Fatalf("Failed to write to %s: %v", dir, err)
+		}
+		if name == "soci-index-builder789" {
+			// a running build
+			continue
+		}
+		for _, path := range []string{filepath.Join(dir, "store", "blob"), filepath.Join(dir, "store"), dir} {
+			if err := os.Chtimes(path, abandonedAt, abandonedAt); err != nil {
+				t.Fatalf("Failed to change the times of %s: %v", path, err)
+			}
+		}
+	}
+
+	cleanup, err := removeAbandonedTempDirs(context.Background(), workDir, 6*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to remove the abandoned work directories: %v", err)
+	}
+	if cleanup.Removed != 2 || cleanup.FreedSize != 2048 {
+		t.Fatalf("Expected 2 directories of 2048 bytes removed, got %+v", cleanup)
+	}
+	for name, kept := range map[string]bool{"soci-index-builder123": false, "soci-lambda456": false, "soci-index-builder789": true, "other-tool": true} {
+		if _, err := os.Stat(filepath.Join(workDir, name)); (err == nil) != kept {
+			t.Fatalf("Expected %s to be kept: %v, got %v", name, kept, err)
+		}
+	}
+}
+
+func TestRemoveAbandonedTempDirsWithLock(t *testing.T) {
+	workDir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running, err := createTempDir(ctx, workDir)
+	if err != nil {
+		t.Fatalf("Failed to create a work directory: %v", err)
+	}
+	crashed, err := createTempDir(ctx, workDir)
+	if err != nil {
+		t.Fatalf("Failed to create a work directory: %v", err)
+	}
+	// the build of the running directory didn't write anything for long, but its lock is fresh
+	abandonedAt := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(running, abandonedAt, abandonedAt); err != nil {
+		t.Fatalf("Failed to change the times of %s: %v", running, err)
+	}
+	staleAt := time.Now().Add(-tempDirStaleAfter - time.Minute)
+	if err := os.Chtimes(filepath.Join(crashed, tempDirLockName), staleAt, staleAt); err != nil {
+		t.Fatalf("Failed to change the times of the lock: %v", err)
+	}
+
+	cleanup, err := removeAbandonedTempDirs(context.Background(), workDir, 6*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to remove the abandoned work directories: %v", err)
+	}
+	if cleanup.Removed != 1 {
+		t.Fatalf("Expected the directory with the stale lock removed, got %+v", cleanup)
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Fatalf("Expected the directory with a fresh lock to be kept: %v", err)
+	}
+	if _, err := os.Stat(crashed); !os.IsNotExist(err) {
+		t.Fatalf("Expected the directory with a stale lock to be removed: %v", err)
+	}
+}
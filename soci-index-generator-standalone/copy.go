@@ -0,0 +1,54 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// Copy an image with its SOCI indices to another repository, keeping the indices associated with the image
+func copyImage(ctx context.Context, fromUrl string, toUrl string, opts buildOptions) (*buildResult, error) {
+	fromHost, fromRepo, fromReference := parseImageUrl(fromUrl)
+	toHost, toRepo, toReference := parseImageUrl(toUrl)
+	// without a reference the image is copied to the same tag or digest
+	fromReference = imageReference(ctx, fromReference, opts)
+
+	source, err := registryutils.Init(context.WithValue(ctx, "RegistryURL", fromHost), fromHost, opts.registryOptions...)
+	if err != nil {
+		return resultError(ctx, "Registry initialization error", err)
+	}
+	destination, err := registryutils.Init(context.WithValue(ctx, "RegistryURL", toHost), toHost, opts.registryOptions...)
+	if err != nil {
+		return resultError(ctx, "Registry initialization error", err)
+	}
+
+	destinationCtx := context.WithValue(ctx, "RegistryURL", toHost)
+	if opts.createRepository != nil {
+		_, err = destination.CreateRepository(destinationCtx, toRepo, *opts.createRepository)
+		if err != nil {
+			return resultError(destinationCtx, "Repository creation error", err)
+		}
+	}
+
+	ctx = context.WithValue(ctx, "RegistryURL", fromHost)
+	imageDescriptor, indexDescriptors, err := source.Copy(ctx, fromRepo, fromReference, destination, toRepo, toReference)
+	if err != nil {
+		return resultError(ctx, "Image copy error", err)
+	}
+
+	for _, indexDescriptor := range indexDescriptors {
+		err = auditPush(destinationCtx, opts, toRepo, imageDescriptor.Digest.String(), indexDescriptor)
+		if err != nil {
+			return resultError(ctx, AuditFailedMessage, err)
+		}
+	}
+
+	out := fmt.Sprintf("Copied image %s with %d SOCI indices to %s", imageDescriptor.Digest, len(indexDescriptors), toUrl)
+	log.Info(ctx, out)
+	return &buildResult{Message: out, ImageDigest: imageDescriptor.Digest.String()}, nil
+}
@@ -0,0 +1,187 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+// How the ztoc of a layer differs between two SOCI indices
+const (
+	layerAdded      = "added"
+	layerRemoved    = "removed"
+	layerUnchanged  = "unchanged"
+	layerEquivalent = "equivalent"
+	layerChanged    = "changed"
+)
+
+// Differences between two SOCI indices
+type diffResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// whether both indices cover the same layers with ztocs of the same files and spans
+	Equivalent bool        `json:"equivalent"`
+	Layers     []layerDiff `json:"layers"`
+}
+
+// How the ztoc of an image layer differs between two SOCI indices
+type layerDiff struct {
+	LayerDigest string `json:"layerDigest"`
+	// one of added, removed, unchanged, equivalent (same files and spans but a different ztoc digest, e.g. from another build tool) or changed
+	Change string     `json:"change"`
+	From   *ztocStats `json:"from,omitempty"`
+	To     *ztocStats `json:"to,omitempty"`
+}
+
+// Summary of a ztoc, the span size isn't stored in a ztoc so it's derived from the number of spans
+type ztocStats struct {
+	Digest   string `json:"digest"`
+	Spans    int    `json:"spans"`
+	SpanSize int64  `json:"spanSize"`
+	Files    int    `json:"files"`
+
+	ztoc *ztoc.Ztoc
+}
+
+// Compare two SOCI indices of a repository, referenced by digest or tag
+func diffIndexes(ctx context.Context, repositoryUrl string, from string, to string, registryOptions []registryutils.Option) (*diffResult, error) {
+	registryHost, repo, _ := strings.Cut(repositoryUrl, "/")
+
+	ctx = context.WithValue(ctx, "RegistryURL", registryHost)
+
+	registry, err := registryutils.Init(ctx, registryHost, registryOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	fromDigest, fromZtocs, err := fetchIndexZtocs(ctx, registry, repo, from)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", from, err)
+	}
+	toDigest, toZtocs, err := fetchIndexZtocs(ctx, registry, repo, to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", to, err)
+	}
+
+	result := compareZtocs(fromZtocs, toZtocs)
+	result.From = fromDigest
+	result.To = toDigest
+	return result, nil
+}
+
+// Fetch a SOCI index and the ztocs of its layers keyed by the layer digest
+func fetchIndexZtocs(ctx context.Context, registry *registryutils.Registry, repo string, reference string) (string, map[string]*ztocStats, error) {
+	desc, content, err := registry.FetchManifest(ctx, repo, reference)
+	if err != nil {
+		return "", nil, err
+	}
+
+	index, _, err := builder.ParseIndex(content)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", desc.Digest, err)
+	}
+
+	ztocs := map[string]*ztocStats{}
+	for _, blob := range index.Blobs {
+		if blob.MediaType != soci.SociLayerMediaType {
+			continue
+		}
+		ztocContent, err := registry.FetchBlob(ctx, repo, blob)
+		if err != nil {
+			return "", nil, err
+		}
+		toc, err := ztoc.Unmarshal(bytes.NewReader(ztocContent))
+		if err != nil {
+			return "", nil, fmt.Errorf("ztoc %s: %w", blob.Digest, err)
+		}
+		ztocs[blob.Annotations[soci.IndexAnnotationImageLayerDigest]] = newZtocStats(blob.Digest.String(), toc)
+	}
+	return desc.Digest.String(), ztocs, nil
+}
+
+func newZtocStats(digest string, toc *ztoc.Ztoc) *ztocStats {
+	spans := int(toc.MaxSpanID) + 1
+	return &ztocStats{
+		Digest:   digest,
+		Spans:    spans,
+		SpanSize: int64(toc.CompressedArchiveSize) / int64(spans),
+		Files:    len(toc.FileMetadata),
+		ztoc:     toc,
+	}
+}
+
+// Compare the ztocs of two SOCI indices layer by layer
+func compareZtocs(from map[string]*ztocStats, to map[string]*ztocStats) *diffResult {
+	layers := map[string]bool{}
+	for layer := range from {
+		layers[layer] = true
+	}
+	for layer := range to {
+		layers[layer] = true
+	}
+
+	result := &diffResult{Equivalent: true}
+	for layer := range layers {
+		diff := layerDiff{LayerDigest: layer, From: from[layer], To: to[layer]}
+		switch {
+		case diff.From == nil:
+			diff.Change = layerAdded
+		case diff.To == nil:
+			diff.Change = layerRemoved
+		case diff.From.Digest == diff.To.Digest:
+			diff.Change = layerUnchanged
+		case reflect.DeepEqual(diff.From.ztoc.TOC, diff.To.ztoc.TOC) && reflect.DeepEqual(diff.From.ztoc.SpanDigests, diff.To.ztoc.SpanDigests):
+			diff.Change = layerEquivalent
+		default:
+			diff.Change = layerChanged
+		}
+		if diff.Change != layerUnchanged && diff.Change != layerEquivalent {
+			result.Equivalent = false
+		}
+		result.Layers = append(result.Layers, diff)
+	}
+	sort.Slice(result.Layers, func(i, j int) bool {
+		return result.Layers[i].LayerDigest < result.Layers[j].LayerDigest
+	})
+	return result
+}
+
+// Format the differences for the given output format, text or json
+func (r *diffResult) format(output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		return string(out), err
+	}
+
+	summary := "SOCI indices are equivalent"
+	if !r.Equivalent {
+		summary = "SOCI indices differ"
+	}
+	lines := []string{fmt.Sprintf("%s: %s and %s", summary, r.From, r.To)}
+	for _, layer := range r.Layers {
+		line := fmt.Sprintf("  %s %s", layer.LayerDigest, layer.Change)
+		if layer.From != nil && layer.To != nil && layer.Change != layerUnchanged {
+			line += fmt.Sprintf(", ztoc %s -> %s", layer.From.Digest, layer.To.Digest)
+			if layer.From.Spans != layer.To.Spans {
+				line += fmt.Sprintf(", %d spans of ~%d bytes -> %d spans of ~%d bytes", layer.From.Spans, layer.From.SpanSize, layer.To.Spans, layer.To.SpanSize)
+			}
+			if layer.From.Files != layer.To.Files {
+				line += fmt.Sprintf(", %d files -> %d files", layer.From.Files, layer.To.Files)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
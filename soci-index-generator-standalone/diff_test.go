@@ -0,0 +1,50 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCompareZtocs(t *testing.T) {
+	newZtoc := func(spanDigests ...digest.Digest) *ztoc.Ztoc {
+		return &ztoc.Ztoc{
+			TOC:                   ztoc.TOC{FileMetadata: []ztoc.FileMetadata{{Name: "file"}}},
+			CompressionInfo:       ztoc.CompressionInfo{MaxSpanID: 0, SpanDigests: spanDigests},
+			CompressedArchiveSize: 1024,
+		}
+	}
+
+	from := map[string]*ztocStats{
+		"sha256:unchanged":  newZtocStats("sha256:a", newZtoc("sha256:span")),
+		"sha256:equivalent": newZtocStats("sha256:b", newZtoc("sha256:span")),
+		"sha256:changed":    newZtocStats("sha256:c", newZtoc("sha256:span")),
+		"sha256:removed":    newZtocStats("sha256:d", newZtoc("sha256:span")),
+	}
+	to := map[string]*ztocStats{
+		"sha256:unchanged":  newZtocStats("sha256:a", newZtoc("sha256:span")),
+		"sha256:equivalent": newZtocStats("sha256:e", newZtoc("sha256:span")),
+		"sha256:changed":    newZtocStats("sha256:f", newZtoc("sha256:other")),
+	}
+
+	result := compareZtocs(from, to)
+	if result.Equivalent {
+		t.Fatalf("Expected the indices to differ")
+	}
+	for _, layer := range result.Layers {
+		if "sha256:"+layer.Change != layer.LayerDigest {
+			t.Fatalf("Unexpected change of layer %s: %s", layer.LayerDigest, layer.Change)
+		}
+	}
+
+	delete(from, "sha256:removed")
+	delete(from, "sha256:changed")
+	delete(to, "sha256:changed")
+	if !compareZtocs(from, to).Equivalent {
+		t.Fatalf("Expected the indices to be equivalent")
+	}
+}
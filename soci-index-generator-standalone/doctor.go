@@ -0,0 +1,191 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/fs"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+)
+
+// Outcomes of a doctor check
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkWarn = "warn"
+)
+
+// The soci-snapshotter release the builder is written against. The ztoc and SOCI index formats
+// changed between minor releases, so the tool must be built with a release of this series.
+const supportedSociRelease = "v0.6."
+
+// The outcome of one doctor check, with a hint how to fix it if it didn't pass
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+type doctorResult struct {
+	Checks []doctorCheck `json:"checks"`
+}
+
+// Settings checked by the doctor command
+type doctorOptions struct {
+	// OCI repository URI to check connectivity and ECR permissions for, the registry checks are skipped if empty
+	repository   string
+	workDir      string
+	minFreeSpace int64
+	buildOptions
+}
+
+// Check whether the environment can build and push SOCI indices
+func runDoctor(ctx context.Context, opts doctorOptions) doctorResult {
+	var result doctorResult
+	if opts.repository == "" {
+		result.Checks = append(result.Checks, checkAwsCredentials(ctx, true))
+	} else {
+		ecrChecks := checkEcrAccess(ctx, opts)
+		// other registries only need AWS credentials for the AWS integrations (DynamoDB, S3, SNS, ...)
+		result.Checks = append(result.Checks, checkAwsCredentials(ctx, len(ecrChecks) > 0))
+		result.Checks = append(result.Checks, ecrChecks...)
+		result.Checks = append(result.Checks, checkRegistry(ctx, opts))
+	}
+	result.Checks = append(result.Checks, checkWorkDir(opts.workDir, opts.minFreeSpace))
+	result.Checks = append(result.Checks, checkSociVersion())
+	return result
+}
+
+// Check the AWS credentials of the caller, a failure is only a warning if they aren't required
+func checkAwsCredentials(ctx context.Context, required bool) doctorCheck {
+	check := doctorCheck{Name: "AWS credentials"}
+	identity, err := sts.New(session.New()).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		check.Hint = "configure credentials with AWS_PROFILE, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or an instance, task or function role"
+		if !required {
+			check.Status = checkWarn
+		}
+		return check
+	}
+	check.Status = checkPass
+	check.Detail = *identity.Arn
+	return check
+}
+
+// Probe the ECR permissions of the caller on the repository, no checks if it isn't in ECR
+func checkEcrAccess(ctx context.Context, opts doctorOptions) []doctorCheck {
+	registryUrl, repo, _ := parseImageUrl(opts.repository)
+	permissions, err := registryutils.CheckEcrPermissions(ctx, registryUrl, repo, opts.registryOptions...)
+	if errors.Is(err, registryutils.ErrNotEcrRegistry) {
+		return nil
+	}
+	var checks []doctorCheck
+	for _, permission := range permissions {
+		check := doctorCheck{Name: permission.Action, Status: checkPass}
+		if permission.Err != nil {
+			check.Status = checkFail
+			check.Detail = permission.Err.Error()
+			check.Hint = fmt.Sprintf("allow %s on the repository %s in the IAM policy of the caller or the repository policy", permission.Action, repo)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// Check that the registry is reachable and the image resolves
+func checkRegistry(ctx context.Context, opts doctorOptions) doctorCheck {
+	registryUrl, repo, reference := parseImageUrl(opts.repository)
+	check := doctorCheck{Name: "registry connectivity"}
+	registry, err := registryutils.Init(ctx, registryUrl, opts.registryOptions...)
+	if err == nil {
+		desc, headErr := registry.HeadManifest(ctx, repo, imageReference(ctx, reference, opts.buildOptions))
+		if headErr == nil {
+			check.Status = checkPass
+			check.Detail = fmt.Sprintf("resolved %s to %s", opts.repository, desc.Digest)
+			return check
+		}
+		err = headErr
+	}
+	check.Status = checkFail
+	check.Detail = err.Error()
+	check.Hint = "check that the image exists, that the registry is reachable from here (proxies, VPC endpoints, security groups) and -registry-ca-cert for private CAs"
+	return check
+}
+
+// Check that the work directory exists and has room for the pulled images
+func checkWorkDir(workDir string, minFreeSpace int64) doctorCheck {
+	check := doctorCheck{Name: "free space in " + workDir}
+	if _, err := os.Stat(workDir); err != nil {
+		check.Status = checkFail
+		check.Detail = err.Error()
+		check.Hint = "create the work directory or pass an existing one with -work-dir"
+		return check
+	}
+	freeSpace := int64(fs.CalculateFreeSpace(workDir))
+	check.Detail = size.Format(freeSpace) + " free"
+	if freeSpace < minFreeSpace {
+		check.Status = checkFail
+		check.Hint = fmt.Sprintf("images are pulled to the work directory, free at least %s or mount a larger volume, e.g. raise the ephemeral storage of the function", size.Format(minFreeSpace))
+		return check
+	}
+	check.Status = checkPass
+	return check
+}
+
+// Check that the tool is linked with the soci-snapshotter release it is written against
+func checkSociVersion() doctorCheck {
+	check := doctorCheck{Name: "soci-snapshotter library", Detail: version.SociVersion}
+	if !strings.HasPrefix(version.SociVersion, supportedSociRelease) {
+		check.Status = checkFail
+		check.Hint = fmt.Sprintf("build the tool with %s %sx as pinned in go.mod", version.SociModule, supportedSociRelease)
+		return check
+	}
+	check.Status = checkPass
+	return check
+}
+
+// Whether any check failed, warnings don't count
+func (r *doctorResult) failed() bool {
+	for _, check := range r.Checks {
+		if check.Status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Format the checks for the given output format, text or json
+func (r *doctorResult) format(output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		return string(out), err
+	}
+
+	var lines []string
+	for _, check := range r.Checks {
+		line := fmt.Sprintf("%-4s %s", strings.ToUpper(check.Status), check.Name)
+		if check.Detail != "" {
+			line += ": " + check.Detail
+		}
+		lines = append(lines, line)
+		if check.Hint != "" {
+			lines = append(lines, "     hint: "+check.Hint)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,38 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+// This test ensures that the doctor checks pass against a reachable image and fail with a hint otherwise
+func TestDoctorChecks(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("test-repository", "latest", []byte("small"))
+	opts := doctorOptions{buildOptions: testRegistryOptions(testRegistry)}
+
+	opts.repository = testRegistry.ImageURI("test-repository", "latest")
+	if check := checkRegistry(context.Background(), opts); check.Status != checkPass {
+		t.Fatalf("Expected the registry check to pass but got %+v", check)
+	}
+	opts.repository = testRegistry.ImageURI("test-repository", "missing")
+	if check := checkRegistry(context.Background(), opts); check.Status != checkFail || check.Hint == "" {
+		t.Fatalf("Expected the registry check to fail with a hint but got %+v", check)
+	}
+
+	if check := checkWorkDir(t.TempDir(), 1); check.Status != checkPass {
+		t.Fatalf("Expected the work dir check to pass but got %+v", check)
+	}
+	if check := checkWorkDir(filepath.Join(t.TempDir(), "missing"), 1); check.Status != checkFail {
+		t.Fatalf("Expected the missing work dir to fail but got %+v", check)
+	}
+	if check := checkWorkDir(t.TempDir(), 1<<62); check.Status != checkFail {
+		t.Fatalf("Expected the full work dir to fail but got %+v", check)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// suffix of the tag of the eStargz conversion of an image, the one of the stargz-snapshotter tooling
+const defaultEstargzTagSuffix = "-esgz"
+
+// Convert the pulled image to eStargz for the target platforms and push it with the eStargz tag, for clusters
+// running the stargz-snapshotter. Multi-platform images are converted to an index of the converted platforms.
+func convertAndPushEstargz(ctx context.Context, registry *registryutils.Registry, repo string, dataDir string, storeDir string, sociStore *store.SociStore, image images.Image, targetPlatforms []ocispec.Platform, opts buildOptions, result *buildResult) error {
+	containerdStore, err := initContainerdStore(storeDir)
+	if err != nil {
+		return err
+	}
+	fetchLayer := func(ctx context.Context, desc ocispec.Descriptor) error {
+		return registry.PullBlob(ctx, repo, sociStore, desc)
+	}
+
+	convertStart := time.Now()
+	var manifests []ocispec.Descriptor
+	for _, platform := range targetPlatforms {
+		platformCtx := context.WithValue(ctx, "Platform", platforms.Format(platform))
+		converter := builder.New(containerdStore, sociStore,
+			builder.WithPlatform(platform),
+			builder.WithTempDir(dataDir),
+			builder.WithLayerFetcher(fetchLayer))
+		manifest, err := converter.ConvertEstargz(platformCtx, image)
+		if err != nil {
+			return fmt.Errorf("%s: %w", platforms.Format(platform), err)
+		}
+		manifest.Platform = &platform
+		manifests = append(manifests, manifest)
+	}
+	converted := manifests[0]
+	if images.IsIndexType(image.Target.MediaType) {
+		converted, err = writeEstargzIndex(ctx, sociStore, image.Target.MediaType, manifests)
+		if err != nil {
+			return err
+		}
+	}
+	converted.Platform = nil
+	result.Timings.since("estargz-convert", convertStart)
+
+	tag := estargzTag(strings.TrimPrefix(image.Name, repo+"@"), opts.estargzTagSuffix)
+	result.Estargz = &estargzResult{ImageDigest: converted.Digest.String(), Tag: tag}
+	ctx = context.WithValue(ctx, "EstargzImageDigest", converted.Digest.String())
+	log.Info(ctx, fmt.Sprintf("Converted image %s to eStargz image %s", image.Target.Digest, converted.Digest))
+
+	if opts.layoutDir != "" {
+		// Record the image in the layout's index.json with its eStargz tag
+		err = sociStore.Tag(ctx, converted, tag)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.noPush {
+		log.Info(ctx, SkipEstargzPushOnNoPushMessage)
+		return nil
+	}
+
+	pushStart := time.Now()
+	err = registry.PushImage(ctx, sociStore, converted, repo, tag)
+	if err != nil {
+		return err
+	}
+	result.Timings.since("estargz-push", pushStart)
+	log.Info(ctx, EstargzSuccessMessage)
+	return nil
+}
+
+// Write the index of the converted platform manifests of a multi-platform image to the local store
+func writeEstargzIndex(ctx context.Context, sociStore *store.SociStore, mediaType string, manifests []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: mediaType,
+		Manifests: manifests,
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(index), Size: int64(len(index))}
+	err = sociStore.Push(ctx, desc, bytes.NewReader(index))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// The tag of the eStargz conversion of an image given by a tag or digest, e.g. latest-esgz or sha256-<hex>-esgz
+func estargzTag(reference string, suffix string) string {
+	if suffix == "" {
+		suffix = defaultEstargzTagSuffix
+	}
+	return strings.Replace(reference, ":", "-", 1) + suffix
+}
@@ -0,0 +1,264 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// a gzip checkpoint holds the 32KiB window of the decompressor at the start of a span
+	checkpointSize = 32 << 10
+	// approximate size of the descriptor of a ztoc in the SOCI index manifest
+	ztocDescriptorSize = 512
+)
+
+// Estimate of what building the SOCI indices of an image would do
+type estimateResult struct {
+	ImageDigest string `json:"imageDigest"`
+	// bytes pulled before building, blobs shared by the platforms are pulled once
+	DownloadSize int64              `json:"downloadSize"`
+	Platforms    []platformEstimate `json:"platforms"`
+}
+
+// Estimate of the SOCI index of one platform of the image
+type platformEstimate struct {
+	Platform       string          `json:"platform"`
+	ManifestDigest string          `json:"manifestDigest,omitempty"`
+	Layers         []layerEstimate `json:"layers,omitempty"`
+	// size of the ztoc checkpoints and the index manifest, the file metadata of the ztocs isn't known without the layers
+	IndexSize int64 `json:"indexSize"`
+	// layer sizes and the thresholds suggested for them
+	Histogram  []sizeBucket      `json:"histogram,omitempty"`
+	Suggestion *tuningSuggestion `json:"suggestion,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Whether a ztoc would be built for a layer
+type layerEstimate struct {
+	Digest     string `json:"digest"`
+	MediaType  string `json:"mediaType"`
+	Size       int64  `json:"size"`
+	Indexed    bool   `json:"indexed"`
+	SkipReason string `json:"skipReason,omitempty"`
+	// format of the layer that other snapshotters load lazily, e.g. estargz
+	LazyLoading string `json:"lazyLoading,omitempty"`
+}
+
+// Estimate the SOCI indices of an image from its manifests only, without pulling any layers
+func estimateIndex(ctx context.Context, imageUrl string, opts buildOptions) (*estimateResult, error) {
+	registryHost, repo, reference := parseImageUrl(imageUrl)
+
+	ctx = context.WithValue(ctx, "RegistryURL", registryHost)
+	reference = imageReference(ctx, reference, opts)
+
+	registry, err := registryutils.Init(ctx, registryHost, opts.registryOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return estimateImage(ctx, registry, repo, reference, opts)
+}
+
+// Estimate the SOCI indices of an image in a repository of the registry
+func estimateImage(ctx context.Context, registry *registryutils.Registry, repo string, reference string, opts buildOptions) (*estimateResult, error) {
+	desc, content, err := registry.FetchManifest(ctx, repo, reference)
+	if err != nil {
+		return nil, err
+	}
+	result := &estimateResult{ImageDigest: desc.Digest.String(), DownloadSize: desc.Size}
+
+	// the manifest of each platform of the image, a single manifest is taken as the manifest of all platforms
+	manifests := map[string]ocispec.Manifest{}
+	var manifestDescs []ocispec.Descriptor
+	if isImageIndex(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, err
+		}
+		manifestContents, err := registry.FetchManifests(ctx, repo, index.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		for i, manifestDesc := range index.Manifests {
+			manifest, err := parseManifest(manifestContents[i])
+			if err != nil {
+				return nil, err
+			}
+			manifests[manifestDesc.Digest.String()] = manifest
+			manifestDescs = append(manifestDescs, manifestDesc)
+		}
+	} else {
+		manifest, err := parseManifest(content)
+		if err != nil {
+			return nil, err
+		}
+		manifests[desc.Digest.String()] = manifest
+		manifestDescs = append(manifestDescs, desc)
+	}
+
+	targetPlatforms := opts.platforms
+	if len(targetPlatforms) == 0 && !isImageIndex(desc.MediaType) {
+		// like the build, a single platform image is estimated for the platform it declares
+		configBytes, err := registry.FetchBlob(ctx, repo, manifests[desc.Digest.String()].Config)
+		if err != nil {
+			return nil, err
+		}
+		imagePlatform, err := configPlatform(configBytes)
+		if err != nil {
+			return nil, err
+		}
+		targetPlatforms = []ocispec.Platform{imagePlatform}
+	}
+	if len(targetPlatforms) == 0 {
+		targetPlatforms = []ocispec.Platform{platforms.DefaultSpec()}
+	}
+
+	pulled := map[string]bool{desc.Digest.String(): true}
+	pull := func(blob ocispec.Descriptor) {
+		if !pulled[blob.Digest.String()] {
+			pulled[blob.Digest.String()] = true
+			result.DownloadSize += blob.Size
+		}
+	}
+
+	for _, platform := range targetPlatforms {
+		estimate := platformEstimate{Platform: platforms.Format(platform)}
+		manifestDesc, ok := matchPlatform(manifestDescs, platform)
+		if !ok {
+			estimate.Error = "no manifest for the platform in the image"
+			result.Platforms = append(result.Platforms, estimate)
+			continue
+		}
+		estimate.ManifestDigest = manifestDesc.Digest.String()
+		pull(manifestDesc)
+		pull(manifests[manifestDesc.Digest.String()].Config)
+
+		indexBuilder := builder.New(nil, nil, builder.WithMinLayerSize(opts.minLayerSize), builder.WithSpanSize(opts.spanSize))
+		// the suggested min-layer-size is chosen from the layers that could be indexed at any size
+		anySizeBuilder := builder.New(nil, nil, builder.WithMinLayerSize(0))
+		var layerSizes, indexableSizes []int64
+		for _, layer := range manifests[manifestDesc.Digest.String()].Layers {
+			pull(layer)
+			compressionAlgo, skipReason, err := indexBuilder.CheckLayer(ctx, layer)
+			if err != nil {
+				skipReason = err.Error()
+			}
+			estimate.Layers = append(estimate.Layers, layerEstimate{
+				Digest:      layer.Digest.String(),
+				MediaType:   layer.MediaType,
+				Size:        layer.Size,
+				Indexed:     skipReason == "",
+				SkipReason:  skipReason,
+				LazyLoading: builder.LazyLoadingFormat(layer),
+			})
+			if skipReason == "" {
+				estimate.IndexSize += estimateZtocSize(layer.Size, compressionAlgo, indexBuilder.SpanSize())
+			}
+			layerSizes = append(layerSizes, layer.Size)
+			if _, skipReason, err := anySizeBuilder.CheckLayer(ctx, layer); err == nil && skipReason == "" {
+				indexableSizes = append(indexableSizes, layer.Size)
+			}
+		}
+		estimate.Histogram = layerHistogram(layerSizes)
+		estimate.Suggestion = suggestTuning(indexableSizes, estimate.imageSize())
+		result.Platforms = append(result.Platforms, estimate)
+	}
+
+	return result, nil
+}
+
+// The compressed size of the layers of the platform
+func (p platformEstimate) imageSize() int64 {
+	var imageSize int64
+	for _, layer := range p.Layers {
+		imageSize += layer.Size
+	}
+	return imageSize
+}
+
+// Estimate the size of a layer's ztoc from the checkpoints of its spans
+func estimateZtocSize(layerSize int64, compressionAlgo string, spanSize int64) int64 {
+	if compressionAlgo == compression.Uncompressed {
+		// uncompressed layers can be read at any offset and need no checkpoints
+		return ztocDescriptorSize
+	}
+	spans := layerSize/spanSize + 1
+	return spans*checkpointSize + ztocDescriptorSize
+}
+
+// Find the manifest of a platform, a single manifest without a platform matches any platform
+func matchPlatform(manifestDescs []ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, bool) {
+	if len(manifestDescs) == 1 && manifestDescs[0].Platform == nil {
+		return manifestDescs[0], true
+	}
+	matcher := platforms.OnlyStrict(platform)
+	for _, desc := range manifestDescs {
+		if desc.Platform != nil && matcher.Match(*desc.Platform) {
+			return desc, true
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
+
+func isImageIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == registryutils.MediaTypeDockerManifestList
+}
+
+func parseManifest(content []byte) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	err := json.Unmarshal(content, &manifest)
+	return manifest, err
+}
+
+// Format the estimate for the given output format, text or json
+func (r *estimateResult) format(output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		return string(out), err
+	}
+
+	lines := []string{fmt.Sprintf("Image %s, download %s", r.ImageDigest, size.Format(r.DownloadSize))}
+	for _, platform := range r.Platforms {
+		if platform.Error != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", platform.Platform, platform.Error))
+			continue
+		}
+		indexed := 0
+		for _, layer := range platform.Layers {
+			if layer.Indexed {
+				indexed++
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d of %d layers indexed, estimated SOCI index size %s", platform.Platform, indexed, len(platform.Layers), size.Format(platform.IndexSize)))
+		for _, layer := range platform.Layers {
+			outcome := "indexed"
+			if !layer.Indexed {
+				outcome = "skipped, " + layer.SkipReason
+			}
+			if layer.LazyLoading != "" {
+				outcome += ", already lazily loadable as " + layer.LazyLoading
+			}
+			lines = append(lines, fmt.Sprintf("  %s %s %s", layer.Digest, size.Format(layer.Size), outcome))
+		}
+		if len(platform.Layers) > 0 {
+			lines = append(lines, "  layer sizes:")
+			lines = append(lines, formatHistogram(platform.Histogram, "    ")...)
+		}
+		if suggestion := platform.Suggestion; suggestion != nil {
+			lines = append(lines, fmt.Sprintf("  suggested -min-layer-size %s (indexes %.1f%% of the image) and -span-size %s",
+				size.Format(suggestion.MinLayerSize), suggestion.CoveragePercent, size.Format(suggestion.SpanSize)))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,51 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMatchPlatform(t *testing.T) {
+	amd64 := ocispec.Descriptor{Digest: "sha256:amd64", Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}}
+	arm64 := ocispec.Descriptor{Digest: "sha256:arm64", Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}}
+
+	desc, ok := matchPlatform([]ocispec.Descriptor{amd64, arm64}, ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	if !ok || desc.Digest != arm64.Digest {
+		t.Fatalf("Unexpected manifest for linux/arm64. Expected %s but got %s", arm64.Digest, desc.Digest)
+	}
+
+	_, ok = matchPlatform([]ocispec.Descriptor{amd64, arm64}, ocispec.Platform{OS: "windows", Architecture: "amd64"})
+	if ok {
+		t.Fatalf("Expected no manifest for windows/amd64")
+	}
+
+	single := ocispec.Descriptor{Digest: "sha256:single"}
+	desc, ok = matchPlatform([]ocispec.Descriptor{single}, ocispec.Platform{OS: "linux", Architecture: "arm64"})
+	if !ok || desc.Digest != single.Digest {
+		t.Fatalf("Expected the single manifest to match any platform")
+	}
+}
+
+func TestEstimateZtocSize(t *testing.T) {
+	if estimateZtocSize(10<<20, compression.Gzip, 4<<20) != 3*checkpointSize+ztocDescriptorSize {
+		t.Fatalf("Unexpected estimate for a gzip layer of three spans: %d", estimateZtocSize(10<<20, compression.Gzip, 4<<20))
+	}
+	if estimateZtocSize(10<<20, compression.Uncompressed, 4<<20) != ztocDescriptorSize {
+		t.Fatalf("Unexpected estimate for an uncompressed layer: %d", estimateZtocSize(10<<20, compression.Uncompressed, 4<<20))
+	}
+}
+
+func TestConfigPlatform(t *testing.T) {
+	platform, err := configPlatform([]byte(`{"os":"linux","architecture":"arm64"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if platform.OS != "linux" || platform.Architecture != "arm64" {
+		t.Fatalf("Unexpected platform %+v", platform)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// Classes of failed builds
+const (
+	failureThrottled = "throttled"
+	failureNetwork   = "network"
+	failureTimeout   = "timeout"
+	failureCancelled = "cancelled"
+	failureAuth      = "auth"
+	failureNotFound  = "not-found"
+	failureRegistry  = "registry"
+	failurePolicy    = "policy"
+	failureInvalid   = "invalid"
+	failureStorage   = "storage"
+	failureInternal  = "internal"
+)
+
+// A failed build, written to stderr as the last line so that wrapper scripts and alarms can classify the failure
+// without parsing the error message
+type buildFailure struct {
+	Class string `json:"class"`
+	// the step that failed, the message of the build result, e.g. "Image pull error"
+	Stage       string `json:"stage"`
+	Registry    string `json:"registry"`
+	Repository  string `json:"repository"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	Error       string `json:"error"`
+	// whether building the image again may succeed without changing anything, e.g. after throttling
+	Retryable bool `json:"retryable"`
+}
+
+func newBuildFailure(imageUrl string, result *buildResult, err error) buildFailure {
+	registryHost, repo, _ := parseImageUrl(imageUrl)
+	class, retryable := classifyError(err)
+	failure := buildFailure{
+		Class:      class,
+		Registry:   registryHost,
+		Repository: repo,
+		Error:      err.Error(),
+		Retryable:  retryable,
+	}
+	if result != nil {
+		failure.Stage = result.Message
+		failure.ImageDigest = result.ImageDigest
+	}
+	return failure
+}
+
+// The class of an error and whether the build may succeed when it's retried
+func classifyError(err error) (string, bool) {
+	var errResp *errcode.ErrorResponse
+	var awsErr awserr.RequestFailure
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrBuildDeadline), errors.Is(err, builder.ErrZtocTimeout):
+		return failureTimeout, true
+	case errors.Is(err, builder.ErrCancelled), errors.Is(err, context.Canceled):
+		return failureCancelled, true
+	case errors.Is(err, ErrInsufficientCoverage), errors.Is(err, ErrScanGate), errors.Is(err, ErrTagDrift),
+		errors.As(err, new(*registryutils.LifecyclePolicyConflictError)):
+		return failurePolicy, false
+	case errors.As(err, &errResp):
+		return classifyStatus(errResp.StatusCode)
+	case errors.As(err, &awsErr):
+		if request.IsErrorThrottle(awsErr) {
+			return failureThrottled, true
+		}
+		return classifyStatus(awsErr.StatusCode())
+	case errors.Is(err, syscall.ENOSPC):
+		return failureStorage, false
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return failureNetwork, true
+	case errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts), errors.Is(err, builder.ErrNotSociIndex):
+		return failureInvalid, false
+	}
+	return failureInternal, false
+}
+
+// The class of a failed registry or API request by its status code
+func classifyStatus(status int) (string, bool) {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return failureThrottled, true
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return failureAuth, false
+	case status == http.StatusNotFound:
+		return failureNotFound, false
+	case status >= 500:
+		return failureRegistry, true
+	}
+	return failureInvalid, false
+}
@@ -0,0 +1,70 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		class     string
+		retryable bool
+	}{
+		{&errcode.ErrorResponse{StatusCode: http.StatusTooManyRequests}, failureThrottled, true},
+		{fmt.Errorf("pull: %w", &errcode.ErrorResponse{StatusCode: http.StatusNotFound}), failureNotFound, false},
+		{&errcode.ErrorResponse{StatusCode: http.StatusForbidden}, failureAuth, false},
+		{&errcode.ErrorResponse{StatusCode: http.StatusBadGateway}, failureRegistry, true},
+		{awserr.NewRequestFailure(awserr.New("ThrottlingException", "rate exceeded", nil), http.StatusBadRequest, "id"), failureThrottled, true},
+		{fmt.Errorf("gate: %w", ErrScanGate), failurePolicy, false},
+		{fmt.Errorf("%w: %w", builder.ErrCancelled, context.DeadlineExceeded), failureTimeout, true},
+		{context.Canceled, failureCancelled, true},
+		{errors.New("something broke"), failureInternal, false},
+	} {
+		class, retryable := classifyError(tc.err)
+		if class != tc.class || retryable != tc.retryable {
+			t.Fatalf("classifyError(%v) = %s, %v, expected %s, %v", tc.err, class, retryable, tc.class, tc.retryable)
+		}
+	}
+}
+
+func TestNewBuildFailure(t *testing.T) {
+	result := &buildResult{Message: "Image pull error", ImageDigest: "sha256:abc"}
+	failure := newBuildFailure("example.com/team/app:latest", result, &errcode.ErrorResponse{StatusCode: http.StatusTooManyRequests})
+	out, err := json.Marshal(failure)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	expected := map[string]interface{}{
+		"class":       failureThrottled,
+		"stage":       "Image pull error",
+		"registry":    "example.com",
+		"repository":  "team/app",
+		"imageDigest": "sha256:abc",
+		"retryable":   true,
+	}
+	for key, value := range expected {
+		if decoded[key] != value {
+			t.Fatalf("expected %s %v, got %v in %s", key, value, decoded[key], out)
+		}
+	}
+	if decoded["error"] == "" {
+		t.Fatalf("expected the error message in %s", out)
+	}
+}
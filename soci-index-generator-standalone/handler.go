@@ -5,27 +5,38 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"errors"
-	"path"
+	"path/filepath"
 
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/audit"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/filter"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/fs"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/lock"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/notify"
 	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/state"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
 	"github.com/containerd/containerd/images"
+	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/oci"
 
-	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/platforms"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -34,102 +45,658 @@ var (
 	ErrEmptyIndex = errors.New("no ztocs created, all layers either skipped or produced errors")
 )
 
+var ErrInsufficientCoverage = errors.New("SOCI index covers too little of the image")
+
+var ErrScanGate = errors.New("image didn't pass the vulnerability scan gate")
+
+var ErrTagDrift = errors.New("image tag points at a different digest than the one the SOCI index was built for")
+
+var ErrBuildDeadline = errors.New("build stopped to leave time for the clean up before the deadline")
+
 const (
-	BuildFailedMessage          = "SOCI index build error"
-	PushFailedMessage           = "SOCI index push error"
-	SkipPushOnEmptyIndexMessage = "Skipping pushing SOCI index as it does not contain any zTOCs"
-	BuildAndPushSuccessMessage  = "Successfully built and pushed SOCI index"
+	BuildFailedMessage             = "SOCI index build error"
+	PushFailedMessage              = "SOCI index push error"
+	SkipPushOnEmptyIndexMessage    = "Skipping pushing SOCI index as it does not contain any zTOCs"
+	BuildAndPushSuccessMessage     = "Successfully built and pushed SOCI index"
+	SkipPushOnNoPushMessage        = "Successfully built SOCI index, skipping push as requested"
+	PushSuccessMessage             = "Successfully pushed SOCI index"
+	SkipAlreadyIndexedMessage      = "Skipping image as its SOCI index was already pushed"
+	SkipLockedMessage              = "Skipping image as another worker is building its SOCI index"
+	PlatformsFailedMessage         = "SOCI index build error for some platforms"
+	VerifyFailedMessage            = "SOCI index verification error"
+	AuditFailedMessage             = "Audit log write error"
+	LifecycleConflictMessage       = "Lifecycle policy conflict error"
+	CancelledMessage               = "SOCI index build cancelled"
+	SkipOptedOutMessage            = "Skipping image as it opted out of SOCI indexing"
+	SkipTooSmallMessage            = "Skipping image as it is too small to benefit from SOCI"
+	SkipLazyLoadableMessage        = "Skipping image as its layers are already lazily loadable"
+	CoverageTooLowMessage          = "SOCI index coverage below the required minimum"
+	SkipDoneMessage                = "Skipping image as it was done before the batch was interrupted"
+	SkipScanGateMessage            = "Skipping image as it didn't pass the vulnerability scan gate"
+	ScanGateFailedMessage          = "Image didn't pass the vulnerability scan gate"
+	TagDriftMessage                = "Image tag moved to another digest during the build"
+	DeadlineMessage                = "SOCI index build stopped before the deadline"
+	SkipFilteredMessage            = "Skipping image as the image filter excludes it"
+	SkipTooOldMessage              = "Skipping image as it was pushed before the max age of the image filter"
+	EstargzFailedMessage           = "eStargz conversion error"
+	EstargzSuccessMessage          = "Successfully converted and pushed the eStargz image"
+	SkipEstargzPushOnNoPushMessage = "Successfully converted the image to eStargz, skipping push as requested"
+
+	// values of -verify-digests
+	verifyDigestsAlways         = "always"
+	verifyDigestsTrustTransport = "trust-transport"
+
+	// values of -on-platform-error
+	platformErrorFail     = "fail"
+	platformErrorContinue = "continue"
+
+	// values of -lifecycle-policy-check
+	lifecycleCheckOff  = "off"
+	lifecycleCheckWarn = "warn"
+	lifecycleCheckFail = "fail"
+
+	// values of -require-scan-status
+	scanStatusComplete = "COMPLETE"
+	scanStatusPassed   = "PASSED"
+
+	// values of -on-scan-gate
+	scanGateSkip = "skip"
+	scanGateFail = "fail"
+
+	// values of -tag-drift-check
+	tagDriftOff  = "off"
+	tagDriftWarn = "warn"
+	tagDriftFail = "fail"
+
+	// values of -convert
+	convertSoci    = "soci"
+	convertEstargz = "estargz"
+	convertBoth    = "both"
+
+	// values of -lazy-loadable-images
+	lazyLoadableWarn = "warn"
+	lazyLoadableSkip = "skip"
 
 	artifactsStoreName = "store"
-	artifactsDbName    = "artifacts.db"
+
+	// tag resolved when the image URI has neither a tag nor a digest
+	defaultImageTag = "latest"
+
+	// time left before the deadline of the run when the build is stopped, see withDeadlineMargin.
+	// reference: https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	defaultDeadlineMargin       = 10 * time.Second
+	defaultDeadlineMarginPerGiB = 2 * time.Second
+
+	// annotations of the SOCI index recording the builder, see builderAnnotations
+	annotationBuilderVersion    = "soci-index-builder.version"
+	annotationBuilderCommit     = "soci-index-builder.commit"
+	annotationSociVersion       = "soci-index-builder.soci-snapshotter-version"
+	annotationSourceImageDigest = "soci-index-builder.source-image-digest"
 )
 
-func handleRequest(ctx context.Context, imageUrl string, minLayerSize int64) (string, error) {
-	digest := strings.Split(imageUrl, ":")[1]
-	registryHost := strings.Split(imageUrl, "/")[0]
-	repo := strings.TrimPrefix(imageUrl, registryHost+"/")
-	repo = strings.TrimSuffix(repo, ":"+digest)
+// Options of a single SOCI index build
+type buildOptions struct {
+	// directory the temporary directories of the builds are created in, the OS temp directory if empty
+	workDir string
+	// time left before the deadline of the run to clean up, plus deadlineMarginPerGiB for each GiB pulled
+	deadlineMargin       time.Duration
+	deadlineMarginPerGiB time.Duration
+	// minimum layer size to build a ztoc for a layer
+	minLayerSize int64
+	// span size of the ztocs, the builder's default if 0
+	spanSize int64
+	// limit of building the ztoc of a single layer, 0 means no limit
+	ztocTimeout time.Duration
+	// don't annotate the SOCI indices with the version of the builder and the build time
+	noBuilderAnnotations bool
+	// build byte-identical SOCI indices for the same image, the build time is taken from SOURCE_DATE_EPOCH or the image
+	reproducible bool
+	// what happens to layers whose ztoc can't be built, builder.LayerErrorSkip, builder.LayerErrorFail or empty for the default
+	onLayerError string
+	// minimum percentage of the image bytes the SOCI index must cover, 0 accepts any coverage
+	requireCoverage float64
+	// workers decompressing and hashing each gzip layer while its ztoc is built, 1 or less uses the library's builder
+	decompressWorkers int
+	// optional cache of ztocs by layer digest shared with other builds
+	ztocCache cache.Cache
+	// platforms to build SOCI indices for, the host platform if empty
+	platforms []ocispec.Platform
+	// whether a failed platform aborts the build (platformErrorFail) or the remaining platforms are still built
+	onPlatformError string
+	// directory to keep the OCI layout in. A temporary directory is used when empty.
+	layoutDir string
+	// skip pushing the built SOCI index, it is kept in layoutDir instead
+	noPush bool
+	// publishes the outcome of each build, no notifications if nil
+	notifier notify.Notifier
+	// records every pushed SOCI index with the actor and trigger, no audit log if nil
+	auditLog     audit.Log
+	auditActor   string
+	auditTrigger string
+	// read the SOCI index back from the registry after pushing it
+	verifyPush bool
+	// serialization of the SOCI index, one of the builder.ManifestType values
+	manifestType string
+	// verify the digests of the pulled layers when reading them, instead of trusting the transport (-verify-digests)
+	verifyDigests bool
+	// optional store of already processed images, used to skip them
+	stateStore state.Store
+	// optional lock keyed by image digest, so that concurrent workers don't build the same image
+	locker lock.Locker
+	// how long a lock is held if it isn't renewed, it's renewed every third of the lease while the image is built
+	lockLease time.Duration
+	// whether to warn or fail when the lifecycle policy of the repository would expire the SOCI index
+	lifecyclePolicyCheck string
+	// whether to warn or fail when the tag of the image points at a different digest right before pushing
+	tagDriftCheck string
+	// settings of the destination ECR repository if it should be created when it doesn't exist
+	createRepository *registryutils.RepositorySettings
+	// min layer size, span size and platforms of the repositories matching a pattern, the first match applies
+	repositoryOverrides []repositoryOverride
+	// options of the registry client
+	registryOptions []registryutils.Option
+	// tag resolved when the image URI has neither a tag nor a digest, defaultImageTag if empty
+	defaultTag string
+	// build images opting out with the soci.skip annotation or label anyway
+	ignoreOptOut bool
+	// images whose layers are smaller than this on all platforms are skipped before pulling them, 0 builds all
+	minImageSize int64
+	// whether images with eStargz or zstd:chunked layers are built with a warning (lazyLoadableWarn) or skipped
+	lazyLoadableImages string
+	// scan the image manifests must have before they are built, scanStatusComplete, scanStatusPassed or empty to not check
+	requireScanStatus string
+	// least severe finding that keeps an image from passing with scanStatusPassed, e.g. CRITICAL
+	scanSeverity string
+	// whether images not passing the scan gate are skipped (scanGateSkip) or fail the build
+	onScanGate string
+	// allow and deny lists of the images that are built, nil to build all of them
+	imageFilter *filter.Filter
+	// what the image is converted to: a SOCI index (convertSoci or empty), an eStargz image (convertEstargz) or both
+	convert string
+	// appended to the tag of the image for the tag of its eStargz conversion, defaultEstargzTagSuffix if empty
+	estargzTagSuffix string
+}
+
+// How long sending the notification of a build may take, the context of the build may be done already
+const notifyTimeout = 10 * time.Second
+
+func handleRequest(ctx context.Context, imageUrl string, opts buildOptions) (*buildResult, error) {
+	startedAt := time.Now()
+	result, err := processImage(ctx, imageUrl, opts)
+	if opts.notifier != nil {
+		event := newEvent(imageUrl, result, err, time.Since(startedAt))
+		// cancelled and timed out builds are notified too
+		notifyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notifyTimeout)
+		defer cancel()
+		if notifyErr := opts.notifier.Notify(notifyCtx, event); notifyErr != nil {
+			// notifications are best effort, the outcome of the build doesn't change
+			log.Error(ctx, "Notification error", notifyErr)
+		}
+	}
+	return result, err
+}
+
+// Build and push the SOCI indices of an image, skipping it if the state store or lock say so
+func processImage(ctx context.Context, imageUrl string, opts buildOptions) (result *buildResult, err error) {
+	registryHost, repo, digest := parseImageUrl(imageUrl)
 
 	ctx = context.WithValue(ctx, "RegistryURL", registryHost)
+	digest = imageReference(ctx, digest, opts)
+	opts, override := withRepositoryOverride(opts, repo)
+	if override != nil {
+		log.Info(ctx, fmt.Sprintf("Using the build options of repository pattern %q", override.Pattern))
+	}
+	if opts.imageFilter != nil && !opts.imageFilter.Allows(ctx, repo, digest) {
+		log.Info(ctx, SkipFilteredMessage)
+		return &buildResult{Message: SkipFilteredMessage}, nil
+	}
 
-	registry, err := registryutils.Init(ctx, registryHost)
+	registry, err := registryutils.Init(ctx, registryHost, opts.registryOptions...)
 	if err != nil {
-		fmt.Printf("Error initializing registry: %v", err)
+		return resultError(ctx, "Registry init error", err)
 	}
+	defer func() {
+		if result != nil && registry != nil {
+			result.PulledSize = registry.PulledSize()
+			result.PushedSize = registry.PushedSize()
+		}
+	}()
 
 	err = registry.ValidateImageManifest(ctx, repo, digest)
 	if err != nil {
 		log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
 		// Returning a non error to skip retries
-		return "Exited early due to manifest validation error", nil
+		return &buildResult{Message: "Exited early due to manifest validation error"}, nil
+	}
+
+	if opts.imageFilter != nil {
+		if maxAge := opts.imageFilter.MaxAge(ctx); maxAge > 0 {
+			tooOld, err := imageTooOld(ctx, registry, repo, digest, maxAge)
+			if err != nil {
+				return resultError(ctx, "Image push time read error", err)
+			}
+			if tooOld {
+				return &buildResult{Message: SkipTooOldMessage}, nil
+			}
+		}
+	}
+
+	if !opts.ignoreOptOut {
+		optOut, err := findOptOut(ctx, registry, repo, digest)
+		if err != nil {
+			return resultError(ctx, "Opt-out check error", err)
+		}
+		if optOut != "" {
+			log.Info(ctx, fmt.Sprintf("%s, it's set with the %s", SkipOptedOutMessage, optOut))
+			return &buildResult{Message: SkipOptedOutMessage}, nil
+		}
+	}
+
+	// the estimate from the manifests is read once for the checks of the image and the build
+	var estimate *estimateResult
+	if opts.minImageSize > 0 || opts.requireScanStatus != "" {
+		estimate, err = estimateImage(ctx, registry, repo, digest, opts)
+		if err != nil {
+			return resultError(ctx, "Image manifest read error", err)
+		}
+	}
+
+	if opts.minImageSize > 0 {
+		tooSmall := imageTooSmall(ctx, estimate, opts)
+		if tooSmall != nil {
+			return tooSmall, nil
+		}
+	}
+
+	if opts.requireScanStatus != "" {
+		reason, err := scanGateFailure(ctx, registry, repo, estimate, opts)
+		if err != nil {
+			return resultError(ctx, "Scan findings read error", err)
+		}
+		if reason != "" {
+			if opts.onScanGate == scanGateFail {
+				return resultError(ctx, ScanGateFailedMessage, fmt.Errorf("%w: %s", ErrScanGate, reason))
+			}
+			log.Info(ctx, fmt.Sprintf("%s, %s", SkipScanGateMessage, reason))
+			return &buildResult{Message: SkipScanGateMessage}, nil
+		}
+	}
+
+	if opts.stateStore == nil && opts.locker == nil {
+		return buildAndPushIndex(ctx, registry, repo, digest, estimate, opts)
+	}
+
+	imageDescriptor, err := registry.HeadManifest(ctx, repo, digest)
+	if err != nil {
+		return resultError(ctx, "Image resolve error", err)
+	}
+	ctx = context.WithValue(ctx, "ImageDigest", imageDescriptor.Digest.String())
+	if imageDescriptor.Digest.String() != digest {
+		log.Info(ctx, fmt.Sprintf("Resolved %s:%s to %s", repo, digest, imageDescriptor.Digest))
+	}
+
+	if opts.locker != nil {
+		acquired, err := opts.locker.Acquire(ctx, imageDescriptor.Digest.String())
+		if err != nil {
+			return resultError(ctx, "Lock acquire error", err)
+		}
+		if !acquired {
+			log.Info(ctx, SkipLockedMessage)
+			return &buildResult{Message: SkipLockedMessage, ImageDigest: imageDescriptor.Digest.String()}, nil
+		}
+		stopRenewing := renewLock(ctx, opts.locker, imageDescriptor.Digest.String(), opts.lockLease/3)
+		defer func() {
+			stopRenewing()
+			// the lock is released even if the build was cancelled
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+			defer cancel()
+			if err := opts.locker.Release(releaseCtx, imageDescriptor.Digest.String()); err != nil {
+				log.Error(ctx, "Lock release error", err)
+			}
+		}()
+	}
+
+	if opts.stateStore == nil {
+		return buildAndPushIndex(ctx, registry, repo, digest, estimate, opts)
+	}
+
+	record, err := opts.stateStore.Get(ctx, imageDescriptor.Digest.String())
+	if err != nil {
+		return resultError(ctx, "State store read error", err)
+	}
+	if state.IsProcessed(record) {
+		log.Info(ctx, fmt.Sprintf("%s, SOCI index %s was pushed at %s", SkipAlreadyIndexedMessage, record.IndexDigest, record.UpdatedAt.Format(time.RFC3339)))
+		return &buildResult{Message: SkipAlreadyIndexedMessage, ImageDigest: imageDescriptor.Digest.String()}, nil
+	}
+
+	startedAt := time.Now()
+	result, err = buildAndPushIndex(ctx, registry, repo, digest, estimate, opts)
+
+	current := state.Record{
+		ImageDigest: imageDescriptor.Digest.String(),
+		Repository:  repo,
+		IndexDigest: strings.Join(result.indexDigests(), ","),
+		Status:      buildStatus(result.Message, err),
+		Message:     result.Message,
+		UpdatedAt:   time.Now(),
+		Duration:    time.Since(startedAt),
+	}
+	if err != nil {
+		current.Message = fmt.Sprintf("%s: %v", result.Message, err)
 	}
+	log.Info(ctx, fmt.Sprintf("Build took %s, %s", current.Duration.Round(time.Millisecond), state.DescribeChange(record, current)))
+	if stateErr := opts.stateStore.Put(ctx, current); stateErr != nil {
+		// The build itself is done, failing to record it only means it may be repeated
+		log.Error(ctx, "State store write error", stateErr)
+	}
+
+	return result, err
+}
 
-	// Directory in lambda storage to store images and SOCI artifacts
-	dataDir, err := createTempDir(ctx)
+// Check from the manifests whether the image is smaller than the minimum image size on all target platforms,
+// pulling it would be pointless as the SOCI index couldn't make a difference. Returns the skip result if it is.
+func imageTooSmall(ctx context.Context, estimate *estimateResult, opts buildOptions) *buildResult {
+	var largest int64
+	for _, platform := range estimate.Platforms {
+		largest = max(largest, platform.imageSize())
+	}
+	if largest >= opts.minImageSize {
+		return nil
+	}
+	log.Info(ctx, fmt.Sprintf("%s, its layers are %s which is less than min-image-size %s", SkipTooSmallMessage, size.Format(largest), size.Format(opts.minImageSize)))
+	return &buildResult{Message: SkipTooSmallMessage, ImageDigest: estimate.ImageDigest}
+}
+
+// Check whether the image was pushed longer ago than the max age of the image filter. Images in registries that
+// don't record push times are built with a warning.
+func imageTooOld(ctx context.Context, registry *registryutils.Registry, repo string, reference string, maxAge time.Duration) (bool, error) {
+	pushedAt, err := registry.ImagePushedAt(ctx, repo, reference)
+	if errors.Is(err, registryutils.ErrNotEcrRegistry) {
+		log.Warn(ctx, "The registry has no push times, the max age of the image filter isn't applied")
+		return false, nil
+	}
 	if err != nil {
-		return lambdaError(ctx, "Directory create error", err)
+		return false, err
+	}
+	if time.Since(pushedAt) <= maxAge {
+		return false, nil
+	}
+	log.Info(ctx, fmt.Sprintf("%s, it was pushed at %s", SkipTooOldMessage, pushedAt.Format(time.RFC3339)))
+	return true, nil
+}
+
+// Check the ECR scan findings of the manifest of every target platform against -require-scan-status, so that the
+// faster startup of a SOCI index isn't given to vulnerable images. Returns why the image doesn't pass, empty if it does.
+func scanGateFailure(ctx context.Context, registry *registryutils.Registry, repo string, estimate *estimateResult, opts buildOptions) (string, error) {
+	for _, platform := range estimate.Platforms {
+		if platform.ManifestDigest == "" {
+			continue
+		}
+		findings, err := registry.ImageScanFindings(ctx, repo, platform.ManifestDigest)
+		if errors.Is(err, registryutils.ErrNotEcrRegistry) {
+			return "the registry has no ECR scan findings", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !findings.Complete() {
+			return fmt.Sprintf("the scan status of %s is %s", platform.Platform, findings.Status), nil
+		}
+		if opts.requireScanStatus != scanStatusPassed {
+			continue
+		}
+		if count := findings.CountAtLeast(opts.scanSeverity); count > 0 {
+			return fmt.Sprintf("the scan of %s has %d findings of severity %s or higher", platform.Platform, count, opts.scanSeverity), nil
+		}
 	}
+	return "", nil
+}
+
+// Detect layers of the image in a format that other snapshotters load lazily, e.g. eStargz.
+// Returns the format of the first such layer, empty if there is none.
+func detectLazyLoading(estimate *estimateResult) string {
+	for _, platform := range estimate.Platforms {
+		for _, layer := range platform.Layers {
+			if layer.LazyLoading != "" {
+				return layer.LazyLoading
+			}
+		}
+	}
+	return ""
+}
+
+// Pull the image, build the SOCI index of each platform and push it. The estimate of the image is read from its
+// manifests if the checks of processImage didn't need it.
+func buildAndPushIndex(ctx context.Context, registry *registryutils.Registry, repo string, digest string, estimate *estimateResult, opts buildOptions) (*buildResult, error) {
+	// Directory in the work directory to store images and SOCI artifacts
+	dataDir, err := createTempDir(ctx, opts.workDir)
+	if err != nil {
+		return resultError(ctx, "Directory create error", err)
+	}
+	// the build returns before the work directory is removed, when its context is done at the latest
 	defer cleanUp(ctx, dataDir)
 
-	// The channel to signal the deadline monitor goroutine to exit early
-	quitChannel := make(chan int)
-	defer func() {
-		quitChannel <- 1
-	}()
+	runCtx := ctx
+	ctx, cancel := withDeadlineMargin(runCtx, opts.deadlineMargin)
+	defer cancel()
 
-	setDeadline(ctx, quitChannel, dataDir)
+	storeDir := filepath.Join(dataDir, artifactsStoreName)
+	if opts.layoutDir != "" {
+		storeDir = opts.layoutDir
+	}
 
-	sociStore, err := initSociStore(ctx, dataDir)
+	sociStore, err := initSociStore(ctx, storeDir)
 	if err != nil {
-		return lambdaError(ctx, "OCI storage initialization error", err)
+		return resultError(ctx, "OCI storage initialization error", err)
+	}
+
+	targetPlatforms := opts.platforms
+	if len(targetPlatforms) == 0 {
+		targetPlatforms = []ocispec.Platform{platforms.DefaultSpec()}
+	}
+
+	if !opts.noPush {
+		err = checkLifecyclePolicy(ctx, registry, repo, opts)
+		if err != nil {
+			return resultError(ctx, LifecycleConflictMessage, err)
+		}
 	}
 
-	desc, err := registry.Pull(ctx, repo, sociStore, digest)
+	if estimate == nil {
+		estimate, err = estimateImage(ctx, registry, repo, digest, opts)
+		if err != nil {
+			return resultError(ctx, "Image manifest read error", err)
+		}
+	}
+	result := &buildResult{}
+	result.LazyLoading = detectLazyLoading(estimate)
+	if result.LazyLoading != "" {
+		if opts.lazyLoadableImages == lazyLoadableSkip {
+			log.Info(ctx, fmt.Sprintf("%s, they are %s layers", SkipLazyLoadableMessage, result.LazyLoading))
+			result.Message = SkipLazyLoadableMessage
+			return result, nil
+		}
+		log.Warn(ctx, fmt.Sprintf("The image has %s layers, which other snapshotters already load lazily without a SOCI index", result.LazyLoading))
+	}
+
+	pullStart := time.Now()
+	desc, err := registry.Pull(ctx, repo, sociStore, digest, cachedLayerFilter(opts), targetPlatforms...)
 	if err != nil {
-		return lambdaError(ctx, "Image pull error", err)
+		return resultError(ctx, "Image pull error", err)
 	}
+	result.Timings.since("pull", pullStart)
+	result.ImageDigest = desc.Digest.String()
+
+	// removing the pulled layers takes longer the larger they are
+	ctx, cancelBuild := withDeadlineMargin(runCtx, deadlineMargin(opts, registry.PulledSize()))
+	defer cancelBuild()
 
 	image := images.Image{
 		Name:   repo + "@" + digest,
 		Target: *desc,
 	}
 
-	indexDescriptor, err := buildIndex(ctx, dataDir, sociStore, image, minLayerSize)
+	if len(opts.platforms) == 0 && images.IsManifestType(desc.MediaType) {
+		// A single platform image is built for the platform it declares, which may not be the host's
+		imagePlatform, err := singlePlatform(ctx, sociStore, *desc)
+		if err != nil {
+			return resultError(ctx, "Image config read error", err)
+		}
+		targetPlatforms = []ocispec.Platform{imagePlatform}
+	}
+
+	if opts.convert != convertEstargz {
+		var errs []error
+		for _, platform := range targetPlatforms {
+			platformResult, err := buildAndPushPlatform(ctx, registry, repo, dataDir, storeDir, sociStore, image, platform, opts)
+			result.Platforms = append(result.Platforms, platformResult)
+			if err != nil {
+				if opts.onPlatformError != platformErrorContinue {
+					result.Message = platformResult.Message
+					return result, err
+				}
+				errs = append(errs, fmt.Errorf("%s: %w", platformResult.Platform, err))
+			}
+		}
+		result.Message = summarizePlatforms(result.Platforms)
+
+		// When continuing on platform errors the build only fails if no platform succeeded
+		if len(errs) == len(targetPlatforms) {
+			return result, errors.Join(errs...)
+		}
+	}
+
+	if opts.convert == convertEstargz || opts.convert == convertBoth {
+		err = convertAndPushEstargz(ctx, registry, repo, dataDir, storeDir, sociStore, image, targetPlatforms, opts, result)
+		if err != nil {
+			msg, err := cancellation(ctx, EstargzFailedMessage, err)
+			log.Error(ctx, msg, err)
+			result.Message = msg
+			return result, err
+		}
+		if opts.convert == convertEstargz {
+			result.Message = EstargzSuccessMessage
+			if opts.noPush {
+				result.Message = SkipEstargzPushOnNoPushMessage
+			}
+		}
+	}
+	return result, nil
+}
+
+// Build and push the SOCI index for one platform of the image
+func buildAndPushPlatform(ctx context.Context, registry *registryutils.Registry, repo string, dataDir string, storeDir string, sociStore *store.SociStore, image images.Image, platform ocispec.Platform, opts buildOptions) (platformResult, error) {
+	result := platformResult{Platform: platforms.Format(platform)}
+	ctx = context.WithValue(ctx, "Platform", result.Platform)
+
+	fetchLayer := func(ctx context.Context, desc ocispec.Descriptor) error {
+		return registry.PullBlob(ctx, repo, sociStore, desc)
+	}
+	margin := deadlineMargin(opts, registry.PulledSize())
+	indexDescriptor, savings, err := buildIndex(ctx, dataDir, storeDir, sociStore, image, platform, fetchLayer, margin, opts, &result.Timings, &result.SkippedLayers)
 	if err != nil {
+		if errors.Is(err, ErrInsufficientCoverage) {
+			result.Savings = savings
+			return result.failed(ctx, CoverageTooLowMessage, err)
+		}
 		if err.Error() == ErrEmptyIndex.Error() {
+			if opts.requireCoverage > 0 {
+				// an empty index covers nothing, which is below any required coverage
+				return result.failed(ctx, CoverageTooLowMessage, fmt.Errorf("%w: no layer is lazily loaded, %.1f%% required", ErrInsufficientCoverage, opts.requireCoverage))
+			}
 			log.Warn(ctx, SkipPushOnEmptyIndexMessage)
-			return SkipPushOnEmptyIndexMessage, nil
+			result.Message = SkipPushOnEmptyIndexMessage
+			return result, nil
 		}
-		return lambdaError(ctx, BuildFailedMessage, err)
+		return result.failed(ctx, BuildFailedMessage, err)
+	}
+	result.IndexDigest = indexDescriptor.Digest.String()
+	result.Savings = savings
+	ctx = context.WithValue(ctx, "SOCIIndexDigest", result.IndexDigest)
+
+	if opts.layoutDir != "" {
+		// Record the index in the layout's index.json so that the push command can find it later
+		err = sociStore.Tag(ctx, *indexDescriptor, indexDescriptor.Digest.String())
+		if err != nil {
+			return result.failed(ctx, "OCI layout write error", err)
+		}
+	}
+
+	if opts.noPush {
+		log.Info(ctx, SkipPushOnNoPushMessage)
+		result.Message = SkipPushOnNoPushMessage
+		return result, nil
+	}
+
+	verifyStart := time.Now()
+	err = verifyIndexBlobs(ctx, sociStore, *indexDescriptor)
+	if err != nil {
+		return result.failed(ctx, VerifyFailedMessage, err)
+	}
+	result.Timings.since("verify-ztocs", verifyStart)
+
+	err = checkTagDrift(ctx, registry, repo, image, opts)
+	if err != nil {
+		return result.failed(ctx, TagDriftMessage, err)
 	}
-	ctx = context.WithValue(ctx, "SOCIIndexDigest", indexDescriptor.Digest.String())
 
+	pushStart := time.Now()
 	err = registry.Push(ctx, sociStore, *indexDescriptor, repo)
 	if err != nil {
-		return lambdaError(ctx, PushFailedMessage, err)
+		return result.failed(ctx, PushFailedMessage, err)
+	}
+	result.Timings.since("push", pushStart)
+
+	err = auditPush(ctx, opts, repo, image.Target.Digest.String(), *indexDescriptor)
+	if err != nil {
+		return result.failed(ctx, AuditFailedMessage, err)
+	}
+
+	if opts.verifyPush {
+		verifyStart := time.Now()
+		err = registry.VerifyPush(ctx, repo, *indexDescriptor)
+		if err != nil {
+			return result.failed(ctx, VerifyFailedMessage, err)
+		}
+		result.Timings.since("verify-push", verifyStart)
 	}
 
 	log.Info(ctx, BuildAndPushSuccessMessage)
-	return BuildAndPushSuccessMessage, nil
+	result.Message = BuildAndPushSuccessMessage
+	result.indexDescriptor = indexDescriptor
+	return result, nil
 }
 
-// Create a temp directory in /tmp
-// The directory is prefixed by the Lambda's request id
-func createTempDir(ctx context.Context) (string, error) {
+// Free space in bytes the work directory should have, we support images as big as 6GB
+const minFreeSpace = 6_000_000_000
+
+// Create a temp directory in the work directory, the OS temp directory if empty
+func createTempDir(ctx context.Context, workDir string) (string, error) {
+	if workDir == "" {
+		workDir = os.TempDir()
+	}
 	// free space in bytes
-	freeSpace := fs.CalculateFreeSpace("/tmp")
-	log.Info(ctx, fmt.Sprintf("There are %d bytes of free space in /tmp directory", freeSpace))
-	if freeSpace < 6_000_000_000 {
+	freeSpace := fs.CalculateFreeSpace(workDir)
+	log.Info(ctx, fmt.Sprintf("There are %d bytes of free space in %s", freeSpace, workDir))
+	if freeSpace < minFreeSpace {
 		// this is problematic because we support images as big as 6GB
-		log.Warn(ctx, fmt.Sprintf("Free space in /tmp is only %d bytes, which is less than 6GB", freeSpace))
+		log.Warn(ctx, fmt.Sprintf("Free space in %s is only %d bytes, which is less than 6GB", workDir, freeSpace))
 	}
 
 	log.Info(ctx, "Creating a directory to store images and SOCI artifacts")
-	tempDir, err := os.MkdirTemp("/tmp", "soci-lambda") // The temp dir name is prefixed by the request id
-	return tempDir, err
+	tempDir, err := os.MkdirTemp(workDir, tempDirPrefix)
+	if err != nil {
+		return "", err
+	}
+	// the lock tells the builds of other runs that the directory isn't abandoned
+	if err := lockTempDir(ctx, tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+	return tempDir, nil
 }
 
-// Clean up the data written by the Lambda
+// Clean up the data written by the build
 func cleanUp(ctx context.Context, dataDir string) {
 	log.Info(ctx, fmt.Sprintf("Removing all files in %s", dataDir))
 	if err := os.RemoveAll(dataDir); err != nil {
@@ -137,105 +704,433 @@ func cleanUp(ctx context.Context, dataDir string) {
 	}
 }
 
-// Set up deadline for the lambda to proactively clean up its data before the invocation timeout. We don't
-// want to keep data in storage when the Lambda reaches its invocation timeout.
-// This function creates a goroutine that will do cleanup when the invocation timeout is near.
-// quitChannel is used for signaling that goroutine when the invocation ends naturally.
-func setDeadline(ctx context.Context, quitChannel chan int, dataDir string) {
-	// setting deadline as 10 seconds before lambda timeout.
-	// reference: https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
-	deadline, _ := ctx.Deadline()
-	deadline = deadline.Add(-10 * time.Second)
-	timeoutChannel := time.After(time.Until(deadline))
-	go func() {
-		for {
-			select {
-			case <-timeoutChannel:
-				cleanUp(ctx, dataDir)
-				log.Error(ctx, "Invocation timeout error", fmt.Errorf("Invocation timeout after 14 minutes and 50 seconds"))
-				return
-			case <-quitChannel:
-				return
-			}
+// Stop the build margin before the deadline of the run, if it has one, so that there's time left to clean up
+// and report the outcome. The context of the build is cancelled with ErrBuildDeadline when the margin starts.
+func withDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}
+	}
+	cause := fmt.Errorf("%w, %s before the deadline %s", ErrBuildDeadline, margin, deadline.Format(time.RFC3339))
+	return context.WithDeadlineCause(ctx, deadline.Add(-margin), cause)
+}
+
+// Wait for the ztoc builds the builder stopped waiting for, they still read layer files in the work directory
+// and it's removed once the build returns. They get the ztoc timeout at most (if there is one), and once the
+// context of the build is done half of the margin before the deadline at most, the rest is left to remove the
+// work directory.
+func waitForZtocBuilds(ctx context.Context, indexBuilder *builder.Builder, margin time.Duration, ztocTimeout time.Duration) {
+	waitCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	if ztocTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		waitCtx, cancelTimeout = context.WithTimeout(waitCtx, ztocTimeout)
+		defer cancelTimeout()
+	}
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(margin/2, cancel)
+	})
+	defer stop()
+	if err := indexBuilder.Wait(waitCtx); err != nil {
+		log.Warn(ctx, "Ztoc builds are still running, their layer files are removed with the work directory")
+	}
+}
+
+// The margin before the deadline of a build that pulled pulledSize bytes
+func deadlineMargin(opts buildOptions, pulledSize int64) time.Duration {
+	return opts.deadlineMargin + time.Duration(float64(opts.deadlineMarginPerGiB)*float64(pulledSize)/(1<<30))
+}
+
+// Annotations of the SOCI index recording which builder built it when, for audits of indices built by outdated builders
+func builderAnnotations(ctx context.Context, store content.Provider, image images.Image, platform ocispec.Platform, opts buildOptions) (map[string]string, error) {
+	if opts.noBuilderAnnotations {
+		return nil, nil
+	}
+	info := version.Get()
+	annotations := map[string]string{
+		annotationBuilderVersion:    info.Version,
+		annotationSociVersion:       info.SociSnapshotter,
+		annotationSourceImageDigest: image.Target.Digest.String(),
+	}
+	if info.Commit != "" {
+		annotations[annotationBuilderCommit] = info.Commit
+	}
+	created, err := indexCreated(ctx, store, image, platform, opts)
+	if err != nil {
+		return nil, err
+	}
+	if created != nil {
+		annotations[ocispec.AnnotationCreated] = created.UTC().Format(time.RFC3339)
+	}
+	return annotations, nil
+}
+
+// The build time recorded in the SOCI index. Reproducible builds use SOURCE_DATE_EPOCH, like other reproducible
+// build tools, or the creation time of the image, and record none if the image has no creation time.
+func indexCreated(ctx context.Context, store content.Provider, image images.Image, platform ocispec.Platform, opts buildOptions) (*time.Time, error) {
+	if !opts.reproducible {
+		now := time.Now()
+		return &now, nil
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
 		}
-	}()
+		created := time.Unix(seconds, 0)
+		return &created, nil
+	}
+	configDesc, err := image.Config(ctx, store, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, err
+	}
+	configBytes, err := content.ReadBlob(ctx, store, configDesc)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, err
+	}
+	return config.Created, nil
 }
 
 // Init containerd store
-func initContainerdStore(dataDir string) (content.Store, error) {
-	containerdStore, err := local.NewStore(path.Join(dataDir, artifactsStoreName))
+func initContainerdStore(storeDir string) (content.Store, error) {
+	containerdStore, err := local.NewStore(storeDir)
 	return containerdStore, err
 }
 
 // Init SOCI artifact store
-func initSociStore(ctx context.Context, dataDir string) (*store.SociStore, error) {
+func initSociStore(ctx context.Context, storeDir string) (*store.SociStore, error) {
 	// Note: We are wrapping an *oci.Store in a store.SociStore because soci.WriteSociIndex
 	// expects a store.Store, an interface that extends the oci.Store to provide support
 	// for garbage collection.
-	ociStore, err := oci.NewWithContext(ctx, path.Join(dataDir, artifactsStoreName))
-	return &store.SociStore{ociStore}, err
+	ociStore, err := oci.NewWithContext(ctx, storeDir)
+	return &store.SociStore{Store: ociStore}, err
 }
 
-// Init a new instance of SOCI artifacts DB
-func initSociArtifactsDb(dataDir string) (*soci.ArtifactsDb, error) {
-	artifactsDbPath := path.Join(dataDir, artifactsDbName)
-	artifactsDb, err := soci.NewDB(artifactsDbPath)
+// Build soci index for an image and returns its ocispec.Descriptor.
+// The layers that weren't indexed because of their format are recorded in skippedLayers, even if the index is empty.
+// Layers that weren't pulled because their ztocs are cached are downloaded with fetchLayer if the cached ztocs can't be used.
+// margin is the margin of the build before the deadline, see withDeadlineMargin.
+func buildIndex(ctx context.Context, dataDir string, storeDir string, sociStore *store.SociStore, image images.Image, platform ocispec.Platform, fetchLayer func(ctx context.Context, desc ocispec.Descriptor) error, margin time.Duration, opts buildOptions, timings *timings, skippedLayers *[]builder.LayerDiagnostic) (*ocispec.Descriptor, *builder.Savings, error) {
+	log.Info(ctx, "Building SOCI index")
+
+	containerdStore, err := initContainerdStore(storeDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return artifactsDb, nil
+	annotations, err := builderAnnotations(ctx, containerdStore, image, platform, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indexBuilder := builder.New(containerdStore, sociStore,
+		builder.WithPlatform(platform),
+		builder.WithMinLayerSize(opts.minLayerSize),
+		builder.WithSpanSize(opts.spanSize),
+		builder.WithZtocTimeout(opts.ztocTimeout),
+		builder.WithDecompressWorkers(opts.decompressWorkers),
+		builder.WithAnnotations(annotations),
+		builder.WithLayerErrorPolicy(opts.onLayerError),
+		builder.WithTempDir(dataDir),
+		builder.WithLayerVerification(opts.verifyDigests),
+		builder.WithZtocCache(opts.ztocCache),
+		builder.WithLayerFetcher(fetchLayer))
+	defer waitForZtocBuilds(ctx, indexBuilder, margin, opts.ztocTimeout)
+
+	// Build the SOCI index
+	buildStart := time.Now()
+	index, err := indexBuilder.Build(ctx, image)
+	*skippedLayers = indexBuilder.Diagnostics()
+	if err != nil {
+		return nil, nil, err
+	}
+	timings.since("build", buildStart)
+	if opts.verifyDigests {
+		// layers are verified while they are copied for the ztoc builder, so this is part of the build time
+		timings.add("verify-layers", indexBuilder.VerifyDuration())
+	}
+
+	manifest, err := images.Manifest(ctx, containerdStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, nil, err
+	}
+	savings := builder.EstimateSavings(manifest.Layers, index.Index)
+	log.Info(ctx, fmt.Sprintf("SOCI index covers %d of %d layers, %s of %s (%.1f%%) of the image is lazily loaded",
+		savings.DeferredLayers, savings.Layers, size.Format(savings.DeferredSize), size.Format(savings.ImageSize), savings.CoveragePercent))
+	if savings.CoveragePercent < opts.requireCoverage {
+		return nil, &savings, fmt.Errorf("%w: %.1f%% of the image is lazily loaded, %.1f%% required", ErrInsufficientCoverage, savings.CoveragePercent, opts.requireCoverage)
+	}
+
+	// Write the SOCI index to the OCI store
+	indexDescriptor, err := builder.WriteIndex(ctx, index.Index, sociStore, opts.manifestType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &indexDescriptor, &savings, nil
 }
 
-// Build soci index for an image and returns its ocispec.Descriptor
-func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image, minLayerSize int64) (*ocispec.Descriptor, error) {
-	log.Info(ctx, "Building SOCI index")
-	platform := platforms.DefaultSpec() // TODO: make this a user option
+// Split an image URI into the registry host, the repository name and the tag or digest.
+// The host ends at the first slash, with its port and IPv6 literals in brackets, e.g. [::1]:5000.
+// A digest pins the image, so the tag of a URI with both (repo:tag@sha256:...) is dropped.
+// The reference is empty if the URI has neither, see imageReference.
+func parseImageUrl(imageUrl string) (registryHost string, repo string, reference string) {
+	registryHost, repo, _ = strings.Cut(imageUrl, "/")
+	// host names are case-insensitive, ECR hosts are only recognized in lower case
+	registryHost = strings.ToLower(registryHost)
+	repo, imageDigest, hasDigest := strings.Cut(repo, "@")
+	tag := ""
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	if hasDigest {
+		return registryHost, repo, imageDigest
+	}
+	return registryHost, repo, tag
+}
+
+// The tag or digest of an image URI, the default tag if it has neither
+func imageReference(ctx context.Context, reference string, opts buildOptions) string {
+	if reference != "" {
+		return reference
+	}
+	tag := opts.defaultTag
+	if tag == "" {
+		tag = defaultImageTag
+	}
+	log.Info(ctx, fmt.Sprintf("The image URI has no tag or digest, resolving the %q tag", tag))
+	return tag
+}
+
+// Map the outcome of a build to the status recorded in the state store
+func buildStatus(out string, err error) string {
+	switch {
+	case err != nil:
+		return state.StatusFailed
+	case out == PlatformsFailedMessage:
+		return state.StatusFailed
+	case out == BuildAndPushSuccessMessage || out == EstargzSuccessMessage:
+		return state.StatusPushed
+	case out == SkipPushOnNoPushMessage || out == SkipEstargzPushOnNoPushMessage:
+		return state.StatusBuilt
+	default:
+		return state.StatusSkipped
+	}
+}
 
-	artifactsDb, err := initSociArtifactsDb(dataDir)
+// Read the platform declared in the config of a single platform image
+func singlePlatform(ctx context.Context, sociStore *store.SociStore, manifestDesc ocispec.Descriptor) (ocispec.Platform, error) {
+	manifestBytes, err := orascontent.FetchAll(ctx, sociStore, manifestDesc)
 	if err != nil {
-		return nil, err
+		return ocispec.Platform{}, err
+	}
+	var manifest ocispec.Manifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return ocispec.Platform{}, err
 	}
 
-	containerdStore, err := initContainerdStore(dataDir)
+	configBytes, err := orascontent.FetchAll(ctx, sociStore, manifest.Config)
 	if err != nil {
-		return nil, err
+		return ocispec.Platform{}, err
 	}
+	return configPlatform(configBytes)
+}
 
-	builder, err := soci.NewIndexBuilder(containerdStore, sociStore, artifactsDb, soci.WithPlatform(platform), soci.WithMinLayerSize(minLayerSize))
+// Parse the platform declared in an image config
+func configPlatform(configBytes []byte) (ocispec.Platform, error) {
+	var config ocispec.Image
+	err := json.Unmarshal(configBytes, &config)
 	if err != nil {
-		return nil, err
+		return ocispec.Platform{}, err
 	}
+	if config.OS == "" || config.Architecture == "" {
+		// configs without a platform are matched against the host platform
+		return platforms.DefaultSpec(), nil
+	}
+	return platforms.Normalize(config.Platform), nil
+}
 
-	// Build the SOCI index
-	index, err := builder.Build(ctx, image)
+// Verify the digests of the SOCI index manifest and its ztocs in the local store before they are pushed
+func verifyIndexBlobs(ctx context.Context, sociStore *store.SociStore, indexDescriptor ocispec.Descriptor) error {
+	manifestBytes, err := orascontent.FetchAll(ctx, sociStore, indexDescriptor)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if digest.FromBytes(manifestBytes) != indexDescriptor.Digest {
+		return fmt.Errorf("SOCI index digest mismatch, expected %s", indexDescriptor.Digest)
 	}
 
-	// Write the SOCI index to the OCI store
-	err = soci.WriteSociIndex(ctx, index, sociStore, artifactsDb)
+	index, _, err := builder.ParseIndex(manifestBytes)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, blob := range index.Blobs {
+		rc, err := sociStore.Fetch(ctx, blob)
+		if err != nil {
+			return err
+		}
+		actual, err := digest.FromReader(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if actual != blob.Digest {
+			return fmt.Errorf("ztoc digest mismatch, expected %s but got %s", blob.Digest, actual)
+		}
 	}
+	return nil
+}
 
-	// Get SOCI indices for the image from the OCI store
-	// TODO: consider making soci's WriteSociIndex to return the descriptor directly
-	indexDescriptorInfos, _, err := soci.GetIndexDescriptorCollection(ctx, containerdStore, artifactsDb, image, []ocispec.Platform{platform})
+// Warn or fail, depending on -tag-drift-check, when the image was given by a tag that was moved to another digest
+// while the SOCI index was built. The index would still be pushed for the digest that was pulled, which the tag no
+// longer points at, so nodes pulling the tag wouldn't use it.
+func checkTagDrift(ctx context.Context, registry *registryutils.Registry, repo string, image images.Image, opts buildOptions) error {
+	if opts.tagDriftCheck == "" || opts.tagDriftCheck == tagDriftOff {
+		return nil
+	}
+	reference := strings.TrimPrefix(image.Name, repo+"@")
+	if _, err := digest.Parse(reference); err == nil {
+		return nil
+	}
+	current, err := registry.HeadManifest(ctx, repo, reference)
 	if err != nil {
-		return nil, err
+		if opts.tagDriftCheck == tagDriftFail {
+			return fmt.Errorf("re-resolving the tag %s: %w", reference, err)
+		}
+		log.Warn(ctx, fmt.Sprintf("Couldn't re-resolve the tag %s: %v", reference, err))
+		return nil
 	}
-	if len(indexDescriptorInfos) == 0 {
-		return nil, errors.New("No SOCI indices found in OCI store")
+	if current.Digest == image.Target.Digest {
+		return nil
 	}
-	sort.Slice(indexDescriptorInfos, func(i, j int) bool {
-		return indexDescriptorInfos[i].CreatedAt.Before(indexDescriptorInfos[j].CreatedAt)
-	})
+	drift := fmt.Errorf("%w: %s:%s was %s and is now %s", ErrTagDrift, repo, reference, image.Target.Digest, current.Digest)
+	if opts.tagDriftCheck == tagDriftFail {
+		return drift
+	}
+	log.Warn(ctx, drift.Error())
+	return nil
+}
 
-	return &indexDescriptorInfos[len(indexDescriptorInfos)-1].Descriptor, nil
+// Warn or fail, depending on -lifecycle-policy-check, when the repository's lifecycle policy would expire pushed SOCI indices
+func checkLifecyclePolicy(ctx context.Context, registry *registryutils.Registry, repo string, opts buildOptions) error {
+	if opts.lifecyclePolicyCheck == "" || opts.lifecyclePolicyCheck == lifecycleCheckOff {
+		return nil
+	}
+	rules, err := registry.ConflictingLifecycleRules(ctx, repo)
+	if err != nil {
+		if opts.lifecyclePolicyCheck == lifecycleCheckFail {
+			return err
+		}
+		log.Warn(ctx, fmt.Sprintf("Couldn't check the lifecycle policy: %v", err))
+		return nil
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	conflict := &registryutils.LifecyclePolicyConflictError{Repository: repo, Rules: rules}
+	if opts.lifecyclePolicyCheck == lifecycleCheckFail {
+		return conflict
+	}
+	log.Warn(ctx, conflict.Error())
+	return nil
+}
+
+// Layers whose ztoc is in the ztoc cache don't need to be downloaded, nil without a cache or when only converting
+// the image to eStargz, which needs all of them
+func cachedLayerFilter(opts buildOptions) func(ctx context.Context, desc ocispec.Descriptor) bool {
+	if opts.ztocCache == nil || opts.convert == convertEstargz {
+		return nil
+	}
+	spanSize := opts.spanSize
+	if spanSize == 0 {
+		spanSize = builder.DefaultSpanSize
+	}
+	return func(ctx context.Context, desc ocispec.Descriptor) bool {
+		if !images.IsLayerType(desc.MediaType) || desc.Size < opts.minLayerSize {
+			return false
+		}
+		cached, err := opts.ztocCache.Has(ctx, cache.Key{LayerDigest: desc.Digest, SpanSize: spanSize})
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't look up layer %s in the ztoc cache: %v", desc.Digest, err))
+			return false
+		}
+		if cached {
+			log.Info(ctx, fmt.Sprintf("Skipping download of layer %s, its ztoc is cached", desc.Digest))
+		}
+		return cached
+	}
 }
 
-// Log and return the lambda handler error
-func lambdaError(ctx context.Context, msg string, err error) (string, error) {
-	log.Error(ctx, msg, err)
-	return msg, err
+// How long releasing a lock may take once the build is done
+const lockReleaseTimeout = 10 * time.Second
+
+// Renew the lease of a lock every interval until the returned function is called, so that builds
+// taking longer than the lease keep their lock. Nothing is renewed if interval isn't positive.
+func renewLock(ctx context.Context, locker lock.Locker, key string, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := locker.Renew(ctx, key); err != nil {
+					log.Error(ctx, "Lock renewal error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Record a pushed SOCI index in the audit log, if there is one
+func auditPush(ctx context.Context, opts buildOptions, repo string, imageDigest string, indexDescriptor ocispec.Descriptor) error {
+	if opts.auditLog == nil {
+		return nil
+	}
+	registryHost, _ := ctx.Value("RegistryURL").(string)
+	return opts.auditLog.Append(ctx, audit.Entry{
+		Time:        time.Now(),
+		Actor:       opts.auditActor,
+		Trigger:     opts.auditTrigger,
+		Registry:    registryHost,
+		Repository:  repo,
+		ImageDigest: imageDigest,
+		Descriptor:  indexDescriptor,
+	})
+}
+
+// Describe the outcome of a build for the notifiers
+func newEvent(imageUrl string, result *buildResult, err error, duration time.Duration) notify.Event {
+	_, repo, _ := parseImageUrl(imageUrl)
+	event := notify.Event{
+		Status:       buildStatus(result.Message, err),
+		Repository:   repo,
+		ImageDigest:  result.ImageDigest,
+		IndexDigests: result.indexDigests(),
+		Message:      result.Message,
+		DurationMs:   duration.Milliseconds(),
+		Time:         time.Now(),
+	}
+	if event.Status == state.StatusFailed {
+		// the message names the step that failed
+		event.ErrorClass = result.Message
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
 }
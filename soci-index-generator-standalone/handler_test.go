@@ -5,53 +5,575 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/filter"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/notify"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
 )
 
-// This test ensures that the handler can pull Docker and OCI images, build, and push the SOCI index back to the repository.
-// To run this test locally, you need to push an image to a private ECR repository, and set following environment variables:
-// DOCKER_IMAGE_URI: the fully URI of your Docker image.
-// OCI_IMAGE_URI: the fully URI of your OCI image.
+// Options of a build against the in-process test registry
+func testRegistryOptions(testRegistry *testregistry.Registry) buildOptions {
+	return buildOptions{
+		minLayerSize:    1 << 10,
+		verifyDigests:   true,
+		registryOptions: []registryutils.Option{registryutils.WithTransport(testRegistry.Transport())},
+	}
+}
+
+// Layer content that doesn't compress, so the layer is as large as its content
+func randomContent(t *testing.T, size int) []byte {
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("Failed to generate layer content: %v", err)
+	}
+	return content
+}
+
+// This test ensures that the handler can pull an image, build, and push the SOCI index back to the repository.
 func TestHandlerHappyPath(t *testing.T) {
-	doTest := func(imageUri string) {
-		ctx := context.Background()
-		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Minute*5))
-		defer cancel()
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10), []byte("small"))
 
-		resp, err := handleRequest(ctx, imageUri, 10485760/4)
-		if err != nil {
-			t.Fatalf("HandleRequest failed %v", err)
-		}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute*5))
+	defer cancel()
 
-		expected_resp := "Successfully built and pushed SOCI index"
-		if resp != expected_resp {
-			t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp)
-		}
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), testRegistryOptions(testRegistry))
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+
+	expected_resp := "Successfully built and pushed SOCI index"
+	if resp.Message != expected_resp {
+		t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp.Message)
+	}
+
+	referrers := testRegistry.Referrers("test-repository", image.Digest)
+	if len(referrers) != 1 || referrers[0].Digest.String() != resp.Platforms[0].IndexDigest {
+		t.Fatalf("Expected the SOCI index %s to be the only referrer of the image but got %v", resp.Platforms[0].IndexDigest, referrers)
+	}
+	if referrers[0].ArtifactType != soci.SociIndexArtifactType {
+		t.Fatalf("Unexpected artifact type of the SOCI index: %s", referrers[0].ArtifactType)
+	}
+	if referrers[0].Annotations[annotationSourceImageDigest] != image.Digest.String() || referrers[0].Annotations[ocispec.AnnotationCreated] == "" {
+		t.Fatalf("Expected the SOCI index to be annotated with the builder metadata but got %v", referrers[0].Annotations)
+	}
+}
+
+// This test ensures that the handler skips pushing when all layers are too small to be indexed
+func TestHandlerEmptyIndex(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "small", []byte("small"))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "small"), testRegistryOptions(testRegistry))
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != SkipPushOnEmptyIndexMessage {
+		t.Fatalf("Unexpected response. Expected %s but got %s", SkipPushOnEmptyIndexMessage, resp.Message)
+	}
+	if referrers := testRegistry.Referrers("test-repository", image.Digest); len(referrers) != 0 {
+		t.Fatalf("Expected nothing to be pushed but got %v", referrers)
+	}
+}
+
+// This test ensures that the handler fails builds whose SOCI index covers less of the image than required
+func TestHandlerRequireCoverage(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	// only the first layer is indexed, it is about 80% of the image
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10), randomContent(t, 16<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.minLayerSize = 32 << 10
+	opts.requireCoverage = 90
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if !errors.Is(err, ErrInsufficientCoverage) || resp.Message != CoverageTooLowMessage {
+		t.Fatalf("Expected the build to fail for insufficient coverage but got %v %+v", err, resp)
+	}
+	if referrers := testRegistry.Referrers("test-repository", image.Digest); len(referrers) != 0 {
+		t.Fatalf("Expected nothing to be pushed but got %v", referrers)
+	}
+
+	opts.requireCoverage = 75
+	resp, err = handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if err != nil || resp.Message != BuildAndPushSuccessMessage {
+		t.Fatalf("HandleRequest failed %v %+v", err, resp)
+	}
+}
+
+func TestHandlerRequireScanStatus(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	// the test registry isn't ECR, so there are no scan findings and the image doesn't pass
+	opts := testRegistryOptions(testRegistry)
+	opts.requireScanStatus = scanStatusPassed
+	opts.scanSeverity = "CRITICAL"
+	opts.onScanGate = scanGateSkip
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if err != nil || resp.Message != SkipScanGateMessage {
+		t.Fatalf("Expected the image to be skipped but got %v %+v", err, resp)
+	}
+
+	opts.onScanGate = scanGateFail
+	resp, err = handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if !errors.Is(err, ErrScanGate) || resp.Message != ScanGateFailedMessage {
+		t.Fatalf("Expected the build to fail the scan gate but got %v %+v", err, resp)
+	}
+	if referrers := testRegistry.Referrers("test-repository", image.Digest); len(referrers) != 0 {
+		t.Fatalf("Expected nothing to be pushed but got %v", referrers)
+	}
+}
+
+func TestHandlerIndexDescriptor(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 16<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), testRegistryOptions(testRegistry))
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	// the descriptor is the one the referrers API lists
+	descriptors := resp.indexDescriptors()
+	referrers := testRegistry.Referrers("test-repository", image.Digest)
+	if len(descriptors) != 1 || len(referrers) != 1 {
+		t.Fatalf("Expected one descriptor and referrer but got %v and %v", descriptors, referrers)
+	}
+	expected, _ := json.Marshal(referrers[0])
+	actual, _ := json.Marshal(descriptors[0])
+	if string(actual) != string(expected) || descriptors[0].Annotations[annotationSourceImageDigest] != image.Digest.String() {
+		t.Fatalf("Expected the descriptor %s but got %s", expected, actual)
 	}
+}
+
+func TestCheckTagDrift(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	built := testRegistry.PushImage("test-repository", "latest", randomContent(t, 16<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
 
-	doTest(os.Getenv("DOCKER_IMAGE_URI"))
-	doTest(os.Getenv("OCI_IMAGE_URI"))
+	opts := testRegistryOptions(testRegistry)
+	registryHost, _, _ := parseImageUrl(testRegistry.ImageURI("test-repository", "latest"))
+	registry, err := registryutils.Init(ctx, registryHost, opts.registryOptions...)
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	byTag := images.Image{Name: "test-repository@latest", Target: built}
+	byDigest := images.Image{Name: "test-repository@" + built.Digest.String(), Target: built}
+
+	opts.tagDriftCheck = tagDriftFail
+	if err := checkTagDrift(ctx, registry, "test-repository", byTag, opts); err != nil {
+		t.Fatalf("Expected the unchanged tag to pass but got %v", err)
+	}
+
+	// the tag is moved to another image during the build
+	testRegistry.PushImage("test-repository", "latest", randomContent(t, 16<<10))
+	if err := checkTagDrift(ctx, registry, "test-repository", byTag, opts); !errors.Is(err, ErrTagDrift) {
+		t.Fatalf("Expected the moved tag to fail but got %v", err)
+	}
+	if err := checkTagDrift(ctx, registry, "test-repository", byDigest, opts); err != nil {
+		t.Fatalf("Expected an image given by digest to pass but got %v", err)
+	}
+	opts.tagDriftCheck = tagDriftWarn
+	if err := checkTagDrift(ctx, registry, "test-repository", byTag, opts); err != nil {
+		t.Fatalf("Expected the moved tag to only warn but got %v", err)
+	}
 }
 
 // This test ensures that the handler can validate the input digest media type
-// To run this test locally, you need to set following environment variables:
-// NOT_AN_IMAGE_URI: the fully URI of anything that isn't an image.
 func TestHandlerInvalidDigestMediaType(t *testing.T) {
-	imageUri := os.Getenv("NOT_AN_IMAGE_URI")
+	testRegistry := testregistry.New(t)
+	config := testRegistry.PushBlob("test-repository", "application/vnd.example.config.v1+json", []byte("{}"))
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{},
+	})
+	testRegistry.PushManifest("test-repository", "artifact", ocispec.MediaTypeImageManifest, manifest)
 
-	ctx := context.Background()
-	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Minute))
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
 	defer cancel()
 
-	resp, err := handleRequest(ctx, imageUri, 10485760/4)
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "artifact"), testRegistryOptions(testRegistry))
 	if err != nil {
 		t.Fatalf("Invalid image digest is not expected to fail")
 	}
 
 	expected_resp := "Exited early due to manifest validation error"
-	if resp != expected_resp {
-		t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp)
+	if resp.Message != expected_resp {
+		t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp.Message)
+	}
+}
+
+func TestParseImageUrl(t *testing.T) {
+	for _, test := range []struct{ imageUrl, host, repo, reference string }{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:1.0", "123456789012.dkr.ecr.eu-west-1.amazonaws.com", "app", "1.0"},
+		{"public.ecr.aws/docker/library/redis@sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", "public.ecr.aws", "docker/library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187"},
+		{"localhost:5000/team/app:latest", "localhost:5000", "team/app", "latest"},
+		{"localhost:5000/team/app", "localhost:5000", "team/app", ""},
+		{"localhost:5000/team/app:1.0@sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", "localhost:5000", "team/app", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187"},
+		{"[::1]:5000/team/app:latest", "[::1]:5000", "team/app", "latest"},
+		{"[2001:db8::1]/app", "[2001:db8::1]", "app", ""},
+		{"Registry.Example.com:8443/app:V1", "registry.example.com:8443", "app", "V1"},
+	} {
+		host, repo, reference := parseImageUrl(test.imageUrl)
+		if host != test.host || repo != test.repo || reference != test.reference {
+			t.Fatalf("Unexpected parse of %s: %q %q %q", test.imageUrl, host, repo, reference)
+		}
+	}
+}
+
+// This test ensures that registries addressed by an IPv6 literal with a port are reached
+func TestHandlerIPv6Registry(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	resp, err := handleRequest(ctx, "[::1]:5000/test-repository:latest", testRegistryOptions(testRegistry))
+	if err != nil || resp.Message != BuildAndPushSuccessMessage {
+		t.Fatalf("HandleRequest failed %v %+v", err, resp)
+	}
+}
+
+// This test ensures that an image URI without tag or digest resolves the default tag
+func TestHandlerDefaultTag(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "stable", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.defaultTag = "stable"
+	resp, err := handleRequest(ctx, testregistry.Host+"/test-repository", opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != BuildAndPushSuccessMessage || resp.ImageDigest != image.Digest.String() {
+		t.Fatalf("Expected the SOCI index of %s to be pushed but got %+v", image.Digest, resp)
+	}
+}
+
+// This test ensures that images opting out with the soci.skip annotation or label aren't indexed
+func TestHandlerOptOut(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	pushImage := func(tag string, annotations map[string]string, labels map[string]string) {
+		layer := testRegistry.PushBlob("test-repository", ocispec.MediaTypeImageLayerGzip, randomContent(t, 64<<10))
+		config, _ := json.Marshal(ocispec.Image{
+			Platform: platforms.DefaultSpec(),
+			Config:   ocispec.ImageConfig{Labels: labels},
+		})
+		manifest, _ := json.Marshal(ocispec.Manifest{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      testRegistry.PushBlob("test-repository", ocispec.MediaTypeImageConfig, config),
+			Layers:      []ocispec.Descriptor{layer},
+			Annotations: annotations,
+		})
+		testRegistry.PushManifest("test-repository", tag, ocispec.MediaTypeImageManifest, manifest)
+	}
+	pushImage("annotated", map[string]string{optOutKey: "true"}, nil)
+	pushImage("labeled", nil, map[string]string{optOutKey: "true"})
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	for _, tag := range []string{"annotated", "labeled"} {
+		resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", tag), testRegistryOptions(testRegistry))
+		if err != nil {
+			t.Fatalf("HandleRequest failed %v", err)
+		}
+		if resp.Message != SkipOptedOutMessage {
+			t.Fatalf("Unexpected response for %s. Expected %s but got %s", tag, SkipOptedOutMessage, resp.Message)
+		}
+	}
+}
+
+// This test ensures that images smaller than min-image-size are skipped without building them
+func TestHandlerMinImageSize(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.minImageSize = 1 << 20
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != SkipTooSmallMessage || resp.ImageDigest != image.Digest.String() {
+		t.Fatalf("Expected the image to be skipped as too small but got %+v", resp)
+	}
+}
+
+// This test ensures that images with eStargz layers are detected and skipped when requested
+func TestHandlerLazyLoadableImage(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	layer := testRegistry.PushBlob("test-repository", ocispec.MediaTypeImageLayerGzip, randomContent(t, 64<<10))
+	layer.Annotations = map[string]string{"containerd.io/snapshot/stargz/toc.digest": layer.Digest.String()}
+	config, _ := json.Marshal(ocispec.Image{Platform: platforms.DefaultSpec()})
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    testRegistry.PushBlob("test-repository", ocispec.MediaTypeImageConfig, config),
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	testRegistry.PushManifest("test-repository", "estargz", ocispec.MediaTypeImageManifest, manifest)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.lazyLoadableImages = lazyLoadableSkip
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "estargz"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != SkipLazyLoadableMessage || resp.LazyLoading != builder.LazyLoadingEstargz {
+		t.Fatalf("Expected the eStargz image to be skipped but got %+v", resp)
+	}
+}
+
+// This test ensures that reproducible builds of the same image push the same SOCI index
+func TestHandlerReproducible(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.reproducible = true
+	var indexDigests []string
+	for range 2 {
+		resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+		if err != nil || resp.Message != BuildAndPushSuccessMessage {
+			t.Fatalf("HandleRequest failed %v %+v", err, resp)
+		}
+		indexDigests = append(indexDigests, resp.Platforms[0].IndexDigest)
+		// a later build time must not change the index
+		time.Sleep(time.Second)
+	}
+	if indexDigests[0] != indexDigests[1] {
+		t.Fatalf("Expected the same SOCI index for both builds but got %v", indexDigests)
+	}
+	referrers := testRegistry.Referrers("test-repository", image.Digest)
+	if len(referrers) != 1 || referrers[0].Annotations[ocispec.AnnotationCreated] != "2023-11-14T22:13:20Z" {
+		t.Fatalf("Expected one SOCI index created at SOURCE_DATE_EPOCH but got %v", referrers)
+	}
+}
+
+// This test ensures that a build reaching its deadline margin stops with a timeout instead of being killed
+func TestHandlerDeadlineMargin(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.deadlineMargin = time.Minute
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if !errors.Is(err, ErrBuildDeadline) {
+		t.Fatalf("Expected the build to stop at the deadline margin but got %v", err)
+	}
+	if resp.Message != DeadlineMessage {
+		t.Fatalf("Expected %q but got %+v", DeadlineMessage, resp)
+	}
+	if class, retryable := classifyError(err); class != failureTimeout || !retryable {
+		t.Fatalf("Expected a retryable timeout but got %s, %v", class, retryable)
+	}
+
+	margin := deadlineMargin(buildOptions{deadlineMargin: 10 * time.Second, deadlineMarginPerGiB: 2 * time.Second}, 3<<30)
+	if margin != 16*time.Second {
+		t.Fatalf("Expected a margin of 16s for 3GiB but got %s", margin)
+	}
+}
+
+// This test ensures that images excluded by the image filter are skipped without being pulled
+func TestHandlerImageFilter(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("team/app", "latest", randomContent(t, 64<<10))
+	testRegistry.PushImage("team/app", "dev-1", randomContent(t, 64<<10))
+	denied := testRegistry.PushImage("team/scratch", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	filterFile := filepath.Join(t.TempDir(), "filter.json")
+	if err := os.WriteFile(filterFile, []byte(`{"allow": ["team/*"], "deny": ["team/scratch"], "denyTags": ["dev-*"], "maxAge": "90d"}`), 0644); err != nil {
+		t.Fatalf("Failed to write the image filter: %v", err)
+	}
+	source, err := filter.Open(filterFile)
+	if err != nil {
+		t.Fatalf("Failed to open the image filter: %v", err)
+	}
+	opts := testRegistryOptions(testRegistry)
+	opts.imageFilter, err = filter.New(ctx, source, 0)
+	if err != nil {
+		t.Fatalf("Failed to load the image filter: %v", err)
+	}
+
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("team/scratch", "latest"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != SkipFilteredMessage || len(testRegistry.Referrers("team/scratch", denied.Digest)) != 0 {
+		t.Fatalf("Expected the denied image to be skipped but got %+v", resp)
+	}
+	resp, err = handleRequest(ctx, testRegistry.ImageURI("team/app", "dev-1"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != SkipFilteredMessage {
+		t.Fatalf("Expected the image with a denied tag to be skipped but got %+v", resp)
+	}
+
+	// the test registry has no push times, so the max age isn't applied
+	resp, err = handleRequest(ctx, testRegistry.ImageURI("team/app", "latest"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != BuildAndPushSuccessMessage {
+		t.Fatalf("Expected the allowed image to be built but got %+v", resp)
+	}
+}
+
+// A ztoc cache that claims to have every ztoc but can't read any
+type unreadableCache struct{}
+
+func (unreadableCache) Get(ctx context.Context, key cache.Key) ([]byte, error) {
+	return nil, errors.New("ztoc unreadable")
+}
+
+func (unreadableCache) Put(ctx context.Context, key cache.Key, ztoc []byte) error {
+	return nil
+}
+
+func (unreadableCache) Has(ctx context.Context, key cache.Key) (bool, error) {
+	return true, nil
+}
+
+// This test ensures that a layer skipped because its ztoc is cached is downloaded when the cached ztoc can't be read
+func TestHandlerUnreadableCachedZtoc(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+
+	opts := testRegistryOptions(testRegistry)
+	opts.ztocCache = unreadableCache{}
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != BuildAndPushSuccessMessage || resp.Platforms[0].IndexDigest == "" {
+		t.Fatalf("Expected the SOCI index to be built from the downloaded layer but got %+v", resp)
+	}
+}
+
+// A notifier recording the error of the context it was called with
+type contextNotifier struct {
+	ctxErr error
+	called bool
+}
+
+func (n *contextNotifier) Notify(ctx context.Context, event notify.Event) error {
+	n.called = true
+	n.ctxErr = ctx.Err()
+	return nil
+}
+
+// This test ensures that cancelled builds are notified with a context that isn't cancelled
+func TestHandlerNotifyCancelled(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	notifier := &contextNotifier{}
+	opts := testRegistryOptions(testRegistry)
+	opts.notifier = notifier
+	handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if !notifier.called || notifier.ctxErr != nil {
+		t.Fatalf("Expected the cancelled build to be notified with a live context but got %v", notifier.ctxErr)
+	}
+}
+
+// This test ensures that the handler converts the image to eStargz and pushes it with the eStargz tag
+func TestHandlerEstargz(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", randomContent(t, 64<<10))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+	registry, err := registryutils.Init(ctx, testregistry.Host, registryutils.WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	opts := testRegistryOptions(testRegistry)
+	opts.convert = convertEstargz
+	resp, err := handleRequest(ctx, testRegistry.ImageURI("test-repository", "latest"), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != EstargzSuccessMessage || resp.Estargz == nil || resp.Estargz.Tag != "latest-esgz" {
+		t.Fatalf("Expected the image to be converted to eStargz but got %+v", resp)
+	}
+	converted, err := registry.GetManifest(ctx, "test-repository", "latest-esgz")
+	if err != nil {
+		t.Fatalf("Expected the eStargz image to be pushed but got %v", err)
+	}
+	if builder.LazyLoadingFormat(converted.Layers[0]) != builder.LazyLoadingEstargz {
+		t.Fatalf("Expected an eStargz layer but got %v", converted.Layers[0])
+	}
+	if referrers := testRegistry.Referrers("test-repository", image.Digest); len(referrers) != 0 {
+		t.Fatalf("Expected no SOCI index to be pushed but got %v", referrers)
+	}
+
+	// both the SOCI index and the eStargz image
+	opts.convert = convertBoth
+	resp, err = handleRequest(ctx, testregistry.Host+"/test-repository@"+image.Digest.String(), opts)
+	if err != nil {
+		t.Fatalf("HandleRequest failed %v", err)
+	}
+	if resp.Message != BuildAndPushSuccessMessage || resp.Estargz == nil || resp.Estargz.Tag != "sha256-"+image.Digest.Encoded()+"-esgz" {
+		t.Fatalf("Expected the SOCI index to be pushed and the image to be converted to eStargz but got %+v", resp)
+	}
+	if referrers := testRegistry.Referrers("test-repository", image.Digest); len(referrers) != 1 {
+		t.Fatalf("Expected the SOCI index to be pushed but got %v", referrers)
 	}
 }
@@ -0,0 +1,345 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package testregistry runs an in-process OCI distribution registry for tests.
+// It implements the parts of the distribution API the builder uses: blobs, manifests,
+// blob uploads, tags and the referrers API. Content is kept in memory and lost when the test ends.
+package testregistry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Host is the registry's host name in image URIs. The test server's certificate is valid for it,
+// and the registry's transport connects to the test server whatever the host.
+const Host = "example.com"
+
+var specsVersion = specs.Versioned{SchemaVersion: 2}
+
+// Registry is an in-memory OCI registry served over TLS
+type Registry struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// content by repository and digest, manifests are distinguished by their media type
+	blobs     map[string][]byte
+	manifests map[string]manifest
+	// digests by repository and tag
+	tags map[string]digest.Digest
+	// content of unfinished blob uploads by upload ID
+	uploads map[string][]byte
+}
+
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+// New starts a registry that is stopped when the test ends
+func New(t testing.TB) *Registry {
+	r := &Registry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]manifest{},
+		tags:      map[string]digest.Digest{},
+		uploads:   map[string][]byte{},
+	}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// ImageURI is the URI of an image in the registry, e.g. example.com/repository:tag
+func (r *Registry) ImageURI(repository string, tag string) string {
+	return Host + "/" + repository + ":" + tag
+}
+
+// Transport connects to the registry for any host and trusts its certificate
+func (r *Registry) Transport() http.RoundTripper {
+	transport := r.server.Client().Transport.(*http.Transport).Clone()
+	address := r.server.Listener.Addr().String()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	return transport
+}
+
+// PushBlob adds a blob to a repository
+func (r *Registry) PushBlob(repository string, mediaType string, content []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[repository+"@"+desc.Digest.String()] = content
+	return desc
+}
+
+// PushManifest adds a manifest to a repository, tagging it unless tag is empty
+func (r *Registry) PushManifest(repository string, tag string, mediaType string, content []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repository+"@"+desc.Digest.String()] = manifest{mediaType, content}
+	if tag != "" {
+		r.tags[repository+":"+tag] = desc.Digest
+	}
+	return desc
+}
+
+// PushImage adds a single platform image of the host platform to a repository,
+// with one gzip compressed layer containing a file for each given file content
+func (r *Registry) PushImage(repository string, tag string, files ...[]byte) ocispec.Descriptor {
+	var layers []ocispec.Descriptor
+	for i, file := range files {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("file%d", i), Mode: 0644, Size: int64(len(file))})
+		tw.Write(file)
+		tw.Close()
+		gz.Close()
+		layers = append(layers, r.PushBlob(repository, ocispec.MediaTypeImageLayerGzip, buf.Bytes()))
+	}
+
+	config, _ := json.Marshal(ocispec.Image{Platform: platforms.DefaultSpec()})
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned: specsVersion,
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.PushBlob(repository, ocispec.MediaTypeImageConfig, config),
+		Layers:    layers,
+	})
+	return r.PushManifest(repository, tag, ocispec.MediaTypeImageManifest, manifest)
+}
+
+// Referrers lists the manifests in a repository whose subject is the given digest
+func (r *Registry) Referrers(repository string, subject digest.Digest) []ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.referrers(repository, subject, "")
+}
+
+func (r *Registry) referrers(repository string, subject digest.Digest, artifactType string) []ocispec.Descriptor {
+	referrers := []ocispec.Descriptor{}
+	for key, m := range r.manifests {
+		if !strings.HasPrefix(key, repository+"@") {
+			continue
+		}
+		var parsed ocispec.Manifest
+		if json.Unmarshal(m.content, &parsed) != nil || parsed.Subject == nil || parsed.Subject.Digest != subject {
+			continue
+		}
+		desc := ocispec.Descriptor{
+			MediaType:    m.mediaType,
+			ArtifactType: parsed.ArtifactType,
+			Digest:       digest.FromBytes(m.content),
+			Size:         int64(len(m.content)),
+			Annotations:  parsed.Annotations,
+		}
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = parsed.Config.MediaType
+		}
+		if artifactType == "" || desc.ArtifactType == artifactType {
+			referrers = append(referrers, desc)
+		}
+	}
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].Digest < referrers[j].Digest })
+	return referrers
+}
+
+// serve routes /v2/<repository>/<endpoint>/<reference> requests, repositories may contain slashes
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, endpoint := range []string{"/blobs/uploads/", "/blobs/", "/manifests/", "/referrers/", "/tags/list"} {
+		if i := strings.LastIndex(path, endpoint); i > 0 {
+			repository, reference := path[:i], path[i+len(endpoint):]
+			switch endpoint {
+			case "/blobs/uploads/":
+				r.serveUpload(w, req, repository, reference)
+			case "/blobs/":
+				r.serveBlob(w, req, repository, reference)
+			case "/manifests/":
+				r.serveManifest(w, req, repository, reference)
+			case "/referrers/":
+				r.serveReferrers(w, req, repository, reference)
+			case "/tags/list":
+				r.serveTags(w, repository)
+			}
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown endpoint")
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	content, ok := r.blobs[repository+"@"+reference]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	writeContent(w, req, reference, content)
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repository string, uploadId string) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		if expected := req.URL.Query().Get("digest"); expected != "" {
+			r.completeUpload(w, repository, expected, body)
+			return
+		}
+		uploadId = newUploadId()
+		r.uploads[uploadId] = body
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+uploadId)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		if _, ok := r.uploads[uploadId]; !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+			return
+		}
+		r.uploads[uploadId] = append(r.uploads[uploadId], body...)
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+uploadId)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		uploaded, ok := r.uploads[uploadId]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+			return
+		}
+		delete(r.uploads, uploadId)
+		r.completeUpload(w, repository, req.URL.Query().Get("digest"), append(uploaded, body...))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported method")
+	}
+}
+
+func (r *Registry) completeUpload(w http.ResponseWriter, repository string, expected string, content []byte) {
+	if digest.FromBytes(content).String() != expected {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+	r.blobs[repository+"@"+expected] = content
+	w.Header().Set("Location", "/v2/"+repository+"/blobs/"+expected)
+	w.Header().Set("Docker-Content-Digest", expected)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	if req.Method == http.MethodPut {
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		dgst := digest.FromBytes(content)
+		if strings.Contains(reference, ":") && reference != dgst.String() {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+			return
+		}
+		r.manifests[repository+"@"+dgst.String()] = manifest{req.Header.Get("Content-Type"), content}
+		if !strings.Contains(reference, ":") {
+			r.tags[repository+":"+reference] = dgst
+		}
+		var parsed ocispec.Manifest
+		if json.Unmarshal(content, &parsed) == nil && parsed.Subject != nil {
+			w.Header().Set("OCI-Subject", parsed.Subject.Digest.String())
+		}
+		w.Header().Set("Location", "/v2/"+repository+"/manifests/"+dgst.String())
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	dgst := reference
+	if !strings.Contains(reference, ":") {
+		dgst = r.tags[repository+":"+reference].String()
+	}
+	m, ok := r.manifests[repository+"@"+dgst]
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown to registry")
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	writeContent(w, req, dgst, m.content)
+}
+
+func (r *Registry) serveReferrers(w http.ResponseWriter, req *http.Request, repository string, reference string) {
+	artifactType := req.URL.Query().Get("artifactType")
+	index, _ := json.Marshal(ocispec.Index{
+		Versioned: specsVersion,
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: r.referrers(repository, digest.Digest(reference), artifactType),
+	})
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	w.Write(index)
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, repository string) {
+	tags := []string{}
+	for key := range r.tags {
+		if tag, ok := strings.CutPrefix(key, repository+":"); ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+}
+
+// Write a blob or manifest, HEAD requests only get its headers
+func writeContent(w http.ResponseWriter, req *http.Request, dgst string, content []byte) {
+	w.Header().Set("Docker-Content-Digest", dgst)
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		w.Write(content)
+	}
+}
+
+// Write an error response of the distribution API
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func newUploadId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
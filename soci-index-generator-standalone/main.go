@@ -2,29 +2,1046 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/audit"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/config"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cpu"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/filter"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/lock"
+	logutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/notify"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/state"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// Subcommands of the tool. Invoking the tool without a subcommand (i.e. with flags only)
+// runs the build command for backward compatibility.
+var commands = map[string]func(args []string){
+	"build":    buildCommand,
+	"push":     pushCommand,
+	"estimate": estimateCommand,
+	"check":    checkCommand,
+	"diff":     diffCommand,
+	"copy":     copyCommand,
+	"cache":    cacheCommand,
+	"clean":    cleanCommand,
+	"doctor":   doctorCommand,
+	"version":  versionCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	buildCommand(os.Args[1:])
+}
+
+// Build the SOCI index for an image and push it to the image's repository
+func buildCommand(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
 	// parse the repository URI from a -repository flag
-	repo := flag.String("repository", "", "OCI repository URI (with tag or digest) to build the SOCI index for")
-	minLayerSize := flag.Int64("min-layer-size", 10485760, "minimum layer size to build a ztoc for a layer (default 10MB)")
-	flag.Parse()
+	repo := flags.String("repository", "", "OCI repository URI (with tag or digest) to build the SOCI index for")
+	defaultTag := flags.String("default-tag", defaultImageTag, "tag to resolve when the image URI has neither a tag nor a digest")
+	lazyLoadable := flags.String("lazy-loadable-images", lazyLoadableWarn, "images with eStargz or zstd:chunked layers, which other snapshotters already load lazily: warn and build them anyway, or skip them")
+	requireScanStatus := flags.String("require-scan-status", "", "only build images whose ECR vulnerability scan (basic or enhanced) is COMPLETE, or PASSED, i.e. complete without findings of -scan-severity or higher (default no check)")
+	scanSeverity := flags.String("scan-severity", "CRITICAL", "least severe finding failing -require-scan-status PASSED: CRITICAL, HIGH, MEDIUM, LOW or INFORMATIONAL")
+	onScanGate := flags.String("on-scan-gate", scanGateSkip, "images not passing -require-scan-status, including images in registries other than ECR: skip them, or fail")
+	ignoreOptOut := flags.Bool("ignore-opt-out", false, "build images opting out with the soci.skip=true manifest annotation or image label anyway")
+	summaryFile := flags.String("summary-file", "", "with -images-file, write the totals of the batch to this file: images built, skipped and failed by reason, bytes pulled and pushed and the duration")
+	summaryFormat := flags.String("summary-format", "", "format of the totals of an -images-file run: text, json or markdown, which adds a table of the outcome of each image (default text on stderr and json in -summary-file)")
+	progressFile := flags.String("progress-file", "", "with -images-file, record the outcome of each image in this file and skip the images done in an earlier, interrupted run of the batch (failed images are built again)")
+	shardCount := flags.Int("shard-count", 0, "with -images-file, split the images into this many shards, e.g. the size of an AWS Batch array job, and build only the images of -shard-index")
+	shardIndex := flags.Int("shard-index", -1, "shard of the images built by this run, from 0 to -shard-count - 1 (default AWS_BATCH_JOB_ARRAY_INDEX)")
+	imagesFile := flags.String("images-file", "", "file with the OCI repository URIs of many images to build SOCI indices for, one per line (- for stdin), instead of -repository")
+	batchCacheSize := size.Flag(flags, "batch-cache-max-size", 256<<20, "size cap of the ztocs of shared layers kept in memory during an -images-file run, the least recently used are dropped (0 means no limit)")
+	imageFilter := flags.String("image-filter", "", "allow and deny lists of the repositories, images and tags to build and the max age of the images, a JSON file, an S3 object (s3://bucket/key) or a DynamoDB table (dynamodb://table)")
+	imageFilterRefresh := flags.Duration("image-filter-refresh", 5*time.Minute, "how often -image-filter is loaded again during a run, 0 loads it once")
+	repositoryConfig := flags.String("repository-config", "", "JSON file of -min-layer-size, -span-size and -platform overrides by repository name pattern, e.g. ml/*")
+	minLayerSize := size.Flag(flags, "min-layer-size", 10<<20, "minimum layer size to build a ztoc for a layer, e.g. 10MiB, 500MB or 1G")
+	minImageSize := size.Flag(flags, "min-image-size", 0, "skip images whose layers are smaller than this in total, without pulling them, e.g. 50MiB (default 0, build all)")
+	spanSize := size.Flag(flags, "span-size", 4<<20, "span size of the ztocs, e.g. 4MiB")
+	workDir := flags.String("work-dir", "", "directory to pull images and build SOCI indices in (default the OS temp directory, e.g. /tmp or %TEMP%)")
+	cleanupMargin := flags.Duration("deadline-margin", defaultDeadlineMargin, "stop the build this long before the deadline of the run, so that it cleans up and reports a timeout instead of being killed")
+	cleanupMarginPerGiB := flags.Duration("deadline-margin-per-gib", defaultDeadlineMarginPerGiB, "added to -deadline-margin for each GiB of the image pulled, removing larger images takes longer")
+	removeAbandoned := flags.Bool("remove-abandoned-work-dirs", true, "at startup, remove the directories in the work directory left behind by crashed or killed builds, see the clean command")
+	layoutDir := flags.String("layout", "", "directory to keep the OCI layout with the image and the built SOCI index in (default: a temporary directory that is removed)")
+	noPush := flags.Bool("no-push", false, "build the SOCI index without pushing it, use together with -layout and the push command")
+	convert := flags.String("convert", convertSoci, "what to convert the image to: soci (a SOCI index), estargz (an eStargz image for the stargz-snapshotter, pushed to the same repository) or both")
+	estargzTagSuffix := flags.String("estargz-tag-suffix", defaultEstargzTagSuffix, "appended to the tag of the image, or to its digest with the colon replaced by a dash, for the tag of the eStargz image")
+	verifyPush := flags.Bool("verify-push", false, "after pushing, check that the SOCI index is listed as a referrer of the image and all its blobs exist")
+	verifyDigests := flags.String("verify-digests", verifyDigestsAlways, "verification of pulled layers: always re-verify their digests when reading them, or trust-transport for trusted private mirrors")
+	lifecycleCheck := lifecyclePolicyFlag(flags)
+	tagDriftCheck := flags.String("tag-drift-check", tagDriftWarn, "re-resolve the image tag right before pushing and warn or fail if it moved to another digest during the build: off, warn or fail")
+	manifestType := flags.String("index-manifest-type", builder.ManifestTypeImage, "serialization of the SOCI index: image-manifest (OCI 1.0, config media type), image-manifest-artifact-type (OCI 1.1, artifactType) or artifact-manifest, some registries reject one or the other")
+	noBuilderAnnotations := flags.Bool("no-builder-annotations", false, "don't annotate the SOCI index with the builder version, soci-snapshotter version, build time and image digest, e.g. for reproducible index digests")
+	reproducible := flags.Bool("reproducible", false, "build byte-identical SOCI indices for the same image, with the build time from SOURCE_DATE_EPOCH or the image's creation time")
+	showTimings := flags.Bool("timings", false, "report how long pulling, building, verifying and pushing took")
+	snsTopicArn := flags.String("sns-topic-arn", "", "SNS topic to publish a JSON message with the outcome of the build to")
+	eventBus := flags.String("event-bus", "", "EventBridge event bus (name or ARN) to emit a soci.index.built event to after each successful build")
+	eventSource := flags.String("event-source", "soci-index-builder", "source of the emitted EventBridge events")
+	webhookUrl := flags.String("webhook-url", "", "URL to post a summary of the build to, e.g. a Slack incoming webhook")
+	webhookTemplate := flags.String("webhook-template", "", "file with a Go text/template of the webhook payload, rendered with the build event (default a Slack message)")
+	webhookOn := flags.String("webhook-on", "", "comma separated outcomes to post the webhook for: success, skipped, failed (default all)")
+	dynamoDBTable := flags.String("dynamodb-table", "", "DynamoDB table recording processed image digests, images with an already pushed SOCI index are skipped")
+	stateDb := flags.String("state-db", "", "local SQLite database recording processed image digests, outcomes and timings, images with an already pushed SOCI index are skipped")
+	lockTable := flags.String("lock-table", "", "DynamoDB table used to lock image digests, so that concurrent workers don't build the same SOCI index")
+	lockLease := flags.Duration("lock-lease", 10*time.Minute, "how long a lock is held before it expires if the worker doesn't release or renew it, it's renewed every third of the lease while the image is built")
+	ztocTimeout := flags.Duration("ztoc-timeout", 0, "limit of building the ztoc of a single layer (default no limit)")
+	maxCpus := flags.Int("max-cpus", 0, "CPUs the builder may use (GOMAXPROCS), default the CPU limit of the container's cgroup or all CPUs")
+	decompressWorkers := flags.Int("decompress-workers", 1, "workers decompressing and hashing each gzip layer while its ztoc is built, the layers of an image are built in parallel already, GOMAXPROCS divided by the workers at a time")
+	ztocCache := flags.String("ztoc-cache", "", "cache of ztocs by layer digest shared by builds, an S3 location (s3://bucket/prefix) or a local directory")
+	ztocCacheMaxSize := size.Flag(flags, "ztoc-cache-max-size", 0, "size cap of a -ztoc-cache directory, the least recently used ztocs are removed when it's exceeded (default no limit)")
+	ztocCacheTable := flags.String("ztoc-cache-table", "", "DynamoDB table recording the digest and size of the ztocs in -ztoc-cache")
+	platformList := flags.String("platform", "", "comma separated platforms to build SOCI indices for, e.g. linux/amd64,linux/arm64 (default the host platform)")
+	onLayerError := flags.String("on-layer-error", "", "what to do with layers whose ztoc can't be built: skip them (also corrupt or unreadable ones) or fail (also for layers of unsupported formats), default skips unsupported formats and fails on errors")
+	requireCoverage := flags.Float64("require-coverage", 0, "fail the build if the SOCI index lazily loads less than this percentage of the image bytes, e.g. 80 (default 0, any coverage)")
+	onPlatformError := flags.String("on-platform-error", platformErrorFail, "what to do when building for one of several platforms fails: fail or continue with the remaining platforms")
+	output := flags.String("output", "text", "format of the build result: text or json")
+	digestFile := flags.String("digest-file", "", "write the digest of the built SOCI index to this file, one per line for several platforms (empty if none was built)")
+	imageDigestFile := flags.String("image-digest-file", "", "write the resolved digest of the image to this file")
+	printDescriptor := flags.Bool("print-descriptor", false, "print the OCI descriptor (media type, artifact type, digest, size and annotations) of each pushed SOCI index as a line of JSON instead of the build result")
+	auditOptions := auditFlags(flags)
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	startProfiling := profileFlags(flags)
+	loadConfig := configFlags(flags)
+	parseFlags(flags, args)
+	loadConfig()
+	defer openLogFile().Close()
+	stopProfiling := startProfiling()
+	defer stopProfiling()
+	logutils.Info(context.Background(), fmt.Sprintf("Using %d CPUs", cpu.SetMaxProcs(*maxCpus)))
+
+	if (*repo == "") == (*imagesFile == "") {
+		log.Fatal("exactly one of -repository or -images-file is required")
+	}
+	if *imagesFile != "" && *layoutDir != "" {
+		log.Fatal("-layout can't be used with -images-file")
+	}
+	if *shardCount > 0 {
+		if *imagesFile == "" {
+			log.Fatal("-shard-count requires -images-file")
+		}
+		if *shardIndex < 0 {
+			arrayIndex, err := strconv.Atoi(os.Getenv("AWS_BATCH_JOB_ARRAY_INDEX"))
+			if err != nil {
+				log.Fatal("-shard-count requires -shard-index or AWS_BATCH_JOB_ARRAY_INDEX")
+			}
+			*shardIndex = arrayIndex
+		}
+		if *shardIndex < 0 || *shardIndex >= *shardCount {
+			log.Fatalf("invalid -shard-index %d, expected 0 to %d", *shardIndex, *shardCount-1)
+		}
+	} else if *shardIndex >= 0 {
+		log.Fatal("-shard-index requires -shard-count")
+	}
+	if *progressFile != "" && *imagesFile == "" {
+		log.Fatal("-progress-file requires -images-file")
+	}
+	if (*summaryFile != "" || *summaryFormat != "") && *imagesFile == "" {
+		log.Fatal("-summary-file and -summary-format require -images-file")
+	}
+	if *summaryFormat != "" && *summaryFormat != "text" && *summaryFormat != "json" && *summaryFormat != "markdown" {
+		log.Fatalf("invalid -summary-format %q, expected text, json or markdown", *summaryFormat)
+	}
+	if *imagesFile != "" && (*digestFile != "" || *imageDigestFile != "" || *printDescriptor) {
+		log.Fatal("-digest-file, -image-digest-file and -print-descriptor can't be used with -images-file")
+	}
+	if *noPush && *layoutDir == "" {
+		log.Fatal("-no-push requires -layout, otherwise the built SOCI index is discarded")
+	}
+	if *ztocCacheTable != "" && *ztocCache == "" {
+		log.Fatal("-ztoc-cache-table requires -ztoc-cache")
+	}
+	if *dynamoDBTable != "" && *stateDb != "" {
+		log.Fatal("-dynamodb-table and -state-db are mutually exclusive")
+	}
+	if *onLayerError != "" && *onLayerError != builder.LayerErrorSkip && *onLayerError != builder.LayerErrorFail {
+		log.Fatalf("invalid -on-layer-error %q, expected skip or fail", *onLayerError)
+	}
+	if *requireCoverage < 0 || *requireCoverage > 100 {
+		log.Fatalf("invalid -require-coverage %v, expected a percentage between 0 and 100", *requireCoverage)
+	}
+	if *onPlatformError != platformErrorFail && *onPlatformError != platformErrorContinue {
+		log.Fatalf("invalid -on-platform-error %q, expected fail or continue", *onPlatformError)
+	}
+	if *verifyDigests != verifyDigestsAlways && *verifyDigests != verifyDigestsTrustTransport {
+		log.Fatalf("invalid -verify-digests %q, expected always or trust-transport", *verifyDigests)
+	}
+	if *lifecycleCheck != lifecycleCheckOff && *lifecycleCheck != lifecycleCheckWarn && *lifecycleCheck != lifecycleCheckFail {
+		log.Fatalf("invalid -lifecycle-policy-check %q, expected off, warn or fail", *lifecycleCheck)
+	}
+	if *tagDriftCheck != tagDriftOff && *tagDriftCheck != tagDriftWarn && *tagDriftCheck != tagDriftFail {
+		log.Fatalf("invalid -tag-drift-check %q, expected off, warn or fail", *tagDriftCheck)
+	}
+	if *manifestType != builder.ManifestTypeImage && *manifestType != builder.ManifestTypeImageArtifactType && *manifestType != builder.ManifestTypeArtifact {
+		log.Fatalf("invalid -index-manifest-type %q, expected image-manifest, image-manifest-artifact-type or artifact-manifest", *manifestType)
+	}
+	if *convert != convertSoci && *convert != convertEstargz && *convert != convertBoth {
+		log.Fatalf("invalid -convert %q, expected soci, estargz or both", *convert)
+	}
+	if *lazyLoadable != lazyLoadableWarn && *lazyLoadable != lazyLoadableSkip {
+		log.Fatalf("invalid -lazy-loadable-images %q, expected warn or skip", *lazyLoadable)
+	}
+	if *requireScanStatus != "" && *requireScanStatus != scanStatusComplete && *requireScanStatus != scanStatusPassed {
+		log.Fatalf("invalid -require-scan-status %q, expected COMPLETE or PASSED", *requireScanStatus)
+	}
+	if !slices.Contains(registryutils.ScanSeverities, *scanSeverity) {
+		log.Fatalf("invalid -scan-severity %q, expected CRITICAL, HIGH, MEDIUM, LOW or INFORMATIONAL", *scanSeverity)
+	}
+	if *onScanGate != scanGateSkip && *onScanGate != scanGateFail {
+		log.Fatalf("invalid -on-scan-gate %q, expected skip or fail", *onScanGate)
+	}
+	if *cleanupMargin < 0 || *cleanupMarginPerGiB < 0 {
+		log.Fatal("invalid -deadline-margin or -deadline-margin-per-gib, expected a duration of 0 or more")
+	}
+	targetPlatforms, err := parsePlatforms(*platformList)
+	if err != nil {
+		log.Fatalf("invalid -platform: %v", err)
+	}
+
+	opts := buildOptions{
+		workDir:              *workDir,
+		deadlineMargin:       *cleanupMargin,
+		deadlineMarginPerGiB: *cleanupMarginPerGiB,
+		minLayerSize:         *minLayerSize,
+		manifestType:         *manifestType,
+		lifecyclePolicyCheck: *lifecycleCheck,
+		tagDriftCheck:        *tagDriftCheck,
+		spanSize:             *spanSize,
+		ztocTimeout:          *ztocTimeout,
+		decompressWorkers:    *decompressWorkers,
+		noBuilderAnnotations: *noBuilderAnnotations,
+		reproducible:         *reproducible,
+		platforms:            targetPlatforms,
+		onPlatformError:      *onPlatformError,
+		onLayerError:         *onLayerError,
+		requireCoverage:      *requireCoverage,
+		layoutDir:            *layoutDir,
+		noPush:               *noPush,
+		verifyPush:           *verifyPush,
+		verifyDigests:        *verifyDigests == verifyDigestsAlways,
+		registryOptions:      registryOptions(),
+		defaultTag:           *defaultTag,
+		ignoreOptOut:         *ignoreOptOut,
+		minImageSize:         *minImageSize,
+		lazyLoadableImages:   *lazyLoadable,
+		requireScanStatus:    *requireScanStatus,
+		scanSeverity:         *scanSeverity,
+		onScanGate:           *onScanGate,
+		convert:              *convert,
+		estargzTagSuffix:     *estargzTagSuffix,
+	}
+	if *repositoryConfig != "" {
+		opts.repositoryOverrides, err = loadRepositoryOverrides(*repositoryConfig)
+		if err != nil {
+			log.Fatalf("invalid -repository-config: %v", err)
+		}
+	}
+	if *imageFilter != "" {
+		source, err := filter.Open(*imageFilter)
+		if err != nil {
+			log.Fatalf("invalid -image-filter: %v", err)
+		}
+		opts.imageFilter, err = filter.New(context.Background(), source, *imageFilterRefresh)
+		if err != nil {
+			log.Fatalf("error loading -image-filter %q: %v", *imageFilter, err)
+		}
+	}
+	if *ztocCache != "" {
+		opts.ztocCache, err = cache.Open(*ztocCache)
+		if err != nil {
+			log.Fatalf("invalid -ztoc-cache: %v", err)
+		}
+		if dirCache, ok := opts.ztocCache.(*cache.DirCache); ok {
+			dirCache.SetMaxSize(*ztocCacheMaxSize)
+		}
+		if *ztocCacheTable != "" {
+			indexed := cache.NewDynamoDBIndexedCache(opts.ztocCache, *ztocCacheTable)
+			if dirCache, ok := opts.ztocCache.(*cache.DirCache); ok {
+				// deletes the ztocs removed to stay under -ztoc-cache-max-size from the table
+				dirCache.OnRemove(indexed.Forget)
+			}
+			opts.ztocCache = indexed
+		}
+	}
+	if *dynamoDBTable != "" {
+		opts.stateStore = state.NewDynamoDBStore(*dynamoDBTable)
+	}
+	if *lockTable != "" {
+		opts.locker = lock.NewDynamoDBLocker(*lockTable, *lockLease)
+		opts.lockLease = *lockLease
+	}
+	auditOptions(&opts)
+	var notifiers notify.Multi
+	if *snsTopicArn != "" {
+		notifiers = append(notifiers, notify.NewSNSNotifier(*snsTopicArn))
+	}
+	if *eventBus != "" {
+		notifiers = append(notifiers, notify.NewEventBridgeNotifier(*eventBus, *eventSource))
+	}
+	if *webhookUrl != "" {
+		payloadTemplate := notify.DefaultWebhookTemplate
+		if *webhookTemplate != "" {
+			content, err := os.ReadFile(*webhookTemplate)
+			if err != nil {
+				log.Fatalf("error reading webhook template %q: %v", *webhookTemplate, err)
+			}
+			payloadTemplate = string(content)
+		}
+		var outcomes []string
+		if *webhookOn != "" {
+			outcomes = strings.Split(*webhookOn, ",")
+		}
+		webhook, err := notify.NewWebhookNotifier(*webhookUrl, payloadTemplate, outcomes)
+		if err != nil {
+			log.Fatalf("invalid webhook configuration: %v", err)
+		}
+		notifiers = append(notifiers, webhook)
+	}
+	if len(notifiers) > 0 {
+		opts.notifier = notifiers
+	}
+	if *stateDb != "" {
+		sqliteStore, err := state.NewSQLiteStore(*stateDb)
+		if err != nil {
+			log.Fatalf("error opening state database %q: %v", *stateDb, err)
+		}
+		defer sqliteStore.Close()
+		opts.stateStore = sqliteStore
+	}
+	if *removeAbandoned {
+		removeAbandonedAtStartup(*workDir)
+	}
+
+	if *imagesFile != "" {
+		imageUrls, err := readImageList(*imagesFile)
+		if err != nil {
+			log.Fatalf("error reading %q: %v", *imagesFile, err)
+		}
+		if *shardCount > 0 {
+			imageUrls = shardImages(imageUrls, *shardIndex, *shardCount)
+			logutils.Info(context.Background(), fmt.Sprintf("Building the %d images of shard %d of %d", len(imageUrls), *shardIndex, *shardCount))
+		}
+		var progress *batchProgress
+		if *progressFile != "" {
+			progress, err = openBatchProgress(*progressFile)
+			if err != nil {
+				log.Fatalf("error opening the progress file %q: %v", *progressFile, err)
+			}
+			defer progress.Close()
+		}
+		ctx, stop := newSignalContext()
+		defer stop()
+		startedAt := time.Now()
+		items := buildImages(ctx, imageUrls, opts, *batchCacheSize, progress)
+		summary := summarizeBatch(items, time.Since(startedAt))
+		builderInfo := version.Get()
+		for _, item := range items {
+			if !*showTimings {
+				item.stripTimings()
+			}
+			item.Builder = &builderInfo
+		}
+		out, err := formatBatch(items, *output)
+		if err != nil {
+			log.Fatalf("error formatting the build results: %v", err)
+		}
+		fmt.Println(out)
+		// stdout stays the outcomes of the images, e.g. to parse them with -output json
+		printedFormat, fileFormat := "text", "json"
+		if *summaryFormat != "" {
+			printedFormat, fileFormat = *summaryFormat, *summaryFormat
+		}
+		printed, err := formatSummary(summary, items, printedFormat)
+		if err != nil {
+			log.Fatalf("error formatting the batch summary: %v", err)
+		}
+		fmt.Fprintln(os.Stderr, printed)
+		if *summaryFile != "" {
+			written, err := formatSummary(summary, items, fileFormat)
+			if err == nil {
+				err = os.WriteFile(*summaryFile, []byte(written+"\n"), 0644)
+			}
+			if err != nil {
+				log.Fatalf("error writing the summary file %q: %v", *summaryFile, err)
+			}
+		}
+		if batchFailed(items) {
+			// os.Exit skips the deferred calls
+			stopProfiling()
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	// invoke the handler with the provided repository URI
+	result, err := handleRequest(ctx, *repo, opts)
+	if err != nil {
+		// profiles of failed builds are written too, os.Exit skips the deferred calls
+		stopProfiling()
+		log.Printf("error building SOCI index for %q: %v", *repo, err)
+		failure, _ := json.Marshal(newBuildFailure(*repo, result, err))
+		fmt.Fprintln(os.Stderr, string(failure))
+		os.Exit(1)
+	}
+	if !*showTimings {
+		result.stripTimings()
+	}
+	builderInfo := version.Get()
+	result.Builder = &builderInfo
+	if *digestFile != "" {
+		writeDigestFile(*digestFile, result.indexDigests()...)
+	}
+	if *imageDigestFile != "" {
+		writeDigestFile(*imageDigestFile, result.ImageDigest)
+	}
+	if *printDescriptor {
+		for _, descriptor := range result.indexDescriptors() {
+			line, err := json.Marshal(descriptor)
+			if err != nil {
+				log.Fatalf("error formatting the SOCI index descriptor: %v", err)
+			}
+			fmt.Println(string(line))
+		}
+		return
+	}
+	out, err := result.format(*output)
+	if err != nil {
+		log.Fatalf("error formatting the build result: %v", err)
+	}
+	fmt.Println(out)
+}
+
+// Write digests to a file for pipelines, one per line like docker build --iidfile.
+// The file is written even without digests so that it never holds those of an earlier run.
+func writeDigestFile(path string, digests ...string) {
+	var content string
+	for _, digest := range digests {
+		if digest != "" {
+			content += digest + "\n"
+		}
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		log.Fatalf("error writing digest file %q: %v", path, err)
+	}
+}
+
+// Push the SOCI indices from a previously built OCI layout
+func pushCommand(args []string) {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	layoutDir := flags.String("layout", "", "OCI layout directory containing the already built SOCI index (see build -layout)")
+	repo := flags.String("repository", "", "OCI repository URI of the image to push the SOCI index to")
+	verifyPush := flags.Bool("verify-push", false, "after pushing, check that the SOCI index is listed as a referrer of the image and all its blobs exist")
+	lifecycleCheck := lifecyclePolicyFlag(flags)
+	auditOptions := auditFlags(flags)
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	if *layoutDir == "" || *repo == "" {
+		log.Fatal("missing required -layout or -repository argument")
+	}
+	if *lifecycleCheck != lifecycleCheckOff && *lifecycleCheck != lifecycleCheckWarn && *lifecycleCheck != lifecycleCheckFail {
+		log.Fatalf("invalid -lifecycle-policy-check %q, expected off, warn or fail", *lifecycleCheck)
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	opts := buildOptions{verifyPush: *verifyPush, lifecyclePolicyCheck: *lifecycleCheck, registryOptions: registryOptions()}
+	auditOptions(&opts)
+	result, err := pushLayout(ctx, *layoutDir, *repo, opts)
+	if err != nil {
+		log.Fatalf("error pushing SOCI index from %q to %q: %v", *layoutDir, *repo, err)
+	}
+	fmt.Println(result.Message)
+}
+
+// Report which layers would be indexed and how much would be downloaded, without pulling any layers
+func estimateCommand(args []string) {
+	flags := flag.NewFlagSet("estimate", flag.ExitOnError)
+	repo := flags.String("repository", "", "OCI repository URI (with tag or digest) to estimate the SOCI index of")
+	defaultTag := flags.String("default-tag", defaultImageTag, "tag to resolve when the image URI has neither a tag nor a digest")
+	minLayerSize := size.Flag(flags, "min-layer-size", 10<<20, "minimum layer size to build a ztoc for a layer, e.g. 10MiB, 500MB or 1G")
+	spanSize := size.Flag(flags, "span-size", 4<<20, "span size of the ztocs, e.g. 4MiB")
+	platformList := flags.String("platform", "", "comma separated platforms to estimate SOCI indices for, e.g. linux/amd64,linux/arm64 (default the host platform)")
+	output := flags.String("output", "text", "format of the estimate: text or json")
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
 
 	if *repo == "" {
 		log.Fatal("missing required -repository argument")
 	}
+	targetPlatforms, err := parsePlatforms(*platformList)
+	if err != nil {
+		log.Fatalf("invalid -platform: %v", err)
+	}
+
+	opts := buildOptions{
+		minLayerSize:    *minLayerSize,
+		spanSize:        *spanSize,
+		platforms:       targetPlatforms,
+		registryOptions: registryOptions(),
+		defaultTag:      *defaultTag,
+	}
 
-	ctx := context.Background()
-	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Minute*5))
+	ctx, cancel := newCommandContext()
 	defer cancel()
-	// invoke the handler with the provided repository URI
-	out, err := handleRequest(ctx, *repo, *minLayerSize)
+	result, err := estimateIndex(ctx, *repo, opts)
+	if err != nil {
+		log.Fatalf("error estimating SOCI index for %q: %v", *repo, err)
+	}
+	out, err := result.format(*output)
+	if err != nil {
+		log.Fatalf("error formatting the estimate: %v", err)
+	}
+	fmt.Println(out)
+}
+
+// Check whether an image has a SOCI index, exits with 1 if it hasn't, e.g. for deploy gates
+func checkCommand(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repo := flags.String("repository", "", "OCI repository URI (with tag or digest) of the image to check")
+	imageDigest := flags.String("digest", "", "digest of the image to check, instead of the tag or digest of -repository")
+	defaultTag := flags.String("default-tag", defaultImageTag, "tag to resolve when the image URI has neither a tag nor a digest")
+	platformList := flags.String("platform", "", "comma separated platforms that must have a SOCI index, e.g. linux/amd64,linux/arm64 (default all platforms of the image)")
+	output := flags.String("output", "text", "format of the check: text or json")
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	if *repo == "" {
+		log.Fatal("missing required -repository argument")
+	}
+	imageUrl := *repo
+	if *imageDigest != "" {
+		if _, err := digest.Parse(*imageDigest); err != nil {
+			log.Fatalf("invalid -digest %q: %v", *imageDigest, err)
+		}
+		registryHost, repository, _ := parseImageUrl(*repo)
+		imageUrl = registryHost + "/" + repository + "@" + *imageDigest
+	}
+	targetPlatforms, err := parsePlatforms(*platformList)
+	if err != nil {
+		log.Fatalf("invalid -platform: %v", err)
+	}
+
+	opts := buildOptions{
+		platforms:       targetPlatforms,
+		registryOptions: registryOptions(),
+		defaultTag:      *defaultTag,
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	result, err := checkIndexed(ctx, imageUrl, opts)
+	if err != nil {
+		log.Fatalf("error checking the SOCI index of %q: %v", imageUrl, err)
+	}
+	out, err := result.format(*output)
+	if err != nil {
+		log.Fatalf("error formatting the check: %v", err)
+	}
+	fmt.Println(out)
+	if !result.Indexed {
+		os.Exit(1)
+	}
+}
+
+// Compare two SOCI indices, exits with 1 if they aren't equivalent
+func diffCommand(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	repo := flags.String("repository", "", "OCI repository URI (without tag or digest) containing both SOCI indices")
+	from := flags.String("from", "", "digest or tag of the first SOCI index")
+	to := flags.String("to", "", "digest or tag of the second SOCI index")
+	output := flags.String("output", "text", "format of the differences: text or json")
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	if *repo == "" || *from == "" || *to == "" {
+		log.Fatal("missing required -repository, -from or -to argument")
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	result, err := diffIndexes(ctx, *repo, *from, *to, registryOptions())
 	if err != nil {
-		log.Fatalf("error building SOCI index for %q: %v", *repo, err)
+		log.Fatalf("error comparing SOCI indices in %q: %v", *repo, err)
+	}
+	out, err := result.format(*output)
+	if err != nil {
+		log.Fatalf("error formatting the differences: %v", err)
 	}
 	fmt.Println(out)
+	if !result.Equivalent {
+		os.Exit(1)
+	}
+}
+
+// Copy an image with its SOCI indices to another repository
+func copyCommand(args []string) {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	from := flags.String("from", "", "OCI repository URI (with tag or digest) of the image to copy")
+	to := flags.String("to", "", "OCI repository URI to copy the image and its SOCI indices to, with the tag of -from if it has no tag")
+	defaultTag := flags.String("default-tag", defaultImageTag, "tag to resolve when the image URI has neither a tag nor a digest")
+	createRepository := flags.Bool("create-repository", false, "create the destination ECR repository if it doesn't exist")
+	tagImmutability := flags.Bool("tag-immutability", false, "enable tag immutability on a repository created with -create-repository")
+	scanOnPush := flags.Bool("scan-on-push", false, "enable scan on push on a repository created with -create-repository")
+	auditOptions := auditFlags(flags)
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	if *from == "" || *to == "" {
+		log.Fatal("missing required -from or -to argument")
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	opts := buildOptions{registryOptions: registryOptions(), defaultTag: *defaultTag}
+	if *createRepository {
+		opts.createRepository = &registryutils.RepositorySettings{TagImmutability: *tagImmutability, ScanOnPush: *scanOnPush}
+	}
+	auditOptions(&opts)
+	result, err := copyImage(ctx, *from, *to, opts)
+	if err != nil {
+		log.Fatalf("error copying %q to %q: %v", *from, *to, err)
+	}
+	fmt.Println(result.Message)
+}
+
+// Print the version and build information of the tool
+func versionCommand(args []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	output := flags.String("output", "text", "format of the build information: text or json")
+	parseFlags(flags, args)
+
+	info := version.Get()
+	if *output == "json" {
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			log.Fatalf("error formatting the build information: %v", err)
+		}
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("version: %s\ncommit: %s\ngo: %s\nsoci-snapshotter: %s\n", info.Version, info.Commit, info.GoVersion, info.SociSnapshotter)
+}
+
+// Check credentials, ECR permissions, registry connectivity, free space and the soci library, exits with 1 if any check fails
+func doctorCommand(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	repo := flags.String("repository", "", "OCI repository URI (with tag or digest) to check registry connectivity and ECR permissions for")
+	defaultTag := flags.String("default-tag", defaultImageTag, "tag to resolve when the image URI has neither a tag nor a digest")
+	workDir := flags.String("work-dir", os.TempDir(), "directory images are pulled to (see build -work-dir), checked for free space")
+	requiredFreeSpace := size.Flag(flags, "min-free-space", minFreeSpace, "free space the work directory needs, e.g. 10GiB")
+	output := flags.String("output", "text", "format of the checks: text or json")
+	registryOptions := registryFlags(flags)
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	result := runDoctor(ctx, doctorOptions{
+		repository:   *repo,
+		workDir:      *workDir,
+		minFreeSpace: *requiredFreeSpace,
+		buildOptions: buildOptions{registryOptions: registryOptions(), defaultTag: *defaultTag},
+	})
+	out, err := result.format(*output)
+	if err != nil {
+		log.Fatalf("error formatting the checks: %v", err)
+	}
+	fmt.Println(out)
+	if result.failed() {
+		os.Exit(1)
+	}
+}
+
+// Register the flag checking the lifecycle policy of the repository before pushing
+func lifecyclePolicyFlag(flags *flag.FlagSet) *string {
+	return flags.String("lifecycle-policy-check", lifecycleCheckOff, "check whether the lifecycle policy of the ECR repository expires untagged images, which deletes the SOCI index: off, warn or fail")
+}
+
+// Maintain a local ztoc cache, "cache prune" removes the least recently used ztocs
+func cacheCommand(args []string) {
+	if len(args) == 0 || args[0] != "prune" {
+		log.Fatal("usage: cache prune -dir <directory> [-max-size <size>] [-max-age <duration>] [-table <table>]")
+	}
+	flags := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	dir := flags.String("dir", "", "local ztoc cache directory (see build -ztoc-cache)")
+	maxSize := size.Flag(flags, "max-size", 0, "remove the least recently used ztocs until the cache is no larger, e.g. 10GiB")
+	maxAge := flags.Duration("max-age", 0, "remove the ztocs that weren't used for longer, e.g. 720h")
+	table := flags.String("table", "", "DynamoDB table indexing the cache (see build -ztoc-cache-table), the removed ztocs are deleted from it")
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args[1:])
+	defer openLogFile().Close()
+
+	if *dir == "" {
+		log.Fatal("missing required -dir argument")
+	}
+	if *maxSize == 0 && *maxAge == 0 {
+		log.Fatal("at least one of -max-size or -max-age is required")
+	}
+	dirCache, err := cache.NewDirCache(*dir)
+	if err != nil {
+		log.Fatalf("error opening cache %q: %v", *dir, err)
+	}
+	if *table != "" {
+		// deletes the pruned ztocs from the table
+		dirCache.OnRemove(cache.NewDynamoDBIndexedCache(dirCache, *table).Forget)
+	}
+	result, err := dirCache.Prune(*maxSize, *maxAge)
+	if err != nil {
+		log.Fatalf("error pruning cache %q: %v", *dir, err)
+	}
+	fmt.Printf("Removed %d ztocs (%s), %s kept\n", result.Removed, size.Format(result.FreedSize), size.Format(result.Size))
+}
+
+// Remove the work directories left behind by crashed builds, prune the ztoc cache and compact the state database
+func cleanCommand(args []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	workDir := flags.String("work-dir", os.TempDir(), "directory images are pulled to (see build -work-dir), its abandoned soci-index-builder* and soci-lambda* directories are removed")
+	olderThan := flags.Duration("older-than", abandonedTempDirAge, "remove the work directories without the lock of a running build, e.g. of earlier versions, only if nothing was written to them for longer")
+	cacheDir := flags.String("ztoc-cache", "", "local ztoc cache directory to prune (see build -ztoc-cache)")
+	cacheMaxSize := size.Flag(flags, "cache-max-size", 0, "with -ztoc-cache, remove the least recently used ztocs until the cache is no larger, e.g. 10GiB")
+	cacheMaxAge := flags.Duration("cache-max-age", 0, "with -ztoc-cache, remove the ztocs that weren't used for longer, e.g. 720h")
+	cacheTable := flags.String("ztoc-cache-table", "", "DynamoDB table indexing -ztoc-cache (see build -ztoc-cache-table), the removed ztocs are deleted from it")
+	stateDb := flags.String("state-db", "", "SQLite state database to compact (see build -state-db)")
+	openLogFile := logFlags(flags)
+	parseFlags(flags, args)
+	defer openLogFile().Close()
+
+	if *cacheDir != "" && *cacheMaxSize == 0 && *cacheMaxAge == 0 {
+		log.Fatal("-ztoc-cache requires at least one of -cache-max-size or -cache-max-age")
+	}
+	if *cacheTable != "" && *cacheDir == "" {
+		log.Fatal("-ztoc-cache-table requires -ztoc-cache")
+	}
+
+	ctx, cancel := newCommandContext()
+	defer cancel()
+	cleanup, err := removeAbandonedTempDirs(ctx, *workDir, *olderThan)
+	if err != nil {
+		log.Fatalf("error removing the abandoned work directories in %q: %v", *workDir, err)
+	}
+	fmt.Printf("Removed %d abandoned work directories (%s) from %s\n", cleanup.Removed, size.Format(cleanup.FreedSize), *workDir)
+
+	if *cacheDir != "" {
+		dirCache, err := cache.NewDirCache(*cacheDir)
+		if err != nil {
+			log.Fatalf("error opening cache %q: %v", *cacheDir, err)
+		}
+		if *cacheTable != "" {
+			// deletes the pruned ztocs from the table
+			dirCache.OnRemove(cache.NewDynamoDBIndexedCache(dirCache, *cacheTable).Forget)
+		}
+		result, err := dirCache.Prune(*cacheMaxSize, *cacheMaxAge)
+		if err != nil {
+			log.Fatalf("error pruning cache %q: %v", *cacheDir, err)
+		}
+		fmt.Printf("Removed %d ztocs (%s), %s kept\n", result.Removed, size.Format(result.FreedSize), size.Format(result.Size))
+	}
+
+	if *stateDb != "" {
+		info, err := os.Stat(*stateDb)
+		if err != nil {
+			// opening a missing database would create it
+			log.Fatalf("error opening state database %q: %v", *stateDb, err)
+		}
+		sqliteStore, err := state.NewSQLiteStore(*stateDb)
+		if err != nil {
+			log.Fatalf("error opening state database %q: %v", *stateDb, err)
+		}
+		defer sqliteStore.Close()
+		if err := sqliteStore.Compact(ctx); err != nil {
+			log.Fatalf("error compacting state database %q: %v", *stateDb, err)
+		}
+		compacted, err := os.Stat(*stateDb)
+		if err != nil {
+			log.Fatalf("error opening state database %q: %v", *stateDb, err)
+		}
+		fmt.Printf("Compacted the state database from %s to %s\n", size.Format(info.Size()), size.Format(compacted.Size()))
+	}
+}
+
+// Parse a comma separated list of platforms
+func parsePlatforms(platformList string) ([]ocispec.Platform, error) {
+	var parsed []ocispec.Platform
+	for _, platform := range strings.Split(platformList, ",") {
+		if platform == "" {
+			continue
+		}
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, platforms.Normalize(p))
+	}
+	return parsed, nil
+}
+
+// Register the flags shared by all commands that talk to registries.
+// The returned function builds the registry client options after the flags are parsed.
+func registryFlags(flags *flag.FlagSet) func() []registryutils.Option {
+	userAgentSuffix := flags.String("user-agent-suffix", "", "custom suffix appended to the User-Agent sent to registries and the ECR API")
+	debugHttp := flags.Bool("debug-http", false, "log method, URL, status, retry count and latency of every registry request (credentials are redacted)")
+	manifestTimeout := flags.Duration("manifest-timeout", 0, "limit of a single manifest fetch, timed out requests are retried (default no limit)")
+	blobDownloadTimeout := flags.Duration("layer-download-timeout", 0, "limit of downloading a single layer, timed out requests are retried (default no limit)")
+	downloadResumes := flags.Int("layer-download-resumes", registryutils.DefaultDownloadResumes, "how many times an interrupted layer download is resumed with a Range request where the registry supports it, 0 downloads the layer again")
+	pushTimeout := flags.Duration("push-timeout", 0, "limit of each blob or manifest push request, timed out requests are retried (default no limit)")
+	throttleBudget := flags.Duration("throttle-budget", registryutils.DefaultThrottling.Budget, "how long a request throttled by the registry or the ECR API is retried with jittered exponential backoff before it fails, 0 retries only a few times")
+	var transportSettings registryutils.TransportSettings
+	flags.StringVar(&transportSettings.Proxy, "registry-proxy", "", "URL of an HTTP proxy for registry requests, e.g. a SigV4 signing proxy (default from HTTPS_PROXY)")
+	flags.StringVar(&transportSettings.CACertFile, "registry-ca-cert", "", "PEM file of CA certificates to trust for registries in addition to the system's")
+	flags.StringVar(&transportSettings.ClientCertFile, "registry-client-cert", "", "PEM file of the client certificate presented to registries requiring mutual TLS")
+	flags.StringVar(&transportSettings.ClientKeyFile, "registry-client-key", "", "PEM file of the key of -registry-client-cert")
+	flags.IntVar(&transportSettings.MaxIdleConnsPerHost, "registry-max-idle-conns", 0, "idle connections kept open to each registry host for reuse, raise it with the blob concurrency over high-latency links (default 2)")
+	flags.DurationVar(&transportSettings.IdleConnTimeout, "registry-idle-timeout", 0, "how long an idle connection to a registry is kept open (default 90s)")
+	flags.DurationVar(&transportSettings.TLSHandshakeTimeout, "registry-tls-handshake-timeout", 0, "limit of the TLS handshake with a registry (default 10s)")
+	flags.BoolVar(&transportSettings.DisableHTTP2, "registry-disable-http2", false, "talk HTTP/1.1 to registries, for proxies that break HTTP/2")
+	registryConfig := flags.String("registry-config", "", "JSON file of settings by registry host (plain HTTP, proxy, CA and client certificates, basic auth, throttle budget, concurrency, pull-through mirrors) overriding the flags for that registry")
+	return func() []registryutils.Option {
+		throttling := registryutils.DefaultThrottling
+		throttling.Budget = *throttleBudget
+		transport, err := registryutils.NewTransport(transportSettings)
+		if err != nil {
+			log.Fatalf("invalid registry transport settings: %v", err)
+		}
+		options := []registryutils.Option{
+			registryutils.WithTransport(transport),
+			registryutils.WithUserAgent(version.UserAgent(*userAgentSuffix)),
+			registryutils.WithDebugHttp(*debugHttp),
+			registryutils.WithTimeouts(registryutils.Timeouts{
+				Manifest:     *manifestTimeout,
+				BlobDownload: *blobDownloadTimeout,
+				Push:         *pushTimeout,
+			}),
+			registryutils.WithThrottling(throttling),
+			registryutils.WithDownloadResumes(*downloadResumes),
+		}
+		if *registryConfig != "" {
+			hosts, err := registryutils.LoadHostSettings(*registryConfig)
+			if err != nil {
+				log.Fatalf("invalid -registry-config: %v", err)
+			}
+			options = append(options, registryutils.WithHostSettings(hosts))
+		}
+		return options
+	}
+}
+
+// Register the flags of the audit log of pushed SOCI indices.
+// The returned function sets the audit options of a command after the flags are parsed.
+func auditFlags(flags *flag.FlagSet) func(opts *buildOptions) {
+	auditFile := flags.String("audit-log", "", "local file to append a JSON line to for every pushed SOCI index")
+	auditTable := flags.String("audit-table", "", "DynamoDB table to append an item to for every pushed SOCI index")
+	actor := flags.String("audit-actor", "", "who is pushing, recorded in the audit log (default user@host)")
+	trigger := flags.String("audit-trigger", "", "what triggered the push, e.g. a CI job URL, recorded in the audit log (default the command line)")
+	return func(opts *buildOptions) {
+		if *auditFile != "" && *auditTable != "" {
+			log.Fatal("-audit-log and -audit-table are mutually exclusive")
+		}
+		if *auditFile != "" {
+			opts.auditLog = audit.NewFileLog(*auditFile)
+		}
+		if *auditTable != "" {
+			opts.auditLog = audit.NewDynamoDBLog(*auditTable)
+		}
+		opts.auditActor = *actor
+		if opts.auditActor == "" {
+			opts.auditActor = audit.DefaultActor()
+		}
+		opts.auditTrigger = *trigger
+		if opts.auditTrigger == "" {
+			opts.auditTrigger = strings.Join(os.Args, " ")
+		}
+	}
+}
+
+// Register the flag of the SSM Parameter Store path the flags are loaded from.
+// The returned function sets the flags not given on the command line or in the environment from the parameters under the path
+// (e.g. /soci-builder/min-layer-size), it must be called right after the flags are parsed.
+func configFlags(flags *flag.FlagSet) func() {
+	ssmPath := flags.String("config-ssm-path", "", "SSM Parameter Store path whose parameters, named like the flags, set the flags not given on the command line or in the environment, e.g. /soci-builder")
+	return func() {
+		if *ssmPath == "" {
+			return
+		}
+		ctx, cancel := newCommandContext()
+		defer cancel()
+		parameters, err := config.NewParameterStore().Load(ctx, *ssmPath)
+		if err != nil {
+			log.Fatalf("error loading the configuration from %q: %v", *ssmPath, err)
+		}
+		given := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		for name, value := range parameters {
+			if given[name] {
+				continue
+			}
+			if flags.Lookup(name) == nil {
+				logutils.Warn(ctx, fmt.Sprintf("Ignoring the parameter %s in %s, the %s command has no such flag", name, *ssmPath, flags.Name()))
+				continue
+			}
+			if err := flags.Set(name, value); err != nil {
+				log.Fatalf("invalid parameter %s in %q: %v", name, *ssmPath, err)
+			}
+		}
+		logutils.Info(ctx, fmt.Sprintf("Loaded the configuration from %s", *ssmPath))
+	}
+}
+
+// Parse the command line, then set the flags not given on it from their environment variables,
+// e.g. SOCI_BUILDER_MIN_LAYER_SIZE for -min-layer-size. Flags given on the command line take precedence.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			log.Fatalf("invalid %s %q: %v", flagEnvName(f.Name), value, err)
+		}
+	})
+}
+
+// The environment variable of a flag
+func flagEnvName(name string) string {
+	return "SOCI_BUILDER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Register the flags configuring where the logs are written.
+// The returned function opens the log file after the flags are parsed, it must be closed when the command ends.
+func logFlags(flags *flag.FlagSet) func() io.Closer {
+	logFile := flags.String("log-file", "", "write logs to this file instead of stderr, rotating it by size and age")
+	logMaxSize := size.Flag(flags, "log-max-size", 100<<20, "rotate the log file when it grows larger than this, e.g. 100MiB (0 for no limit)")
+	logMaxAge := flags.Duration("log-max-age", 24*time.Hour, "rotate the log file when it's older than this (0 for no limit)")
+	logBackups := flags.Int("log-backups", 5, "number of rotated log files to keep (0 keeps all)")
+	return func() io.Closer {
+		if *logFile == "" {
+			return io.NopCloser(nil)
+		}
+		f, err := logutils.OpenRotatingFile(*logFile, *logMaxSize, *logMaxAge, *logBackups)
+		if err != nil {
+			log.Fatalf("error opening log file %q: %v", *logFile, err)
+		}
+		logutils.SetOutput(f)
+		return f
+	}
+}
+
+// Register the flags profiling a command.
+// The returned function starts profiling after the flags are parsed, the function it returns
+// writes the profiles and must be called when the command ends.
+func profileFlags(flags *flag.FlagSet) func() func() {
+	cpuProfile := flags.String("cpuprofile", "", "write a CPU profile of the run to this file, see go tool pprof")
+	memProfile := flags.String("memprofile", "", "write a heap profile to this file when the run ends, see go tool pprof")
+	pprofAddr := flags.String("pprof-addr", "", "serve the net/http/pprof endpoints on this address during the run, e.g. localhost:6060")
+	return func() func() {
+		if *pprofAddr != "" {
+			listener, err := net.Listen("tcp", *pprofAddr)
+			if err != nil {
+				log.Fatalf("error listening on -pprof-addr %q: %v", *pprofAddr, err)
+			}
+			// the default mux has the pprof handlers registered by importing net/http/pprof
+			go http.Serve(listener, nil)
+		}
+		var cpuFile *os.File
+		if *cpuProfile != "" {
+			var err error
+			cpuFile, err = os.Create(*cpuProfile)
+			if err != nil {
+				log.Fatalf("error creating CPU profile %q: %v", *cpuProfile, err)
+			}
+			if err := pprof.StartCPUProfile(cpuFile); err != nil {
+				log.Fatalf("error starting CPU profile: %v", err)
+			}
+		}
+		return func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+			}
+			if *memProfile != "" {
+				f, err := os.Create(*memProfile)
+				if err != nil {
+					log.Fatalf("error creating heap profile %q: %v", *memProfile, err)
+				}
+				defer f.Close()
+				// report the live heap, not garbage that wasn't collected yet
+				runtime.GC()
+				if err := pprof.WriteHeapProfile(f); err != nil {
+					log.Fatalf("error writing heap profile: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// The context of a command is cancelled on SIGINT or SIGTERM, interrupting downloads and ztoc builds
+func newCommandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := newSignalContext()
+	ctx, cancel := withCommandDeadline(ctx)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// A context cancelled on SIGINT or SIGTERM, e.g. for the whole run of a batch
+func newSignalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Each command, or each image of a batch, has 5 minutes
+func withCommandDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(ctx, time.Now().Add(time.Minute*5))
 }
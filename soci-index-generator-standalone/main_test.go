@@ -0,0 +1,29 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestParseFlagsEnvironment(t *testing.T) {
+	t.Setenv("SOCI_BUILDER_MIN_LAYER_SIZE", "20")
+	t.Setenv("SOCI_BUILDER_NO_PUSH", "true")
+	t.Setenv("SOCI_BUILDER_OUTPUT", "json")
+
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	minLayerSize := flags.Int("min-layer-size", 10, "")
+	noPush := flags.Bool("no-push", false, "")
+	output := flags.String("output", "text", "")
+	workDir := flags.String("work-dir", "", "")
+	parseFlags(flags, []string{"-output", "text"})
+
+	if *minLayerSize != 20 || !*noPush || *workDir != "" {
+		t.Fatalf("Expected the flags to be set from the environment but got %d %v %q", *minLayerSize, *noPush, *workDir)
+	}
+	if *output != "text" {
+		t.Fatalf("Expected the command line to take precedence but got %q", *output)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// Image owners opt out of SOCI indexing by setting this manifest annotation or image label to "true"
+const optOutKey = "soci.skip"
+
+// Find where an image opts out of SOCI indexing: an annotation of its manifest (or image index)
+// or a label of its config, in any of its platforms. Empty if it doesn't opt out.
+func findOptOut(ctx context.Context, registry *registryutils.Registry, repo string, reference string) (string, error) {
+	desc, content, err := registry.FetchManifest(ctx, repo, reference)
+	if err != nil {
+		return "", err
+	}
+	return manifestOptOut(ctx, registry, repo, desc, content)
+}
+
+func manifestOptOut(ctx context.Context, registry *registryutils.Registry, repo string, desc ocispec.Descriptor, content []byte) (string, error) {
+	// the fields of image manifests and image indices opting out
+	var manifest struct {
+		Annotations map[string]string    `json:"annotations"`
+		Config      *ocispec.Descriptor  `json:"config"`
+		Manifests   []ocispec.Descriptor `json:"manifests"`
+	}
+	err := json.Unmarshal(content, &manifest)
+	if err != nil {
+		return "", err
+	}
+	if manifest.Annotations[optOutKey] == "true" {
+		return fmt.Sprintf("annotation %s of manifest %s", optOutKey, desc.Digest), nil
+	}
+
+	if manifest.Config != nil && slices.Contains(registryutils.ImageConfigMediaTypes, manifest.Config.MediaType) {
+		configBytes, err := registry.FetchBlob(ctx, repo, *manifest.Config)
+		if err != nil {
+			return "", err
+		}
+		var config ocispec.Image
+		err = json.Unmarshal(configBytes, &config)
+		if err != nil {
+			return "", err
+		}
+		if config.Config.Labels[optOutKey] == "true" {
+			return fmt.Sprintf("label %s of image config %s", optOutKey, manifest.Config.Digest), nil
+		}
+	}
+
+	var platformManifests []ocispec.Descriptor
+	for _, platformManifest := range manifest.Manifests {
+		if !images.IsManifestType(platformManifest.MediaType) {
+			continue
+		}
+		if platformManifest.Annotations[optOutKey] == "true" {
+			return fmt.Sprintf("annotation %s of manifest %s", optOutKey, platformManifest.Digest), nil
+		}
+		platformManifests = append(platformManifests, platformManifest)
+	}
+	platformContents, err := registry.FetchManifests(ctx, repo, platformManifests)
+	if err != nil {
+		return "", err
+	}
+	for i, platformManifest := range platformManifests {
+		optOut, err := manifestOptOut(ctx, registry, repo, platformManifest, platformContents[i])
+		if err != nil || optOut != "" {
+			return optOut, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+)
+
+// Build options of the repositories matching a pattern, overriding the flags
+type repositoryOverride struct {
+	// pattern of the repository name without the registry host, e.g. "ml/*" (see path.Match, * doesn't match a /)
+	Pattern string `json:"pattern"`
+	// sizes like the flags, e.g. "50MiB", the flags' values if empty
+	MinLayerSize string `json:"minLayerSize"`
+	SpanSize     string `json:"spanSize"`
+	// comma separated like -platform, the flag's platforms if empty
+	Platforms string `json:"platforms"`
+
+	minLayerSize int64
+	spanSize     int64
+	platforms    []ocispec.Platform
+}
+
+// The file of the overrides by repository pattern
+type repositoryOverridesFile struct {
+	Repositories []repositoryOverride `json:"repositories"`
+}
+
+// Read the overrides by repository pattern from a JSON file of the form
+// {"repositories": [{"pattern": "ml/*", "minLayerSize": "100MiB", "spanSize": "16MiB", "platforms": "linux/amd64"}]}
+func loadRepositoryOverrides(file string) ([]repositoryOverride, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var overridesFile repositoryOverridesFile
+	if err := json.Unmarshal(content, &overridesFile); err != nil {
+		return nil, fmt.Errorf("invalid repository config %s: %w", file, err)
+	}
+	overrides := overridesFile.Repositories
+	for i := range overrides {
+		if err := overrides[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid override of %q in %s: %w", overrides[i].Pattern, file, err)
+		}
+	}
+	return overrides, nil
+}
+
+func (o *repositoryOverride) parse() error {
+	if o.Pattern == "" {
+		return fmt.Errorf("missing pattern")
+	}
+	if _, err := path.Match(o.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	var err error
+	if o.MinLayerSize != "" {
+		if o.minLayerSize, err = size.Parse(o.MinLayerSize); err != nil {
+			return fmt.Errorf("invalid minLayerSize: %w", err)
+		}
+	}
+	if o.SpanSize != "" {
+		if o.spanSize, err = size.Parse(o.SpanSize); err != nil {
+			return fmt.Errorf("invalid spanSize: %w", err)
+		}
+		if o.spanSize <= 0 {
+			return fmt.Errorf("invalid spanSize %q", o.SpanSize)
+		}
+	}
+	if o.platforms, err = parsePlatforms(o.Platforms); err != nil {
+		return fmt.Errorf("invalid platforms: %w", err)
+	}
+	return nil
+}
+
+// Apply the first override whose pattern matches the repository, the options are returned unchanged if none does
+func withRepositoryOverride(opts buildOptions, repo string) (buildOptions, *repositoryOverride) {
+	for i, override := range opts.repositoryOverrides {
+		if matched, _ := path.Match(override.Pattern, repo); !matched {
+			continue
+		}
+		if override.MinLayerSize != "" {
+			opts.minLayerSize = override.minLayerSize
+		}
+		if override.SpanSize != "" {
+			opts.spanSize = override.spanSize
+		}
+		if len(override.platforms) > 0 {
+			opts.platforms = override.platforms
+		}
+		return opts, &opts.repositoryOverrides[i]
+	}
+	return opts, nil
+}
@@ -0,0 +1,54 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoryOverrides(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "repositories.json")
+	config := `{"repositories": [
+		{"pattern": "ml/*", "minLayerSize": "100MiB", "spanSize": "16MiB"},
+		{"pattern": "*", "platforms": "linux/amd64,linux/arm64"}
+	]}`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write the repository config: %v", err)
+	}
+	overrides, err := loadRepositoryOverrides(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load the repository config: %v", err)
+	}
+	opts := buildOptions{minLayerSize: 10 << 20, spanSize: 4 << 20, repositoryOverrides: overrides}
+
+	ml, override := withRepositoryOverride(opts, "ml/training")
+	if override == nil || override.Pattern != "ml/*" || ml.minLayerSize != 100<<20 || ml.spanSize != 16<<20 || len(ml.platforms) != 0 {
+		t.Fatalf("Expected the ml/* override but got %+v", ml)
+	}
+	web, override := withRepositoryOverride(opts, "web")
+	if override == nil || override.Pattern != "*" || web.minLayerSize != 10<<20 || len(web.platforms) != 2 {
+		t.Fatalf("Expected the * override but got %+v", web)
+	}
+	nested, override := withRepositoryOverride(opts, "team/web")
+	if override != nil || nested.minLayerSize != opts.minLayerSize || opts.minLayerSize != 10<<20 {
+		t.Fatalf("Expected no override but got %+v", nested)
+	}
+}
+
+func TestLoadRepositoryOverridesValidates(t *testing.T) {
+	for _, config := range []string{
+		`{"repositories": [{"minLayerSize": "1MiB"}]}`,
+		`{"repositories": [{"pattern": "[", "minLayerSize": "1MiB"}]}`,
+		`{"repositories": [{"pattern": "ml/*", "spanSize": "big"}]}`,
+		`{"repositories": [{"pattern": "ml/*", "platforms": "linux/not-an-arch/v9/x"}]}`,
+	} {
+		configFile := filepath.Join(t.TempDir(), "repositories.json")
+		os.WriteFile(configFile, []byte(config), 0644)
+		if _, err := loadRepositoryOverrides(configFile); err == nil {
+			t.Fatalf("Expected %s to be rejected", config)
+		}
+	}
+}
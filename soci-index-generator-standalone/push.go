@@ -0,0 +1,113 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+var (
+	ErrNoIndexInLayout = errors.New("no SOCI index found in the OCI layout")
+)
+
+// Push the SOCI indices found in a previously built OCI layout to the image's repository
+func pushLayout(ctx context.Context, layoutDir string, imageUrl string, opts buildOptions) (*buildResult, error) {
+	registryHost, repo, _ := parseImageUrl(imageUrl)
+
+	ctx = context.WithValue(ctx, "RegistryURL", registryHost)
+
+	registry, err := registryutils.Init(ctx, registryHost, opts.registryOptions...)
+	if err != nil {
+		return resultError(ctx, "Registry initialization error", err)
+	}
+
+	err = checkLifecyclePolicy(ctx, registry, repo, opts)
+	if err != nil {
+		return resultError(ctx, LifecycleConflictMessage, err)
+	}
+
+	sociStore, err := initSociStore(ctx, layoutDir)
+	if err != nil {
+		return resultError(ctx, "OCI layout open error", err)
+	}
+
+	indexDescriptors, err := findSociIndexes(ctx, sociStore, layoutDir)
+	if err != nil {
+		return resultError(ctx, "OCI layout read error", err)
+	}
+	if len(indexDescriptors) == 0 {
+		return resultError(ctx, PushFailedMessage, ErrNoIndexInLayout)
+	}
+
+	for _, indexDescriptor := range indexDescriptors {
+		ctx := context.WithValue(ctx, "SOCIIndexDigest", indexDescriptor.Digest.String())
+		err = registry.Push(ctx, sociStore, indexDescriptor, repo)
+		if err != nil {
+			return resultError(ctx, PushFailedMessage, err)
+		}
+		err = auditPush(ctx, opts, repo, "", indexDescriptor)
+		if err != nil {
+			return resultError(ctx, AuditFailedMessage, err)
+		}
+		if opts.verifyPush {
+			err = registry.VerifyPush(ctx, repo, indexDescriptor)
+			if err != nil {
+				return resultError(ctx, VerifyFailedMessage, err)
+			}
+		}
+		log.Info(ctx, PushSuccessMessage)
+	}
+
+	return &buildResult{Message: PushSuccessMessage}, nil
+}
+
+// Find the SOCI indices recorded in the index.json of an OCI layout
+func findSociIndexes(ctx context.Context, sociStore *store.SociStore, layoutDir string) ([]ocispec.Descriptor, error) {
+	indexJson, err := os.ReadFile(filepath.Join(layoutDir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var layoutIndex ocispec.Index
+	err = json.Unmarshal(indexJson, &layoutIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexDescriptors []ocispec.Descriptor
+	for _, desc := range layoutIndex.Manifests {
+		if desc.MediaType != ocispec.MediaTypeImageManifest && desc.MediaType != builder.MediaTypeArtifactManifest {
+			continue
+		}
+
+		manifestBytes, err := content.FetchAll(ctx, sociStore, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		_, _, err = builder.ParseIndex(manifestBytes)
+		if errors.Is(err, builder.ErrNotSociIndex) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Info(ctx, fmt.Sprintf("Found SOCI index %s in the OCI layout", desc.Digest))
+		indexDescriptors = append(indexDescriptors, desc)
+	}
+
+	return indexDescriptors, nil
+}
@@ -0,0 +1,230 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Outcome of a build, printed at the end of the build command
+type buildResult struct {
+	Message     string           `json:"message"`
+	ImageDigest string           `json:"imageDigest,omitempty"`
+	Platforms   []platformResult `json:"platforms,omitempty"`
+	Timings     timings          `json:"timings,omitempty"`
+	// format of the image's layers that other snapshotters already load lazily, e.g. estargz
+	LazyLoading string `json:"lazyLoading,omitempty"`
+	// bytes pulled from and pushed to the registry, layers in the ztoc cache and blobs it had already aren't counted
+	PulledSize int64 `json:"pulledSize,omitempty"`
+	PushedSize int64 `json:"pushedSize,omitempty"`
+	// version of the tool and the soci-snapshotter library that built the SOCI indices
+	Builder *version.Info `json:"builder,omitempty"`
+	// eStargz conversion of the image, nil if it wasn't converted
+	Estargz *estargzResult `json:"estargz,omitempty"`
+}
+
+// eStargz conversion of the image, see -convert
+type estargzResult struct {
+	ImageDigest string `json:"imageDigest"`
+	Tag         string `json:"tag"`
+}
+
+// Outcome of building and pushing the SOCI index of one platform of the image
+type platformResult struct {
+	Platform    string `json:"platform"`
+	Message     string `json:"message"`
+	IndexDigest string `json:"indexDigest,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// estimated lazy loading benefit of the built SOCI index
+	Savings *builder.Savings `json:"savings,omitempty"`
+	// layers that weren't indexed because of their format, e.g. zstd or a media type contradicting the content
+	SkippedLayers []builder.LayerDiagnostic `json:"skippedLayers,omitempty"`
+	Timings       timings                   `json:"timings,omitempty"`
+	// descriptor of the pushed SOCI index, nil if none was pushed
+	indexDescriptor *ocispec.Descriptor
+}
+
+// Durations of the phases of a build, in the order they ran
+type timings []timing
+
+type timing struct {
+	Phase      string `json:"phase"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Record the duration of a phase that started at start
+func (t *timings) since(phase string, start time.Time) {
+	t.add(phase, time.Since(start))
+}
+
+func (t *timings) add(phase string, duration time.Duration) {
+	*t = append(*t, timing{Phase: phase, DurationMs: duration.Milliseconds()})
+}
+
+func (t timings) String() string {
+	var phases []string
+	for _, timing := range t {
+		phases = append(phases, fmt.Sprintf("%s %s", timing.Phase, time.Duration(timing.DurationMs)*time.Millisecond))
+	}
+	return strings.Join(phases, ", ")
+}
+
+// Log and return a build error that ended the build before any platform was built
+func resultError(ctx context.Context, msg string, err error) (*buildResult, error) {
+	msg, err = cancellation(ctx, msg, err)
+	log.Error(ctx, msg, err)
+	return &buildResult{Message: msg}, err
+}
+
+// Log and record the error of a platform
+func (r platformResult) failed(ctx context.Context, msg string, err error) (platformResult, error) {
+	msg, err = cancellation(ctx, msg, err)
+	log.Error(ctx, msg, err)
+	r.Message = msg
+	r.Error = err.Error()
+	return r, err
+}
+
+// A stage interrupted by the cancelled context failed because the build was cancelled or reached
+// its deadline margin, its own error only tells where it was interrupted
+func cancellation(ctx context.Context, msg string, err error) (string, error) {
+	if cancelErr := builder.Cancelled(ctx); cancelErr != nil {
+		if errors.Is(cancelErr, ErrBuildDeadline) {
+			return DeadlineMessage, cancelErr
+		}
+		return CancelledMessage, cancelErr
+	}
+	return msg, err
+}
+
+// Summarize the outcomes of all platforms into the message of the build
+func summarizePlatforms(results []platformResult) string {
+	if len(results) == 1 {
+		return results[0].Message
+	}
+
+	messages := map[string]bool{}
+	for _, result := range results {
+		if result.Error != "" {
+			return PlatformsFailedMessage
+		}
+		messages[result.Message] = true
+	}
+	for _, message := range []string{BuildAndPushSuccessMessage, SkipPushOnNoPushMessage} {
+		if messages[message] {
+			return message
+		}
+	}
+	return SkipPushOnEmptyIndexMessage
+}
+
+// Digests of the SOCI indices built for all platforms
+func (r *buildResult) indexDigests() []string {
+	var digests []string
+	for _, platform := range r.Platforms {
+		if platform.IndexDigest != "" {
+			digests = append(digests, platform.IndexDigest)
+		}
+	}
+	return digests
+}
+
+// The descriptors of the pushed SOCI indices, one per platform
+func (r *buildResult) indexDescriptors() []ocispec.Descriptor {
+	var descriptors []ocispec.Descriptor
+	for _, platform := range r.Platforms {
+		if platform.indexDescriptor != nil {
+			descriptors = append(descriptors, *platform.indexDescriptor)
+		}
+	}
+	return descriptors
+}
+
+// Drop the timings of the result, they are only reported when requested
+func (r *buildResult) stripTimings() {
+	r.Timings = nil
+	for i := range r.Platforms {
+		r.Platforms[i].Timings = nil
+	}
+}
+
+// Format the result for the given output format, text or json
+func (r *buildResult) format(output string) (string, error) {
+	if output == "json" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		return string(out), err
+	}
+
+	lines := []string{r.Message}
+	if r.LazyLoading != "" {
+		lines = append(lines, "  layers are already lazily loadable as "+r.LazyLoading)
+	}
+	if len(r.Platforms) == 1 && r.Platforms[0].Savings != nil {
+		lines = append(lines, "  "+formatSavings(r.Platforms[0].Savings))
+	}
+	if len(r.Platforms) == 1 {
+		lines = append(lines, formatSkippedLayers(r.Platforms[0].SkippedLayers, "  ")...)
+	}
+	if r.Estargz != nil {
+		lines = append(lines, fmt.Sprintf("  eStargz image %s tagged %s", r.Estargz.ImageDigest, r.Estargz.Tag))
+	}
+	if len(r.Timings) > 0 {
+		lines = append(lines, "  timings: "+r.Timings.String())
+	}
+	if len(r.Platforms) == 1 && len(r.Platforms[0].Timings) > 0 {
+		lines = append(lines, "  timings: "+r.Platforms[0].Timings.String())
+	}
+	if len(r.Platforms) > 1 {
+		for _, platform := range r.Platforms {
+			line := fmt.Sprintf("  %s: %s", platform.Platform, platform.Message)
+			if platform.IndexDigest != "" {
+				line += " " + platform.IndexDigest
+			}
+			if platform.Error != "" {
+				line += ": " + platform.Error
+			}
+			if platform.Savings != nil {
+				line += ", " + formatSavings(platform.Savings)
+			}
+			if len(platform.Timings) > 0 {
+				line += ", timings: " + platform.Timings.String()
+			}
+			lines = append(lines, line)
+			lines = append(lines, formatSkippedLayers(platform.SkippedLayers, "    ")...)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func formatSavings(savings *builder.Savings) string {
+	return fmt.Sprintf("lazily loaded %s of %s (%.1f%%), %d of %d layers",
+		size.Format(savings.DeferredSize), size.Format(savings.ImageSize), savings.CoveragePercent, savings.DeferredLayers, savings.Layers)
+}
+
+// One line per layer that wasn't indexed because of its format
+func formatSkippedLayers(layers []builder.LayerDiagnostic, indent string) []string {
+	var lines []string
+	for _, layer := range layers {
+		line := fmt.Sprintf("%sskipped layer %s (%s, %s): %s", indent, layer.Digest, layer.MediaType, size.Format(layer.Size), layer.Reason)
+		if layer.DetectedFormat != "" {
+			line += ", detected " + layer.DetectedFormat
+		}
+		if layer.Error != "" {
+			line += ": " + layer.Error
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
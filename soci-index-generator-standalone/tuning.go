@@ -0,0 +1,136 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+)
+
+const (
+	// share of the indexable image bytes the suggested min-layer-size keeps indexed
+	suggestedCoverage = 0.9
+	// the suggested span size splits a typical indexed layer into about this many spans
+	spansPerLayer = 16
+	// bounds of the suggested span size, smaller spans mean more checkpoints and larger ones longer fetches
+	minSuggestedSpanSize = 1 << 20
+	maxSuggestedSpanSize = 16 << 20
+	// width of the longest bar of the text histogram
+	histogramWidth = 40
+)
+
+// Upper bounds of the histogram buckets, the last bucket holds all larger layers
+var bucketBounds = []int64{1 << 20, 10 << 20, 50 << 20, 100 << 20, 500 << 20, 1 << 30}
+
+// The layers of an image in a range of sizes
+type sizeBucket struct {
+	// layers of at least Min and less than Max bytes, Max is 0 for the last bucket
+	Min    int64 `json:"min"`
+	Max    int64 `json:"max,omitempty"`
+	Layers int   `json:"layers"`
+	Size   int64 `json:"size"`
+}
+
+// Thresholds suggested for an image from the sizes of its layers
+type tuningSuggestion struct {
+	MinLayerSize int64 `json:"minLayerSize"`
+	SpanSize     int64 `json:"spanSize"`
+	// share of the image bytes indexed with the suggested min-layer-size
+	CoveragePercent float64 `json:"coveragePercent"`
+}
+
+// Count the layers and their bytes in each size bucket
+func layerHistogram(layerSizes []int64) []sizeBucket {
+	buckets := make([]sizeBucket, len(bucketBounds)+1)
+	for i := range buckets {
+		if i > 0 {
+			buckets[i].Min = bucketBounds[i-1]
+		}
+		if i < len(bucketBounds) {
+			buckets[i].Max = bucketBounds[i]
+		}
+	}
+	for _, layerSize := range layerSizes {
+		i, _ := slices.BinarySearch(bucketBounds, layerSize+1)
+		buckets[i].Layers++
+		buckets[i].Size += layerSize
+	}
+	return buckets
+}
+
+// Suggest a min-layer-size that still indexes the largest layers making up most of the image and the span size
+// for the size of a typical indexed layer. Small layers are cheap to download before the container starts, lazily
+// loading them only adds ztocs to the index. Returns nil if no layer can be indexed.
+func suggestTuning(indexableSizes []int64, imageSize int64) *tuningSuggestion {
+	if len(indexableSizes) == 0 || imageSize == 0 {
+		return nil
+	}
+	sizes := slices.Clone(indexableSizes)
+	slices.SortFunc(sizes, func(a, b int64) int { return cmp.Compare(b, a) })
+	var total int64
+	for _, layerSize := range sizes {
+		total += layerSize
+	}
+
+	// the smallest layer needed to index suggestedCoverage of the indexable bytes, from the largest layer down
+	var covered int64
+	var indexed []int64
+	for _, layerSize := range sizes {
+		indexed = append(indexed, layerSize)
+		covered += layerSize
+		if float64(covered) >= suggestedCoverage*float64(total) {
+			break
+		}
+	}
+	minLayerSize := floorPowerOfTwo(indexed[len(indexed)-1])
+	// layers between the power of two and the smallest needed layer are indexed as well
+	covered = 0
+	for _, layerSize := range sizes {
+		if layerSize >= minLayerSize {
+			covered += layerSize
+		}
+	}
+
+	median := indexed[len(indexed)/2]
+	spanSize := min(max(floorPowerOfTwo(median/spansPerLayer), minSuggestedSpanSize), maxSuggestedSpanSize)
+	return &tuningSuggestion{
+		MinLayerSize:    minLayerSize,
+		SpanSize:        spanSize,
+		CoveragePercent: float64(covered) / float64(imageSize) * 100,
+	}
+}
+
+// The largest power of two not above n, 1 for n below 1
+func floorPowerOfTwo(n int64) int64 {
+	if n < 1 {
+		return 1
+	}
+	return 1 << (63 - bits.LeadingZeros64(uint64(n)))
+}
+
+// Format the histogram as lines of text with a bar for the layer count of each non-empty bucket
+func formatHistogram(buckets []sizeBucket, indent string) []string {
+	largest := 0
+	for _, bucket := range buckets {
+		largest = max(largest, bucket.Layers)
+	}
+	var lines []string
+	for _, bucket := range buckets {
+		if bucket.Layers == 0 {
+			continue
+		}
+		bounds := fmt.Sprintf(">= %s", size.Format(bucket.Min))
+		if bucket.Max > 0 {
+			bounds = fmt.Sprintf("< %s", size.Format(bucket.Max))
+		}
+		bar := strings.Repeat("#", max(1, bucket.Layers*histogramWidth/largest))
+		lines = append(lines, fmt.Sprintf("%s%-10s %3d layers %10s %s", indent, bounds, bucket.Layers, size.Format(bucket.Size), bar))
+	}
+	return lines
+}
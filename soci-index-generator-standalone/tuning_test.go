@@ -0,0 +1,43 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+)
+
+func TestLayerHistogram(t *testing.T) {
+	buckets := layerHistogram([]int64{100, 1 << 20, 20 << 20, 30 << 20, 2 << 30})
+	expected := map[int64]int{0: 1, 1 << 20: 1, 10 << 20: 2, 1 << 30: 1}
+	for _, bucket := range buckets {
+		if bucket.Layers != expected[bucket.Min] {
+			t.Fatalf("Unexpected number of layers in bucket %+v, expected %d", bucket, expected[bucket.Min])
+		}
+	}
+	if buckets[2].Size != 50<<20 || buckets[len(buckets)-1].Max != 0 {
+		t.Fatalf("Unexpected buckets %+v", buckets)
+	}
+}
+
+func TestSuggestTuning(t *testing.T) {
+	// two large layers make up most of the image, the small ones aren't worth indexing
+	suggestion := suggestTuning([]int64{300 << 20, 100 << 20, 5 << 20, 2 << 20, 1 << 20}, 420<<20)
+	if suggestion == nil || suggestion.MinLayerSize != 64<<20 {
+		t.Fatalf("Unexpected suggestion %+v, expected -min-layer-size 64MiB", suggestion)
+	}
+	if suggestion.SpanSize != 4<<20 {
+		t.Fatalf("Unexpected span size %d, expected 4MiB", suggestion.SpanSize)
+	}
+	if suggestion.CoveragePercent < 95 || suggestion.CoveragePercent > 96 {
+		t.Fatalf("Unexpected coverage %.1f%%", suggestion.CoveragePercent)
+	}
+
+	suggestion = suggestTuning([]int64{8 << 20}, 8<<20)
+	if suggestion.MinLayerSize != 8<<20 || suggestion.SpanSize != 1<<20 || suggestion.CoveragePercent != 100 {
+		t.Fatalf("Unexpected suggestion for a single small layer %+v", suggestion)
+	}
+	if suggestTuning(nil, 1<<20) != nil {
+		t.Fatalf("Expected no suggestion without indexable layers")
+	}
+}
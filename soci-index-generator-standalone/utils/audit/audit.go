@@ -0,0 +1,44 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package audit keeps an append-only record of the SOCI artifacts pushed to registries.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Entry records a single push of a SOCI index
+type Entry struct {
+	Time time.Time `json:"time"`
+	// who pushed, e.g. user@host or a pipeline identity
+	Actor string `json:"actor"`
+	// what triggered the push, e.g. the command line or a CI job URL
+	Trigger     string `json:"trigger"`
+	Registry    string `json:"registry"`
+	Repository  string `json:"repository"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// the exact descriptor of the pushed SOCI index
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+}
+
+// Log appends entries to an audit log
+type Log interface {
+	Append(ctx context.Context, entry Entry) error
+}
+
+// DefaultActor identifies the local user and host running the tool
+func DefaultActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s", name, host)
+}
@@ -0,0 +1,71 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB backed audit log.
+// The table must have a string partition key "IndexDigest" and a string sort key "PushedAt".
+// Items are only ever put if they don't exist yet, so existing entries are never overwritten.
+type DynamoDBLog struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+type dynamoDBItem struct {
+	IndexDigest string
+	PushedAt    string
+	Actor       string
+	Trigger     string
+	Registry    string
+	Repository  string
+	ImageDigest string `dynamodbav:",omitempty"`
+	// the descriptor JSON exactly as pushed
+	Descriptor string
+}
+
+// Create an audit log using the given DynamoDB table
+func NewDynamoDBLog(tableName string) *DynamoDBLog {
+	return &DynamoDBLog{
+		client:    dynamodb.New(session.New()),
+		tableName: tableName,
+	}
+}
+
+func (l *DynamoDBLog) Append(ctx context.Context, entry Entry) error {
+	descriptor, err := json.Marshal(entry.Descriptor)
+	if err != nil {
+		return err
+	}
+	item, err := dynamodbattribute.MarshalMap(dynamoDBItem{
+		IndexDigest: entry.Descriptor.Digest.String(),
+		PushedAt:    entry.Time.UTC().Format(time.RFC3339Nano),
+		Actor:       entry.Actor,
+		Trigger:     entry.Trigger,
+		Registry:    entry.Registry,
+		Repository:  entry.Repository,
+		ImageDigest: entry.ImageDigest,
+		Descriptor:  string(descriptor),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(l.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(IndexDigest)"),
+	})
+	return err
+}
@@ -0,0 +1,613 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package builder builds SOCI indices layer by layer.
+// It mirrors soci.IndexBuilder, but gives control over each layer's ztoc build (e.g. timeouts).
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+)
+
+// DefaultSpanSize is the span size of the ztocs unless WithSpanSize sets another
+const DefaultSpanSize = int64(1 << 22) // 4MiB
+
+const (
+	defaultMinLayerSize        = 10 << 20 // 10MiB
+	defaultBuildToolIdentifier = "AWS SOCI CLI v0.1"
+
+	// whiteoutOpaqueDir is a special file that indicates that a directory is opaque
+	whiteoutOpaqueDir = ".wh..wh..opq"
+	disableXAttrsTrue = "true"
+)
+
+var (
+	errUnsupportedLayerFormat = errors.New("unsupported layer format")
+	ErrZtocTimeout            = errors.New("timed out building ztoc")
+	// ErrCancelled is returned when the context is cancelled or its deadline passes during a build
+	ErrCancelled = errors.New("SOCI index build cancelled")
+)
+
+// Cancelled returns ErrCancelled wrapping the cause of the cancelled context, nil if it isn't done
+func Cancelled(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrCancelled, context.Cause(ctx))
+}
+
+type config struct {
+	spanSize     int64
+	minLayerSize int64
+	platform     ocispec.Platform
+	ztocTimeout  time.Duration
+	tempDir      string
+	verifyLayers bool
+	ztocCache    cache.Cache
+	// downloads a layer that wasn't pulled because its ztoc is cached, when the cached ztoc can't be used
+	fetchLayer func(ctx context.Context, desc ocispec.Descriptor) error
+	progress   ProgressReporter
+	// workers decompressing and hashing a gzip layer while its ztoc is built
+	decompressWorkers int
+	// annotations added to the SOCI index
+	annotations map[string]string
+	// what happens to layers whose ztoc can't be built, LayerErrorSkip, LayerErrorFail or empty
+	onLayerError string
+}
+
+// Option specifies a config change of the builder
+type Option func(c *config)
+
+// WithSpanSize specifies the span size of the ztocs, 0 keeps the default span size
+func WithSpanSize(spanSize int64) Option {
+	return func(c *config) {
+		if spanSize > 0 {
+			c.spanSize = spanSize
+		}
+	}
+}
+
+// WithMinLayerSize specifies the minimum layer size to build a ztoc for a layer
+func WithMinLayerSize(minLayerSize int64) Option {
+	return func(c *config) {
+		c.minLayerSize = minLayerSize
+	}
+}
+
+// WithPlatform specifies the platform of the image manifest to build the index for
+func WithPlatform(platform ocispec.Platform) Option {
+	return func(c *config) {
+		c.platform = platform
+	}
+}
+
+// WithZtocTimeout limits how long building the ztoc of a single layer may take, 0 means no limit
+func WithZtocTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.ztocTimeout = timeout
+	}
+}
+
+// WithTempDir specifies the directory for temporary copies of the layers, the default temp dir if empty
+func WithTempDir(tempDir string) Option {
+	return func(c *config) {
+		c.tempDir = tempDir
+	}
+}
+
+// WithLayerVerification verifies the digest of each layer while it's read from the content store
+func WithLayerVerification(verify bool) Option {
+	return func(c *config) {
+		c.verifyLayers = verify
+	}
+}
+
+// WithZtocCache reuses the ztocs of layers found in the cache instead of building them, and caches built ztocs
+func WithZtocCache(ztocCache cache.Cache) Option {
+	return func(c *config) {
+		c.ztocCache = ztocCache
+	}
+}
+
+// WithLayerFetcher downloads missing layers to the content store with fetch before their ztocs are built,
+// e.g. layers that weren't pulled because their ztocs are cached, if the cached ztocs turn out to be unusable
+func WithLayerFetcher(fetch func(ctx context.Context, desc ocispec.Descriptor) error) Option {
+	return func(c *config) {
+		c.fetchLayer = fetch
+	}
+}
+
+// WithDecompressWorkers builds the ztoc of each gzip layer with several workers, 1 or less uses the library's ztoc builder
+func WithDecompressWorkers(workers int) Option {
+	return func(c *config) {
+		c.decompressWorkers = workers
+	}
+}
+
+// WithAnnotations adds annotations to the built SOCI indices, the build tool identifier can't be overridden
+func WithAnnotations(annotations map[string]string) Option {
+	return func(c *config) {
+		c.annotations = annotations
+	}
+}
+
+// WithLayerErrorPolicy specifies what happens to layers whose ztoc can't be built. By default (empty) layers
+// of unsupported formats are skipped and other errors fail the build, LayerErrorSkip skips both and
+// LayerErrorFail fails for both. Skipped layers are reported by Diagnostics.
+func WithLayerErrorPolicy(policy string) Option {
+	return func(c *config) {
+		c.onLayerError = policy
+	}
+}
+
+// Builder creates SOCI indices
+type Builder struct {
+	contentStore content.Store
+	blobStore    orascontent.Storage
+	config       *config
+	ztocBuilder  *ztoc.Builder
+	// total time spent hashing layers to verify their digests, in nanoseconds
+	verifyNanos atomic.Int64
+	// layers of the last build skipped because of their format, in the order of the image layers
+	diagnostics []LayerDiagnostic
+	// ztoc builds still running, including those the build stopped waiting for
+	ztocBuilds sync.WaitGroup
+}
+
+// Wait returns when the ztoc builds the builder stopped waiting for, because of the ztoc timeout or the cancelled
+// context of the build, have finished and removed their layer files. It returns the context's error if it's done first.
+func (b *Builder) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		b.ztocBuilds.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// VerifyDuration returns the total time spent verifying layer digests, summed over all layers built in parallel
+func (b *Builder) VerifyDuration() time.Duration {
+	return time.Duration(b.verifyNanos.Load())
+}
+
+// Diagnostics returns the layers of the last build that weren't indexed because of their format,
+// e.g. layers compressed with an unsupported algorithm or whose content doesn't match their media type,
+// or because building their ztoc failed with the LayerErrorSkip policy
+func (b *Builder) Diagnostics() []LayerDiagnostic {
+	return b.diagnostics
+}
+
+// Create a builder reading image content from contentStore and writing ztocs to blobStore
+func New(contentStore content.Store, blobStore orascontent.Storage, opts ...Option) *Builder {
+	cfg := &config{
+		spanSize:     DefaultSpanSize,
+		minLayerSize: defaultMinLayerSize,
+		platform:     platforms.DefaultSpec(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &Builder{
+		contentStore: contentStore,
+		blobStore:    blobStore,
+		config:       cfg,
+		ztocBuilder:  ztoc.NewBuilder(defaultBuildToolIdentifier),
+	}
+}
+
+// The number of layers whose ztocs are built at a time, so that the workers of all of them use about GOMAXPROCS CPUs
+func (b *Builder) layerConcurrency() int {
+	return max(1, runtime.GOMAXPROCS(0)/max(1, b.config.decompressWorkers))
+}
+
+// Build a SOCI index for an image
+func (b *Builder) Build(ctx context.Context, image images.Image) (*soci.IndexWithMetadata, error) {
+	// get the manifest descriptor before calling images.Manifest, see soci.IndexBuilder.Build
+	manifestDesc, err := soci.GetImageManifestDescriptor(ctx, b.contentStore, image.Target, platforms.OnlyStrict(b.config.platform))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := images.Manifest(ctx, b.contentStore, image.Target, platforms.OnlyStrict(b.config.platform))
+	if err != nil {
+		return nil, err
+	}
+
+	// build a ztoc for each layer, index layers are kept in the order of image layers
+	ztocDescs := make([]*ocispec.Descriptor, len(manifest.Layers))
+	diagnostics := make([]*LayerDiagnostic, len(manifest.Layers))
+	errs := make([]error, len(manifest.Layers))
+	// the errors are kept by layer, the group only limits how many layers are built at a time
+	var layers errgroup.Group
+	layers.SetLimit(b.layerConcurrency())
+	for i, layer := range manifest.Layers {
+		layers.Go(func() error {
+			ztocDescs[i], diagnostics[i], errs[i] = b.buildLayer(ctx, layer)
+			return nil
+		})
+	}
+	layers.Wait()
+
+	if cancelErr := Cancelled(ctx); cancelErr != nil {
+		// the errors of the layers only tell where each of them was interrupted
+		return nil, cancelErr
+	}
+	err = nil
+	for i, layerErr := range errs {
+		switch {
+		case layerErr == nil:
+		case layerErr == errUnsupportedLayerFormat:
+			if b.config.onLayerError == LayerErrorFail {
+				err = errors.Join(err, fmt.Errorf("layer %s: %s", manifest.Layers[i].Digest, diagnostics[i].Reason))
+			}
+		case b.config.onLayerError == LayerErrorSkip:
+			log.Warn(ctx, fmt.Sprintf("Skipping ztoc of layer %s: %v", manifest.Layers[i].Digest, layerErr))
+			diagnostics[i] = newLayerDiagnostic(manifest.Layers[i], "", SkipReasonError)
+			diagnostics[i].Error = layerErr.Error()
+		default:
+			err = errors.Join(err, layerErr)
+		}
+	}
+
+	b.diagnostics = nil
+	for _, diagnostic := range diagnostics {
+		if diagnostic != nil {
+			b.diagnostics = append(b.diagnostics, *diagnostic)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("errors encountered while building soci layers: %w", err)
+	}
+
+	var blobs []ocispec.Descriptor
+	for _, desc := range ztocDescs {
+		if desc != nil {
+			blobs = append(blobs, *desc)
+		}
+	}
+	if len(blobs) == 0 {
+		return nil, soci.ErrEmptyIndex
+	}
+
+	annotations := map[string]string{}
+	for key, value := range b.config.annotations {
+		annotations[key] = value
+	}
+	annotations[soci.IndexAnnotationBuildToolIdentifier] = defaultBuildToolIdentifier
+	subject := &ocispec.Descriptor{
+		MediaType: manifestDesc.MediaType,
+		Digest:    manifestDesc.Digest,
+		Size:      manifestDesc.Size,
+	}
+
+	return &soci.IndexWithMetadata{
+		Index:       soci.NewIndex(blobs, subject, annotations),
+		Platform:    &b.config.platform,
+		ImageDigest: image.Target.Digest,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// Reasons why no ztoc is built for a layer
+const (
+	SkipReasonNotLayer               = "not a layer"
+	SkipReasonTooSmall               = "smaller than min-layer-size"
+	SkipReasonUnsupportedCompression = "unsupported compression"
+	SkipReasonFormatMismatch         = "content doesn't match the media type"
+	SkipReasonError                  = "failed to build the ztoc"
+)
+
+// Policies for layers whose ztoc can't be built, see WithLayerErrorPolicy
+const (
+	// skip layers that fail to build, e.g. corrupt or unreadable ones, like layers of unsupported formats
+	LayerErrorSkip = "skip"
+	// fail the build for layers that fail to build and for layers of unsupported formats
+	LayerErrorFail = "fail"
+)
+
+// CheckLayer checks whether a ztoc would be built for a layer without reading it.
+// Returns the compression of the layer, and the reason if the layer is skipped.
+func (b *Builder) CheckLayer(ctx context.Context, desc ocispec.Descriptor) (compressionAlgo string, skipReason string, err error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return "", SkipReasonNotLayer, nil
+	}
+	if desc.Size < b.config.minLayerSize {
+		return "", SkipReasonTooSmall, nil
+	}
+
+	compressionAlgo, err = images.DiffCompression(ctx, desc.MediaType)
+	if err != nil {
+		return "", "", fmt.Errorf("could not determine layer compression: %w", err)
+	}
+	if compressionAlgo == "" && desc.MediaType == ocispec.MediaTypeImageLayer {
+		// for OCI image layers, empty is returned for an uncompressed layer
+		compressionAlgo = compression.Uncompressed
+	}
+	if !b.ztocBuilder.CheckCompressionAlgorithm(compressionAlgo) {
+		return compressionAlgo, SkipReasonUnsupportedCompression, nil
+	}
+	return compressionAlgo, "", nil
+}
+
+// SpanSize returns the span size the ztocs are built with
+func (b *Builder) SpanSize() int64 {
+	return b.config.spanSize
+}
+
+// Build the ztoc of a layer and push it to the blob store.
+// Returns nil if the layer is skipped (e.g. smaller than the minimum layer size),
+// with a diagnostic if it is skipped because of its format.
+func (b *Builder) buildLayer(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, *LayerDiagnostic, error) {
+	ctx = context.WithValue(ctx, "LayerDigest", desc.Digest.String())
+	compressionAlgo, skipReason, err := b.CheckLayer(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if skipReason != "" {
+		b.report(StageLayerSkipped, desc.Digest, 0, desc.Size)
+	}
+	switch skipReason {
+	case SkipReasonNotLayer:
+		return nil, nil, nil
+	case SkipReasonTooSmall:
+		log.Info(ctx, fmt.Sprintf("Skipping ztoc, layer size %s is less than min-layer-size %s", size.Format(desc.Size), size.Format(b.config.minLayerSize)))
+		return nil, nil, nil
+	case SkipReasonUnsupportedCompression:
+		detectedFormat := b.sniffFormat(ctx, desc)
+		log.Warn(ctx, fmt.Sprintf("Skipping ztoc, layer media type %s is compressed in an unsupported format %q, detected format %q", desc.MediaType, compressionAlgo, detectedFormat))
+		return nil, newLayerDiagnostic(desc, detectedFormat, skipReason), errUnsupportedLayerFormat
+	}
+
+	toc, ztocBytes := b.cachedZtoc(ctx, desc)
+	if toc == nil {
+		err = b.fetchMissingLayer(ctx, desc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if detectedFormat := b.sniffFormat(ctx, desc); detectedFormat != "" && formatMismatch(compressionAlgo, detectedFormat) {
+			b.report(StageLayerSkipped, desc.Digest, 0, desc.Size)
+			log.Warn(ctx, fmt.Sprintf("Skipping ztoc, layer media type %s says %s but its content is %s", desc.MediaType, compressionAlgo, detectedFormat))
+			return nil, newLayerDiagnostic(desc, detectedFormat, SkipReasonFormatMismatch), errUnsupportedLayerFormat
+		}
+		toc, ztocBytes, err = b.buildLayerZtoc(ctx, desc, compressionAlgo)
+		if err != nil {
+			return nil, nil, err
+		}
+		b.cacheZtoc(ctx, desc, ztocBytes)
+	}
+	b.report(StageLayerDone, desc.Digest, desc.Size, desc.Size)
+
+	ztocDesc := ocispec.Descriptor{
+		MediaType: soci.SociLayerMediaType,
+		Digest:    digest.FromBytes(ztocBytes),
+		Size:      int64(len(ztocBytes)),
+	}
+	err = b.blobStore.Push(ctx, ztocDesc, bytes.NewReader(ztocBytes))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return nil, nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
+	}
+
+	ztocDesc.Annotations = map[string]string{
+		soci.IndexAnnotationImageLayerMediaType: desc.MediaType,
+		soci.IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	}
+	if shouldDisableXattrs(toc) {
+		ztocDesc.Annotations[soci.IndexAnnotationDisableXAttrs] = disableXAttrsTrue
+	}
+	return &ztocDesc, nil, nil
+}
+
+// Build the ztoc of a layer, returning it together with its serialized form
+func (b *Builder) buildLayerZtoc(ctx context.Context, desc ocispec.Descriptor, compressionAlgo string) (*ztoc.Ztoc, []byte, error) {
+	layerFile, err := b.copyLayer(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.report(StageBuildingZtoc, desc.Digest, 0, desc.Size)
+	toc, err := b.buildZtoc(ctx, layerFile, compressionAlgo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("layer %s: %w", desc.Digest, err)
+	}
+
+	ztocReader, _, err := ztoc.Marshal(toc)
+	if err != nil {
+		return nil, nil, err
+	}
+	ztocBytes, err := io.ReadAll(ztocReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info(ctx, fmt.Sprintf("Built ztoc %s", digest.FromBytes(ztocBytes)))
+	return toc, ztocBytes, nil
+}
+
+// Get the ztoc of a layer from the cache, nil if there is no cache or it isn't cached.
+// Cache errors are logged and not returned, the ztoc is built instead, see fetchMissingLayer.
+func (b *Builder) cachedZtoc(ctx context.Context, desc ocispec.Descriptor) (*ztoc.Ztoc, []byte) {
+	if b.config.ztocCache == nil {
+		return nil, nil
+	}
+	ztocBytes, err := b.config.ztocCache.Get(ctx, cache.Key{LayerDigest: desc.Digest, SpanSize: b.config.spanSize})
+	if err != nil {
+		if !errors.Is(err, cache.ErrNotFound) {
+			log.Warn(ctx, fmt.Sprintf("Couldn't read the ztoc cache: %v", err))
+		}
+		return nil, nil
+	}
+	toc, err := ztoc.Unmarshal(bytes.NewReader(ztocBytes))
+	if err != nil || toc.CompressedArchiveSize != compression.Offset(desc.Size) {
+		log.Warn(ctx, "Ignoring invalid ztoc in the cache")
+		return nil, nil
+	}
+	log.Info(ctx, fmt.Sprintf("Reusing cached ztoc %s", digest.FromBytes(ztocBytes)))
+	return toc, ztocBytes
+}
+
+// Download a layer missing from the content store, if there is a layer fetcher.
+// Layers whose ztocs are cached may not be pulled, they are needed if their cached ztoc can't be used.
+func (b *Builder) fetchMissingLayer(ctx context.Context, desc ocispec.Descriptor) error {
+	if b.config.fetchLayer == nil {
+		return nil
+	}
+	_, err := b.contentStore.Info(ctx, desc.Digest)
+	if !errdefs.IsNotFound(err) {
+		return err
+	}
+	log.Info(ctx, fmt.Sprintf("Downloading layer %s, its cached ztoc can't be used", desc.Digest))
+	err = b.config.fetchLayer(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// Store the ztoc of a layer in the cache, if there is one
+func (b *Builder) cacheZtoc(ctx context.Context, desc ocispec.Descriptor, ztocBytes []byte) {
+	if b.config.ztocCache == nil {
+		return
+	}
+	err := b.config.ztocCache.Put(ctx, cache.Key{LayerDigest: desc.Digest, SpanSize: b.config.spanSize}, ztocBytes)
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't write the ztoc to the cache: %v", err))
+	}
+}
+
+// Copy a layer from the content store to a temporary file, the ztoc builder works on files
+func (b *Builder) copyLayer(ctx context.Context, desc ocispec.Descriptor) (string, error) {
+	ra, err := b.contentStore.ReaderAt(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	defer ra.Close()
+
+	tmpFile, err := os.CreateTemp(b.config.tempDir, "layer.*")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	var layerReader io.Reader = &contextReader{ctx: ctx, r: io.NewSectionReader(ra, 0, desc.Size)}
+	var digester digest.Digester
+	if b.config.verifyLayers {
+		digester = desc.Digest.Algorithm().Digester()
+		layerReader = io.TeeReader(layerReader, &timedWriter{w: digester.Hash(), nanos: &b.verifyNanos})
+	}
+
+	var layerWriter io.Writer = tmpFile
+	if b.config.progress != nil {
+		layerWriter = &progressWriter{w: tmpFile, builder: b, layerDigest: desc.Digest, total: desc.Size}
+	}
+	n, err := io.Copy(layerWriter, layerReader)
+	if err == nil && n != desc.Size {
+		err = errors.New("the size of the temp file doesn't match that of the layer")
+	}
+	if err == nil && digester != nil && digester.Digest() != desc.Digest {
+		err = fmt.Errorf("layer digest mismatch, expected %s but got %s", desc.Digest, digester.Digest())
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// Build the ztoc of a layer file within the configured timeout, or until the context is cancelled.
+// The layer file is removed when the ztoc builder is done with it, which may be after this returns, see Wait.
+func (b *Builder) buildZtoc(ctx context.Context, layerFile string, compressionAlgo string) (*ztoc.Ztoc, error) {
+	type result struct {
+		toc *ztoc.Ztoc
+		err error
+	}
+	done := make(chan result, 1)
+	b.ztocBuilds.Add(1)
+	go func() {
+		defer b.ztocBuilds.Done()
+		toc, err := b.buildZtocFile(layerFile, compressionAlgo)
+		os.Remove(layerFile)
+		done <- result{toc, err}
+	}()
+
+	var timeout <-chan time.Time
+	if b.config.ztocTimeout > 0 {
+		timer := time.NewTimer(b.config.ztocTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	// the ztoc builder can't be interrupted, its result is discarded when it finishes
+	select {
+	case r := <-done:
+		return r.toc, r.err
+	case <-timeout:
+		return nil, fmt.Errorf("%w after %s", ErrZtocTimeout, b.config.ztocTimeout)
+	case <-ctx.Done():
+		return nil, Cancelled(ctx)
+	}
+}
+
+// Layers without extended attributes or opaque directories can be mounted with xattrs disabled
+func shouldDisableXattrs(toc *ztoc.Ztoc) bool {
+	for _, md := range toc.TOC.FileMetadata {
+		if len(md.Xattrs()) > 0 || strings.HasSuffix(md.Name, whiteoutOpaqueDir) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reader failing as soon as its context is done, so copying a layer stops mid-layer
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := Cancelled(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Writer adding the time spent in its writes to a counter
+type timedWriter struct {
+	w     io.Writer
+	nanos *atomic.Int64
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.nanos.Add(int64(time.Since(start)))
+	return n, err
+}
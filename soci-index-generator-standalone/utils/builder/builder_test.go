@@ -0,0 +1,338 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	mathrand "math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/cache"
+)
+
+// Write a single platform image with one gzip layer per given file content to a content store
+func writeTestImage(t *testing.T, contentStore content.Store, files ...[]byte) images.Image {
+	ctx := context.Background()
+	write := func(mediaType string, blob []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+		if err := content.WriteBlob(ctx, contentStore, desc.Digest.String(), bytes.NewReader(blob), desc); err != nil {
+			t.Fatalf("Failed to write blob: %v", err)
+		}
+		return desc
+	}
+
+	var layers []ocispec.Descriptor
+	for _, file := range files {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(file))})
+		tw.Write(file)
+		tw.Close()
+		gz.Close()
+		layers = append(layers, write(ocispec.MediaTypeImageLayerGzip, buf.Bytes()))
+	}
+
+	platform := platforms.DefaultSpec()
+	config, _ := json.Marshal(ocispec.Image{Platform: platform})
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    write(ocispec.MediaTypeImageConfig, config),
+		Layers:    layers,
+	})
+	return images.Image{Name: "test", Target: write(ocispec.MediaTypeImageManifest, manifest)}
+}
+
+// Write a copy of the image with another layer of the given media type and content
+func appendTestLayer(t *testing.T, contentStore content.Store, image images.Image, mediaType string, blob []byte) images.Image {
+	ctx := context.Background()
+	manifest, err := images.Manifest(ctx, contentStore, image.Target, nil)
+	if err != nil {
+		t.Fatalf("Failed to read the image manifest: %v", err)
+	}
+	layer := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	if err := content.WriteBlob(ctx, contentStore, layer.Digest.String(), bytes.NewReader(blob), layer); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	manifest.Layers = append(manifest.Layers, layer)
+	manifestBytes, _ := json.Marshal(manifest)
+	image.Target = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifestBytes), Size: int64(len(manifestBytes))}
+	if err := content.WriteBlob(ctx, contentStore, image.Target.Digest.String(), bytes.NewReader(manifestBytes), image.Target); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	return image
+}
+
+func newTestBuilder(t *testing.T, opts ...Option) (*Builder, content.Store) {
+	storeDir := t.TempDir()
+	contentStore, err := local.NewStore(storeDir)
+	if err != nil {
+		t.Fatalf("Failed to create content store: %v", err)
+	}
+	blobStore, err := oci.New(storeDir)
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	return New(contentStore, blobStore, append([]Option{WithTempDir(t.TempDir())}, opts...)...), contentStore
+}
+
+func TestBuild(t *testing.T) {
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithLayerVerification(true))
+	// the first layer is large enough to be indexed, the second one is skipped
+	image := writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024), []byte("small"))
+
+	index, err := builder.Build(context.Background(), image)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if len(index.Index.Blobs) != 1 {
+		t.Fatalf("Expected one ztoc in the index but got %d", len(index.Index.Blobs))
+	}
+	if index.Index.Subject.Digest != image.Target.Digest {
+		t.Fatalf("Unexpected subject. Expected %s but got %s", image.Target.Digest, index.Index.Subject.Digest)
+	}
+	if index.Index.Blobs[0].Annotations[soci.IndexAnnotationImageLayerMediaType] != ocispec.MediaTypeImageLayerGzip {
+		t.Fatalf("Missing layer media type annotation: %v", index.Index.Blobs[0].Annotations)
+	}
+
+	if builder.VerifyDuration() == 0 {
+		t.Fatalf("Expected the layer digest to be verified")
+	}
+
+	manifest, err := images.Manifest(context.Background(), contentStore, image.Target, nil)
+	if err != nil {
+		t.Fatalf("Failed to read the image manifest: %v", err)
+	}
+	savings := EstimateSavings(manifest.Layers, index.Index)
+	if savings.Layers != 2 || savings.DeferredLayers != 1 {
+		t.Fatalf("Expected one of two layers deferred but got %d of %d", savings.DeferredLayers, savings.Layers)
+	}
+	if savings.DeferredSize != manifest.Layers[0].Size || savings.ImageSize != manifest.Layers[0].Size+manifest.Layers[1].Size {
+		t.Fatalf("Unexpected savings: %+v", savings)
+	}
+}
+
+func TestBuildEmptyIndex(t *testing.T) {
+	builder, contentStore := newTestBuilder(t)
+	image := writeTestImage(t, contentStore, []byte("small"))
+
+	_, err := builder.Build(context.Background(), image)
+	if !errors.Is(err, soci.ErrEmptyIndex) {
+		t.Fatalf("Expected an empty index error but got %v", err)
+	}
+}
+
+func TestBuildWithZtocCache(t *testing.T) {
+	ztocCache, err := cache.NewDirCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	layer := bytes.Repeat([]byte("soci"), 1024)
+
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithZtocCache(ztocCache))
+	first, err := builder.Build(context.Background(), writeTestImage(t, contentStore, layer))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	// another builder with the same layer reuses the cached ztoc without reading the layer
+	builder, contentStore = newTestBuilder(t, WithMinLayerSize(100), WithZtocCache(ztocCache), WithLayerVerification(true))
+	second, err := builder.Build(context.Background(), writeTestImage(t, contentStore, layer))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if second.Index.Blobs[0].Digest != first.Index.Blobs[0].Digest {
+		t.Fatalf("Expected the cached ztoc %s but got %s", first.Index.Blobs[0].Digest, second.Index.Blobs[0].Digest)
+	}
+	if builder.VerifyDuration() != 0 {
+		t.Fatalf("Expected the layer not to be read")
+	}
+}
+
+func TestBuildReportsProgress(t *testing.T) {
+	var mu sync.Mutex
+	stages := map[Stage]int{}
+	var copied int64
+	reporter := ProgressFunc(func(progress Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		stages[progress.Stage]++
+		if progress.Stage == StageCopyingLayer {
+			copied = progress.Done
+		}
+	})
+
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithProgressReporter(reporter))
+	image := writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024), []byte("small"))
+	index, err := builder.Build(context.Background(), image)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	if stages[StageBuildingZtoc] != 1 || stages[StageLayerDone] != 1 || stages[StageLayerSkipped] != 1 {
+		t.Fatalf("Unexpected progress reports: %v", stages)
+	}
+	manifest, err := images.Manifest(context.Background(), contentStore, image.Target, nil)
+	if err != nil {
+		t.Fatalf("Failed to read the image manifest: %v", err)
+	}
+	if copied != manifest.Layers[0].Size {
+		t.Fatalf("Expected %d bytes copied but got %d", manifest.Layers[0].Size, copied)
+	}
+	if len(index.Index.Blobs) != 1 {
+		t.Fatalf("Expected one ztoc in the index but got %d", len(index.Index.Blobs))
+	}
+}
+
+func TestBuildCancelled(t *testing.T) {
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100))
+	image := writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := builder.Build(ctx, image)
+	if !errors.Is(err, ErrCancelled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error but got %v", err)
+	}
+}
+
+// This test ensures that layers whose content contradicts their media type are skipped with a diagnostic
+func TestBuildDiagnosesFormatMismatch(t *testing.T) {
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100))
+	image := writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024))
+	ctx := context.Background()
+
+	// a zstd frame pushed with the gzip layer media type
+	zstdLayer := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, bytes.Repeat([]byte("soci"), 1024)...)
+	image = appendTestLayer(t, contentStore, image, ocispec.MediaTypeImageLayerGzip, zstdLayer)
+	layer := ocispec.Descriptor{Digest: digest.FromBytes(zstdLayer)}
+
+	index, err := builder.Build(ctx, image)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if len(index.Index.Blobs) != 1 {
+		t.Fatalf("Expected one ztoc in the index but got %d", len(index.Index.Blobs))
+	}
+	diagnostics := builder.Diagnostics()
+	if len(diagnostics) != 1 || diagnostics[0].Digest != layer.Digest.String() || diagnostics[0].DetectedFormat != FormatZstd || diagnostics[0].Reason != SkipReasonFormatMismatch {
+		t.Fatalf("Expected a format mismatch of the zstd layer but got %+v", diagnostics)
+	}
+
+	// the strict policy fails for layers of unsupported formats
+	builder, contentStore = newTestBuilder(t, WithMinLayerSize(100), WithLayerErrorPolicy(LayerErrorFail))
+	image = writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024))
+	image = appendTestLayer(t, contentStore, image, ocispec.MediaTypeImageLayerGzip, zstdLayer)
+	if _, err := builder.Build(ctx, image); err == nil {
+		t.Fatalf("Expected the zstd layer to fail the build with the fail policy")
+	}
+}
+
+// This test ensures that ztocs built with several decompress workers are the same as the library's
+func TestBuildWithDecompressWorkers(t *testing.T) {
+	content := make([]byte, 1<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(content)
+
+	var ztocDigests []digest.Digest
+	for _, workers := range []int{1, 4} {
+		builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithSpanSize(64<<10), WithDecompressWorkers(workers))
+		image := writeTestImage(t, contentStore, content)
+		index, err := builder.Build(context.Background(), image)
+		if err != nil {
+			t.Fatalf("Build with %d workers failed: %v", workers, err)
+		}
+		ztocDigests = append(ztocDigests, index.Index.Blobs[0].Digest)
+	}
+	if ztocDigests[0] != ztocDigests[1] {
+		t.Fatalf("Expected the same ztoc with several decompress workers but got %s and %s", ztocDigests[0], ztocDigests[1])
+	}
+}
+
+// This test ensures that corrupt layers fail the build by default and are skipped with the skip policy
+func TestBuildLayerErrorPolicy(t *testing.T) {
+	corruptLayer := append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte("corrupt"), 1024)...)
+	for _, test := range []struct {
+		policy  string
+		blobs   int
+		failure bool
+	}{
+		{"", 0, true},
+		{LayerErrorSkip, 1, false},
+		{LayerErrorFail, 0, true},
+	} {
+		builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithLayerErrorPolicy(test.policy))
+		image := writeTestImage(t, contentStore, bytes.Repeat([]byte("soci"), 1024))
+		image = appendTestLayer(t, contentStore, image, ocispec.MediaTypeImageLayerGzip, corruptLayer)
+
+		index, err := builder.Build(context.Background(), image)
+		if (err != nil) != test.failure {
+			t.Fatalf("Unexpected error with policy %q: %v", test.policy, err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(index.Index.Blobs) != test.blobs {
+			t.Fatalf("Expected %d ztocs with policy %q but got %d", test.blobs, test.policy, len(index.Index.Blobs))
+		}
+		diagnostics := builder.Diagnostics()
+		if len(diagnostics) != 1 || diagnostics[0].Reason != SkipReasonError || diagnostics[0].Error == "" {
+			t.Fatalf("Expected the corrupt layer to be reported but got %+v", diagnostics)
+		}
+	}
+}
+
+// This test ensures that Wait returns once the ztoc builds the build stopped waiting for are done with their layer files
+func TestBuildWaitsForAbandonedZtocBuilds(t *testing.T) {
+	tempDir := t.TempDir()
+	builder, contentStore := newTestBuilder(t, WithMinLayerSize(100), WithZtocTimeout(time.Nanosecond),
+		WithLayerErrorPolicy(LayerErrorSkip), WithTempDir(tempDir))
+	content := make([]byte, 4<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(content)
+	image := writeTestImage(t, contentStore, content)
+
+	if _, err := builder.Build(context.Background(), image); err == nil {
+		t.Fatalf("Expected the build to fail without ztocs")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := builder.Wait(ctx); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to read the temp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected the layer files to be removed but found %d", len(entries))
+	}
+}
+
+func TestLayerConcurrency(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	// the workers of all layers built at a time fit in GOMAXPROCS, at least one layer is built
+	for workers, expected := range map[int]int{0: 4, 1: 4, 2: 2, 3: 1, 8: 1} {
+		builder, _ := newTestBuilder(t, WithDecompressWorkers(workers))
+		if concurrency := builder.layerConcurrency(); concurrency != expected {
+			t.Fatalf("Expected %d layers at a time with %d decompress workers but got %d", expected, workers, concurrency)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opencontainers/go-digest"
+)
+
+// Build the ztoc of a layer file. With more than one decompress worker the ztocs of gzip layers are built
+// with buildGzipZtoc, otherwise with the library's ztoc builder. Both produce the same ztoc.
+func (b *Builder) buildZtocFile(layerFile string, compressionAlgo string) (*ztoc.Ztoc, error) {
+	if b.config.decompressWorkers <= 1 || compressionAlgo != compression.Gzip {
+		return b.ztocBuilder.BuildZtoc(layerFile, b.config.spanSize, ztoc.WithCompression(compressionAlgo))
+	}
+	return buildGzipZtoc(layerFile, b.config.spanSize, b.config.decompressWorkers)
+}
+
+// Build the ztoc of a gzip layer like ztoc.Builder, which decompresses the layer twice one after the other:
+// once with zlib for the span checkpoints and once to list the files of the tar.
+// Here both passes run at the same time, the files are listed with a faster gzip implementation
+// and the span digests are hashed by the given number of workers.
+func buildGzipZtoc(layerFile string, spanSize int64, workers int) (*ztoc.Ztoc, error) {
+	info, err := os.Stat(layerFile)
+	if err != nil {
+		return nil, err
+	}
+	compressedSize := compression.Offset(info.Size())
+
+	var (
+		wg               sync.WaitGroup
+		compressionInfo  ztoc.CompressionInfo
+		zinfoErr         error
+		toc              ztoc.TOC
+		uncompressedSize compression.Offset
+		tocErr           error
+	)
+	tocBuilder := ztoc.NewTocBuilder()
+	tocBuilder.RegisterTarProvider(compression.Gzip, func(file *os.File) (io.Reader, error) {
+		return gzip.NewReader(file)
+	})
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		compressionInfo, zinfoErr = gzipCompressionInfo(layerFile, spanSize, compressedSize, workers)
+	}()
+	go func() {
+		defer wg.Done()
+		toc, uncompressedSize, tocErr = tocBuilder.TocFromFile(compression.Gzip, layerFile)
+	}()
+	wg.Wait()
+	if zinfoErr != nil {
+		return nil, zinfoErr
+	}
+	if tocErr != nil {
+		return nil, tocErr
+	}
+
+	return &ztoc.Ztoc{
+		Version:                 ztoc.Version09,
+		TOC:                     toc,
+		CompressedArchiveSize:   compressedSize,
+		UncompressedArchiveSize: uncompressedSize,
+		BuildToolIdentifier:     defaultBuildToolIdentifier,
+		CompressionInfo:         compressionInfo,
+	}, nil
+}
+
+// The span checkpoints and digests of a gzip layer, see the gzip zinfo builder of the library
+func gzipCompressionInfo(layerFile string, spanSize int64, compressedSize compression.Offset, workers int) (ztoc.CompressionInfo, error) {
+	index, err := compression.NewZinfoFromFile(compression.Gzip, layerFile, spanSize)
+	if err != nil {
+		return ztoc.CompressionInfo{}, err
+	}
+	defer index.Close()
+
+	digests, err := spanDigests(layerFile, compressedSize, index, workers)
+	if err != nil {
+		return ztoc.CompressionInfo{}, err
+	}
+	checkpoints, err := index.Bytes()
+	if err != nil {
+		return ztoc.CompressionInfo{}, err
+	}
+	return ztoc.CompressionInfo{
+		MaxSpanID:            index.MaxSpanID(),
+		SpanDigests:          digests,
+		Checkpoints:          checkpoints,
+		CompressionAlgorithm: compression.Gzip,
+	}, nil
+}
+
+// Digests of the compressed spans of a layer, hashed by the given number of workers
+func spanDigests(layerFile string, compressedSize compression.Offset, index compression.Zinfo, workers int) ([]digest.Digest, error) {
+	file, err := os.Open(layerFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer file.Close()
+
+	digests := make([]digest.Digest, index.MaxSpanID()+1)
+	errs := make([]error, len(digests))
+	spans := make(chan compression.SpanID)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for spanID := range spans {
+				start := index.StartCompressedOffset(spanID)
+				end := index.EndCompressedOffset(spanID, compressedSize)
+				// ReadAt of a file is safe for concurrent use
+				digests[spanID], errs[spanID] = digest.FromReader(io.NewSectionReader(file, int64(start), int64(end-start)))
+			}
+		}()
+	}
+	for spanID := range digests {
+		spans <- compression.SpanID(spanID)
+	}
+	close(spans)
+	wg.Wait()
+
+	for spanID, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute digest of span %d of %s: %w", spanID, layerFile, err)
+		}
+	}
+	return digests, nil
+}
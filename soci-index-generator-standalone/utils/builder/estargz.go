@@ -0,0 +1,250 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/size"
+)
+
+// ConvertEstargz converts the layers of the image for the builder's platform to eStargz, which the stargz-snapshotter
+// loads lazily, and writes them with the converted config and manifest to the blob store. Layers that are eStargz
+// already are kept. Returns the descriptor of the converted manifest.
+func (b *Builder) ConvertEstargz(ctx context.Context, image images.Image) (ocispec.Descriptor, error) {
+	manifestDesc, err := soci.GetImageManifestDescriptor(ctx, b.contentStore, image.Target, platforms.OnlyStrict(b.config.platform))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	manifest, err := images.Manifest(ctx, b.contentStore, image.Target, platforms.OnlyStrict(b.config.platform))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	configBytes, err := content.ReadBlob(ctx, b.contentStore, manifest.Config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("invalid image config: %w", err)
+	}
+	var rootfs ocispec.RootFS
+	if config["rootfs"] != nil {
+		if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("invalid rootfs of the image config: %w", err)
+		}
+	}
+
+	// the layers are converted one after the other, estargz.Build converts each of them in parallel already
+	diffIDs := make([]digest.Digest, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		if LazyLoadingFormat(layer) == LazyLoadingEstargz {
+			if len(rootfs.DiffIDs) != len(manifest.Layers) {
+				return ocispec.Descriptor{}, fmt.Errorf("the image config has %d diff IDs for %d layers", len(rootfs.DiffIDs), len(manifest.Layers))
+			}
+			log.Info(ctx, fmt.Sprintf("Keeping layer %s, it is eStargz already", layer.Digest))
+			diffIDs[i] = rootfs.DiffIDs[i]
+			continue
+		}
+		manifest.Layers[i], diffIDs[i], err = b.convertLayer(ctx, layer)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	// only the diff IDs of the config change, its other fields are written back as they are
+	rootfs = ocispec.RootFS{Type: "layers", DiffIDs: diffIDs}
+	config["rootfs"], err = json.Marshal(rootfs)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	configBytes, err = json.Marshal(config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	manifest.Config, err = b.pushBlob(ctx, manifest.Config.MediaType, configBytes)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return b.pushBlob(ctx, manifestDesc.MediaType, manifestBytes)
+}
+
+// Convert a layer to eStargz and push it to the blob store, returning its descriptor and diff ID
+func (b *Builder) convertLayer(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, digest.Digest, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return ocispec.Descriptor{}, "", fmt.Errorf("%w: media type %s", errUnsupportedLayerFormat, desc.MediaType)
+	}
+	err := b.fetchMissingLayer(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	ra, err := b.contentStore.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer ra.Close()
+
+	log.Info(ctx, fmt.Sprintf("Converting layer %s of %s to eStargz", desc.Digest, size.Format(desc.Size)))
+	blob, err := estargz.Build(io.NewSectionReader(ra, 0, desc.Size), estargz.WithContext(ctx), estargz.WithCompression(estargzCompression{
+		GzipCompressor:   estargz.NewGzipCompressorWithLevel(gzip.BestCompression),
+		GzipDecompressor: &estargz.GzipDecompressor{},
+	}))
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer blob.Close()
+
+	// the blob is pushed once its digest and size are known
+	tmpFile, err := os.CreateTemp(b.config.tempDir, "estargz.*")
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(io.MultiWriter(tmpFile, digester.Hash()), &contextReader{ctx: ctx, r: blob})
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	// the diff ID is only known once the blob is closed
+	if err := blob.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	uncompressedSize, err := gzipUncompressedSize(tmpFile)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	converted := ocispec.Descriptor{
+		MediaType: estargzMediaType(desc.MediaType),
+		Digest:    digester.Digest(),
+		Size:      n,
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation:         blob.TOCDigest().String(),
+			estargz.StoreUncompressedSizeAnnotation: strconv.FormatInt(uncompressedSize, 10),
+		},
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	err = b.blobStore.Push(ctx, converted, tmpFile)
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, "", fmt.Errorf("cannot push eStargz layer to local store: %w", err)
+	}
+	log.Info(ctx, fmt.Sprintf("Converted layer %s to eStargz layer %s of %s", desc.Digest, converted.Digest, size.Format(converted.Size)))
+	return converted, blob.DiffID(), nil
+}
+
+// The size of the decompressed content of a gzip file, e.g. of an eStargz blob made of several gzip streams
+func gzipUncompressedSize(file *os.File) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	return io.Copy(io.Discard, gz)
+}
+
+// The gzip compression of eStargz layers of the library, writing the footer without compress/gzip. The library
+// expects an empty gzip stream written with NoCompression to take exactly FooterSize bytes, which it doesn't with
+// the compress/flate of newer Go releases, and panics.
+type estargzCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+// Write the TOC like estargz.GzipCompressor, followed by the footer pointing at it
+func (c estargzCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(estargzFooter(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// The estargz.FooterSize bytes of the footer of an eStargz blob: an empty gzip stream with the offset of the TOC
+// in an extra field of its header, see https://tools.ietf.org/html/rfc1952#section-2.3
+func estargzFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	// magic, deflate, FEXTRA, no modification time, no extra flags, unknown OS
+	footer := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff}
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	// an empty final stored deflate block, then the CRC-32 and size of the empty content
+	return append(footer, 0x01, 0x00, 0x00, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// eStargz layers are gzip compressed, with the Docker media type in Docker manifests
+func estargzMediaType(layerMediaType string) string {
+	if strings.HasPrefix(layerMediaType, "application/vnd.docker.") {
+		return images.MediaTypeDockerSchema2LayerGzip
+	}
+	return ocispec.MediaTypeImageLayerGzip
+}
+
+// Push a config or manifest to the blob store
+func (b *Builder) pushBlob(ctx context.Context, mediaType string, blob []byte) (ocispec.Descriptor, error) {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	err := b.blobStore.Push(ctx, desc, bytes.NewReader(blob))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
@@ -0,0 +1,86 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestConvertEstargz(t *testing.T) {
+	ctx := context.Background()
+	builder, contentStore := newTestBuilder(t)
+	file := bytes.Repeat([]byte("estargz"), 1024)
+	image := writeTestImage(t, contentStore, file)
+
+	manifestDesc, err := builder.ConvertEstargz(ctx, image)
+	if err != nil {
+		t.Fatalf("ConvertEstargz failed: %v", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(readBlob(t, contentStore, manifestDesc), &manifest); err != nil {
+		t.Fatalf("Failed to parse the converted manifest: %v", err)
+	}
+	if len(manifest.Layers) != 1 || LazyLoadingFormat(manifest.Layers[0]) != LazyLoadingEstargz {
+		t.Fatalf("Expected one eStargz layer but got %v", manifest.Layers)
+	}
+
+	layer := readBlob(t, contentStore, manifest.Layers[0])
+	reader, err := estargz.Open(io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer))))
+	if err != nil {
+		t.Fatalf("Failed to open the eStargz layer: %v", err)
+	}
+	if reader.TOCDigest().String() != manifest.Layers[0].Annotations[estargz.TOCJSONDigestAnnotation] {
+		t.Fatalf("Expected the TOC digest %s to be annotated but got %v", reader.TOCDigest(), manifest.Layers[0].Annotations)
+	}
+	if _, ok := reader.Lookup("file"); !ok {
+		t.Fatalf("Expected the file of the layer in the eStargz layer")
+	}
+
+	var config ocispec.Image
+	if err := json.Unmarshal(readBlob(t, contentStore, manifest.Config), &config); err != nil {
+		t.Fatalf("Failed to parse the converted config: %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(layer))
+	if err != nil {
+		t.Fatalf("Failed to decompress the eStargz layer: %v", err)
+	}
+	diffID, err := digest.FromReader(gz)
+	if err != nil {
+		t.Fatalf("Failed to decompress the eStargz layer: %v", err)
+	}
+	if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != diffID {
+		t.Fatalf("Expected the diff ID %s in the converted config but got %v", diffID, config.RootFS.DiffIDs)
+	}
+	if config.OS == "" || config.Architecture == "" {
+		t.Fatalf("Expected the platform of the config to be kept but got %+v", config.Platform)
+	}
+
+	// converting the converted image keeps its layers
+	image.Target = manifestDesc
+	again, err := builder.ConvertEstargz(ctx, image)
+	if err != nil {
+		t.Fatalf("ConvertEstargz failed: %v", err)
+	}
+	if again.Digest != manifestDesc.Digest {
+		t.Fatalf("Expected the eStargz image to be kept as it is but got %s", again.Digest)
+	}
+}
+
+func readBlob(t *testing.T, contentStore content.Store, desc ocispec.Descriptor) []byte {
+	blob, err := content.ReadBlob(context.Background(), contentStore, desc)
+	if err != nil {
+		t.Fatalf("Failed to read blob %s: %v", desc.Digest, err)
+	}
+	return blob
+}
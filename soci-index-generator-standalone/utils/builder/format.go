@@ -0,0 +1,98 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Formats of layer content detected from its first bytes
+const (
+	FormatGzip    = "gzip"
+	FormatZstd    = "zstd"
+	FormatBzip2   = "bzip2"
+	FormatXz      = "xz"
+	FormatTar     = "tar"
+	FormatUnknown = "unknown"
+)
+
+// LayerDiagnostic explains why no ztoc was built for a layer because of its format or an error
+type LayerDiagnostic struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	// format detected from the first bytes of the layer, empty if the layer wasn't pulled
+	DetectedFormat string `json:"detectedFormat,omitempty"`
+	Reason         string `json:"reason"`
+	// error building the ztoc of a layer skipped with the LayerErrorSkip policy
+	Error string `json:"error,omitempty"`
+}
+
+func newLayerDiagnostic(desc ocispec.Descriptor, detectedFormat string, reason string) *LayerDiagnostic {
+	return &LayerDiagnostic{
+		Digest:         desc.Digest.String(),
+		MediaType:      desc.MediaType,
+		Size:           desc.Size,
+		DetectedFormat: detectedFormat,
+		Reason:         reason,
+	}
+}
+
+// Detect the format of layer content from its magic bytes
+func detectFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return FormatBzip2
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz
+	case len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar")):
+		return FormatTar
+	default:
+		return FormatUnknown
+	}
+}
+
+// Read the first bytes of a layer from the content store and detect its format,
+// empty if the layer can't be read (e.g. it wasn't pulled because its ztoc is cached)
+func (b *Builder) sniffFormat(ctx context.Context, desc ocispec.Descriptor) string {
+	if b.contentStore == nil {
+		return ""
+	}
+	ra, err := b.contentStore.ReaderAt(ctx, desc)
+	if err != nil {
+		return ""
+	}
+	defer ra.Close()
+
+	header := make([]byte, min(512, desc.Size))
+	n, err := ra.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return ""
+	}
+	return detectFormat(header[:n])
+}
+
+// Whether the detected format of a layer contradicts the compression of its media type
+func formatMismatch(compressionAlgo string, detectedFormat string) bool {
+	switch compressionAlgo {
+	case compression.Gzip:
+		return detectedFormat != FormatGzip
+	case compression.Zstd:
+		return detectedFormat != FormatZstd
+	case compression.Uncompressed:
+		// tar archives in the old v7 format have no magic bytes
+		return detectedFormat != FormatTar && detectedFormat != FormatUnknown
+	default:
+		return false
+	}
+}
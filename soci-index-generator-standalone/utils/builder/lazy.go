@@ -0,0 +1,37 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layer formats that other snapshotters load lazily without a SOCI index
+const (
+	LazyLoadingEstargz     = "estargz"
+	LazyLoadingZstdChunked = "zstd:chunked"
+)
+
+const (
+	// set on eStargz layers by the stargz-snapshotter tooling
+	annotationStargzTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+	// set on zstd:chunked layers by the containers/storage tooling
+	annotationZstdChunkedManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	annotationZstdChunkedManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+)
+
+// LazyLoadingFormat detects from its annotations whether a layer is in a format that other
+// snapshotters load lazily, like eStargz or zstd:chunked. Empty if it isn't.
+func LazyLoadingFormat(layer ocispec.Descriptor) string {
+	if _, ok := layer.Annotations[annotationStargzTOCDigest]; ok {
+		return LazyLoadingEstargz
+	}
+	if _, ok := layer.Annotations[annotationZstdChunkedManifestChecksum]; ok {
+		return LazyLoadingZstdChunked
+	}
+	if _, ok := layer.Annotations[annotationZstdChunkedManifestPosition]; ok {
+		return LazyLoadingZstdChunked
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Manifest types a SOCI index can be serialized as, some registries reject one or the other
+const (
+	// OCI 1.0 image manifest with the SOCI index artifact type as the config media type, as pushed by the soci CLI
+	ManifestTypeImage = "image-manifest"
+	// OCI 1.1 image manifest with the SOCI index artifact type as artifactType and the empty config
+	ManifestTypeImageArtifactType = "image-manifest-artifact-type"
+	// OCI artifact manifest of the OCI 1.1 release candidates, supported by some older registries
+	ManifestTypeArtifact = "artifact-manifest"
+
+	MediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
+)
+
+var (
+	ErrNotSociIndex = errors.New("manifest is not a SOCI index")
+
+	emptyJSON = []byte("{}")
+	// config of the OCI 1.0 image manifest, see soci.MarshalIndex
+	sociIndexConfig = ocispec.Descriptor{
+		MediaType: soci.SociIndexArtifactType,
+		Digest:    digest.FromBytes(emptyJSON),
+		Size:      int64(len(emptyJSON)),
+	}
+)
+
+// Superset of the fields of image and artifact manifests
+type indexManifest struct {
+	SchemaVersion int                  `json:"schemaVersion,omitempty"`
+	MediaType     string               `json:"mediaType"`
+	ArtifactType  string               `json:"artifactType,omitempty"`
+	Config        *ocispec.Descriptor  `json:"config,omitempty"`
+	Layers        []ocispec.Descriptor `json:"layers,omitempty"`
+	Blobs         []ocispec.Descriptor `json:"blobs,omitempty"`
+	Subject       *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string    `json:"annotations,omitempty"`
+}
+
+// MarshalIndex serializes a SOCI index as the given manifest type.
+// Returns the manifest and the config blob that has to be pushed with it, if any.
+func MarshalIndex(index *soci.Index, manifestType string) (ocispec.Descriptor, []byte, *ocispec.Descriptor, error) {
+	manifest := indexManifest{Subject: index.Subject, Annotations: index.Annotations}
+	var config *ocispec.Descriptor
+	switch manifestType {
+	case ManifestTypeImage, "":
+		manifest.SchemaVersion = 2
+		manifest.MediaType = ocispec.MediaTypeImageManifest
+		config = &sociIndexConfig
+		manifest.Layers = index.Blobs
+	case ManifestTypeImageArtifactType:
+		manifest.SchemaVersion = 2
+		manifest.MediaType = ocispec.MediaTypeImageManifest
+		manifest.ArtifactType = soci.SociIndexArtifactType
+		config = &ocispec.DescriptorEmptyJSON
+		manifest.Layers = index.Blobs
+	case ManifestTypeArtifact:
+		manifest.MediaType = MediaTypeArtifactManifest
+		manifest.ArtifactType = soci.SociIndexArtifactType
+		manifest.Blobs = index.Blobs
+	default:
+		return ocispec.Descriptor{}, nil, nil, fmt.Errorf("unknown manifest type %q, expected %s, %s or %s", manifestType, ManifestTypeImage, ManifestTypeImageArtifactType, ManifestTypeArtifact)
+	}
+	manifest.Config = config
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, nil, err
+	}
+	// like in the referrers API, the descriptor carries the artifact type and the annotations of the manifest
+	desc := ocispec.Descriptor{
+		MediaType:    manifest.MediaType,
+		ArtifactType: soci.SociIndexArtifactType,
+		Digest:       digest.FromBytes(content),
+		Size:         int64(len(content)),
+		Annotations:  index.Annotations,
+	}
+	return desc, content, config, nil
+}
+
+// WriteIndex serializes a SOCI index as the given manifest type and writes it with its config to the store
+func WriteIndex(ctx context.Context, index *soci.Index, store orascontent.Pusher, manifestType string) (ocispec.Descriptor, error) {
+	desc, content, config, err := MarshalIndex(index, manifestType)
+	if err != nil {
+		return desc, err
+	}
+	if config != nil {
+		err = store.Push(ctx, *config, bytes.NewReader(emptyJSON))
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return desc, fmt.Errorf("cannot write SOCI index config to local store: %w", err)
+		}
+	}
+	err = store.Push(ctx, desc, bytes.NewReader(content))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return desc, fmt.Errorf("cannot write SOCI index to local store: %w", err)
+	}
+	return desc, nil
+}
+
+// ParseIndex deserializes a SOCI index from any of the manifest types, or returns ErrNotSociIndex
+func ParseIndex(content []byte) (*soci.Index, *ocispec.Descriptor, error) {
+	var manifest indexManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, nil, err
+	}
+
+	isSociIndex := manifest.ArtifactType == soci.SociIndexArtifactType ||
+		(manifest.Config != nil && manifest.Config.MediaType == soci.SociIndexArtifactType)
+	if !isSociIndex {
+		return nil, nil, ErrNotSociIndex
+	}
+
+	blobs := manifest.Layers
+	if manifest.MediaType == MediaTypeArtifactManifest {
+		blobs = manifest.Blobs
+	}
+	index := &soci.Index{
+		MediaType:    manifest.MediaType,
+		ArtifactType: soci.SociIndexArtifactType,
+		Blobs:        blobs,
+		Subject:      manifest.Subject,
+		Annotations:  manifest.Annotations,
+	}
+	return index, manifest.Config, nil
+}
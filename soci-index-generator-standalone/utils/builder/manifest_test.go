@@ -0,0 +1,69 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func testIndex() *soci.Index {
+	ztoc := ocispec.Descriptor{MediaType: soci.SociLayerMediaType, Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000", Size: 1}
+	subject := &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111", Size: 2}
+	return soci.NewIndex([]ocispec.Descriptor{ztoc}, subject, map[string]string{soci.IndexAnnotationBuildToolIdentifier: defaultBuildToolIdentifier})
+}
+
+func TestMarshalIndexMatchesSoci(t *testing.T) {
+	index := testIndex()
+	expected, err := soci.MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("soci.MarshalIndex failed: %v", err)
+	}
+	_, content, _, err := MarshalIndex(index, ManifestTypeImage)
+	if err != nil {
+		t.Fatalf("MarshalIndex failed: %v", err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Fatalf("Unexpected image manifest. Expected %s but got %s", expected, content)
+	}
+}
+
+func TestWriteAndParseIndex(t *testing.T) {
+	for _, manifestType := range []string{ManifestTypeImage, ManifestTypeImageArtifactType, ManifestTypeArtifact} {
+		store := memory.New()
+		desc, err := WriteIndex(context.Background(), testIndex(), store, manifestType)
+		if err != nil {
+			t.Fatalf("%s: WriteIndex failed: %v", manifestType, err)
+		}
+
+		rc, err := store.Fetch(context.Background(), desc)
+		if err != nil {
+			t.Fatalf("%s: the index was not written: %v", manifestType, err)
+		}
+		var content bytes.Buffer
+		content.ReadFrom(rc)
+		rc.Close()
+
+		index, config, err := ParseIndex(content.Bytes())
+		if err != nil {
+			t.Fatalf("%s: ParseIndex failed: %v", manifestType, err)
+		}
+		if len(index.Blobs) != 1 || index.Subject == nil {
+			t.Fatalf("%s: unexpected parsed index %+v", manifestType, index)
+		}
+		if (config == nil) != (manifestType == ManifestTypeArtifact) {
+			t.Fatalf("%s: unexpected config %v", manifestType, config)
+		}
+	}
+
+	if _, _, err := ParseIndex([]byte(`{"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`)); !errors.Is(err, ErrNotSociIndex) {
+		t.Fatalf("Expected an image manifest not to be parsed as a SOCI index but got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Stage of building the ztoc of a layer
+type Stage string
+
+const (
+	// the layer is copied from the content store, reported after every write
+	StageCopyingLayer Stage = "copying layer"
+	// the ztoc of the copied layer is being built, the ztoc builder doesn't report its progress
+	StageBuildingZtoc Stage = "building ztoc"
+	// the ztoc of the layer was built or found in the ztoc cache
+	StageLayerDone Stage = "layer done"
+	// no ztoc is built for the layer, e.g. because it's smaller than the minimum layer size
+	StageLayerSkipped Stage = "layer skipped"
+)
+
+// Progress of a layer, Done and Total are in bytes of the layer
+type Progress struct {
+	Stage       Stage
+	LayerDigest digest.Digest
+	Done        int64
+	Total       int64
+}
+
+// ProgressReporter is notified of the progress of each layer, e.g. to show it in a UI.
+// Layers are built in parallel, so Report is called concurrently and should return quickly.
+type ProgressReporter interface {
+	Report(progress Progress)
+}
+
+// ProgressFunc adapts a function to a ProgressReporter
+type ProgressFunc func(progress Progress)
+
+func (f ProgressFunc) Report(progress Progress) {
+	f(progress)
+}
+
+// WithProgressReporter reports the progress of each layer to reporter
+func WithProgressReporter(reporter ProgressReporter) Option {
+	return func(c *config) {
+		c.progress = reporter
+	}
+}
+
+// Report the progress of a layer, if there is a reporter
+func (b *Builder) report(stage Stage, layerDigest digest.Digest, done int64, total int64) {
+	if b.config.progress != nil {
+		b.config.progress.Report(Progress{Stage: stage, LayerDigest: layerDigest, Done: done, Total: total})
+	}
+}
+
+// Writer reporting the bytes written so far
+type progressWriter struct {
+	w           io.Writer
+	builder     *Builder
+	layerDigest digest.Digest
+	done        int64
+	total       int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	p.builder.report(StageCopyingLayer, p.layerDigest, p.done, p.total)
+	return n, err
+}
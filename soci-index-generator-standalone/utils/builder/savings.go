@@ -0,0 +1,49 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Savings is the estimated lazy loading benefit of a SOCI index. Layers with a ztoc are fetched on demand
+// when a container starts instead of being downloaded and unpacked before it starts.
+type Savings struct {
+	// compressed size of all layers of the image
+	ImageSize int64 `json:"imageSize"`
+	// compressed size of the layers with a ztoc, whose download is deferred
+	DeferredSize int64 `json:"deferredSize"`
+	// number of layers of the image and of those with a ztoc
+	Layers         int `json:"layers"`
+	DeferredLayers int `json:"deferredLayers"`
+	// share of the image size covered by ztocs, in percent
+	CoveragePercent float64 `json:"coveragePercent"`
+}
+
+// EstimateSavings computes the lazy loading benefit of a SOCI index for the layers of its image
+func EstimateSavings(layers []ocispec.Descriptor, index *soci.Index) Savings {
+	indexed := map[string]bool{}
+	for _, blob := range index.Blobs {
+		indexed[blob.Annotations[soci.IndexAnnotationImageLayerDigest]] = true
+	}
+
+	var savings Savings
+	for _, layer := range layers {
+		if !images.IsLayerType(layer.MediaType) {
+			continue
+		}
+		savings.ImageSize += layer.Size
+		savings.Layers++
+		if indexed[layer.Digest.String()] {
+			savings.DeferredSize += layer.Size
+			savings.DeferredLayers++
+		}
+	}
+	if savings.ImageSize > 0 {
+		savings.CoveragePercent = float64(savings.DeferredSize) * 100 / float64(savings.ImageSize)
+	}
+	return savings
+}
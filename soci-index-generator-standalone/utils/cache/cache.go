@@ -0,0 +1,63 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package cache shares built ztocs by the digest of their layer, so a layer is only indexed once,
+// no matter how many images (or workers) it is used by.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrNotFound = errors.New("ztoc not found in the cache")
+
+// Key of a cached ztoc, ztocs of a layer built with different span sizes differ
+type Key struct {
+	LayerDigest digest.Digest
+	SpanSize    int64
+}
+
+// Relative path of the ztoc in a cache, e.g. sha256/0123.../4194304
+func (k Key) path() string {
+	return fmt.Sprintf("%s/%s/%d", k.LayerDigest.Algorithm(), k.LayerDigest.Encoded(), k.SpanSize)
+}
+
+// Parse the relative path of a ztoc in a cache back into its key
+func keyFromPath(path string) (Key, bool) {
+	algorithm, rest, _ := strings.Cut(path, "/")
+	encoded, spanSize, _ := strings.Cut(rest, "/")
+	layerDigest := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded)
+	span, err := strconv.ParseInt(spanSize, 10, 64)
+	if err != nil || layerDigest.Validate() != nil {
+		return Key{}, false
+	}
+	return Key{LayerDigest: layerDigest, SpanSize: span}, true
+}
+
+// Cache of serialized ztocs
+type Cache interface {
+	// Get the ztoc of a layer, ErrNotFound if it isn't cached
+	Get(ctx context.Context, key Key) ([]byte, error)
+	// Put stores the ztoc of a layer
+	Put(ctx context.Context, key Key, ztoc []byte) error
+	// Has checks whether the ztoc of a layer is cached without reading it
+	Has(ctx context.Context, key Key) (bool, error)
+}
+
+// Open a cache at an S3 location (s3://bucket/prefix) or in a local directory
+func Open(location string) (Cache, error) {
+	if strings.HasPrefix(location, "s3://") {
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("missing bucket in %q", location)
+		}
+		return NewS3Cache(bucket, prefix), nil
+	}
+	return NewDirCache(location)
+}
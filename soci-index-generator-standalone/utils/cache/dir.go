@@ -0,0 +1,91 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DirCache keeps ztocs in a local directory, e.g. on a volume shared by the builds of a host.
+// The modification time of a ztoc is updated when it's read, so it tells when the ztoc was last used.
+type DirCache struct {
+	dir string
+	// the least recently used ztocs are removed when the cache grows larger, 0 means no limit
+	maxSize int64
+	// called for each ztoc removed by Prune, e.g. to forget it in an index of the cache
+	onRemove func(key Key) error
+}
+
+func NewDirCache(dir string) (*DirCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirCache{dir: dir}, nil
+}
+
+// SetMaxSize caps the size of the cache, the least recently used ztocs are removed after a put exceeds it
+func (c *DirCache) SetMaxSize(maxSize int64) {
+	c.maxSize = maxSize
+}
+
+// OnRemove sets a function called with the key of each ztoc removed by Prune, an error stops the pruning
+func (c *DirCache) OnRemove(onRemove func(key Key) error) {
+	c.onRemove = onRemove
+}
+
+func (c *DirCache) Get(ctx context.Context, key Key) ([]byte, error) {
+	path := filepath.Join(c.dir, key.path())
+	ztoc, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return ztoc, err
+}
+
+func (c *DirCache) Has(ctx context.Context, key Key) (bool, error) {
+	_, err := os.Stat(filepath.Join(c.dir, key.path()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *DirCache) Put(ctx context.Context, key Key, ztoc []byte) error {
+	path := filepath.Join(c.dir, key.path())
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first, so concurrent builds never read a partial ztoc
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".ztoc.*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(ztoc)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if c.maxSize > 0 {
+		_, err = c.Prune(c.maxSize, 0)
+	}
+	return err
+}
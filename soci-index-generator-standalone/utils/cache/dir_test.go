@@ -0,0 +1,96 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDirCache(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewDirCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	key := Key{LayerDigest: digest.FromString("layer"), SpanSize: 4 << 20}
+
+	_, err = c.Get(ctx, key)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a cache miss but got %v", err)
+	}
+
+	err = c.Put(ctx, key, []byte("ztoc"))
+	if err != nil {
+		t.Fatalf("Failed to put the ztoc: %v", err)
+	}
+	ztoc, err := c.Get(ctx, key)
+	if err != nil || string(ztoc) != "ztoc" {
+		t.Fatalf("Expected the cached ztoc but got %q, %v", ztoc, err)
+	}
+
+	// ztocs with another span size are distinct
+	_, err = c.Get(ctx, Key{LayerDigest: key.LayerDigest, SpanSize: 1 << 20})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a cache miss for another span size but got %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	c, err := Open("s3://bucket/ztocs")
+	if err != nil {
+		t.Fatalf("Failed to open the S3 cache: %v", err)
+	}
+	s3Cache, ok := c.(*S3Cache)
+	if !ok || s3Cache.bucket != "bucket" || s3Cache.prefix != "ztocs" {
+		t.Fatalf("Unexpected cache: %#v", c)
+	}
+	if _, err := Open("s3://"); err == nil {
+		t.Fatalf("Expected an error for a location without bucket")
+	}
+}
+
+func TestDirCachePrune(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := NewDirCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	var keys []Key
+	for i, name := range []string{"old", "recent", "new"} {
+		key := Key{LayerDigest: digest.FromString(name), SpanSize: 4 << 20}
+		keys = append(keys, key)
+		c.Put(ctx, key, make([]byte, 100))
+		usedAt := time.Now().Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(filepath.Join(dir, key.path()), usedAt, usedAt)
+	}
+	// reading a ztoc makes it the most recently used
+	c.Get(ctx, keys[0])
+
+	result, err := c.Prune(200, 0)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if result.Removed != 1 || result.FreedSize != 100 || result.Size != 200 {
+		t.Fatalf("Expected one ztoc to be removed but got %+v", result)
+	}
+	if cached, _ := c.Has(ctx, keys[1]); cached {
+		t.Fatalf("Expected the least recently used ztoc to be removed")
+	}
+
+	result, err = c.Prune(0, 30*time.Minute)
+	if err != nil || result.Removed != 1 {
+		t.Fatalf("Expected the ztoc unused for longer than the max age to be removed but got %+v, %v", result, err)
+	}
+	if cached, _ := c.Has(ctx, keys[0]); !cached {
+		t.Fatalf("Expected the recently read ztoc to be kept")
+	}
+}
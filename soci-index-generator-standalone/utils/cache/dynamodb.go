@@ -0,0 +1,129 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/opencontainers/go-digest"
+)
+
+// DynamoDBIndexedCache records the digest and size of the ztocs of a cache in a DynamoDB table.
+// Builders look up layers in the table, so they know which layers they don't need to download
+// without touching the blobs, and cached ztocs are verified against the recorded digest.
+// The table must have a string partition key "LayerKey".
+type DynamoDBIndexedCache struct {
+	blobs     Cache
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+type dynamoDBItem struct {
+	// layer digest and span size, e.g. sha256/0123.../4194304
+	LayerKey    string
+	LayerDigest string
+	SpanSize    int64
+	ZtocDigest  string
+	ZtocSize    int64
+}
+
+// Index the ztocs of a cache in the given DynamoDB table.
+// Pass Forget to the OnRemove of a local cache directory to delete the ztocs pruned from it from the table.
+func NewDynamoDBIndexedCache(blobs Cache, tableName string) *DynamoDBIndexedCache {
+	return newDynamoDBIndexedCache(blobs, dynamodb.New(session.New()), tableName)
+}
+
+func newDynamoDBIndexedCache(blobs Cache, client dynamodbiface.DynamoDBAPI, tableName string) *DynamoDBIndexedCache {
+	return &DynamoDBIndexedCache{
+		blobs:     blobs,
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+// Get the recorded ztoc of a layer, nil if there is none
+func (c *DynamoDBIndexedCache) lookup(ctx context.Context, key Key) (*dynamoDBItem, error) {
+	output, err := c.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(c.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LayerKey": {S: aws.String(key.path())},
+		},
+	})
+	if err != nil || output.Item == nil {
+		return nil, err
+	}
+	var item dynamoDBItem
+	err = dynamodbattribute.UnmarshalMap(output.Item, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Forget deletes the recorded ztoc of a layer, e.g. after it was removed from the cache
+func (c *DynamoDBIndexedCache) Forget(key Key) error {
+	_, err := c.client.DeleteItemWithContext(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(c.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LayerKey": {S: aws.String(key.path())},
+		},
+	})
+	return err
+}
+
+func (c *DynamoDBIndexedCache) Get(ctx context.Context, key Key) ([]byte, error) {
+	item, err := c.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrNotFound
+	}
+	ztoc, err := c.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(ztoc)) != item.ZtocSize || digest.FromBytes(ztoc).String() != item.ZtocDigest {
+		return nil, fmt.Errorf("cached ztoc of layer %s doesn't match the recorded ztoc %s", key.LayerDigest, item.ZtocDigest)
+	}
+	return ztoc, nil
+}
+
+// Has checks the table first and then whether the recorded ztoc is still in the cache, e.g. it wasn't pruned
+func (c *DynamoDBIndexedCache) Has(ctx context.Context, key Key) (bool, error) {
+	item, err := c.lookup(ctx, key)
+	if err != nil || item == nil {
+		return false, err
+	}
+	return c.blobs.Has(ctx, key)
+}
+
+// Put stores the ztoc in the cache first, so recorded ztocs can always be read
+func (c *DynamoDBIndexedCache) Put(ctx context.Context, key Key, ztoc []byte) error {
+	err := c.blobs.Put(ctx, key, ztoc)
+	if err != nil {
+		return err
+	}
+	item, err := dynamodbattribute.MarshalMap(dynamoDBItem{
+		LayerKey:    key.path(),
+		LayerDigest: key.LayerDigest.String(),
+		SpanSize:    key.SpanSize,
+		ZtocDigest:  digest.FromBytes(ztoc).String(),
+		ZtocSize:    int64(len(ztoc)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(c.tableName),
+		Item:      item,
+	})
+	return err
+}
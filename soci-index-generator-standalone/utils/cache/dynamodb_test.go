@@ -0,0 +1,104 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/opencontainers/go-digest"
+)
+
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key["LayerKey"].S]}, nil
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.items[*input.Item["LayerKey"].S] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	delete(f.items, *input.Key["LayerKey"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestDynamoDBIndexedCache(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := NewDirCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	c := newDynamoDBIndexedCache(blobs, &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}, "ztocs")
+	key := Key{LayerDigest: digest.FromString("layer"), SpanSize: 4 << 20}
+
+	if cached, err := c.Has(ctx, key); err != nil || cached {
+		t.Fatalf("Expected a cache miss but got %v, %v", cached, err)
+	}
+	err = c.Put(ctx, key, []byte("ztoc"))
+	if err != nil {
+		t.Fatalf("Failed to put the ztoc: %v", err)
+	}
+	if cached, err := c.Has(ctx, key); err != nil || !cached {
+		t.Fatalf("Expected the ztoc to be recorded but got %v, %v", cached, err)
+	}
+	ztoc, err := c.Get(ctx, key)
+	if err != nil || string(ztoc) != "ztoc" {
+		t.Fatalf("Expected the cached ztoc but got %q, %v", ztoc, err)
+	}
+
+	// ztocs not matching the record are rejected
+	blobs.Put(ctx, key, []byte("other"))
+	if _, err := c.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected a mismatch error but got %v", err)
+	}
+}
+
+func TestDynamoDBIndexedCachePrune(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := NewDirCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	table := &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	c := newDynamoDBIndexedCache(blobs, table, "ztocs")
+	blobs.OnRemove(c.Forget)
+	key := Key{LayerDigest: digest.FromString("layer"), SpanSize: 4 << 20}
+	err = c.Put(ctx, key, []byte("ztoc"))
+	if err != nil {
+		t.Fatalf("Failed to put the ztoc: %v", err)
+	}
+
+	// a ztoc removed from the directory behind the table's back isn't reported as cached
+	os.Remove(filepath.Join(blobs.dir, key.path()))
+	if cached, err := c.Has(ctx, key); err != nil || cached {
+		t.Fatalf("Expected a cache miss for the removed ztoc but got %v, %v", cached, err)
+	}
+
+	// pruned ztocs are deleted from the table
+	err = c.Put(ctx, key, []byte("ztoc"))
+	if err != nil {
+		t.Fatalf("Failed to put the ztoc: %v", err)
+	}
+	result, err := blobs.Prune(0, time.Nanosecond)
+	if err != nil || result.Removed != 1 {
+		t.Fatalf("Expected the ztoc to be pruned but got %+v, %v", result, err)
+	}
+	if len(table.items) != 0 {
+		t.Fatalf("Expected the pruned ztoc to be deleted from the table but got %v", table.items)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// MemoryCache keeps ztocs in memory for the duration of a run.
+// With a max size the least recently used ztocs are dropped when it's exceeded.
+type MemoryCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	// least recently used at the front
+	lru   *list.List
+	ztocs map[Key]*list.Element
+}
+
+type memoryEntry struct {
+	key  Key
+	ztoc []byte
+}
+
+// Create a memory cache holding at most maxSize bytes of ztocs, 0 means no limit
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{maxSize: maxSize, lru: list.New(), ztocs: map[Key]*list.Element{}}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key Key) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.ztocs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c.lru.MoveToBack(element)
+	return element.Value.(*memoryEntry).ztoc, nil
+}
+
+func (c *MemoryCache) Has(ctx context.Context, key Key) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.ztocs[key]
+	return ok, nil
+}
+
+func (c *MemoryCache) Put(ctx context.Context, key Key, ztoc []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.ztocs[key]; ok {
+		c.remove(element)
+	}
+	c.ztocs[key] = c.lru.PushBack(&memoryEntry{key, ztoc})
+	c.size += int64(len(ztoc))
+	for c.maxSize > 0 && c.size > c.maxSize {
+		c.remove(c.lru.Front())
+	}
+	return nil
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*memoryEntry)
+	delete(c.ztocs, entry.key)
+	c.size -= int64(len(entry.ztoc))
+}
+
+// Tiered looks up ztocs in a fast cache first, e.g. in memory, and then in a shared one.
+// Ztocs found in the shared cache are kept in the fast one, built ztocs are put into both.
+type Tiered struct {
+	fast   Cache
+	shared Cache
+}
+
+func NewTiered(fast Cache, shared Cache) *Tiered {
+	return &Tiered{fast: fast, shared: shared}
+}
+
+func (c *Tiered) Get(ctx context.Context, key Key) ([]byte, error) {
+	ztoc, err := c.fast.Get(ctx, key)
+	if err == nil {
+		return ztoc, nil
+	}
+	ztoc, err = c.shared.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.fast.Put(ctx, key, ztoc)
+	return ztoc, nil
+}
+
+func (c *Tiered) Has(ctx context.Context, key Key) (bool, error) {
+	cached, err := c.fast.Has(ctx, key)
+	if err == nil && cached {
+		return true, nil
+	}
+	return c.shared.Has(ctx, key)
+}
+
+func (c *Tiered) Put(ctx context.Context, key Key, ztoc []byte) error {
+	c.fast.Put(ctx, key, ztoc)
+	return c.shared.Put(ctx, key, ztoc)
+}
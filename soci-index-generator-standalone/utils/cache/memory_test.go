@@ -0,0 +1,55 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTiered(t *testing.T) {
+	ctx := context.Background()
+	fast, shared := NewMemoryCache(0), NewMemoryCache(0)
+	c := NewTiered(fast, shared)
+	key := Key{LayerDigest: digest.FromString("layer"), SpanSize: 4 << 20}
+
+	shared.Put(ctx, key, []byte("ztoc"))
+	ztoc, err := c.Get(ctx, key)
+	if err != nil || string(ztoc) != "ztoc" {
+		t.Fatalf("Expected the ztoc of the shared cache but got %q, %v", ztoc, err)
+	}
+	if cached, _ := fast.Has(ctx, key); !cached {
+		t.Fatalf("Expected the ztoc to be kept in the fast cache")
+	}
+
+	other := Key{LayerDigest: digest.FromString("other"), SpanSize: 4 << 20}
+	c.Put(ctx, other, []byte("built"))
+	for _, tier := range []Cache{fast, shared} {
+		if cached, _ := tier.Has(ctx, other); !cached {
+			t.Fatalf("Expected the built ztoc in both caches")
+		}
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryCache(200)
+	var keys []Key
+	for _, name := range []string{"first", "second", "third"} {
+		keys = append(keys, Key{LayerDigest: digest.FromString(name), SpanSize: 4 << 20})
+	}
+	c.Put(ctx, keys[0], make([]byte, 100))
+	c.Put(ctx, keys[1], make([]byte, 100))
+	// reading the first ztoc makes the second the least recently used
+	c.Get(ctx, keys[0])
+	c.Put(ctx, keys[2], make([]byte, 100))
+
+	for i, expected := range []bool{true, false, true} {
+		if cached, _ := c.Has(ctx, keys[i]); cached != expected {
+			t.Fatalf("Expected ztoc %d cached %v but got %v", i, expected, cached)
+		}
+	}
+}
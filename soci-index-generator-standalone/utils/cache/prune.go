@@ -0,0 +1,85 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcome of pruning a cache directory
+type PruneResult struct {
+	Removed   int
+	FreedSize int64
+	// size of the ztocs kept in the cache
+	Size int64
+}
+
+// Prune removes the least recently used ztocs until the cache is no larger than maxSize (0 means no limit),
+// and the ztocs unused for longer than maxAge (0 means no limit). Removed ztocs are passed to the OnRemove function.
+func (c *DirCache) Prune(maxSize int64, maxAge time.Duration) (PruneResult, error) {
+	type entry struct {
+		path   string
+		size   int64
+		usedAt time.Time
+	}
+	var entries []entry
+	var result PruneResult
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			// removed by a concurrent prune
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".ztoc.") && time.Since(info.ModTime()) < time.Hour {
+			// being written by a concurrent build
+			return nil
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		result.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].usedAt.Before(entries[j].usedAt)
+	})
+	for _, e := range entries {
+		tooLarge := maxSize > 0 && result.Size > maxSize
+		tooOld := maxAge > 0 && time.Since(e.usedAt) > maxAge
+		if !tooLarge && !tooOld {
+			continue
+		}
+		err := os.Remove(e.path)
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		result.Removed++
+		result.FreedSize += e.size
+		result.Size -= e.size
+		if c.onRemove == nil {
+			continue
+		}
+		relPath, err := filepath.Rel(c.dir, e.path)
+		if err != nil {
+			return result, err
+		}
+		if key, ok := keyFromPath(filepath.ToSlash(relPath)); ok {
+			if err := c.onRemove(key); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,78 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3Cache keeps ztocs in an S3 bucket shared by a fleet of builders
+type S3Cache struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+func NewS3Cache(bucket string, prefix string) *S3Cache {
+	return &S3Cache{
+		client: s3.New(session.New()),
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+func (c *S3Cache) key(key Key) *string {
+	return aws.String(path.Join(c.prefix, key.path()))
+}
+
+func (c *S3Cache) Get(ctx context.Context, key Key) ([]byte, error) {
+	out, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    c.key(key),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (c *S3Cache) Has(ctx context.Context, key Key) (bool, error) {
+	_, err := c.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    c.key(key),
+	})
+	if err != nil {
+		// HEAD responses have no body, so the error code is just the status
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *S3Cache) Put(ctx context.Context, key Key, ztoc []byte) error {
+	_, err := c.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    c.key(key),
+		Body:   bytes.NewReader(ztoc),
+	})
+	return err
+}
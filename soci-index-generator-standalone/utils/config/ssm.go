@@ -0,0 +1,47 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package config loads settings of the tool from SSM Parameter Store, so a fleet of builders
+// can be reconfigured by changing the parameters instead of redeploying them with other flags.
+package config
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// ParameterStore reads the parameters under a path of SSM Parameter Store
+type ParameterStore struct {
+	client ssmiface.SSMAPI
+}
+
+// Create a parameter store reader with the default AWS session
+func NewParameterStore() *ParameterStore {
+	return &ParameterStore{client: ssm.New(session.New())}
+}
+
+// Load the parameters directly under the path by their name relative to it, e.g. /soci-builder/min-layer-size
+// is returned as min-layer-size. SecureString parameters are decrypted.
+func (s *ParameterStore) Load(ctx context.Context, parameterPath string) (map[string]string, error) {
+	parameterPath = "/" + strings.Trim(parameterPath, "/")
+	values := map[string]string{}
+	err := s.client.GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
+		Path:           aws.String(parameterPath),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range page.Parameters {
+			values[path.Base(aws.StringValue(parameter.Name))] = aws.StringValue(parameter.Value)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
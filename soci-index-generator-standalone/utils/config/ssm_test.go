@@ -0,0 +1,47 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// fakeSSM returns its parameters one per page
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters []*ssm.Parameter
+	path       string
+}
+
+func (f *fakeSSM) GetParametersByPathPagesWithContext(ctx aws.Context, input *ssm.GetParametersByPathInput, fn func(*ssm.GetParametersByPathOutput, bool) bool, opts ...request.Option) error {
+	f.path = aws.StringValue(input.Path)
+	for i, parameter := range f.parameters {
+		if !fn(&ssm.GetParametersByPathOutput{Parameters: []*ssm.Parameter{parameter}}, i == len(f.parameters)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestParameterStoreLoad(t *testing.T) {
+	client := &fakeSSM{parameters: []*ssm.Parameter{
+		{Name: aws.String("/soci-builder/min-layer-size"), Value: aws.String("20MiB")},
+		{Name: aws.String("/soci-builder/sns-topic-arn"), Value: aws.String("arn:aws:sns:eu-west-1:123456789012:builds")},
+	}}
+	values, err := (&ParameterStore{client: client}).Load(context.Background(), "soci-builder/")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	expected := map[string]string{"min-layer-size": "20MiB", "sns-topic-arn": "arn:aws:sns:eu-west-1:123456789012:builds"}
+	if !reflect.DeepEqual(values, expected) || client.path != "/soci-builder" {
+		t.Fatalf("Expected %v from /soci-builder but got %v from %s", expected, values, client.path)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package cpu sizes GOMAXPROCS to the CPUs the builder may use, e.g. the CPU limit of its container
+package cpu
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Limit returns the CPU quota of the cgroup of the process in CPUs, e.g. 1.5, if it has one
+func Limit() (float64, bool) {
+	return cgroupLimit(cgroupRoot)
+}
+
+// Read the CPU quota from the cgroup v2 cpu.max or the cgroup v1 CFS quota and period
+func cgroupLimit(root string) (float64, bool) {
+	if content, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		// "<quota> <period>" or "max <period>" without a limit
+		fields := strings.Fields(string(content))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return quota(fields[0], fields[1])
+	}
+	quotaContent, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	periodContent, err := os.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	// a quota of -1 means no limit
+	return quota(strings.TrimSpace(string(quotaContent)), strings.TrimSpace(string(periodContent)))
+}
+
+func quota(quotaUs string, periodUs string) (float64, bool) {
+	q, err := strconv.ParseFloat(quotaUs, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(periodUs, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// SetMaxProcs sets GOMAXPROCS to maxCpus, or if it is 0 to the CPU limit of the cgroup rounded up,
+// so the builder isn't throttled for running more threads than its quota. GOMAXPROCS is kept if it's
+// set in the environment or there is no limit. Returns the resulting GOMAXPROCS.
+func SetMaxProcs(maxCpus int) int {
+	if maxCpus <= 0 {
+		if os.Getenv("GOMAXPROCS") != "" {
+			return runtime.GOMAXPROCS(0)
+		}
+		limit, ok := Limit()
+		if !ok {
+			return runtime.GOMAXPROCS(0)
+		}
+		maxCpus = procsForLimit(limit)
+	}
+	runtime.GOMAXPROCS(min(maxCpus, runtime.NumCPU()))
+	return runtime.GOMAXPROCS(0)
+}
+
+// At least one CPU, a fractional CPU is rounded up
+func procsForLimit(limit float64) int {
+	return max(1, int(math.Ceil(limit)))
+}
@@ -0,0 +1,43 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package cpu
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupLimit(t *testing.T) {
+	write := func(path string, content string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	v2 := t.TempDir()
+	write(filepath.Join(v2, "cpu.max"), "150000 100000\n")
+	if limit, ok := cgroupLimit(v2); !ok || limit != 1.5 || procsForLimit(limit) != 2 {
+		t.Fatalf("Expected a limit of 1.5 CPUs but got %v %v", limit, ok)
+	}
+
+	unlimited := t.TempDir()
+	write(filepath.Join(unlimited, "cpu.max"), "max 100000\n")
+	if limit, ok := cgroupLimit(unlimited); ok {
+		t.Fatalf("Expected no limit but got %v", limit)
+	}
+
+	v1 := t.TempDir()
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "50000\n")
+	write(filepath.Join(v1, "cpu", "cpu.cfs_period_us"), "100000\n")
+	if limit, ok := cgroupLimit(v1); !ok || limit != 0.5 || procsForLimit(limit) != 1 {
+		t.Fatalf("Expected a limit of 0.5 CPUs but got %v %v", limit, ok)
+	}
+
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "-1\n")
+	if limit, ok := cgroupLimit(v1); ok {
+		t.Fatalf("Expected no limit but got %v", limit)
+	}
+}
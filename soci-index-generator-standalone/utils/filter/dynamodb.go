@@ -0,0 +1,85 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Values of the Action attribute of the items of a DynamoDB rules table
+const (
+	ActionAllow    = "allow"
+	ActionDeny     = "deny"
+	ActionAllowTag = "allow-tag"
+	ActionDenyTag  = "deny-tag"
+	// the pattern of the item is the maximum age of the images, e.g. 90d
+	ActionMaxAge = "max-age"
+)
+
+// DynamoDB table of the rules, one item per pattern.
+// The table must have a string partition key "Pattern", the "Action" attribute is one of the Action values.
+type dynamoDBSource struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+type ruleItem struct {
+	Pattern string
+	Action  string
+}
+
+func newDynamoDBSource(tableName string) *dynamoDBSource {
+	return &dynamoDBSource{client: dynamodb.New(session.New()), tableName: tableName}
+}
+
+func (s *dynamoDBSource) Load(ctx context.Context) (Rules, error) {
+	var rules Rules
+	var itemErr error
+	err := s.client.ScanPagesWithContext(ctx, &dynamodb.ScanInput{
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, attributes := range page.Items {
+			var item ruleItem
+			if itemErr = dynamodbattribute.UnmarshalMap(attributes, &item); itemErr != nil {
+				return false
+			}
+			switch item.Action {
+			case ActionAllow:
+				rules.Allow = append(rules.Allow, item.Pattern)
+			case ActionDeny:
+				rules.Deny = append(rules.Deny, item.Pattern)
+			case ActionAllowTag:
+				rules.AllowTags = append(rules.AllowTags, item.Pattern)
+			case ActionDenyTag:
+				rules.DenyTags = append(rules.DenyTags, item.Pattern)
+			case ActionMaxAge:
+				var maxAge time.Duration
+				if maxAge, itemErr = ParseAge(item.Pattern); itemErr != nil {
+					return false
+				}
+				rules.MaxAge = Age(maxAge)
+			default:
+				itemErr = fmt.Errorf("invalid action %q of pattern %q, expected %s, %s, %s, %s or %s", item.Action, item.Pattern, ActionAllow, ActionDeny, ActionAllowTag, ActionDenyTag, ActionMaxAge)
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = itemErr
+	}
+	if err != nil {
+		return Rules{}, err
+	}
+	return rules, rules.validate()
+}
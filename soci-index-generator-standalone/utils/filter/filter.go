@@ -0,0 +1,209 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package filter decides which images are indexed from allow and deny lists of repository and tag patterns
+// and a maximum image age, loaded from a file, an S3 object or a DynamoDB table so that a platform team can change them
+// for the whole fleet of builders without redeploying their configuration.
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Rules deciding which images are indexed. Patterns are matched like path.Match against the repository name
+// without the registry host, e.g. team/* (* doesn't match a /), or against the image if they have a tag
+// or digest, e.g. team/app:release-* or team/app@sha256:0123...
+type Rules struct {
+	// images that are indexed, all of them if empty
+	Allow []string `json:"allow"`
+	// images that aren't indexed even if they are allowed
+	Deny []string `json:"deny"`
+	// tags of the images that are indexed in any repository, e.g. release-*, all of them if empty.
+	// Images given by digest have no tag, they match no tag pattern.
+	AllowTags []string `json:"allowTags"`
+	// tags of the images that aren't indexed in any repository even if they are allowed, e.g. dev-*
+	DenyTags []string `json:"denyTags"`
+	// images pushed longer ago than this aren't indexed, no limit if 0
+	MaxAge Age `json:"maxAge"`
+}
+
+// How long ago an image was pushed, a Go duration (e.g. 36h) or a number of days (e.g. 90d) in JSON
+type Age time.Duration
+
+func (a *Age) UnmarshalJSON(content []byte) error {
+	var value string
+	if err := json.Unmarshal(content, &value); err != nil {
+		return err
+	}
+	age, err := ParseAge(value)
+	*a = Age(age)
+	return err
+}
+
+// ParseAge parses an age of a rule, a Go duration or a number of days, e.g. 90d
+func ParseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid age %q, expected a number of days or a duration", value)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected a number of days or a duration", value)
+	}
+	return age, nil
+}
+
+// Whether the image with the tag or digest reference in the repository is indexed
+func (r Rules) Allows(repository string, reference string) bool {
+	if matchAny(r.Deny, repository, reference) || matchTag(r.DenyTags, reference) {
+		return false
+	}
+	if len(r.AllowTags) > 0 && !matchTag(r.AllowTags, reference) {
+		return false
+	}
+	return len(r.Allow) == 0 || matchAny(r.Allow, repository, reference)
+}
+
+func matchTag(patterns []string, reference string) bool {
+	if strings.Contains(reference, ":") {
+		// a digest
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, reference); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, repository string, reference string) bool {
+	image := repository + ":" + reference
+	if strings.Contains(reference, ":") {
+		// a digest
+		image = repository + "@" + reference
+	}
+	for _, pattern := range patterns {
+		name := repository
+		if strings.ContainsAny(pattern, ":@") {
+			name = image
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rules) validate() error {
+	for _, pattern := range slices.Concat(r.Allow, r.Deny, r.AllowTags, r.DenyTags) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Source of the rules, read again when they are refreshed
+type Source interface {
+	Load(ctx context.Context) (Rules, error)
+}
+
+// Open the source of the rules at an S3 location (s3://bucket/key) of a JSON object, in a DynamoDB table
+// (dynamodb://table) or in a local JSON file
+func Open(location string) (Source, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("missing bucket or key in %q", location)
+		}
+		return newS3Source(bucket, key), nil
+	case strings.HasPrefix(location, "dynamodb://"):
+		table := strings.TrimPrefix(location, "dynamodb://")
+		if table == "" {
+			return nil, fmt.Errorf("missing table in %q", location)
+		}
+		return newDynamoDBSource(table), nil
+	}
+	return fileSource(location), nil
+}
+
+// JSON file of the rules
+type fileSource string
+
+func (f fileSource) Load(ctx context.Context) (Rules, error) {
+	content, err := os.ReadFile(string(f))
+	if err != nil {
+		return Rules{}, err
+	}
+	return parseRules(content)
+}
+
+func parseRules(content []byte) (Rules, error) {
+	var rules Rules
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return Rules{}, err
+	}
+	return rules, rules.validate()
+}
+
+// Filter checks images against the rules of a source, loading them again once they are older than the refresh interval
+type Filter struct {
+	source  Source
+	refresh time.Duration
+
+	mu       sync.Mutex
+	rules    Rules
+	loadedAt time.Time
+}
+
+// Load the rules of the source, refresh 0 keeps them for the whole run
+func New(ctx context.Context, source Source, refresh time.Duration) (*Filter, error) {
+	rules, err := source.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{source: source, refresh: refresh, rules: rules, loadedAt: time.Now()}, nil
+}
+
+// Whether the image is indexed
+func (f *Filter) Allows(ctx context.Context, repository string, reference string) bool {
+	return f.current(ctx).Allows(repository, reference)
+}
+
+// The maximum age of the images that are indexed, 0 if there is none
+func (f *Filter) MaxAge(ctx context.Context) time.Duration {
+	return time.Duration(f.current(ctx).MaxAge)
+}
+
+// The rules, loaded again if they are older than the refresh interval.
+// Rules that can't be refreshed are kept until the next refresh.
+func (f *Filter) current(ctx context.Context) Rules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.refresh > 0 && time.Since(f.loadedAt) >= f.refresh {
+		rules, err := f.source.Load(ctx)
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't refresh the image filter, keeping the rules loaded at %s: %v", f.loadedAt.Format(time.RFC3339), err))
+		} else {
+			f.rules = rules
+		}
+		f.loadedAt = time.Now()
+	}
+	return f.rules
+}
@@ -0,0 +1,209 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+func TestRulesAllows(t *testing.T) {
+	rules := Rules{
+		Allow: []string{"team/*", "platform/base:release-*"},
+		Deny:  []string{"team/scratch", "team/app@sha256:bad"},
+	}
+	for _, tc := range []struct {
+		repository string
+		reference  string
+		allowed    bool
+	}{
+		{"team/app", "latest", true},
+		{"team/app", "sha256:good", true},
+		{"team/app", "sha256:bad", false},
+		{"team/scratch", "latest", false},
+		{"team/nested/app", "latest", false},
+		{"platform/base", "release-1.2", true},
+		{"platform/base", "latest", false},
+		{"other/app", "latest", false},
+	} {
+		if allowed := rules.Allows(tc.repository, tc.reference); allowed != tc.allowed {
+			t.Fatalf("Expected %s %s allowed: %v, got %v", tc.repository, tc.reference, tc.allowed, allowed)
+		}
+	}
+	if !(Rules{}).Allows("any/repository", "latest") {
+		t.Fatalf("Expected rules without patterns to allow all images")
+	}
+}
+
+func TestRulesAllowsTags(t *testing.T) {
+	rules := Rules{AllowTags: []string{"release-*", "dev-*"}, DenyTags: []string{"dev-*"}}
+	for _, tc := range []struct {
+		reference string
+		allowed   bool
+	}{
+		{"release-1.2", true},
+		{"dev-1234", false},
+		{"latest", false},
+		// images given by digest match no tag pattern
+		{"sha256:1234", false},
+	} {
+		if allowed := rules.Allows("team/app", tc.reference); allowed != tc.allowed {
+			t.Fatalf("Expected %s allowed: %v, got %v", tc.reference, tc.allowed, allowed)
+		}
+	}
+	if !(Rules{DenyTags: []string{"dev-*"}}).Allows("team/app", "sha256:1234") {
+		t.Fatalf("Expected an image given by digest not to be denied by a tag pattern")
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"90d": 90 * 24 * time.Hour, "36h": 36 * time.Hour, "0d": 0} {
+		if age, err := ParseAge(value); err != nil || age != expected {
+			t.Fatalf("Expected %s to be %s but got %s, %v", value, expected, age, err)
+		}
+	}
+	for _, value := range []string{"d", "-1d", "90 days", "-1h"} {
+		if _, err := ParseAge(value); err == nil {
+			t.Fatalf("Expected the invalid age %q to be rejected", value)
+		}
+	}
+	rules, err := parseRules([]byte(`{"maxAge": "90d"}`))
+	if err != nil || time.Duration(rules.MaxAge) != 90*24*time.Hour {
+		t.Fatalf("Expected a max age of 90 days but got %+v, %v", rules, err)
+	}
+	if _, err := parseRules([]byte(`{"maxAge": "soon"}`)); err == nil {
+		t.Fatalf("Expected an invalid max age to be rejected")
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "filter.json")
+	if err := os.WriteFile(file, []byte(`{"deny": ["team/[scratch"]}`), 0644); err != nil {
+		t.Fatalf("Failed to write the rules: %v", err)
+	}
+	source, err := Open(file)
+	if err != nil {
+		t.Fatalf("Failed to open the rules: %v", err)
+	}
+	if _, err := source.Load(context.Background()); err == nil {
+		t.Fatalf("Expected an invalid pattern to be rejected")
+	}
+	if _, err := Open("s3://bucket"); err == nil {
+		t.Fatalf("Expected an S3 location without a key to be rejected")
+	}
+}
+
+// Source returning the given rules or error, counting the loads
+type fakeSource struct {
+	rules Rules
+	err   error
+	loads int
+}
+
+func (s *fakeSource) Load(ctx context.Context) (Rules, error) {
+	s.loads++
+	return s.rules, s.err
+}
+
+func TestFilterRefresh(t *testing.T) {
+	ctx := context.Background()
+	source := &fakeSource{rules: Rules{Deny: []string{"team/app"}}}
+	filter, err := New(ctx, source, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create the filter: %v", err)
+	}
+	if filter.Allows(ctx, "team/app", "latest") {
+		t.Fatalf("Expected the image to be denied")
+	}
+
+	// the rules changed in the source, but aren't refreshed yet
+	source.rules = Rules{}
+	if filter.Allows(ctx, "team/app", "latest") || source.loads != 1 {
+		t.Fatalf("Expected the rules to be kept until the refresh, loaded %d times", source.loads)
+	}
+
+	filter.loadedAt = time.Now().Add(-2 * time.Hour)
+	if !filter.Allows(ctx, "team/app", "latest") || source.loads != 2 {
+		t.Fatalf("Expected the refreshed rules to allow the image, loaded %d times", source.loads)
+	}
+
+	// rules that can't be refreshed are kept
+	source.rules, source.err = Rules{Deny: []string{"team/app"}}, errors.New("access denied")
+	filter.loadedAt = time.Now().Add(-2 * time.Hour)
+	if !filter.Allows(ctx, "team/app", "latest") {
+		t.Fatalf("Expected the last loaded rules to be kept")
+	}
+}
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(f.objects[*input.Bucket+"/"+*input.Key]))}, nil
+}
+
+func TestS3Source(t *testing.T) {
+	source := &s3Source{client: &fakeS3{objects: map[string]string{"config/soci/filter.json": `{"allow": ["team/*"]}`}}, bucket: "config", key: "soci/filter.json"}
+	rules, err := source.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to load the rules: %v", err)
+	}
+	if len(rules.Allow) != 1 || rules.Allow[0] != "team/*" {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+}
+
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	pages [][]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	for i, page := range f.pages {
+		if !fn(&dynamodb.ScanOutput{Items: page}, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func ruleAttributes(pattern string, action string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"Pattern": {S: aws.String(pattern)}, "Action": {S: aws.String(action)}}
+}
+
+func TestDynamoDBSource(t *testing.T) {
+	client := &fakeDynamoDB{pages: [][]map[string]*dynamodb.AttributeValue{
+		{ruleAttributes("team/*", ActionAllow)},
+		{ruleAttributes("team/scratch", ActionDeny), ruleAttributes("ml/*", ActionAllow)},
+		{ruleAttributes("dev-*", ActionDenyTag), ruleAttributes("90d", ActionMaxAge)},
+	}}
+	source := &dynamoDBSource{client: client, tableName: "soci-filter"}
+	rules, err := source.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to load the rules: %v", err)
+	}
+	if len(rules.Allow) != 2 || len(rules.Deny) != 1 || rules.Deny[0] != "team/scratch" || len(rules.DenyTags) != 1 || time.Duration(rules.MaxAge) != 90*24*time.Hour {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+
+	client.pages = append(client.pages, []map[string]*dynamodb.AttributeValue{ruleAttributes("other/*", "skip")})
+	if _, err := source.Load(context.Background()); err == nil {
+		t.Fatalf("Expected an item with an invalid action to be rejected")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// JSON object of the rules in an S3 bucket
+type s3Source struct {
+	client s3iface.S3API
+	bucket string
+	key    string
+}
+
+func newS3Source(bucket string, key string) *s3Source {
+	return &s3Source{client: s3.New(session.New()), bucket: bucket, key: key}
+}
+
+func (s *s3Source) Load(ctx context.Context) (Rules, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		return Rules{}, err
+	}
+	defer out.Body.Close()
+	content, err := io.ReadAll(out.Body)
+	if err != nil {
+		return Rules{}, err
+	}
+	return parseRules(content)
+}
@@ -0,0 +1,21 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package fs
+
+import "golang.org/x/sys/windows"
+
+// Calculate free splace in bytes of a directory
+func CalculateFreeSpace(path string) uint64 {
+	directoryName, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		panic(err)
+	}
+	// free bytes available to the caller, which respects disk quotas like Bavail does on unix
+	var freeBytesAvailable, totalBytes, totalFreeBytes uint64
+	err = windows.GetDiskFreeSpaceEx(directoryName, &freeBytesAvailable, &totalBytes, &totalFreeBytes)
+	if err != nil {
+		panic(err)
+	}
+	return freeBytesAvailable
+}
@@ -0,0 +1,131 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package lock provides distributed locks so that concurrent workers don't build the same SOCI index simultaneously
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Locker takes exclusive, expiring locks keyed by a string (e.g. an image digest)
+type Locker interface {
+	// Try to take the lock, returns false if it is held by another owner
+	Acquire(ctx context.Context, key string) (bool, error)
+	// Renew the lease of a lock taken by Acquire, so it doesn't expire while it's still used
+	Renew(ctx context.Context, key string) error
+	// Release a lock taken by Acquire
+	Release(ctx context.Context, key string) error
+}
+
+// DynamoDB backed lock.
+// The table must have a string partition key "LockKey". The "ExpiresAt" attribute holds
+// the lease expiry in epoch seconds and can be used as the table's TTL attribute.
+type DynamoDBLocker struct {
+	client        dynamodbiface.DynamoDBAPI
+	tableName     string
+	owner         string
+	leaseDuration time.Duration
+}
+
+// Create a locker using the given DynamoDB table. Locks that are not released
+// (e.g. because the worker crashed) or renewed expire after leaseDuration.
+func NewDynamoDBLocker(tableName string, leaseDuration time.Duration) *DynamoDBLocker {
+	return &DynamoDBLocker{
+		client:        dynamodb.New(session.New()),
+		tableName:     tableName,
+		owner:         newOwnerId(),
+		leaseDuration: leaseDuration,
+	}
+}
+
+func (l *DynamoDBLocker) Acquire(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	_, err := l.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.tableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockKey":   {S: aws.String(key)},
+			"Owner":     {S: aws.String(l.owner)},
+			"ExpiresAt": {N: aws.String(strconv.FormatInt(now.Add(l.leaseDuration).Unix(), 10))},
+		},
+		// free lock or a lease that expired
+		ConditionExpression: aws.String("attribute_not_exists(LockKey) OR ExpiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *DynamoDBLocker) Renew(ctx context.Context, key string) error {
+	_, err := l.client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(l.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockKey": {S: aws.String(key)},
+		},
+		UpdateExpression:    aws.String("SET ExpiresAt = :expiresAt"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":     {S: aws.String(l.owner)},
+			":expiresAt": {N: aws.String(strconv.FormatInt(time.Now().Add(l.leaseDuration).Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return fmt.Errorf("lock %s expired and was taken by another owner", key)
+	}
+	return err
+}
+
+func (l *DynamoDBLocker) Release(ctx context.Context, key string) error {
+	_, err := l.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockKey": {S: aws.String(key)},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(l.owner)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return fmt.Errorf("lock %s expired and was taken by another owner", key)
+	}
+	return err
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// Identify this process as the owner of the locks it takes
+func newOwnerId() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
@@ -0,0 +1,157 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package lock
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB evaluates the condition expressions of DynamoDBLocker on an in-memory table
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+var errConditionalCheckFailed = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	key := *input.Item["LockKey"].S
+	if item, ok := f.items[key]; ok {
+		// attribute_not_exists(LockKey) OR ExpiresAt < :now
+		expiresAt, _ := strconv.ParseInt(*item["ExpiresAt"].N, 10, 64)
+		now, _ := strconv.ParseInt(*input.ExpressionAttributeValues[":now"].N, 10, 64)
+		if expiresAt >= now {
+			return nil, errConditionalCheckFailed
+		}
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// Whether the item of the key exists and is owned by :owner
+func (f *fakeDynamoDB) ownedBy(key map[string]*dynamodb.AttributeValue, values map[string]*dynamodb.AttributeValue) bool {
+	item, ok := f.items[*key["LockKey"].S]
+	return ok && *item["Owner"].S == *values[":owner"].S
+}
+
+func (f *fakeDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if !f.ownedBy(input.Key, input.ExpressionAttributeValues) {
+		return nil, errConditionalCheckFailed
+	}
+	f.items[*input.Key["LockKey"].S]["ExpiresAt"] = input.ExpressionAttributeValues[":expiresAt"]
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if !f.ownedBy(input.Key, input.ExpressionAttributeValues) {
+		return nil, errConditionalCheckFailed
+	}
+	delete(f.items, *input.Key["LockKey"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// Two workers sharing a lock table
+func newTestLockers(leaseDuration time.Duration) (*DynamoDBLocker, *DynamoDBLocker, *fakeDynamoDB) {
+	table := &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}
+	first := &DynamoDBLocker{client: table, tableName: "locks", owner: "worker-1", leaseDuration: leaseDuration}
+	second := &DynamoDBLocker{client: table, tableName: "locks", owner: "worker-2", leaseDuration: leaseDuration}
+	return first, second, table
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	first, second, _ := newTestLockers(time.Minute)
+
+	acquired, err := first.Acquire(ctx, "sha256:1234")
+	if err != nil || !acquired {
+		t.Fatalf("Expected the free lock to be acquired but got %v, %v", acquired, err)
+	}
+	// locks of other keys are independent
+	acquired, err = second.Acquire(ctx, "sha256:5678")
+	if err != nil || !acquired {
+		t.Fatalf("Expected the lock of another key to be acquired but got %v, %v", acquired, err)
+	}
+}
+
+func TestAcquireContended(t *testing.T) {
+	ctx := context.Background()
+	first, second, _ := newTestLockers(time.Minute)
+
+	if acquired, err := first.Acquire(ctx, "sha256:1234"); err != nil || !acquired {
+		t.Fatalf("Expected the free lock to be acquired but got %v, %v", acquired, err)
+	}
+	acquired, err := second.Acquire(ctx, "sha256:1234")
+	if err != nil || acquired {
+		t.Fatalf("Expected the held lock not to be acquired but got %v, %v", acquired, err)
+	}
+}
+
+func TestAcquireExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	first, second, table := newTestLockers(time.Minute)
+
+	if acquired, err := first.Acquire(ctx, "sha256:1234"); err != nil || !acquired {
+		t.Fatalf("Expected the free lock to be acquired but got %v, %v", acquired, err)
+	}
+	// the first worker crashed 2 minutes ago
+	table.items["sha256:1234"]["ExpiresAt"].N = aws.String(strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	acquired, err := second.Acquire(ctx, "sha256:1234")
+	if err != nil || !acquired {
+		t.Fatalf("Expected the expired lock to be acquired but got %v, %v", acquired, err)
+	}
+	if err := first.Renew(ctx, "sha256:1234"); err == nil {
+		t.Fatalf("Expected renewing the lock taken by another owner to fail")
+	}
+	if err := first.Release(ctx, "sha256:1234"); err == nil {
+		t.Fatalf("Expected releasing the lock taken by another owner to fail")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	ctx := context.Background()
+	first, second, table := newTestLockers(time.Minute)
+
+	if acquired, err := first.Acquire(ctx, "sha256:1234"); err != nil || !acquired {
+		t.Fatalf("Expected the free lock to be acquired but got %v, %v", acquired, err)
+	}
+	table.items["sha256:1234"]["ExpiresAt"].N = aws.String(strconv.FormatInt(time.Now().Unix(), 10))
+	if err := first.Renew(ctx, "sha256:1234"); err != nil {
+		t.Fatalf("Failed to renew the lock: %v", err)
+	}
+	expiresAt, _ := strconv.ParseInt(*table.items["sha256:1234"]["ExpiresAt"].N, 10, 64)
+	if expiresAt < time.Now().Add(50*time.Second).Unix() {
+		t.Fatalf("Expected the lease to be extended but it expires at %d", expiresAt)
+	}
+	if acquired, err := second.Acquire(ctx, "sha256:1234"); err != nil || acquired {
+		t.Fatalf("Expected the renewed lock not to be acquired but got %v, %v", acquired, err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ctx := context.Background()
+	first, second, _ := newTestLockers(time.Minute)
+
+	if acquired, err := first.Acquire(ctx, "sha256:1234"); err != nil || !acquired {
+		t.Fatalf("Expected the free lock to be acquired but got %v, %v", acquired, err)
+	}
+	if err := second.Release(ctx, "sha256:1234"); err == nil {
+		t.Fatalf("Expected releasing the lock of another owner to fail")
+	}
+	if err := first.Release(ctx, "sha256:1234"); err != nil {
+		t.Fatalf("Failed to release the lock: %v", err)
+	}
+	acquired, err := second.Acquire(ctx, "sha256:1234")
+	if err != nil || !acquired {
+		t.Fatalf("Expected the released lock to be acquired but got %v, %v", acquired, err)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "builder.log")
+	f, err := OpenRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("Failed to open the log file: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "fourth\n" {
+		t.Fatalf("Unexpected content of the current log file: %q", current)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected two backups to be kept but got %v", backups)
+	}
+	oldest, _ := os.ReadFile(backups[0])
+	if !strings.HasPrefix(string(oldest), "second") {
+		t.Fatalf("Expected the oldest backup to be removed but got %q", oldest)
+	}
+}
@@ -29,6 +29,13 @@ func Info(ctx context.Context, msg string) {
 	logEvent.Msg(msg)
 }
 
+// Debug logs a message with additional structured fields
+func Debug(ctx context.Context, msg string, fields map[string]interface{}) {
+	logEvent := log.Debug().Fields(fields)
+	addContext(ctx, logEvent)
+	logEvent.Msg(msg)
+}
+
 // Add more context to the log event
 func addContext(ctx context.Context, logEvent *zerolog.Event) {
 	contextKeys := []string{
@@ -36,6 +43,8 @@ func addContext(ctx context.Context, logEvent *zerolog.Event) {
 		"RepositoryName",
 		"ImageDigest",
 		"ImageTag",
+		"Platform",
+		"LayerDigest",
 		"SOCIIndexDigest"}
 
 	for _, contextKey := range contextKeys {
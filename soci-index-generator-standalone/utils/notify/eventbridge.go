@@ -0,0 +1,64 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+)
+
+// EventIndexBuilt is the detail type of the events emitted after a SOCI index was built
+const EventIndexBuilt = "soci.index.built"
+
+// EventBridgeNotifier emits a soci.index.built event with the build event as detail for every successful build,
+// so other automation such as cache warmers or deployment gates can subscribe to it
+type EventBridgeNotifier struct {
+	client   eventbridgeiface.EventBridgeAPI
+	eventBus string
+	source   string
+}
+
+// Create a notifier putting events on the given event bus (name or ARN) with the given source
+func NewEventBridgeNotifier(eventBus string, source string) *EventBridgeNotifier {
+	return &EventBridgeNotifier{
+		client:   eventbridge.New(session.New()),
+		eventBus: eventBus,
+		source:   source,
+	}
+}
+
+func (n *EventBridgeNotifier) Notify(ctx context.Context, event Event) error {
+	if outcomeOf(event.Status) != OutcomeSuccess {
+		return nil
+	}
+
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	output, err := n.client.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: aws.String(n.eventBus),
+			Source:       aws.String(n.source),
+			DetailType:   aws.String(EventIndexBuilt),
+			Detail:       aws.String(string(detail)),
+			Time:         aws.Time(event.Time),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	// PutEvents reports failed entries in the response instead of an error
+	if aws.Int64Value(output.FailedEntryCount) > 0 && len(output.Entries) > 0 {
+		return fmt.Errorf("putting event failed: %s: %s", aws.StringValue(output.Entries[0].ErrorCode), aws.StringValue(output.Entries[0].ErrorMessage))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+)
+
+type fakeEventBridge struct {
+	eventbridgeiface.EventBridgeAPI
+	entries []*eventbridge.PutEventsRequestEntry
+}
+
+func (f *fakeEventBridge) PutEventsWithContext(ctx aws.Context, input *eventbridge.PutEventsInput, opts ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	f.entries = append(f.entries, input.Entries...)
+	return &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil
+}
+
+func TestEventBridgeNotifier(t *testing.T) {
+	client := &fakeEventBridge{}
+	notifier := &EventBridgeNotifier{client: client, eventBus: "default", source: "soci-index-builder"}
+
+	ctx := context.Background()
+	for _, status := range []string{"failed", "skipped", "pushed"} {
+		if err := notifier.Notify(ctx, Event{Status: status, Repository: "repo"}); err != nil {
+			t.Fatalf("Notify failed: %v", err)
+		}
+	}
+
+	if len(client.entries) != 1 {
+		t.Fatalf("Expected an event for the pushed build only but got %d", len(client.entries))
+	}
+	if *client.entries[0].DetailType != EventIndexBuilt || *client.entries[0].Source != "soci-index-builder" {
+		t.Fatalf("Unexpected event %v", client.entries[0])
+	}
+}
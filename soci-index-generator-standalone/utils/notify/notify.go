@@ -0,0 +1,44 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package notify publishes the outcome of builds to downstream systems.
+package notify
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Event describes the outcome of building the SOCI indices of an image
+type Event struct {
+	// one of the state statuses: pushed, built, skipped or failed
+	Status       string   `json:"status"`
+	Repository   string   `json:"repository"`
+	ImageDigest  string   `json:"imageDigest,omitempty"`
+	IndexDigests []string `json:"indexDigests,omitempty"`
+	Message      string   `json:"message"`
+	Error        string   `json:"error,omitempty"`
+	// the step that failed, e.g. "Image pull error", so alerts can be routed without parsing the error
+	ErrorClass string    `json:"errorClass,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Time       time.Time `json:"time"`
+}
+
+// Notifier publishes build events
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Multi notifies all of its notifiers, failing notifiers don't keep the others from being notified
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, event Event) error {
+	var errs []error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,51 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// SNSNotifier publishes build events as JSON messages to an SNS topic.
+// The status and error class are also set as message attributes, so subscriptions can filter on them.
+type SNSNotifier struct {
+	client   snsiface.SNSAPI
+	topicArn string
+}
+
+// Create a notifier publishing to the given SNS topic
+func NewSNSNotifier(topicArn string) *SNSNotifier {
+	return &SNSNotifier{
+		client:   sns.New(session.New()),
+		topicArn: topicArn,
+	}
+}
+
+func (n *SNSNotifier) Notify(ctx context.Context, event Event) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	attributes := map[string]*sns.MessageAttributeValue{
+		"status": {DataType: aws.String("String"), StringValue: aws.String(event.Status)},
+	}
+	if event.ErrorClass != "" {
+		attributes["errorClass"] = &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(event.ErrorClass)}
+	}
+
+	_, err = n.client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn:          aws.String(n.topicArn),
+		Subject:           aws.String("SOCI index build " + event.Status),
+		Message:           aws.String(string(message)),
+		MessageAttributes: attributes,
+	})
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	f.published = append(f.published, input)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestSNSNotifier(t *testing.T) {
+	client := &fakeSNS{}
+	notifier := &SNSNotifier{client: client, topicArn: "arn:aws:sns:eu-west-1:123456789012:soci"}
+
+	err := notifier.Notify(context.Background(), Event{Status: "failed", Repository: "repo", ErrorClass: "Image pull error"})
+	if err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(client.published) != 1 {
+		t.Fatalf("Expected one published message but got %d", len(client.published))
+	}
+
+	input := client.published[0]
+	var event Event
+	if err := json.Unmarshal([]byte(*input.Message), &event); err != nil || event.Repository != "repo" {
+		t.Fatalf("Unexpected message %s: %v", *input.Message, err)
+	}
+	if *input.MessageAttributes["status"].StringValue != "failed" || *input.MessageAttributes["errorClass"].StringValue != "Image pull error" {
+		t.Fatalf("Unexpected message attributes: %v", input.MessageAttributes)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// Outcomes a webhook can be sent for
+const (
+	OutcomeSuccess = "success"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// DefaultWebhookTemplate is a Slack compatible payload summarizing the build
+const DefaultWebhookTemplate = `{"text": {{ json (printf "SOCI index build %s for %s@%s: %s" .Status .Repository .ImageDigest .Message) }}}`
+
+// WebhookNotifier posts build events to an HTTP endpoint, e.g. a Slack incoming webhook.
+// The payload is rendered from a text/template with the Event as data and a json function to quote values.
+type WebhookNotifier struct {
+	url      string
+	payload  *template.Template
+	outcomes map[string]bool
+	client   *http.Client
+}
+
+// Create a notifier posting to url for the given outcomes (success, skipped or failed), all outcomes if none are given
+func NewWebhookNotifier(url string, payloadTemplate string, outcomes []string) (*WebhookNotifier, error) {
+	payload, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(payloadTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &WebhookNotifier{
+		url:      url,
+		payload:  payload,
+		outcomes: map[string]bool{},
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, outcome := range outcomes {
+		if outcome != OutcomeSuccess && outcome != OutcomeSkipped && outcome != OutcomeFailed {
+			return nil, fmt.Errorf("invalid outcome %q, expected success, skipped or failed", outcome)
+		}
+		n.outcomes[outcome] = true
+	}
+	return n, nil
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	if len(n.outcomes) > 0 && !n.outcomes[outcomeOf(event.Status)] {
+		return nil
+	}
+
+	var body bytes.Buffer
+	if err := n.payload.Execute(&body, event); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Outcome of a build status, pushed and built are both a success
+func outcomeOf(status string) string {
+	switch status {
+	case "pushed", "built":
+		return OutcomeSuccess
+	case "skipped":
+		return OutcomeSkipped
+	default:
+		return OutcomeFailed
+	}
+}
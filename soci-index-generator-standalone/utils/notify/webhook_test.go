@@ -0,0 +1,47 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var payloads []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]string
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Invalid payload %s: %v", body, err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	notifier, err := NewWebhookNotifier(server.URL, DefaultWebhookTemplate, []string{OutcomeFailed})
+	if err != nil {
+		t.Fatalf("Failed to create the notifier: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := notifier.Notify(ctx, Event{Status: "pushed", Repository: "repo"}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if err := notifier.Notify(ctx, Event{Status: "failed", Repository: "repo", ImageDigest: "sha256:abc", Message: `Image pull error "quoted"`}); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+
+	if len(payloads) != 1 {
+		t.Fatalf("Expected only the failed build to be posted but got %d payloads", len(payloads))
+	}
+	expected := `SOCI index build failed for repo@sha256:abc: Image pull error "quoted"`
+	if payloads[0]["text"] != expected {
+		t.Fatalf("Unexpected payload text. Expected %s but got %s", expected, payloads[0]["text"])
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	orasregistry "oras.land/oras-go/v2/registry"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Copy an image and the SOCI indices referring to it to a repository of another (or the same) registry.
+// The SOCI indices of multi-platform images refer to the platform manifests, so the referrers of each of them are copied.
+// Returns the descriptor of the image and of the copied SOCI indices.
+func (registry *Registry) Copy(ctx context.Context, repositoryName string, reference string, destination *Registry, destinationRepositoryName string, destinationReference string) (ocispec.Descriptor, []ocispec.Descriptor, error) {
+	log.Info(ctx, "Copying image")
+	src, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	dst, err := destination.registry.Repository(ctx, destinationRepositoryName)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+
+	imageDescriptor, err := oras.Copy(ctx, src, reference, dst, destinationReference, oras.CopyOptions{CopyGraphOptions: registry.copyGraphOptions()})
+	if err != nil {
+		return imageDescriptor, nil, err
+	}
+
+	manifests := []ocispec.Descriptor{imageDescriptor}
+	if imageDescriptor.MediaType == ocispec.MediaTypeImageIndex || imageDescriptor.MediaType == MediaTypeDockerManifestList {
+		successors, err := content.Successors(ctx, src, imageDescriptor)
+		if err != nil {
+			return imageDescriptor, nil, err
+		}
+		for _, successor := range successors {
+			if images.IsManifestType(successor.MediaType) {
+				manifests = append(manifests, successor)
+			}
+		}
+	}
+
+	var indexDescriptors []ocispec.Descriptor
+	for _, manifest := range manifests {
+		referrers, err := sociReferrers(ctx, src, manifest)
+		if err != nil {
+			return imageDescriptor, indexDescriptors, fmt.Errorf("listing SOCI indices of %s: %w", manifest.Digest, err)
+		}
+		for _, referrer := range referrers {
+			log.Info(ctx, fmt.Sprintf("Copying SOCI index %s of %s", referrer.Digest, manifest.Digest))
+			err = oras.CopyGraph(ctx, src, dst, referrer, registry.copyGraphOptions())
+			if err != nil {
+				return imageDescriptor, indexDescriptors, err
+			}
+			indexDescriptors = append(indexDescriptors, referrer)
+		}
+	}
+
+	return imageDescriptor, indexDescriptors, nil
+}
+
+// List the SOCI indices referring to a manifest, using the referrers tag schema on registries without the referrers API
+func sociReferrers(ctx context.Context, repo orasregistry.ReferrerLister, manifest ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var referrers []ocispec.Descriptor
+	err := repo.Referrers(ctx, manifest, soci.SociIndexArtifactType, func(descs []ocispec.Descriptor) error {
+		referrers = append(referrers, descs...)
+		return nil
+	})
+	return referrers, err
+}
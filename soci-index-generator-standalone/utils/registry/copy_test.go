@@ -0,0 +1,93 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+// The manifest of a SOCI index with one ztoc referring to subject
+func sociIndexManifest(subject *ocispec.Descriptor, ztoc []byte) []byte {
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactType,
+		Config:       ocispec.DescriptorEmptyJSON,
+		Layers:       []ocispec.Descriptor{{MediaType: soci.SociLayerMediaType, Digest: digest.FromBytes(ztoc), Size: int64(len(ztoc))}},
+		Subject:      subject,
+	})
+	return manifest
+}
+
+// Push a SOCI index with one ztoc referring to subject, with its blobs
+func pushSociIndex(testRegistry *testregistry.Registry, repository string, subject ocispec.Descriptor, ztoc []byte) ocispec.Descriptor {
+	testRegistry.PushBlob(repository, ocispec.MediaTypeEmptyJSON, ocispec.DescriptorEmptyJSON.Data)
+	testRegistry.PushBlob(repository, soci.SociLayerMediaType, ztoc)
+	return testRegistry.PushManifest(repository, "", ocispec.MediaTypeImageManifest, sociIndexManifest(&subject, ztoc))
+}
+
+// Push a multi-platform image of two platforms, each with a SOCI index, returning the platform manifests and indices
+func pushMultiPlatformImage(testRegistry *testregistry.Registry, repository string, tag string) ([]ocispec.Descriptor, []ocispec.Descriptor) {
+	var manifests, indices []ocispec.Descriptor
+	for _, platform := range []ocispec.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}} {
+		manifest := testRegistry.PushImage(repository, "", []byte(platform.Architecture))
+		manifest.Platform = &platform
+		manifests = append(manifests, manifest)
+		indices = append(indices, pushSociIndex(testRegistry, repository, manifest, []byte("ztoc of "+platform.Architecture)))
+	}
+	index, _ := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	})
+	testRegistry.PushManifest(repository, tag, ocispec.MediaTypeImageIndex, index)
+	return manifests, indices
+}
+
+func TestCopy(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	manifests, indices := pushMultiPlatformImage(testRegistry, "source", "latest")
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+	registry, err := Init(ctx, testregistry.Host, WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	imageDescriptor, copied, err := registry.Copy(ctx, "source", "latest", registry, "destination", "copied")
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if imageDescriptor.MediaType != ocispec.MediaTypeImageIndex || len(copied) != len(indices) {
+		t.Fatalf("Expected the image index and %d SOCI indices to be copied but got %v, %v", len(indices), imageDescriptor, copied)
+	}
+
+	destination, err := registry.HeadManifest(ctx, "destination", "copied")
+	if err != nil || destination.Digest != imageDescriptor.Digest {
+		t.Fatalf("Expected the image index %s at the destination but got %v, %v", imageDescriptor.Digest, destination, err)
+	}
+	for i, manifest := range manifests {
+		if _, err := registry.HeadManifest(ctx, "destination", manifest.Digest.String()); err != nil {
+			t.Fatalf("Expected the %s manifest at the destination but got %v", manifest.Platform.Architecture, err)
+		}
+		referrers := testRegistry.Referrers("destination", manifest.Digest)
+		if len(referrers) != 1 || referrers[0].Digest != indices[i].Digest {
+			t.Fatalf("Expected the SOCI index %s to refer to the %s manifest at the destination but got %v", indices[i].Digest, manifest.Platform.Architecture, referrers)
+		}
+		if err := registry.VerifyPush(ctx, "destination", referrers[0]); err != nil {
+			t.Fatalf("Expected the copied SOCI index with its blobs but got %v", err)
+		}
+	}
+}
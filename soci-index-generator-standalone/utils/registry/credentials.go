@@ -0,0 +1,100 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// How long before its expiry an ECR authorization token is refreshed
+const ecrTokenRefreshMargin = 15 * time.Minute
+
+// ECR authorization tokens are valid for 12 hours
+const ecrTokenLifetime = 12 * time.Hour
+
+// Credentials of the ECR registries used during this run by registry host,
+// so registry clients of the same registry share the token instead of getting a new one each
+var (
+	ecrCredentialsMu     sync.Mutex
+	ecrCredentialsByHost = map[string]*ecrCredentials{}
+)
+
+// The shared credentials of the registry host, created with the given client if there are none yet
+func cachedEcrCredentials(registryHost string, client ecriface.ECRAPI) *ecrCredentials {
+	ecrCredentialsMu.Lock()
+	defer ecrCredentialsMu.Unlock()
+
+	credentials, ok := ecrCredentialsByHost[registryHost]
+	if !ok {
+		credentials = &ecrCredentials{client: client}
+		ecrCredentialsByHost[registryHost] = credentials
+	}
+	return credentials
+}
+
+// ecrCredentials gets ECR authorization tokens and refreshes them before they expire
+type ecrCredentials struct {
+	client ecriface.ECRAPI
+
+	mu         sync.Mutex
+	credential auth.Credential
+	expiresAt  time.Time
+}
+
+// Credential returns the current token as basic auth credentials, see auth.Client.Credential
+func (c *ecrCredentials) Credential(ctx context.Context, hostport string) (auth.Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credential != auth.EmptyCredential && time.Until(c.expiresAt) > ecrTokenRefreshMargin {
+		return c.credential, nil
+	}
+	refresh := c.credential != auth.EmptyCredential
+
+	getAuthorizationTokenResponse, err := c.client.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
+		return auth.EmptyCredential, errors.New("Couldn't authorize with ECR: empty authorization data returned")
+	}
+	authorizationData := getAuthorizationTokenResponse.AuthorizationData[0]
+	ecrAuthorizationToken := aws.StringValue(authorizationData.AuthorizationToken)
+	if len(ecrAuthorizationToken) == 0 {
+		return auth.EmptyCredential, errors.New("Couldn't authorize with ECR: empty authorization token returned")
+	}
+
+	// the token is the base64 encoded user:password of basic auth
+	decoded, err := base64.StdEncoding.DecodeString(ecrAuthorizationToken)
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("Couldn't authorize with ECR: decoding the authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return auth.EmptyCredential, errors.New("Couldn't authorize with ECR: malformed authorization token returned")
+	}
+
+	c.credential = auth.Credential{Username: username, Password: password}
+	c.expiresAt = time.Now().Add(ecrTokenLifetime)
+	if authorizationData.ExpiresAt != nil {
+		c.expiresAt = *authorizationData.ExpiresAt
+	}
+	if refresh {
+		log.Info(ctx, "Refreshed ECR authorization token")
+	}
+	return c.credential, nil
+}
@@ -0,0 +1,84 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+var ErrNotEcrRegistry = errors.New("Registry is not an ECR registry")
+
+// Settings of ECR repositories created by the builder
+type RepositorySettings struct {
+	// reject pushes of tags that already exist
+	TagImmutability bool
+	// scan images for vulnerabilities when they are pushed
+	ScanOnPush bool
+}
+
+// Create the ECR repository unless it already exists, reporting whether it was created
+func (registry *Registry) CreateRepository(ctx context.Context, repositoryName string, settings RepositorySettings) (bool, error) {
+	if registry.ecrClient == nil {
+		return false, ErrNotEcrRegistry
+	}
+	registryId := ecrRegistryId(registry.registry.Reference.Registry)
+
+	_, err := registry.ecrClient.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      registryId,
+		RepositoryNames: []*string{aws.String(repositoryName)},
+	})
+	if err == nil {
+		return false, nil
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+		return false, err
+	}
+
+	tagMutability := ecr.ImageTagMutabilityMutable
+	if settings.TagImmutability {
+		tagMutability = ecr.ImageTagMutabilityImmutable
+	}
+	log.Info(ctx, "Creating ECR repository "+repositoryName)
+	_, err = registry.ecrClient.CreateRepositoryWithContext(ctx, &ecr.CreateRepositoryInput{
+		RegistryId:                 registryId,
+		RepositoryName:             aws.String(repositoryName),
+		ImageTagMutability:         aws.String(tagMutability),
+		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(settings.ScanOnPush)},
+	})
+	if err != nil {
+		// another worker may have created it in the meantime
+		if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeRepositoryAlreadyExistsException {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Host of an ECR registry, e.g. 123456789012.dkr.ecr.eu-west-1.amazonaws.com or 123456789012.dkr.ecr-fips.us-east-1.amazonaws.com
+var ecrHostRegex = regexp.MustCompile(`^\d{12}\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// The region in the host of an ECR registry, empty if it isn't one
+func ecrRegion(registryHost string) string {
+	match := ecrHostRegex.FindStringSubmatch(registryHost)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// The account ID in the host of an ECR registry, e.g. 123456789012.dkr.ecr.eu-west-1.amazonaws.com
+func ecrRegistryId(registryHost string) *string {
+	return aws.String(strings.Split(registryHost, ".")[0])
+}
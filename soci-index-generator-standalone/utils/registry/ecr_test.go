@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+type fakeEcr struct {
+	ecriface.ECRAPI
+	repositories map[string]*ecr.CreateRepositoryInput
+}
+
+func (f *fakeEcr) DescribeRepositoriesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	repository, ok := f.repositories[*input.RepositoryNames[0]]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+	}
+	return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{
+		{RepositoryName: repository.RepositoryName, ImageTagMutability: repository.ImageTagMutability},
+	}}, nil
+}
+
+func (f *fakeEcr) CreateRepositoryWithContext(ctx aws.Context, input *ecr.CreateRepositoryInput, opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	f.repositories[*input.RepositoryName] = input
+	return &ecr.CreateRepositoryOutput{}, nil
+}
+
+func TestCreateRepository(t *testing.T) {
+	remoteRegistry, _ := remote.NewRegistry("123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	fake := &fakeEcr{repositories: map[string]*ecr.CreateRepositoryInput{}}
+	registry := &Registry{registry: remoteRegistry, ecrClient: fake}
+
+	created, err := registry.CreateRepository(context.Background(), "team/app", RepositorySettings{TagImmutability: true, ScanOnPush: true})
+	if err != nil || !created {
+		t.Fatalf("Expected the repository to be created, got %v, %v", created, err)
+	}
+	input := fake.repositories["team/app"]
+	if *input.RegistryId != "123456789012" || *input.ImageTagMutability != ecr.ImageTagMutabilityImmutable || !*input.ImageScanningConfiguration.ScanOnPush {
+		t.Fatalf("Unexpected repository settings: %v", input)
+	}
+
+	created, err = registry.CreateRepository(context.Background(), "team/app", RepositorySettings{})
+	if err != nil || created {
+		t.Fatalf("Expected the existing repository to be kept, got %v, %v", created, err)
+	}
+	immutable, err := registry.ecrTagImmutable(context.Background(), "team/app")
+	if err != nil || !immutable {
+		t.Fatalf("Expected the created repository to have immutable tags, got %v, %v", immutable, err)
+	}
+
+	_, err = (&Registry{registry: remoteRegistry}).CreateRepository(context.Background(), "team/app", RepositorySettings{})
+	if err != ErrNotEcrRegistry {
+		t.Fatalf("Expected an error for a registry other than ECR but got %v", err)
+	}
+}
+
+func TestUntaggedExpirationRules(t *testing.T) {
+	policy := `{"rules": [
+		{"rulePriority": 1, "selection": {"tagStatus": "tagged", "tagPrefixList": ["dev"], "countType": "imageCountMoreThan", "countNumber": 10}, "action": {"type": "expire"}},
+		{"rulePriority": 2, "selection": {"tagStatus": "untagged", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 14}, "action": {"type": "expire"}},
+		{"rulePriority": 3, "selection": {"tagStatus": "any", "countType": "imageCountMoreThan", "countNumber": 100}, "action": {"type": "expire"}}
+	]}`
+	rules, err := untaggedExpirationRules(policy)
+	if err != nil {
+		t.Fatalf("Failed to parse the lifecycle policy: %v", err)
+	}
+	if len(rules) != 2 || rules[0].RulePriority != 2 || rules[1].RulePriority != 3 {
+		t.Fatalf("Expected rules 2 and 3 to expire untagged images but got %+v", rules)
+	}
+}
+
+func TestEcrRegion(t *testing.T) {
+	for host, region := range map[string]string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com":      "eu-west-1",
+		"123456789012.dkr.ecr-fips.us-east-1.amazonaws.com": "us-east-1",
+		"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn":  "cn-north-1",
+		"public.ecr.aws": "",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com.example": "",
+	} {
+		if ecrRegion(host) != region {
+			t.Fatalf("Expected region %q of %s but got %q", region, host, ecrRegion(host))
+		}
+	}
+}
+
+type fakeEcrTokens struct {
+	ecriface.ECRAPI
+	requests  int
+	expiresAt time.Time
+}
+
+func (f *fakeEcrTokens) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.requests++
+	token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password-%d", f.requests)))
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{
+		{AuthorizationToken: aws.String(token), ExpiresAt: aws.Time(f.expiresAt)},
+	}}, nil
+}
+
+func TestEcrCredentialsRefresh(t *testing.T) {
+	fake := &fakeEcrTokens{expiresAt: time.Now().Add(ecrTokenLifetime)}
+	credentials := &ecrCredentials{client: fake}
+
+	for i := 0; i < 2; i++ {
+		credential, err := credentials.Credential(context.Background(), "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+		if err != nil {
+			t.Fatalf("Failed to get credentials: %v", err)
+		}
+		if credential.Username != "AWS" || credential.Password != "password-1" {
+			t.Fatalf("Unexpected credentials: %+v", credential)
+		}
+	}
+	if fake.requests != 1 {
+		t.Fatalf("Expected the token to be reused but got %d token requests", fake.requests)
+	}
+
+	// a token about to expire is refreshed
+	credentials.expiresAt = time.Now().Add(time.Minute)
+	credential, err := credentials.Credential(context.Background(), "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	if err != nil || credential.Password != "password-2" {
+		t.Fatalf("Expected a refreshed token but got %+v, %v", credential, err)
+	}
+}
+
+func TestCachedEcrCredentials(t *testing.T) {
+	fake := &fakeEcrTokens{expiresAt: time.Now().Add(ecrTokenLifetime)}
+	for i := 0; i < 3; i++ {
+		_, err := cachedEcrCredentials("210987654321.dkr.ecr.eu-west-1.amazonaws.com", fake).Credential(context.Background(), "")
+		if err != nil {
+			t.Fatalf("Failed to get credentials: %v", err)
+		}
+	}
+	if fake.requests != 1 {
+		t.Fatalf("Expected one token request for the registry but got %d", fake.requests)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Most image IDs of a BatchGetImage and layer digests of a BatchCheckLayerAvailability call
+const ecrBatchSize = 100
+
+// Fetch the raw content of many manifests of the repository by their descriptors, in the order of the descriptors.
+// ECR registries return them with a single BatchGetImage call per 100 manifests instead of a request per manifest.
+// Manifests ECR doesn't return with the expected digest, or all of them if the call fails, are fetched one by one.
+func (registry *Registry) FetchManifests(ctx context.Context, repositoryName string, descs []ocispec.Descriptor) ([][]byte, error) {
+	fetched := registry.batchGetManifests(ctx, repositoryName, descs)
+	manifests := make([][]byte, len(descs))
+	for i, desc := range descs {
+		if manifest, ok := fetched[desc.Digest]; ok {
+			manifests[i] = manifest
+			continue
+		}
+		_, manifest, err := registry.FetchManifest(ctx, repositoryName, desc.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		manifests[i] = manifest
+	}
+	return manifests, nil
+}
+
+// Fetch the manifests with BatchGetImage, by digest. Manifests that couldn't be fetched this way are missing.
+func (registry *Registry) batchGetManifests(ctx context.Context, repositoryName string, descs []ocispec.Descriptor) map[digest.Digest][]byte {
+	fetched := map[digest.Digest][]byte{}
+	if registry.ecrClient == nil || len(descs) < 2 {
+		return fetched
+	}
+	for start := 0; start < len(descs); start += ecrBatchSize {
+		batch := descs[start:min(start+ecrBatchSize, len(descs))]
+		mediaTypes := map[string]bool{MediaTypeDockerManifest: true, MediaTypeOCIManifest: true}
+		var imageIds []*ecr.ImageIdentifier
+		for _, desc := range batch {
+			mediaTypes[desc.MediaType] = true
+			imageIds = append(imageIds, &ecr.ImageIdentifier{ImageDigest: aws.String(desc.Digest.String())})
+		}
+		var acceptedMediaTypes []*string
+		for mediaType := range mediaTypes {
+			acceptedMediaTypes = append(acceptedMediaTypes, aws.String(mediaType))
+		}
+		out, err := registry.ecrClient.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         ecrRegistryId(registry.registry.Reference.Registry),
+			RepositoryName:     aws.String(repositoryName),
+			ImageIds:           imageIds,
+			AcceptedMediaTypes: acceptedMediaTypes,
+		})
+		if err != nil {
+			// e.g. without ecr:BatchGetImage permission, the manifests are still fetched from the registry
+			log.Debug(ctx, "BatchGetImage failed, fetching the manifests one by one", map[string]interface{}{"error": err.Error()})
+			return fetched
+		}
+		for _, image := range out.Images {
+			manifest := []byte(aws.StringValue(image.ImageManifest))
+			// ECR may convert a manifest to an accepted media type, only the original content is used
+			if image.ImageId != nil && digest.FromBytes(manifest).String() == aws.StringValue(image.ImageId.ImageDigest) {
+				fetched[digest.FromBytes(manifest)] = manifest
+			}
+		}
+	}
+	return fetched
+}
+
+// Check with BatchCheckLayerAvailability which of the blobs are in the ECR repository already.
+// Returns the availability by digest, nil for other registries or if the call fails.
+func (registry *Registry) blobAvailability(ctx context.Context, repositoryName string, descs []ocispec.Descriptor) map[digest.Digest]bool {
+	if registry.ecrClient == nil || len(descs) < 2 {
+		return nil
+	}
+	available := map[digest.Digest]bool{}
+	for start := 0; start < len(descs); start += ecrBatchSize {
+		batch := descs[start:min(start+ecrBatchSize, len(descs))]
+		var layerDigests []*string
+		for _, desc := range batch {
+			layerDigests = append(layerDigests, aws.String(desc.Digest.String()))
+		}
+		out, err := registry.ecrClient.BatchCheckLayerAvailabilityWithContext(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+			RegistryId:     ecrRegistryId(registry.registry.Reference.Registry),
+			RepositoryName: aws.String(repositoryName),
+			LayerDigests:   layerDigests,
+		})
+		if err != nil {
+			log.Debug(ctx, "BatchCheckLayerAvailability failed, checking the blobs one by one", map[string]interface{}{"error": err.Error()})
+			return nil
+		}
+		for _, layer := range out.Layers {
+			if layer.LayerDigest != nil {
+				available[digest.Digest(*layer.LayerDigest)] = aws.StringValue(layer.LayerAvailability) == ecr.LayerAvailabilityAvailable
+			}
+		}
+	}
+	return available
+}
+
+// knownBlobsStorage answers whether a blob exists from the availability checked beforehand,
+// so that copying a graph doesn't send a HEAD request for each of them
+type knownBlobsStorage struct {
+	content.Storage
+	available map[digest.Digest]bool
+}
+
+func (s *knownBlobsStorage) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	if available, ok := s.available[desc.Digest]; ok {
+		return available, nil
+	}
+	return s.Storage.Exists(ctx, desc)
+}
@@ -0,0 +1,112 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+type fakeEcrBatch struct {
+	ecriface.ECRAPI
+	manifests map[string]string
+	blobs     map[string]bool
+	calls     int
+}
+
+func (f *fakeEcrBatch) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	f.calls++
+	out := &ecr.BatchGetImageOutput{}
+	for _, imageId := range input.ImageIds {
+		if manifest, ok := f.manifests[*imageId.ImageDigest]; ok {
+			out.Images = append(out.Images, &ecr.Image{ImageId: imageId, ImageManifest: aws.String(manifest)})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEcrBatch) BatchCheckLayerAvailabilityWithContext(ctx aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, opts ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+	f.calls++
+	out := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, layerDigest := range input.LayerDigests {
+		availability := ecr.LayerAvailabilityUnavailable
+		if f.blobs[*layerDigest] {
+			availability = ecr.LayerAvailabilityAvailable
+		}
+		out.Layers = append(out.Layers, &ecr.Layer{LayerDigest: layerDigest, LayerAvailability: aws.String(availability)})
+	}
+	return out, nil
+}
+
+func TestFetchManifests(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	first := testRegistry.PushImage("test-repository", "first", []byte("first"))
+	second := testRegistry.PushImage("test-repository", "second", []byte("second"))
+
+	ctx := context.Background()
+	registry, err := Init(ctx, testregistry.Host, WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	_, firstContent, _ := registry.FetchManifest(ctx, "test-repository", first.Digest.String())
+	_, secondContent, _ := registry.FetchManifest(ctx, "test-repository", second.Digest.String())
+
+	// the first manifest comes from ECR, the second one is converted by ECR and fetched from the registry instead
+	fake := &fakeEcrBatch{manifests: map[string]string{
+		first.Digest.String():  string(firstContent),
+		second.Digest.String(): `{"schemaVersion":2}`,
+	}}
+	registry.ecrClient = fake
+	manifests, err := registry.FetchManifests(ctx, "test-repository", []ocispec.Descriptor{first, second})
+	if err != nil {
+		t.Fatalf("FetchManifests failed: %v", err)
+	}
+	if fake.calls != 1 || !bytes.Equal(manifests[0], firstContent) || !bytes.Equal(manifests[1], secondContent) {
+		t.Fatalf("Unexpected manifests after %d calls: %s, %s", fake.calls, manifests[0], manifests[1])
+	}
+}
+
+func TestKnownBlobsStorage(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	ctx := context.Background()
+	registry, err := Init(ctx, testregistry.Host, WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	repo, err := registry.registry.Repository(ctx, "test-repository")
+	if err != nil {
+		t.Fatalf("Repository failed: %v", err)
+	}
+	pushed := testRegistry.PushBlob("test-repository", "application/octet-stream", []byte("pushed"))
+	known := ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("known"), Size: 5}
+	missing := ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("missing"), Size: 7}
+
+	// ECR claims a blob the test registry doesn't have, so the answers show where they came from
+	registry.ecrClient = &fakeEcrBatch{blobs: map[string]bool{known.Digest.String(): true}}
+	storage := registry.withKnownBlobs(ctx, "test-repository", repo, []ocispec.Descriptor{known, missing})
+	for _, c := range []struct {
+		desc     ocispec.Descriptor
+		expected bool
+	}{{known, true}, {missing, false}, {pushed, true}} {
+		exists, err := storage.Exists(ctx, c.desc)
+		if err != nil || exists != c.expected {
+			t.Fatalf("Expected %s to exist %v but got %v, %v", c.desc.Digest, c.expected, exists, err)
+		}
+	}
+
+	registry.ecrClient = nil
+	if storage := registry.withKnownBlobs(ctx, "test-repository", repo, []ocispec.Descriptor{known, missing}); storage != repo {
+		t.Fatalf("Expected the repository to be used as is outside of ECR")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Settings of one registry host, overriding the settings given for all registries
+type HostSettings struct {
+	// talk to the registry over plain HTTP instead of HTTPS
+	PlainHTTP bool `json:"plainHttp"`
+	// proxy, CA certificates and client certificate of the registry, see TransportSettings
+	Proxy          string `json:"proxy"`
+	CACertFile     string `json:"caCert"`
+	ClientCertFile string `json:"clientCert"`
+	ClientKeyFile  string `json:"clientKey"`
+	// basic auth user of registries other than ECR, the password is read from the PasswordEnv environment variable
+	Username    string `json:"username"`
+	PasswordEnv string `json:"passwordEnv"`
+	// ARN or name of a Secrets Manager secret with the credentials instead, JSON with a username and a password
+	// or the password of Username
+	CredentialsSecret string `json:"credentialsSecret"`
+	// how long a throttled request is retried, e.g. "5m", the budget for all registries if empty
+	ThrottleBudget string `json:"throttleBudget"`
+	// blobs transferred at the same time, oras' default if 0
+	Concurrency int `json:"concurrency"`
+	// pull-through mirrors images are pulled from before the registry itself, tried in order, each a host
+	// optionally followed by the path its repositories are under, e.g. "mirror.example.com/docker-hub".
+	// A mirror uses the settings of its own host, pushes always go to the registry.
+	Mirrors []string `json:"mirrors"`
+}
+
+// The file of the settings by registry host
+type hostsFile struct {
+	Registries map[string]HostSettings `json:"registries"`
+}
+
+// WithHostSettings sets settings for individual registry hosts (host and port are
+// matched exactly, e.g. "harbor.example.com" or "localhost:5000")
+func WithHostSettings(hosts map[string]HostSettings) Option {
+	return func(c *config) {
+		c.hosts = hosts
+	}
+}
+
+// LoadHostSettings reads the settings by registry host from a JSON file of the form
+// {"registries": {"harbor.example.com": {"caCert": "harbor-ca.pem", "username": "robot$builder", "passwordEnv": "HARBOR_PASSWORD"}}}
+func LoadHostSettings(path string) (map[string]HostSettings, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file hostsFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid registry config %s: %w", path, err)
+	}
+	for host, settings := range file.Registries {
+		if err := settings.validate(); err != nil {
+			return nil, fmt.Errorf("invalid settings of %s in %s: %w", host, path, err)
+		}
+	}
+	return file.Registries, nil
+}
+
+func (s HostSettings) validate() error {
+	if s.ThrottleBudget != "" {
+		if _, err := time.ParseDuration(s.ThrottleBudget); err != nil {
+			return fmt.Errorf("invalid throttleBudget: %w", err)
+		}
+	}
+	if s.CredentialsSecret != "" && s.PasswordEnv != "" {
+		return fmt.Errorf("passwordEnv and credentialsSecret are mutually exclusive")
+	}
+	if s.CredentialsSecret == "" && (s.Username == "") != (s.PasswordEnv == "") {
+		return fmt.Errorf("username and passwordEnv must be given together")
+	}
+	if s.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d", s.Concurrency)
+	}
+	for _, mirror := range s.Mirrors {
+		if host, _ := splitMirror(mirror); host == "" {
+			return fmt.Errorf("invalid mirror %q, expected a host optionally followed by a path", mirror)
+		}
+	}
+	return nil
+}
+
+// Apply the settings of the host to the config of its registry client
+func (s HostSettings) apply(cfg *config) error {
+	transportSettings := TransportSettings{Proxy: s.Proxy, CACertFile: s.CACertFile, ClientCertFile: s.ClientCertFile, ClientKeyFile: s.ClientKeyFile}
+	if transportSettings != (TransportSettings{}) {
+		// the settings the host doesn't override are those of the flags, e.g. the connection pool size
+		base, ok := cfg.transport.(*http.Transport)
+		if !ok {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		transport, err := newTransport(base, transportSettings)
+		if err != nil {
+			return err
+		}
+		cfg.transport = transport
+	}
+	if s.ThrottleBudget != "" {
+		budget, err := time.ParseDuration(s.ThrottleBudget)
+		if err != nil {
+			return err
+		}
+		cfg.throttling.Budget = budget
+	}
+	return nil
+}
+
+// The basic auth credentials of the host, nil if it has none
+func (s HostSettings) credentialFunc(ctx context.Context, registryHost string) (auth.CredentialFunc, error) {
+	if s.CredentialsSecret != "" {
+		credentials := cachedSecretCredentials(s.CredentialsSecret, s.Username, newSecretsManagerClient(s.CredentialsSecret))
+		// fail early if the secret can't be read
+		if _, err := credentials.Credential(ctx, registryHost); err != nil {
+			return nil, err
+		}
+		return credentials.Credential, nil
+	}
+	if s.Username == "" {
+		return nil, nil
+	}
+	password, ok := os.LookupEnv(s.PasswordEnv)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s with the registry password is not set", s.PasswordEnv)
+	}
+	return auth.StaticCredential(registryHost, auth.Credential{Username: s.Username, Password: password}), nil
+}
@@ -0,0 +1,165 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+func TestHostSettings(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	// a plain HTTP registry requiring basic auth
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "builder" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(manifest).String())
+		w.Write(manifest)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	configFile := filepath.Join(t.TempDir(), "registries.json")
+	config := `{"registries": {"` + host + `": {"plainHttp": true, "username": "builder", "passwordEnv": "TEST_REGISTRY_PASSWORD", "concurrency": 2}}}`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write the registry config: %v", err)
+	}
+	hosts, err := LoadHostSettings(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load the registry config: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := Init(ctx, host, WithHostSettings(hosts)); err == nil {
+		t.Fatalf("Expected an error without the password in the environment")
+	}
+	t.Setenv("TEST_REGISTRY_PASSWORD", "secret")
+	registry, err := Init(ctx, host, WithHostSettings(hosts))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if registry.concurrency != 2 {
+		t.Fatalf("Unexpected concurrency %d", registry.concurrency)
+	}
+	if _, err := registry.HeadManifest(ctx, "test-repository", "latest"); err != nil {
+		t.Fatalf("Expected the manifest to resolve over plain HTTP with basic auth but got %v", err)
+	}
+}
+
+func TestLoadHostSettingsValidates(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "registries.json")
+	os.WriteFile(configFile, []byte(`{"registries": {"harbor.example.com": {"throttleBudget": "soon"}}}`), 0644)
+	if _, err := LoadHostSettings(configFile); err == nil {
+		t.Fatalf("Expected an invalid throttle budget to be rejected")
+	}
+	os.WriteFile(configFile, []byte(`{"registries": {"registry-1.docker.io": {"mirrors": ["/docker-hub"]}}}`), 0644)
+	if _, err := LoadHostSettings(configFile); err == nil {
+		t.Fatalf("Expected a mirror without a host to be rejected")
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	// all hosts reach the test registry, only the second mirror has the image under the path of its repositories
+	image := testRegistry.PushImage("docker-hub/library/redis", "7", []byte("redis"))
+	testRegistry.PushImage("library/nginx", "1", []byte("nginx"))
+
+	hosts := map[string]HostSettings{
+		"registry.example.com": {Mirrors: []string{testregistry.Host + "/empty", testregistry.Host + "/docker-hub"}},
+	}
+	ctx := context.Background()
+	registry, err := Init(ctx, "registry.example.com", WithHostSettings(hosts), WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create the store: %v", err)
+	}
+	sociStore := &store.SociStore{Store: ociStore}
+
+	// the first mirror doesn't have the image, the second one has
+	desc, err := registry.Pull(ctx, "library/redis", sociStore, "7", nil)
+	if err != nil {
+		t.Fatalf("Expected the image to be pulled from the mirror but got %v", err)
+	}
+	if desc.Digest != image.Digest {
+		t.Fatalf("Expected the image %s but got %s", image.Digest, desc.Digest)
+	}
+	// images the mirrors don't have are pulled from the registry
+	if _, err := registry.Pull(ctx, "library/nginx", sociStore, "1", nil); err != nil {
+		t.Fatalf("Expected the image to be pulled from the registry but got %v", err)
+	}
+}
+
+// delayedTransport answers the requests of a blob late, e.g. so that the other blobs of an image are pulled first
+type delayedTransport struct {
+	base   http.RoundTripper
+	digest digest.Digest
+}
+
+func (t delayedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/blobs/"+t.digest.String()) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func TestMirrorsPulledSize(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	testRegistry.PushImage("library/redis", "7", []byte("redis"))
+	// the mirror has a stale image whose layer is missing, the attempt fails once its config is pulled
+	config := testRegistry.PushBlob("stale/library/redis", ocispec.MediaTypeImageConfig, []byte(`{"architecture":"stale"}`))
+	missing := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("missing"), Size: 7}
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{missing},
+	})
+	testRegistry.PushManifest("stale/library/redis", "7", ocispec.MediaTypeImageManifest, manifest)
+
+	ctx := context.Background()
+	pull := func(hosts map[string]HostSettings) int64 {
+		transport := delayedTransport{base: testRegistry.Transport(), digest: missing.Digest}
+		registry, err := Init(ctx, "registry.example.com", WithHostSettings(hosts), WithTransport(transport))
+		if err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		ociStore, err := oci.NewWithContext(ctx, t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create the store: %v", err)
+		}
+		if _, err := registry.Pull(ctx, "library/redis", &store.SociStore{Store: ociStore}, "7", nil); err != nil {
+			t.Fatalf("Expected the image to be pulled but got %v", err)
+		}
+		return registry.PulledSize()
+	}
+
+	// only the bytes of the attempt that succeeded are counted
+	expected := pull(nil)
+	pulled := pull(map[string]HostSettings{"registry.example.com": {Mirrors: []string{testregistry.Host + "/stale"}}})
+	if pulled != expected {
+		t.Fatalf("Expected %d bytes pulled but got %d", expected, pulled)
+	}
+}
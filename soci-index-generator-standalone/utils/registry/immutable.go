@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Error code of ECR for pushes of tags that already exist in immutable repositories
+const errorCodeTagInvalid = "TAG_INVALID"
+
+// Registries without the referrers API list the referrers of an image in an image index
+// tagged with the image digest, e.g. sha256-0123... (the referrers tag schema)
+func referrersTag(subject ocispec.Descriptor) string {
+	return subject.Digest.Algorithm().String() + "-" + subject.Digest.Encoded()
+}
+
+// Check whether the referrers tag of the image can't be updated, because it already exists
+// in an ECR repository with tag immutability enabled
+func (registry *Registry) referrersTagImmutable(ctx context.Context, repo *remote.Repository, repositoryName string, subject ocispec.Descriptor) (bool, error) {
+	immutable, err := registry.ecrTagImmutable(ctx, repositoryName)
+	if err != nil || !immutable {
+		return false, err
+	}
+	_, err = repo.Resolve(ctx, referrersTag(subject))
+	return err == nil, nil
+}
+
+// Check whether tag immutability is enabled on an ECR repository, false for other registries
+func (registry *Registry) ecrTagImmutable(ctx context.Context, repositoryName string) (bool, error) {
+	if registry.ecrClient == nil {
+		return false, nil
+	}
+	out, err := registry.ecrClient.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      ecrRegistryId(registry.registry.Reference.Registry),
+		RepositoryNames: []*string{aws.String(repositoryName)},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, repository := range out.Repositories {
+		if aws.StringValue(repository.ImageTagMutability) == ecr.ImageTagMutabilityImmutable {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check whether a push failed because the referrers tag already exists and can't be overwritten
+func isImmutableTagError(err error) bool {
+	if !strings.Contains(err.Error(), "referrers index tagged by") {
+		return false
+	}
+	var errResp *errcode.ErrorResponse
+	if !errors.As(err, &errResp) || (errResp.StatusCode != http.StatusBadRequest && errResp.StatusCode != http.StatusConflict) {
+		return false
+	}
+	for _, e := range errResp.Errors {
+		message := strings.ToLower(e.Message)
+		if e.Code == errorCodeTagInvalid || strings.Contains(message, "immutable") || strings.Contains(message, "already exists") {
+			return true
+		}
+	}
+	return false
+}
+
+// Open the repository for pushing the SOCI index by digest only, without updating the referrers tag.
+// It stays discoverable through the referrers API, but not by clients relying on the referrers tag.
+func (registry *Registry) digestOnlyRepository(ctx context.Context, repositoryName string) (*remote.Repository, error) {
+	log.Warn(ctx, "The referrers tag of the image already exists and is immutable, pushing the SOCI index by digest only")
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	digestOnly := repo.(*remote.Repository)
+	return digestOnly, digestOnly.SetReferrersCapability(true)
+}
@@ -0,0 +1,33 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+func TestIsImmutableTagError(t *testing.T) {
+	immutable := &errcode.ErrorResponse{
+		Method:     http.MethodPut,
+		StatusCode: http.StatusBadRequest,
+		Errors: errcode.Errors{{
+			Code:    errorCodeTagInvalid,
+			Message: "The image tag 'sha256-0123' already exists in the 'app' repository and cannot be overwritten because the repository is immutable.",
+		}},
+	}
+	if !isImmutableTagError(fmt.Errorf("failed to push referrers index tagged by sha256-0123: %w", immutable)) {
+		t.Fatalf("Expected a failed push of the referrers tag to be detected")
+	}
+	if isImmutableTagError(fmt.Errorf("failed to push manifest: %w", immutable)) {
+		t.Fatalf("Expected other failed pushes not to be detected")
+	}
+	if isImmutableTagError(fmt.Errorf("failed to push referrers index tagged by sha256-0123: %w", errors.New("connection reset"))) {
+		t.Fatalf("Expected other errors not to be detected")
+	}
+}
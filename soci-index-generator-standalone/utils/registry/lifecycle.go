@@ -0,0 +1,87 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Rule of an ECR lifecycle policy
+type LifecycleRule struct {
+	RulePriority int    `json:"rulePriority"`
+	Description  string `json:"description,omitempty"`
+	Selection    struct {
+		TagStatus   string `json:"tagStatus"`
+		CountType   string `json:"countType"`
+		CountUnit   string `json:"countUnit,omitempty"`
+		CountNumber int    `json:"countNumber"`
+	} `json:"selection"`
+	Action struct {
+		Type string `json:"type"`
+	} `json:"action"`
+}
+
+// LifecyclePolicyConflictError is returned when the lifecycle policy of a repository would expire pushed SOCI indices
+type LifecyclePolicyConflictError struct {
+	Repository string
+	Rules      []LifecycleRule
+}
+
+func (e *LifecyclePolicyConflictError) Error() string {
+	priorities := make([]int, len(e.Rules))
+	for i, rule := range e.Rules {
+		priorities[i] = rule.RulePriority
+	}
+	return fmt.Sprintf("lifecycle policy rules %v of repository %s expire untagged images, which would delete the SOCI index", priorities, e.Repository)
+}
+
+// Find the rules of the repository's lifecycle policy expiring untagged images.
+// SOCI indices are pushed without a tag, so these rules delete them, often long after they were pushed.
+// There are none for registries other than ECR and repositories without a lifecycle policy.
+func (registry *Registry) ConflictingLifecycleRules(ctx context.Context, repositoryName string) ([]LifecycleRule, error) {
+	if registry.ecrClient == nil {
+		return nil, nil
+	}
+	out, err := registry.ecrClient.GetLifecyclePolicyWithContext(ctx, &ecr.GetLifecyclePolicyInput{
+		RegistryId:     ecrRegistryId(registry.registry.Reference.Registry),
+		RepositoryName: aws.String(repositoryName),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeLifecyclePolicyNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return untaggedExpirationRules(aws.StringValue(out.LifecyclePolicyText))
+}
+
+// Parse a lifecycle policy and return its rules expiring untagged images
+func untaggedExpirationRules(policyText string) ([]LifecycleRule, error) {
+	var policy struct {
+		Rules []LifecycleRule `json:"rules"`
+	}
+	err := json.Unmarshal([]byte(policyText), &policy)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the lifecycle policy: %w", err)
+	}
+
+	var conflicting []LifecycleRule
+	for _, rule := range policy.Rules {
+		if rule.Action.Type != "expire" {
+			continue
+		}
+		if rule.Selection.TagStatus == "untagged" || rule.Selection.TagStatus == "any" {
+			conflicting = append(conflicting, rule)
+		}
+	}
+	return conflicting, nil
+}
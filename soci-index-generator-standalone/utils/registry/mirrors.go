@@ -0,0 +1,77 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"oras.land/oras-go/v2"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// mirror is a pull-through mirror of a registry, e.g. a Harbor proxy cache or an ECR pull through cache of Docker Hub
+type mirror struct {
+	name   string
+	client *Registry
+	// path the mirrored repositories are under, e.g. docker-hub for docker-hub/library/redis
+	prefix string
+}
+
+// Split a mirror into its host and the path of its repositories
+func splitMirror(mirror string) (string, string) {
+	host, prefix, _ := strings.Cut(mirror, "/")
+	return host, strings.Trim(prefix, "/")
+}
+
+// Initialize the clients of the mirrors of a registry, each with the settings of its host
+func initMirrors(ctx context.Context, mirrors []string, opts ...Option) ([]mirror, error) {
+	var initialized []mirror
+	for _, name := range mirrors {
+		host, prefix := splitMirror(name)
+		client, _, err := initHost(ctx, host, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %s: %w", name, err)
+		}
+		initialized = append(initialized, mirror{name: name, client: client, prefix: prefix})
+	}
+	return initialized, nil
+}
+
+// Pull from the repository on the mirrors of the registry in order, and from the registry itself when none of them
+// has the content. A mirror that is down or doesn't have the image only costs a failed request.
+// pull counts the bytes it pulls into the given counter, they are added to the pulled bytes only if the attempt succeeds.
+func (registry *Registry) pullFromMirrors(ctx context.Context, repositoryName string, pull func(repo oras.ReadOnlyTarget, pulled *atomic.Int64) error) error {
+	attempt := func(repo oras.ReadOnlyTarget) error {
+		var pulled atomic.Int64
+		err := pull(repo, &pulled)
+		if err == nil {
+			registry.pulled.Add(pulled.Load())
+		}
+		return err
+	}
+	for _, mirror := range registry.mirrors {
+		repo, err := mirror.client.registry.Repository(ctx, path.Join(mirror.prefix, repositoryName))
+		if err == nil {
+			err = attempt(repo)
+		}
+		if err == nil {
+			log.Info(ctx, fmt.Sprintf("Pulled from mirror %s", mirror.name))
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Warn(ctx, fmt.Sprintf("Couldn't pull from mirror %s, trying the next one: %v", mirror.name, err))
+	}
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	return attempt(repo)
+}
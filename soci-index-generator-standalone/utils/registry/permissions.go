@@ -0,0 +1,65 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The outcome of probing an ECR API action, Err is nil if the action is allowed
+type PermissionCheck struct {
+	Action string
+	Err    error
+}
+
+// Check that the caller may get authorization tokens, pull and push in an ECR repository.
+// The actions are probed with requests that can't change the repository: pulling an image that doesn't exist
+// and pushing an invalid manifest, which ECR only rejects as invalid after authorizing the request.
+func CheckEcrPermissions(ctx context.Context, registryUrl string, repositoryName string, opts ...Option) ([]PermissionCheck, error) {
+	if !isEcrRegistry(registryUrl) {
+		return nil, ErrNotEcrRegistry
+	}
+	ecrClient := newEcrClient(registryUrl, newConfig(opts...))
+	return checkEcrPermissions(ctx, ecrClient, ecrRegistryId(registryUrl), repositoryName), nil
+}
+
+func checkEcrPermissions(ctx context.Context, ecrClient ecriface.ECRAPI, registryId *string, repositoryName string) []PermissionCheck {
+	_, err := ecrClient.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	checks := []PermissionCheck{{Action: "ecr:GetAuthorizationToken", Err: err}}
+
+	// images that don't exist are reported as failures of the response, not as an error
+	_, err = ecrClient.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+		RegistryId:     registryId,
+		RepositoryName: aws.String(repositoryName),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageDigest: aws.String(digest.FromBytes(nil).String())}},
+	})
+	checks = append(checks, PermissionCheck{Action: "ecr:BatchGetImage", Err: err})
+
+	_, err = ecrClient.PutImageWithContext(ctx, &ecr.PutImageInput{
+		RegistryId:             registryId,
+		RepositoryName:         aws.String(repositoryName),
+		ImageManifest:          aws.String("{}"),
+		ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+	})
+	checks = append(checks, PermissionCheck{Action: "ecr:PutImage", Err: allowedUnless(err, ecr.ErrCodeInvalidParameterException)})
+	return checks
+}
+
+// The error of a probe, nil if it failed with one of the expected codes after passing authorization
+func allowedUnless(err error, expectedCodes ...string) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && slices.Contains(expectedCodes, awsErr.Code()) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// ECR API of a caller that may pull but not push
+type pullOnlyEcr struct {
+	ecriface.ECRAPI
+}
+
+func (f *pullOnlyEcr) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	return &ecr.GetAuthorizationTokenOutput{}, nil
+}
+
+func (f *pullOnlyEcr) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)}}}, nil
+}
+
+func (f *pullOnlyEcr) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "not authorized to perform: ecr:PutImage", nil)
+}
+
+func TestCheckEcrPermissions(t *testing.T) {
+	checks := checkEcrPermissions(context.Background(), &pullOnlyEcr{}, aws.String("123456789012"), "team/app")
+	if len(checks) != 3 {
+		t.Fatalf("Expected three checked actions but got %v", checks)
+	}
+	for _, check := range checks {
+		denied := check.Action == "ecr:PutImage"
+		if (check.Err != nil) != denied {
+			t.Fatalf("Unexpected outcome of %s: %v", check.Action, check.Err)
+		}
+	}
+}
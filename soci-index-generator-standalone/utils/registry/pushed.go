@@ -0,0 +1,39 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Read when an image, given by a tag or digest, was pushed to an ECR repository.
+// Returns ErrNotEcrRegistry for other registries, which don't record push times.
+func (registry *Registry) ImagePushedAt(ctx context.Context, repositoryName string, reference string) (time.Time, error) {
+	if registry.ecrClient == nil {
+		return time.Time{}, ErrNotEcrRegistry
+	}
+	imageId := &ecr.ImageIdentifier{ImageTag: aws.String(reference)}
+	if strings.Contains(reference, ":") {
+		// a digest
+		imageId = &ecr.ImageIdentifier{ImageDigest: aws.String(reference)}
+	}
+	out, err := registry.ecrClient.DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+		RegistryId:     ecrRegistryId(registry.registry.Reference.Registry),
+		RepositoryName: aws.String(repositoryName),
+		ImageIds:       []*ecr.ImageIdentifier{imageId},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(out.ImageDetails) == 0 || out.ImageDetails[0].ImagePushedAt == nil {
+		return time.Time{}, fmt.Errorf("no push time of %s:%s", repositoryName, reference)
+	}
+	return *out.ImageDetails[0].ImagePushedAt, nil
+}
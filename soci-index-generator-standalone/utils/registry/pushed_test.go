@@ -0,0 +1,59 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+type fakeEcrImages struct {
+	ecriface.ECRAPI
+	// push times by tag or digest
+	pushedAt map[string]time.Time
+}
+
+func (f *fakeEcrImages) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	imageId := input.ImageIds[0]
+	reference := aws.StringValue(imageId.ImageTag)
+	if imageId.ImageDigest != nil {
+		reference = *imageId.ImageDigest
+	}
+	pushedAt, ok := f.pushedAt[reference]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeImageNotFoundException, "not found", nil)
+	}
+	return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{ImagePushedAt: aws.Time(pushedAt)}}}, nil
+}
+
+func TestImagePushedAt(t *testing.T) {
+	remoteRegistry, _ := remote.NewRegistry("123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	pushedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := &fakeEcrImages{pushedAt: map[string]time.Time{"latest": pushedAt, "sha256:1234": pushedAt}}
+	registry := &Registry{registry: remoteRegistry, ecrClient: fake}
+	ctx := context.Background()
+
+	for _, reference := range []string{"latest", "sha256:1234"} {
+		actual, err := registry.ImagePushedAt(ctx, "team/app", reference)
+		if err != nil || !actual.Equal(pushedAt) {
+			t.Fatalf("Expected %s to be pushed at %s but got %s, %v", reference, pushedAt, actual, err)
+		}
+	}
+	if _, err := registry.ImagePushedAt(ctx, "team/app", "unknown"); err == nil {
+		t.Fatalf("Expected an error for an unknown tag")
+	}
+
+	registry = &Registry{registry: remoteRegistry}
+	if _, err := registry.ImagePushedAt(ctx, "team/app", "latest"); err != ErrNotEcrRegistry {
+		t.Fatalf("Expected ErrNotEcrRegistry but got %v", err)
+	}
+}
@@ -13,17 +13,24 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/platforms"
 
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -41,36 +48,166 @@ var ImageConfigMediaTypes = []string{MediaTypeDockerImageConfig, MediaTypeOCIIma
 
 type Registry struct {
 	registry *remote.Registry
+	// ECR API client, only set for ECR registries
+	ecrClient ecriface.ECRAPI
+	// blobs transferred at the same time, oras' default if 0
+	concurrency int
+	// pull-through mirrors images are pulled from before the registry itself, in order
+	mirrors []mirror
+	// bytes of the blobs and manifests pulled and pushed, blobs that were skipped or existed already aren't counted
+	pulled atomic.Int64
+	pushed atomic.Int64
 }
 
 var RegistryNotSupportingOciArtifacts = errors.New("Registry does not support OCI artifacts")
 
-// Initialize a remote registry
-func Init(ctx context.Context, registryUrl string) (*Registry, error) {
+// Options of the registry client
+type config struct {
+	userAgent  string
+	debugHttp  bool
+	timeouts   Timeouts
+	throttling Throttling
+	transport  http.RoundTripper
+	// how many times an interrupted blob download is resumed, 0 doesn't resume
+	downloadResumes int
+	// settings of individual registry hosts
+	hosts map[string]HostSettings
+}
+
+// Option specifies a config change of the registry client
+type Option func(c *config)
+
+// WithUserAgent sets the User-Agent sent on all registry and ECR API calls
+func WithUserAgent(userAgent string) Option {
+	return func(c *config) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithDebugHttp logs every registry request with its status, retry count and latency
+func WithDebugHttp(debugHttp bool) Option {
+	return func(c *config) {
+		c.debugHttp = debugHttp
+	}
+}
+
+// WithTimeouts limits how long individual manifest fetches, blob downloads and pushes may take
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *config) {
+		c.timeouts = timeouts
+	}
+}
+
+// WithThrottling sets how long throttled registry requests and ECR API calls are retried
+func WithThrottling(throttling Throttling) Option {
+	return func(c *config) {
+		c.throttling = throttling
+	}
+}
+
+// WithTransport sends all registry requests through the given transport instead of http.DefaultTransport,
+// e.g. to sign them for a proxy, present a client certificate or add headers
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *config) {
+		c.transport = transport
+	}
+}
+
+// WithDownloadResumes sets how many times an interrupted blob download is resumed with a Range request, 0 disables it
+func WithDownloadResumes(resumes int) Option {
+	return func(c *config) {
+		c.downloadResumes = resumes
+	}
+}
+
+func newConfig(opts ...Option) *config {
+	cfg := &config{
+		userAgent:       version.UserAgent(""),
+		throttling:      DefaultThrottling,
+		downloadResumes: DefaultDownloadResumes,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Initialize a remote registry, and its pull-through mirrors if its host settings have any
+func Init(ctx context.Context, registryUrl string, opts ...Option) (*Registry, error) {
 	log.Info(ctx, "Initializing registry client")
-	registry, err := remote.NewRegistry(registryUrl)
+	registry, settings, err := initHost(ctx, registryUrl, opts...)
 	if err != nil {
 		return nil, err
 	}
+	registry.mirrors, err = initMirrors(ctx, settings.Mirrors, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Initialize the client of a registry host with its settings
+func initHost(ctx context.Context, registryUrl string, opts ...Option) (*Registry, HostSettings, error) {
+	cfg := newConfig(opts...)
+	settings := cfg.hosts[registryUrl]
+	if err := settings.apply(cfg); err != nil {
+		return nil, settings, fmt.Errorf("invalid settings of registry %s: %w", registryUrl, err)
+	}
+	registry, err := remote.NewRegistry(registryUrl)
+	if err != nil {
+		return nil, settings, err
+	}
+	credential, err := settings.credentialFunc(ctx, registry.Reference.Registry)
+	if err != nil {
+		return nil, settings, err
+	}
+	registry.RepositoryOptions.PlainHTTP = settings.PlainHTTP
+	client := &auth.Client{
+		Client: newHttpClient(cfg),
+		Header: http.Header{
+			"User-Agent": {cfg.userAgent},
+		},
+		Credential: credential,
+		Cache:      auth.DefaultCache,
+	}
+	registry.RepositoryOptions.Client = client
+	var ecrClient ecriface.ECRAPI
 	if isEcrRegistry(registryUrl) {
-		err := authorizeEcr(registry)
+		ecrClient = newEcrClient(registryUrl, cfg)
+		err := authorizeEcr(ctx, registry, ecrClient, cfg)
 		if err != nil {
-			return nil, err
+			return nil, settings, err
 		}
 	}
-	return &Registry{registry}, nil
+	return &Registry{registry: registry, ecrClient: ecrClient, concurrency: settings.Concurrency}, settings, nil
 }
 
-// Pull an image from the remote registry to a local OCI Store
+// Pull an image from the remote registry (or one of its mirrors) to a local OCI Store
 // imageReference can be either a digest or a tag
-func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
+// For multi-platform images only the manifests of the given platforms are pulled, all of them if none are given.
+// Blobs shared by the platforms are pulled once, blobs for which skipBlob (if not nil) returns true aren't pulled.
+func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, skipBlob func(ctx context.Context, desc ocispec.Descriptor) bool, pullPlatforms ...ocispec.Platform) (*ocispec.Descriptor, error) {
 	log.Info(ctx, "Pulling image")
-	repo, err := registry.registry.Repository(ctx, repositoryName)
-	if err != nil {
-		return nil, err
+	copyOptions := oras.CopyOptions{CopyGraphOptions: registry.copyGraphOptions()}
+	if len(pullPlatforms) > 0 {
+		copyOptions.FindSuccessors = platformSuccessors(pullPlatforms)
+	}
+	if skipBlob != nil {
+		copyOptions.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+			if skipBlob(ctx, desc) {
+				return oras.SkipNode
+			}
+			return nil
+		}
 	}
 
-	imageDescriptor, err := oras.Copy(ctx, repo, imageReference, sociStore, imageReference, oras.DefaultCopyOptions)
+	var imageDescriptor ocispec.Descriptor
+	err := registry.pullFromMirrors(ctx, repositoryName, func(repo oras.ReadOnlyTarget, pulled *atomic.Int64) error {
+		var err error
+		copyOptions.PostCopy = countTransferred(pulled)
+		imageDescriptor, err = oras.Copy(ctx, repo, imageReference, sociStore, imageReference, copyOptions)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -78,6 +215,78 @@ func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociS
 	return &imageDescriptor, nil
 }
 
+// PullBlob pulls a single blob, e.g. a layer skipped by Pull, from the remote registry to a local OCI Store
+func (registry *Registry) PullBlob(ctx context.Context, repositoryName string, sociStore *store.SociStore, desc ocispec.Descriptor) error {
+	copyOptions := registry.copyGraphOptions()
+	return registry.pullFromMirrors(ctx, repositoryName, func(repo oras.ReadOnlyTarget, pulled *atomic.Int64) error {
+		copyOptions.PostCopy = countTransferred(pulled)
+		return oras.CopyGraph(ctx, repo, sociStore, desc, copyOptions)
+	})
+}
+
+// Successors of the nodes of an image, skipping the manifests of other platforms in image indices
+func platformSuccessors(pullPlatforms []ocispec.Platform) func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	matchers := make([]platforms.MatchComparer, len(pullPlatforms))
+	for i, platform := range pullPlatforms {
+		matchers[i] = platforms.OnlyStrict(platform)
+	}
+
+	return func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, desc)
+		if err != nil || (desc.MediaType != ocispec.MediaTypeImageIndex && desc.MediaType != MediaTypeDockerManifestList) {
+			return successors, err
+		}
+
+		var matching []ocispec.Descriptor
+		for _, successor := range successors {
+			if successor.Platform == nil {
+				continue
+			}
+			for _, matcher := range matchers {
+				if matcher.Match(*successor.Platform) {
+					matching = append(matching, successor)
+					break
+				}
+			}
+		}
+		return matching, nil
+	}
+}
+
+// Options of copying a graph of blobs to or from the registry
+func (registry *Registry) copyGraphOptions() oras.CopyGraphOptions {
+	options := oras.DefaultCopyGraphOptions
+	if registry.concurrency > 0 {
+		options.Concurrency = registry.concurrency
+	}
+	return options
+}
+
+// Options of pushing a graph of blobs to the registry, counting the pushed bytes
+func (registry *Registry) pushGraphOptions() oras.CopyGraphOptions {
+	options := registry.copyGraphOptions()
+	options.PostCopy = countTransferred(&registry.pushed)
+	return options
+}
+
+// Add the size of each copied node to the counter
+func countTransferred(counter *atomic.Int64) func(ctx context.Context, desc ocispec.Descriptor) error {
+	return func(ctx context.Context, desc ocispec.Descriptor) error {
+		counter.Add(desc.Size)
+		return nil
+	}
+}
+
+// PulledSize returns the bytes pulled from the registry so far
+func (registry *Registry) PulledSize() int64 {
+	return registry.pulled.Load()
+}
+
+// PushedSize returns the bytes pushed to the registry so far
+func (registry *Registry) PushedSize() int64 {
+	return registry.pushed.Load()
+}
+
 // Push a OCI artifact to remote registry
 // descriptor: ocispec Descriptor of the artifact
 // ociStore: the local OCI store
@@ -89,7 +298,30 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 		return err
 	}
 
-	err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, oras.DefaultCopyGraphOptions)
+	immutable := false
+	if subject := pushedSubject(ctx, sociStore, indexDesc); subject != nil {
+		immutable, err = registry.referrersTagImmutable(ctx, repo.(*remote.Repository), repositoryName, *subject)
+		if err != nil {
+			// a failed push of the referrers tag is still detected
+			log.Warn(ctx, fmt.Sprintf("Couldn't check the tag immutability of the repository: %v", err))
+		}
+	}
+	if immutable {
+		repo, err = registry.digestOnlyRepository(ctx, repositoryName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = oras.CopyGraph(ctx, sociStore, registry.withKnownBlobs(ctx, repositoryName, repo, pushedBlobs(ctx, sociStore, indexDesc)), indexDesc, registry.pushGraphOptions())
+	if err != nil && !immutable && isImmutableTagError(err) {
+		// the blobs and the manifest were pushed already, only the referrers tag is skipped
+		repo, err = registry.digestOnlyRepository(ctx, repositoryName)
+		if err != nil {
+			return err
+		}
+		err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, registry.pushGraphOptions())
+	}
 	if err != nil {
 		// TODO: There might be a better way to check if a registry supporting OCI or not
 		if strings.Contains(err.Error(), "Response status code 405: unsupported: Invalid parameter at 'ImageManifest' failed to satisfy constraint: 'Invalid JSON syntax'") {
@@ -101,6 +333,58 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 	return nil
 }
 
+// PushImage pushes an image, e.g. the eStargz conversion of the pulled image, from the local OCI store to the
+// remote registry and tags it
+func (registry *Registry) PushImage(ctx context.Context, sociStore *store.SociStore, imageDesc ocispec.Descriptor, repositoryName string, tag string) error {
+	log.Info(ctx, fmt.Sprintf("Pushing image %s:%s", repositoryName, tag))
+
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	err = oras.CopyGraph(ctx, sociStore, repo, imageDesc, registry.pushGraphOptions())
+	if err != nil {
+		return err
+	}
+	return repo.Tag(ctx, imageDesc, tag)
+}
+
+// The ztocs of a SOCI index in the local store, nil if it can't be read
+func pushedBlobs(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor) []ocispec.Descriptor {
+	manifestBytes, err := content.FetchAll(ctx, sociStore, indexDesc)
+	if err != nil {
+		return nil
+	}
+	index, _, err := builder.ParseIndex(manifestBytes)
+	if err != nil {
+		return nil
+	}
+	return index.Blobs
+}
+
+// Check the availability of the blobs in an ECR repository with a single call, so that pushing them doesn't check
+// each of them with a HEAD request. The repository is returned as is for other registries.
+func (registry *Registry) withKnownBlobs(ctx context.Context, repositoryName string, repo content.Storage, blobs []ocispec.Descriptor) content.Storage {
+	available := registry.blobAvailability(ctx, repositoryName, blobs)
+	if available == nil {
+		return repo
+	}
+	return &knownBlobsStorage{Storage: repo, available: available}
+}
+
+// The subject of a SOCI index in the local store, nil if it has none or can't be read
+func pushedSubject(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor) *ocispec.Descriptor {
+	manifestBytes, err := content.FetchAll(ctx, sociStore, indexDesc)
+	if err != nil {
+		return nil
+	}
+	index, _, err := builder.ParseIndex(manifestBytes)
+	if err != nil {
+		return nil
+	}
+	return index.Subject
+}
+
 // Call registry's headManifest and return the manifest's descriptor
 func (registry *Registry) HeadManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
 	repo, err := registry.registry.Repository(ctx, repositoryName)
@@ -143,6 +427,47 @@ func (registry *Registry) GetManifest(ctx context.Context, repositoryName string
 	return manifest, nil
 }
 
+// Fetch the raw content of a manifest or image index, reference can be either a digest or a tag
+func (registry *Registry) FetchManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, []byte, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+
+	descriptor, rc, err := repo.FetchReference(ctx, reference)
+	if err != nil {
+		return descriptor, nil, err
+	}
+	defer rc.Close()
+
+	bytes, err := io.ReadAll(rc)
+	if err != nil {
+		return descriptor, nil, err
+	}
+
+	return descriptor, bytes, nil
+}
+
+// List the SOCI indices referring to a manifest of the repository
+func (registry *Registry) SociIndices(ctx context.Context, repositoryName string, manifest ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	return sociReferrers(ctx, repo, manifest)
+}
+
+// Fetch the content of a blob, e.g. a ztoc, from the repository
+func (registry *Registry) FetchBlob(ctx context.Context, repositoryName string, desc ocispec.Descriptor) ([]byte, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	return content.FetchAll(ctx, repo, desc)
+}
+
 // Validate if a digest is a valid image manifest
 func (registry *Registry) ValidateImageManifest(ctx context.Context, repositoryName string, digest string) error {
 	manifest, err := registry.GetManifest(ctx, repositoryName, digest)
@@ -173,36 +498,40 @@ func isEcrRegistry(registryUrl string) bool {
 	return match
 }
 
-// Authorize ECR registry
-func authorizeEcr(ecrRegistry *remote.Registry) error {
-	// getting ecr auth token
-	input := &ecr.GetAuthorizationTokenInput{}
-	var ecrClient *ecr.ECR
+// Create the client of the ECR API in the region of the registry, so images of other regions than AWS_REGION can be processed
+func newEcrClient(registryUrl string, cfg *config) *ecr.ECR {
+	ecrConfig := request.WithRetryer(&aws.Config{}, newThrottleRetryer(cfg.throttling))
+	if region := ecrRegion(registryUrl); region != "" {
+		ecrConfig.Region = aws.String(region)
+	}
 	ecrEndpoint := os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
 	if ecrEndpoint != "" {
-		ecrClient = ecr.New(session.New(&aws.Config{Endpoint: aws.String(ecrEndpoint)}))
-	} else {
-		ecrClient = ecr.New(session.New())
+		ecrConfig.Endpoint = aws.String(ecrEndpoint)
 	}
-	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationToken(input)
+	ecrClient := ecr.New(session.New(ecrConfig))
+	ecrClient.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(cfg.userAgent))
+	return ecrClient
+}
+
+// Authorize ECR registry.
+// The authorization token is shared by all clients of the registry during the run
+// and refreshed before it expires, so long runs don't start failing with 401s.
+func authorizeEcr(ctx context.Context, ecrRegistry *remote.Registry, ecrClient ecriface.ECRAPI, cfg *config) error {
+	credentials := cachedEcrCredentials(ecrRegistry.Reference.Registry, ecrClient)
+	// fail early if the worker can't get a token
+	_, err := credentials.Credential(ctx, ecrRegistry.Reference.Registry)
 	if err != nil {
 		return err
 	}
 
-	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization data returned")
-	}
-
-	ecrAuthorizationToken := getAuthorizationTokenResponse.AuthorizationData[0].AuthorizationToken
-	if len(*ecrAuthorizationToken) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization token returned")
-	}
-
 	ecrRegistry.RepositoryOptions.Client = &auth.Client{
+		Client: newHttpClient(cfg),
 		Header: http.Header{
-			"Authorization": {"Basic " + *ecrAuthorizationToken},
-			"User-Agent":    {"SOCI Index Builder (oras-go)"},
+			"User-Agent": {cfg.userAgent},
 		},
+		Credential: credentials.Credential,
+		// tokens are cached per host and scope for the whole run
+		Cache: auth.DefaultCache,
 	}
 	return nil
 }
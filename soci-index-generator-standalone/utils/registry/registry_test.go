@@ -4,11 +4,18 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
 )
 
 type ExpectedResponse struct {
@@ -16,20 +23,42 @@ type ExpectedResponse struct {
 	Config    ocispec.Descriptor
 }
 
+// Push a Docker image and a Docker manifest list of it to the test registry
+func pushDockerImages(testRegistry *testregistry.Registry) {
+	config := testRegistry.PushBlob("library/redis", MediaTypeDockerImageConfig, []byte(`{"os":"linux","architecture":"amd64"}`))
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: MediaTypeDockerManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{},
+	})
+	manifestDesc := testRegistry.PushManifest("library/redis", "7-amd64", MediaTypeDockerManifest, manifest)
+	manifestDesc.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	index, _ := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: MediaTypeDockerManifestList,
+		Manifests: []ocispec.Descriptor{manifestDesc},
+	})
+	testRegistry.PushManifest("library/redis", "7", MediaTypeDockerManifestList, index)
+}
+
 func TestHeadManifest(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	pushDockerImages(testRegistry)
+
 	doTest := func(registryUrl string, repository string, digestOrTag string, expected ExpectedResponse) {
 		// making the test context
 		ctx := context.Background()
 		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Minute*5))
 		defer cancel()
-		registry, err := Init(ctx, registryUrl)
+		registry, err := Init(ctx, registryUrl, WithTransport(testRegistry.Transport()))
 		if err != nil {
-			panic(err)
+			t.Fatalf("Init failed: %v", err)
 		}
 
 		descriptor, err := registry.HeadManifest(context.Background(), repository, digestOrTag)
 		if err != nil {
-			panic(err)
+			t.Fatalf("HeadManifest failed: %v", err)
 		}
 		if descriptor.MediaType != expected.MediaType {
 			t.Fatalf("Incorrect manifest media type. Expected %s but got %s", expected.MediaType, descriptor.MediaType)
@@ -39,38 +68,31 @@ func TestHeadManifest(t *testing.T) {
 	expected := ExpectedResponse{
 		MediaType: MediaTypeDockerManifestList,
 	}
-	doTest("public.ecr.aws", "docker/library/redis", "7", expected)
-
-	expected = ExpectedResponse{
-		MediaType: MediaTypeDockerManifestList,
-	}
-	doTest("public.ecr.aws", "lambda/python", "3.10", expected)
-
-	expected = ExpectedResponse{
-		MediaType: MediaTypeDockerManifest,
-	}
-	doTest("public.ecr.aws", "lambda/python", "3.10-x86_64", expected)
+	doTest(testregistry.Host, "library/redis", "7", expected)
 
 	expected = ExpectedResponse{
 		MediaType: MediaTypeDockerManifest,
 	}
-	doTest("docker.io", "library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", expected)
+	doTest(testregistry.Host, "library/redis", "7-amd64", expected)
 }
 
 func TestGetManifest(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	pushDockerImages(testRegistry)
+
 	doTest := func(registryUrl string, repository string, digestOrTag string, expected ExpectedResponse) {
 		// making the test context
 		ctx := context.Background()
 		ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Minute*5))
 		defer cancel()
-		registry, err := Init(ctx, registryUrl)
+		registry, err := Init(ctx, registryUrl, WithTransport(testRegistry.Transport()))
 		if err != nil {
-			panic(err)
+			t.Fatalf("Init failed: %v", err)
 		}
 
 		manifest, err := registry.GetManifest(context.Background(), repository, digestOrTag)
 		if err != nil {
-			panic(err)
+			t.Fatalf("GetManifest failed: %v", err)
 		}
 		if manifest.MediaType != expected.MediaType {
 			t.Fatalf("Incorrect manifest media type. Expected %s but got %s", expected.MediaType, manifest.MediaType)
@@ -87,15 +109,7 @@ func TestGetManifest(t *testing.T) {
 			MediaType: "",
 		},
 	}
-	doTest("public.ecr.aws", "docker/library/redis", "7", expected)
-
-	expected = ExpectedResponse{
-		MediaType: MediaTypeDockerManifestList,
-		Config: ocispec.Descriptor{
-			MediaType: "",
-		},
-	}
-	doTest("public.ecr.aws", "lambda/python", "3.10", expected)
+	doTest(testregistry.Host, "library/redis", "7", expected)
 
 	expected = ExpectedResponse{
 		MediaType: MediaTypeDockerManifest,
@@ -103,13 +117,25 @@ func TestGetManifest(t *testing.T) {
 			MediaType: MediaTypeDockerImageConfig,
 		},
 	}
-	doTest("public.ecr.aws", "lambda/python", "3.10-x86_64", expected)
+	doTest(testregistry.Host, "library/redis", "7-amd64", expected)
+}
 
-	expected = ExpectedResponse{
-		MediaType: MediaTypeDockerManifest,
-		Config: ocispec.Descriptor{
-			MediaType: MediaTypeDockerImageConfig,
-		},
+func TestPlatformSuccessors(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	amd64 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: "sha256:amd64", Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}}
+	arm64 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: "sha256:arm64", Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}}
+	indexBytes, _ := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{amd64, arm64}})
+	indexDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromBytes(indexBytes), Size: int64(len(indexBytes))}
+	if err := store.Push(ctx, indexDesc, bytes.NewReader(indexBytes)); err != nil {
+		t.Fatalf("Failed to push the image index: %v", err)
+	}
+
+	successors, err := platformSuccessors([]ocispec.Platform{{OS: "linux", Architecture: "arm64"}})(ctx, store, indexDesc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(successors) != 1 || successors[0].Digest != arm64.Digest {
+		t.Fatalf("Expected only the linux/arm64 manifest but got %v", successors)
 	}
-	doTest("docker.io", "library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", expected)
 }
@@ -0,0 +1,94 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// DefaultDownloadResumes is how many times an interrupted blob download is resumed by default
+const DefaultDownloadResumes = 5
+
+// resumeTransport resumes blob downloads interrupted by a network error with a Range request for the rest of the blob,
+// instead of failing the pull and downloading the whole layer again. Only responses of registries (or their storage
+// backends) advertising byte ranges with Accept-Ranges are resumed. The content is still verified against its digest
+// when it is stored, so a blob that changed between the requests fails the pull.
+type resumeTransport struct {
+	base    http.RoundTripper
+	resumes int
+}
+
+func (t *resumeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !isBlobDownload(req) || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return resp, err
+	}
+	resp.Body = &resumingBody{transport: t, req: req, body: resp.Body, size: resp.ContentLength}
+	return resp, nil
+}
+
+// Whether a request downloads a blob, registries redirect blob downloads to a storage backend outside of /v2/
+func isBlobDownload(req *http.Request) bool {
+	path := req.URL.Path
+	if req.Method != http.MethodGet || strings.Contains(path, "/blobs/uploads") {
+		return false
+	}
+	return strings.Contains(path, "/blobs/") || !strings.HasPrefix(path, "/v2/")
+}
+
+// resumingBody is the body of a blob download that continues from the last read byte after a read error
+type resumingBody struct {
+	transport *resumeTransport
+	req       *http.Request
+	body      io.ReadCloser
+	size      int64
+	offset    int64
+	resumed   int
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF || b.offset >= b.size || b.req.Context().Err() != nil || b.resumed >= b.transport.resumes {
+			return n, err
+		}
+		if resumeErr := b.resume(err); resumeErr != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Replace the interrupted body with the rest of the blob
+func (b *resumingBody) resume(cause error) error {
+	b.resumed++
+	log.Warn(b.req.Context(), fmt.Sprintf("Resuming download of %s at byte %d of %d after %v", redactUrl(b.req.URL), b.offset, b.size, cause))
+
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", b.offset, b.size-1))
+	resp, err := b.transport.base.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected status code %d of a range request", resp.StatusCode)
+	}
+	b.body.Close()
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
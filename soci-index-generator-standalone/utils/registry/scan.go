@@ -0,0 +1,83 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Scan status of an image that was never scanned
+const ScanStatusNotScanned = "NOT_SCANNED"
+
+// Severities of ECR findings from the least to the most severe, enhanced scanning also reports UNTRIAGED findings
+var ScanSeverities = []string{
+	ecr.FindingSeverityInformational,
+	ecr.FindingSeverityLow,
+	ecr.FindingSeverityMedium,
+	ecr.FindingSeverityHigh,
+	ecr.FindingSeverityCritical,
+}
+
+// Outcome of the vulnerability scan of an image manifest
+type ScanFindings struct {
+	// status of the scan, e.g. COMPLETE for basic scanning, ACTIVE for enhanced scanning or ScanStatusNotScanned
+	Status string
+	// findings by severity
+	SeverityCounts map[string]int64
+}
+
+// Whether the scan finished, basic scans are COMPLETE and enhanced scans are ACTIVE once the image was scanned
+func (f *ScanFindings) Complete() bool {
+	return f.Status == ecr.ScanStatusComplete || f.Status == ecr.ScanStatusActive
+}
+
+// The number of findings of the severity or a more severe one
+func (f *ScanFindings) CountAtLeast(severity string) int64 {
+	var count int64
+	counting := false
+	for _, s := range ScanSeverities {
+		counting = counting || s == severity
+		if counting {
+			count += f.SeverityCounts[s]
+		}
+	}
+	return count
+}
+
+// Read the scan status and finding counts of an image manifest in an ECR repository (basic or enhanced scanning).
+// Returns ErrNotEcrRegistry for other registries, which have no scan findings to check.
+func (registry *Registry) ImageScanFindings(ctx context.Context, repositoryName string, manifestDigest string) (*ScanFindings, error) {
+	if registry.ecrClient == nil {
+		return nil, ErrNotEcrRegistry
+	}
+	out, err := registry.ecrClient.DescribeImageScanFindingsWithContext(ctx, &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     ecrRegistryId(registry.registry.Reference.Registry),
+		RepositoryName: aws.String(repositoryName),
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest)},
+		// only the counts of the summary are needed
+		MaxResults: aws.Int64(1),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeScanNotFoundException {
+			return &ScanFindings{Status: ScanStatusNotScanned}, nil
+		}
+		return nil, err
+	}
+	findings := &ScanFindings{SeverityCounts: map[string]int64{}}
+	if out.ImageScanStatus != nil {
+		findings.Status = aws.StringValue(out.ImageScanStatus.Status)
+	}
+	if out.ImageScanFindings != nil {
+		for severity, count := range out.ImageScanFindings.FindingSeverityCounts {
+			findings.SeverityCounts[severity] = aws.Int64Value(count)
+		}
+	}
+	return findings, nil
+}
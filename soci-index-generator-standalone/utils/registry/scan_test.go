@@ -0,0 +1,68 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+type fakeEcrScans struct {
+	ecriface.ECRAPI
+	findings map[string]*ecr.DescribeImageScanFindingsOutput
+}
+
+func (f *fakeEcrScans) DescribeImageScanFindingsWithContext(ctx aws.Context, input *ecr.DescribeImageScanFindingsInput, opts ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+	out, ok := f.findings[*input.ImageId.ImageDigest]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeScanNotFoundException, "not scanned", nil)
+	}
+	return out, nil
+}
+
+func TestImageScanFindings(t *testing.T) {
+	remoteRegistry, _ := remote.NewRegistry("123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	fake := &fakeEcrScans{findings: map[string]*ecr.DescribeImageScanFindingsOutput{
+		"sha256:scanned": {
+			ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+			ImageScanFindings: &ecr.ImageScanFindings{FindingSeverityCounts: map[string]*int64{
+				ecr.FindingSeverityHigh:     aws.Int64(2),
+				ecr.FindingSeverityCritical: aws.Int64(1),
+				ecr.FindingSeverityLow:      aws.Int64(5),
+			}},
+		},
+		"sha256:scanning": {ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusInProgress)}},
+	}}
+	registry := &Registry{registry: remoteRegistry, ecrClient: fake}
+	ctx := context.Background()
+
+	findings, err := registry.ImageScanFindings(ctx, "team/app", "sha256:scanned")
+	if err != nil || !findings.Complete() {
+		t.Fatalf("Expected a complete scan, got %+v, %v", findings, err)
+	}
+	if findings.CountAtLeast(ecr.FindingSeverityCritical) != 1 || findings.CountAtLeast(ecr.FindingSeverityHigh) != 3 || findings.CountAtLeast(ecr.FindingSeverityInformational) != 8 {
+		t.Fatalf("Unexpected finding counts %v", findings.SeverityCounts)
+	}
+
+	findings, err = registry.ImageScanFindings(ctx, "team/app", "sha256:scanning")
+	if err != nil || findings.Complete() {
+		t.Fatalf("Expected an unfinished scan, got %+v, %v", findings, err)
+	}
+	findings, err = registry.ImageScanFindings(ctx, "team/app", "sha256:unknown")
+	if err != nil || findings.Status != ScanStatusNotScanned {
+		t.Fatalf("Expected the image not to be scanned, got %+v, %v", findings, err)
+	}
+
+	registry = &Registry{registry: remoteRegistry}
+	if _, err := registry.ImageScanFindings(ctx, "team/app", "sha256:scanned"); err != ErrNotEcrRegistry {
+		t.Fatalf("Expected ErrNotEcrRegistry but got %v", err)
+	}
+}
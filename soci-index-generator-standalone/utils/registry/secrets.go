@@ -0,0 +1,116 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// How long registry credentials read from Secrets Manager are used before the secret is read again,
+// so rotated credentials are picked up during long runs
+const secretRefreshInterval = 5 * time.Minute
+
+// Credentials read from the secrets during this run by secret ID,
+// so registry clients of the same registry don't each read the secret
+var (
+	secretCredentialsMu   sync.Mutex
+	secretCredentialsById = map[string]*secretCredentials{}
+)
+
+// The shared credentials of the secret, created reading it with the given client if there are none yet
+func cachedSecretCredentials(secretId string, username string, client secretsmanageriface.SecretsManagerAPI) *secretCredentials {
+	secretCredentialsMu.Lock()
+	defer secretCredentialsMu.Unlock()
+
+	credentials, ok := secretCredentialsById[secretId]
+	if !ok {
+		credentials = &secretCredentials{client: client, secretId: secretId, username: username}
+		secretCredentialsById[secretId] = credentials
+	}
+	return credentials
+}
+
+// Create the Secrets Manager client in the region of the secret's ARN, the default region for secret names
+func newSecretsManagerClient(secretId string) secretsmanageriface.SecretsManagerAPI {
+	config := &aws.Config{}
+	if parsed, err := arn.Parse(secretId); err == nil {
+		config.Region = aws.String(parsed.Region)
+	}
+	return secretsmanager.New(session.New(config))
+}
+
+// secretCredentials reads basic auth credentials of a registry from a secret and reads it again
+// every secretRefreshInterval. The secret is either JSON with a username and a password
+// or the password only, for the username of the host settings.
+type secretCredentials struct {
+	client   secretsmanageriface.SecretsManagerAPI
+	secretId string
+	username string
+
+	mu         sync.Mutex
+	credential auth.Credential
+	fetchedAt  time.Time
+}
+
+// Credential returns the credentials of the secret, see auth.Client.Credential
+func (c *secretCredentials) Credential(ctx context.Context, hostport string) (auth.Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credential != auth.EmptyCredential && time.Since(c.fetchedAt) < secretRefreshInterval {
+		return c.credential, nil
+	}
+	credential, err := c.fetch(ctx)
+	if err != nil {
+		if c.credential != auth.EmptyCredential {
+			// the previous credentials may still be valid, the secret is read again on the next request
+			log.Warn(ctx, fmt.Sprintf("Couldn't read the registry credentials from %s again, using the previous ones: %v", c.secretId, err))
+			return c.credential, nil
+		}
+		return auth.EmptyCredential, err
+	}
+	c.credential = credential
+	c.fetchedAt = time.Now()
+	return c.credential, nil
+}
+
+func (c *secretCredentials) fetch(ctx context.Context) (auth.Credential, error) {
+	output, err := c.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(c.secretId)})
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("reading the registry credentials from %s: %w", c.secretId, err)
+	}
+	value := aws.StringValue(output.SecretString)
+	credential := auth.Credential{Username: c.username, Password: value}
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		var secret struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal([]byte(value), &secret); err != nil {
+			return auth.EmptyCredential, fmt.Errorf("invalid registry credentials in %s: %w", c.secretId, err)
+		}
+		credential.Password = secret.Password
+		if secret.Username != "" {
+			credential.Username = secret.Username
+		}
+	}
+	if credential.Username == "" || credential.Password == "" {
+		return auth.EmptyCredential, fmt.Errorf("the secret %s has no username or password of the registry", c.secretId)
+	}
+	return credential, nil
+}
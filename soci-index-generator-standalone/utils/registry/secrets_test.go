@@ -0,0 +1,69 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// fakeSecretsManager returns the current value of the secret, or fails if it is empty
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	value string
+	reads int
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	f.reads++
+	if f.value == "" {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(f.value)}, nil
+}
+
+func TestSecretCredentials(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeSecretsManager{value: `{"username": "robot$builder", "password": "first"}`}
+	credentials := &secretCredentials{client: client, secretId: "harbor-credentials"}
+
+	credential, err := credentials.Credential(ctx, "harbor.example.com")
+	if err != nil || credential != (auth.Credential{Username: "robot$builder", Password: "first"}) {
+		t.Fatalf("Unexpected credentials %+v %v", credential, err)
+	}
+	credentials.Credential(ctx, "harbor.example.com")
+	if client.reads != 1 {
+		t.Fatalf("Expected the secret to be read once but it was read %d times", client.reads)
+	}
+
+	// the rotated secret is read after the refresh interval
+	client.value = `{"username": "robot$builder", "password": "second"}`
+	credentials.fetchedAt = time.Now().Add(-secretRefreshInterval)
+	credential, _ = credentials.Credential(ctx, "harbor.example.com")
+	if credential.Password != "second" {
+		t.Fatalf("Expected the rotated password but got %q", credential.Password)
+	}
+
+	// the previous credentials are used while the secret can't be read
+	client.value = ""
+	credentials.fetchedAt = time.Now().Add(-secretRefreshInterval)
+	credential, err = credentials.Credential(ctx, "harbor.example.com")
+	if err != nil || credential.Password != "second" {
+		t.Fatalf("Expected the previous credentials but got %+v %v", credential, err)
+	}
+
+	plain := &secretCredentials{client: &fakeSecretsManager{value: "token"}, secretId: "docker-hub-token", username: "builder"}
+	credential, err = plain.Credential(ctx, "registry-1.docker.io")
+	if err != nil || credential != (auth.Credential{Username: "builder", Password: "token"}) {
+		t.Fatalf("Unexpected credentials of a plain secret %+v %v", credential, err)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"oras.land/oras-go/v2/registry/remote/retry"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Backoff of requests throttled by the registry (HTTP 429) or the ECR API (ThrottlingException)
+type Throttling struct {
+	// total time a single request may wait for throttling to pass, 0 disables the backoff
+	Budget time.Duration
+	// delay before the first retry, doubled with every further retry
+	MinDelay time.Duration
+	// longest delay between two retries
+	MaxDelay time.Duration
+}
+
+// DefaultThrottling is used unless WithThrottling sets another budget
+var DefaultThrottling = Throttling{Budget: 2 * time.Minute, MinDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// Delay before the given retry of a throttled request: exponential with jitter,
+// so workers throttled at the same time don't retry at the same time either
+func (t Throttling) delay(retry int) time.Duration {
+	delay := t.MaxDelay
+	if retry < 32 && t.MinDelay<<retry < t.MaxDelay {
+		delay = t.MinDelay << retry
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// throttlePolicy retries throttled registry requests until the budget is used up,
+// other failures are retried by the default policy
+type throttlePolicy struct {
+	throttling Throttling
+	throttled  int
+	waited     time.Duration
+}
+
+func newThrottlePolicy(throttling Throttling) func() retry.Policy {
+	return func() retry.Policy {
+		return &throttlePolicy{throttling: throttling}
+	}
+}
+
+func (p *throttlePolicy) Retry(attempt int, resp *http.Response, err error) (time.Duration, error) {
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || p.throttling.Budget <= 0 {
+		return retry.DefaultPolicy.Retry(attempt-p.throttled, resp, err)
+	}
+
+	wait := p.throttling.delay(p.throttled)
+	if signalled := retryAfter(resp, time.Now()); signalled > 0 {
+		wait = signalled
+	}
+	if p.waited+wait > p.throttling.Budget {
+		if resp.Request != nil {
+			log.Warn(resp.Request.Context(), fmt.Sprintf("Not retrying the throttled request to %s, the registry asks to wait %s", resp.Request.URL.Host, wait.Round(time.Second)))
+		}
+		return -1, nil
+	}
+	p.throttled++
+	p.waited += wait
+	return wait, nil
+}
+
+// How long a registry asks to wait before retrying a throttled request, 0 if it doesn't say.
+// Besides Retry-After in seconds or as a date, registries like Docker Hub report an exhausted rate limit
+// with "RateLimit-Remaining: 0;w=<window in seconds>", the limit is only restored within the window.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil && date.After(now) {
+			return date.Sub(now)
+		}
+	}
+	remaining, window, ok := strings.Cut(resp.Header.Get("RateLimit-Remaining"), ";w=")
+	if !ok || strings.TrimSpace(remaining) != "0" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(strings.TrimSpace(window), 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// Until when the requests to a registry host are paused, shared by all registry clients of the process
+// so that concurrent blob transfers and the following builds of a batch wait instead of being throttled too
+var pausedHosts = &hostPauses{until: map[string]time.Time{}}
+
+type hostPauses struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func (p *hostPauses) pause(host string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if until.After(p.until[host]) {
+		p.until[host] = until
+	}
+}
+
+// Wait until the requests to the host are no longer paused
+func (p *hostPauses) wait(ctx context.Context, host string) error {
+	p.mu.Lock()
+	wait := time.Until(p.until[host])
+	p.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pauseTransport holds back the requests to a registry that asked to wait with a throttled response,
+// rather than sending each of them only to be throttled and retried on its own. A wait longer than the
+// throttling budget isn't waited for, the throttled requests fail instead.
+type pauseTransport struct {
+	base   http.RoundTripper
+	budget time.Duration
+	pauses *hostPauses
+}
+
+func (t *pauseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.pauses.wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	if wait := retryAfter(resp, time.Now()); wait > 0 && wait <= t.budget {
+		log.Warn(req.Context(), fmt.Sprintf("Registry %s is throttling, pausing its requests for %s", req.URL.Host, wait.Round(time.Second)))
+		t.pauses.pause(req.URL.Host, time.Now().Add(wait))
+	}
+	return resp, nil
+}
+
+// throttleRetryer retries throttled ECR API calls until the budget is used up,
+// other failures are retried like by the default retryer of the SDK
+type throttleRetryer struct {
+	client.DefaultRetryer
+	throttling Throttling
+}
+
+func newThrottleRetryer(throttling Throttling) request.Retryer {
+	return throttleRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries},
+		throttling:     throttling,
+	}
+}
+
+// MaxRetries is unlimited for throttled calls, ShouldRetry limits the retries instead
+func (r throttleRetryer) MaxRetries() int {
+	if r.throttling.Budget <= 0 {
+		return r.DefaultRetryer.MaxRetries()
+	}
+	return 1 << 30
+}
+
+func (r throttleRetryer) ShouldRetry(req *request.Request) bool {
+	if r.throttling.Budget > 0 && req.IsErrorThrottle() {
+		return time.Since(req.Time) < r.throttling.Budget
+	}
+	return req.RetryCount < r.DefaultRetryer.MaxRetries() && r.DefaultRetryer.ShouldRetry(req)
+}
+
+func (r throttleRetryer) RetryRules(req *request.Request) time.Duration {
+	if r.throttling.Budget > 0 && req.IsErrorThrottle() {
+		return r.throttling.delay(req.RetryCount)
+	}
+	return r.DefaultRetryer.RetryRules(req)
+}
@@ -0,0 +1,90 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeouts of individual registry operations, 0 means no limit
+type Timeouts struct {
+	// fetching a manifest
+	Manifest time.Duration
+	// downloading a single blob, i.e. a layer
+	BlobDownload time.Duration
+	// each request of a blob or manifest push
+	Push time.Duration
+}
+
+// timeoutError is returned when a request exceeds its operation's timeout.
+// It is a net.Error with Timeout() true, so the retrying transport retries the request.
+type timeoutError struct {
+	operation string
+	timeout   time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.operation, e.timeout)
+}
+
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// timeoutTransport limits each request (including reading its response body) to the timeout of its operation
+type timeoutTransport struct {
+	base     http.RoundTripper
+	timeouts Timeouts
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation, timeout := t.timeoutOf(req)
+	if timeout == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &timeoutError{operation, timeout}
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Classify a request by the registry operation it belongs to
+func (t *timeoutTransport) timeoutOf(req *http.Request) (string, time.Duration) {
+	path := req.URL.Path
+	switch {
+	case strings.Contains(path, "/manifests/") && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		return "manifest fetch", t.timeouts.Manifest
+	case strings.Contains(path, "/manifests/") || strings.Contains(path, "/blobs/uploads"):
+		return "push", t.timeouts.Push
+	case strings.Contains(path, "/blobs/") || (!strings.HasPrefix(path, "/v2/") && req.Method == http.MethodGet):
+		// registries redirect blob downloads to a storage backend outside of /v2/
+		return "blob download", t.timeouts.BlobDownload
+	default:
+		return "", 0
+	}
+}
+
+// cancelOnClose releases the request's timeout context once its body is consumed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,228 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/retry"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Headers whose values are never logged
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Query parameters of pre-signed blob URLs whose values are never logged
+var redactedQueryParameters = []string{"X-Amz-Credential", "X-Amz-Signature", "X-Amz-Security-Token", "Signature", "Token"}
+
+// Settings of the HTTP transport to the registry
+type TransportSettings struct {
+	// URL of an HTTP proxy for all registry requests, e.g. a SigV4 signing proxy, the environment's proxy if empty
+	Proxy string
+	// PEM file of CA certificates trusted in addition to the system's
+	CACertFile string
+	// PEM files of the client certificate and its key for mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// idle connections kept open to a registry host, http.DefaultTransport's 2 if 0.
+	// Blobs transferred at the same time beyond this open new connections, which is slow over high-latency links.
+	MaxIdleConnsPerHost int
+	// how long an idle connection is kept open and the limit of a TLS handshake, http.DefaultTransport's if 0
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+	// talk HTTP/1.1 only, for proxies that break HTTP/2
+	DisableHTTP2 bool
+}
+
+// NewTransport creates an HTTP transport to the registry with the given settings, based on http.DefaultTransport
+func NewTransport(settings TransportSettings) (*http.Transport, error) {
+	return newTransport(http.DefaultTransport.(*http.Transport), settings)
+}
+
+// Create an HTTP transport like the base transport, with the given settings changed
+func newTransport(base *http.Transport, settings TransportSettings) (*http.Transport, error) {
+	transport := base.Clone()
+	if settings.Proxy != "" {
+		proxyUrl, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if settings.MaxIdleConnsPerHost < 0 || settings.IdleConnTimeout < 0 || settings.TLSHandshakeTimeout < 0 {
+		return nil, errors.New("connection pool sizes and timeouts can't be negative")
+	}
+	if settings.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+		transport.MaxIdleConns = max(transport.MaxIdleConns, settings.MaxIdleConnsPerHost)
+	}
+	if settings.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = settings.IdleConnTimeout
+	}
+	if settings.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = settings.TLSHandshakeTimeout
+	}
+	if settings.DisableHTTP2 {
+		disableHTTP2(transport)
+	}
+	if settings.CACertFile == "" && settings.ClientCertFile == "" && settings.ClientKeyFile == "" {
+		return transport, nil
+	}
+
+	// the settings of the base transport that aren't changed are kept, e.g. its client certificate
+	tlsConfig := transport.TLSClientConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if settings.CACertFile != "" {
+		pem, err := os.ReadFile(settings.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", settings.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (settings.ClientCertFile == "") != (settings.ClientKeyFile == "") {
+		return nil, errors.New("a client certificate requires its key and vice versa")
+	}
+	if settings.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.ClientCertFile, settings.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// Keep the transport from negotiating HTTP/2 with registries
+func disableHTTP2(transport *http.Transport) {
+	// a non-nil empty map keeps the transport from upgrading TLS connections to HTTP/2
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	// the TLS config of a transport that was used already offers h2 to the server, its protocols are
+	// shared with the transport it was cloned from so they are copied
+	if transport.TLSClientConfig != nil {
+		var nextProtos []string
+		for _, proto := range transport.TLSClientConfig.NextProtos {
+			if proto != "h2" {
+				nextProtos = append(nextProtos, proto)
+			}
+		}
+		transport.TLSClientConfig.NextProtos = nextProtos
+	}
+}
+
+// Build the HTTP client used for all registry requests.
+// Retries, pauses of throttling registries, timeouts, download resumes and debug logging are layered on top of the configured transport.
+func newHttpClient(cfg *config) *http.Client {
+	transport := cfg.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if cfg.debugHttp {
+		transport = &attemptTransport{base: transport}
+	}
+	if cfg.timeouts != (Timeouts{}) {
+		transport = &timeoutTransport{base: transport, timeouts: cfg.timeouts}
+	}
+	transport = &pauseTransport{base: transport, budget: cfg.throttling.Budget, pauses: pausedHosts}
+	transport = &retry.Transport{Base: transport, Policy: newThrottlePolicy(cfg.throttling)}
+	if cfg.downloadResumes > 0 {
+		transport = &resumeTransport{base: transport, resumes: cfg.downloadResumes}
+	}
+	if cfg.debugHttp {
+		transport = &debugTransport{base: transport}
+	}
+	return &http.Client{Transport: transport}
+}
+
+type attemptsKey struct{}
+
+// attemptTransport counts how many times the retrying transport sent a request
+type attemptTransport struct {
+	base http.RoundTripper
+}
+
+func (t *attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if attempts, ok := req.Context().Value(attemptsKey{}).(*int32); ok {
+		atomic.AddInt32(attempts, 1)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// debugTransport logs method, URL, status, retry count and latency of every request
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := new(int32)
+	req = req.WithContext(context.WithValue(req.Context(), attemptsKey{}, attempts))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	fields := map[string]interface{}{
+		"method":         req.Method,
+		"url":            redactUrl(req.URL),
+		"requestHeaders": redactHeaders(req.Header),
+		"retries":        max(atomic.LoadInt32(attempts)-1, 0),
+		"latencyMs":      time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else {
+		fields["status"] = resp.StatusCode
+	}
+	log.Debug(req.Context(), "Registry request", fields)
+
+	return resp, err
+}
+
+// Copy the headers, replacing the values of credentials
+func redactHeaders(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for name, values := range header {
+		redacted[name] = strings.Join(values, ", ")
+	}
+	for _, name := range redactedHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = "[redacted]"
+		}
+	}
+	return redacted
+}
+
+// Format the URL, replacing the values of credentials in the query string
+func redactUrl(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	query := redacted.Query()
+	for _, name := range redactedQueryParameters {
+		if query.Has(name) {
+			query.Set(name, "redacted")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
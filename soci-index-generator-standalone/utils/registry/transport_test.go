@@ -0,0 +1,326 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebugTransportCountsRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newHttpClient(&config{debugHttp: true})
+	resp, err := client.Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 2 {
+		t.Fatalf("Expected the request to succeed after one retry, got status %d after %d requests", resp.StatusCode, requests)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	headers := redactHeaders(http.Header{
+		"Authorization": {"Basic c2VjcmV0"},
+		"User-Agent":    {"soci-index-builder/dev"},
+	})
+	if headers["Authorization"] != "[redacted]" || headers["User-Agent"] != "soci-index-builder/dev" {
+		t.Fatalf("Unexpected redacted headers: %v", headers)
+	}
+
+	u, _ := url.Parse("https://bucket.s3.amazonaws.com/blob?X-Amz-Signature=secret&X-Amz-Expires=60")
+	expected := "https://bucket.s3.amazonaws.com/blob?X-Amz-Expires=60&X-Amz-Signature=redacted"
+	if redactUrl(u) != expected {
+		t.Fatalf("Unexpected redacted URL. Expected %s but got %s", expected, redactUrl(u))
+	}
+}
+
+func TestTimeoutTransportRetriesStalledRequest(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the first manifest fetch stalls
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newHttpClient(&config{timeouts: Timeouts{Manifest: 100 * time.Millisecond}})
+	resp, err := client.Get(server.URL + "/v2/repository/manifests/latest")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("Expected the stalled request to be retried once, got %d requests", atomic.LoadInt32(&requests))
+	}
+}
+
+func TestThrottledRequestIsRetriedWithinBudget(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// more throttled responses than the default policy retries
+		if atomic.AddInt32(&requests, 1) <= 8 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	throttling := Throttling{Budget: time.Second, MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	resp, err := newHttpClient(&config{throttling: throttling}).Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&requests) != 9 {
+		t.Fatalf("Expected the request to succeed after 8 retries, got status %d after %d requests", resp.StatusCode, atomic.LoadInt32(&requests))
+	}
+
+	// once the budget is used up the throttled response is returned
+	atomic.StoreInt32(&requests, 0)
+	throttling = Throttling{Budget: 5 * time.Millisecond, MinDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	resp, err = newHttpClient(&config{throttling: throttling}).Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Expected the throttled response without retries, got status %d after %d requests", resp.StatusCode, atomic.LoadInt32(&requests))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for headers, expected := range map[string]time.Duration{
+		"Retry-After: 30": 30 * time.Second,
+		"Retry-After: Wed, 01 May 2024 12:02:00 GMT":     2 * time.Minute,
+		"Retry-After: Wed, 01 May 2024 11:00:00 GMT":     0,
+		"RateLimit-Remaining: 0;w=21600":                 6 * time.Hour,
+		"RateLimit-Remaining: 42;w=21600":                0,
+		"Retry-After: soon\nRateLimit-Remaining: 0;w=60": time.Minute,
+		"": 0,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		for _, header := range strings.Split(headers, "\n") {
+			if name, value, ok := strings.Cut(header, ": "); ok {
+				resp.Header.Set(name, value)
+			}
+		}
+		if wait := retryAfter(resp, now); wait != expected {
+			t.Fatalf("Expected to wait %s for %q but got %s", expected, headers, wait)
+		}
+	}
+}
+
+func TestPauseTransportHoldsBackRequests(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport := &pauseTransport{base: http.DefaultTransport, budget: time.Minute, pauses: &hostPauses{until: map[string]time.Time{}}}
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL + "/v2/")
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected the first request to be throttled, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	// any other request to the registry waits for the pause to pass
+	start := time.Now()
+	resp, err = client.Get(server.URL + "/v2/test-repository/blobs/sha256:0")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the second request to succeed, got %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Fatalf("Expected the second request to wait for the pause but it took %s", waited)
+	}
+}
+
+func TestThrottlingDelay(t *testing.T) {
+	throttling := Throttling{MinDelay: time.Second, MaxDelay: 30 * time.Second}
+	for retry, maxDelay := range map[int]time.Duration{0: time.Second, 1: 2 * time.Second, 2: 4 * time.Second, 40: 30 * time.Second} {
+		delay := throttling.delay(retry)
+		if delay < maxDelay/2 || delay > maxDelay {
+			t.Fatalf("Delay of retry %d should be between %s and %s but got %s", retry, maxDelay/2, maxDelay, delay)
+		}
+	}
+}
+
+// stampingTransport adds a header to every request, like a SigV4 signing transport would
+type stampingTransport struct{}
+
+func (stampingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Stamp", "soci")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCustomTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Stamp") != "soci" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newHttpClient(&config{transport: stampingTransport{}})
+	resp, err := client.Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the request to be sent through the custom transport, got status %d", resp.StatusCode)
+	}
+}
+
+func TestTransportTrustsCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatalf("Failed to write the CA certificate: %v", err)
+	}
+	transport, err := NewTransport(TransportSettings{CACertFile: caFile})
+	if err != nil {
+		t.Fatalf("Failed to create the transport: %v", err)
+	}
+
+	resp, err := newHttpClient(&config{transport: transport}).Get(server.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	_, err = NewTransport(TransportSettings{ClientCertFile: caFile})
+	if err == nil {
+		t.Fatalf("Expected a client certificate without key to be rejected")
+	}
+}
+
+func TestTransportConnectionTuning(t *testing.T) {
+	// an HTTP/2 capable registry
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0600); err != nil {
+		t.Fatalf("Failed to write the CA certificate: %v", err)
+	}
+	for disableHTTP2, proto := range map[bool]string{false: "HTTP/2.0", true: "HTTP/1.1"} {
+		transport, err := NewTransport(TransportSettings{CACertFile: caFile, MaxIdleConnsPerHost: 16, TLSHandshakeTimeout: time.Second, DisableHTTP2: disableHTTP2})
+		if err != nil {
+			t.Fatalf("Failed to create the transport: %v", err)
+		}
+		if transport.MaxIdleConnsPerHost != 16 || transport.TLSHandshakeTimeout != time.Second {
+			t.Fatalf("Unexpected connection settings %d, %s", transport.MaxIdleConnsPerHost, transport.TLSHandshakeTimeout)
+		}
+		resp, err := newHttpClient(&config{transport: transport}).Get(server.URL + "/v2/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Proto") != proto {
+			t.Fatalf("Expected %s with DisableHTTP2 %v but got %s", proto, disableHTTP2, resp.Header.Get("X-Proto"))
+		}
+	}
+
+	// a registry with its own settings keeps the connection settings of the flags
+	base, _ := NewTransport(TransportSettings{MaxIdleConnsPerHost: 16})
+	cfg := &config{transport: base}
+	if err := (HostSettings{Proxy: "http://proxy.example.com:3128"}).apply(cfg); err != nil {
+		t.Fatalf("Failed to apply the host settings: %v", err)
+	}
+	if transport := cfg.transport.(*http.Transport); transport == base || transport.MaxIdleConnsPerHost != 16 {
+		t.Fatalf("Expected a transport of the host with the flags' connection settings")
+	}
+
+	if _, err := NewTransport(TransportSettings{IdleConnTimeout: -time.Second}); err == nil {
+		t.Fatalf("Expected a negative idle timeout to be rejected")
+	}
+}
+
+func TestResumeTransportResumesInterruptedDownload(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 10<<10)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Accept-Ranges", "bytes")
+		if len(ranges) == 1 {
+			// send half of the blob, then drop the connection
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(blob[:len(blob)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+
+	client := newHttpClient(newConfig())
+	resp, err := client.Get(server.URL + "/v2/test-repository/blobs/sha256:1234")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected the download to be resumed but got %v", err)
+	}
+	if !bytes.Equal(content, blob) {
+		t.Fatalf("Unexpected content of %d bytes, expected %d", len(content), len(blob))
+	}
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-%d", len(blob)/2, len(blob)-1) {
+		t.Fatalf("Expected one range request for the second half but got %v", ranges)
+	}
+}
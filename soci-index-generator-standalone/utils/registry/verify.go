@@ -0,0 +1,74 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/builder"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+var (
+	ErrIndexWithoutSubject = errors.New("pushed SOCI index has no subject")
+	ErrIndexNotReferrer    = errors.New("pushed SOCI index is not listed as a referrer of its image")
+	ErrMissingBlob         = errors.New("blob of the pushed SOCI index is missing in the repository")
+)
+
+// Verify a pushed SOCI index by reading it back: it must be listed as a referrer of its image
+// and its config and ztoc blobs must exist. Guards against registries silently dropping the subject.
+func (registry *Registry) VerifyPush(ctx context.Context, repositoryName string, indexDesc ocispec.Descriptor) error {
+	log.Info(ctx, "Verifying pushed SOCI index")
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+
+	manifestBytes, err := content.FetchAll(ctx, repo, indexDesc)
+	if err != nil {
+		return fmt.Errorf("fetching the pushed SOCI index: %w", err)
+	}
+	index, config, err := builder.ParseIndex(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if index.Subject == nil {
+		return ErrIndexWithoutSubject
+	}
+
+	referrers, err := sociReferrers(ctx, repo, *index.Subject)
+	if err != nil {
+		return fmt.Errorf("listing referrers of %s: %w", index.Subject.Digest, err)
+	}
+	referred := false
+	for _, referrer := range referrers {
+		if referrer.Digest == indexDesc.Digest {
+			referred = true
+			break
+		}
+	}
+	if !referred {
+		return fmt.Errorf("%w: %s", ErrIndexNotReferrer, index.Subject.Digest)
+	}
+
+	blobs := index.Blobs
+	if config != nil {
+		blobs = append([]ocispec.Descriptor{*config}, blobs...)
+	}
+	for _, blob := range blobs {
+		exists, err := repo.Exists(ctx, blob)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrMissingBlob, blob.Digest)
+		}
+	}
+	return nil
+}
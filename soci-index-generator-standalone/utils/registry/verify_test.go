@@ -0,0 +1,75 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/internal/testregistry"
+)
+
+// droppedReferrersTransport answers referrers requests with an empty list, like a registry dropping the subject
+type droppedReferrersTransport struct {
+	base http.RoundTripper
+}
+
+func (t droppedReferrersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/referrers/") {
+		return t.base.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {ocispec.MediaTypeImageIndex}},
+		Body:       io.NopCloser(bytes.NewReader([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))),
+		Request:    req,
+	}, nil
+}
+
+func TestVerifyPush(t *testing.T) {
+	testRegistry := testregistry.New(t)
+	image := testRegistry.PushImage("test-repository", "latest", []byte("layer"))
+	index := pushSociIndex(testRegistry, "test-repository", image, []byte("ztoc"))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Minute))
+	defer cancel()
+	registry, err := Init(ctx, testregistry.Host, WithTransport(testRegistry.Transport()))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := registry.VerifyPush(ctx, "test-repository", index); err != nil {
+		t.Fatalf("Expected the pushed SOCI index to verify but got %v", err)
+	}
+
+	// an index without a subject
+	testRegistry.PushBlob("test-repository", soci.SociLayerMediaType, []byte("ztoc"))
+	withoutSubject := testRegistry.PushManifest("test-repository", "", ocispec.MediaTypeImageManifest, sociIndexManifest(nil, []byte("ztoc")))
+	if err := registry.VerifyPush(ctx, "test-repository", withoutSubject); !errors.Is(err, ErrIndexWithoutSubject) {
+		t.Fatalf("Expected %v but got %v", ErrIndexWithoutSubject, err)
+	}
+
+	// a ztoc that was never pushed
+	missingZtoc := testRegistry.PushManifest("test-repository", "", ocispec.MediaTypeImageManifest, sociIndexManifest(&image, []byte("missing ztoc")))
+	if err := registry.VerifyPush(ctx, "test-repository", missingZtoc); !errors.Is(err, ErrMissingBlob) {
+		t.Fatalf("Expected %v but got %v", ErrMissingBlob, err)
+	}
+
+	// a registry that doesn't list the index as a referrer
+	dropping, err := Init(ctx, testregistry.Host, WithTransport(droppedReferrersTransport{testRegistry.Transport()}))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := dropping.VerifyPush(ctx, "test-repository", index); !errors.Is(err, ErrIndexNotReferrer) {
+		t.Fatalf("Expected %v but got %v", ErrIndexNotReferrer, err)
+	}
+}
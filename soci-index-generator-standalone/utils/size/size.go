@@ -0,0 +1,101 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package size parses and formats human-readable byte sizes like 10MiB, 500MB or 1G.
+package size
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Multipliers of the accepted units. Units without the "i" (MB, M) are decimal, units with it (MiB) are binary.
+var units = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1e3,
+	"KB":  1e3,
+	"KIB": 1 << 10,
+	"M":   1e6,
+	"MB":  1e6,
+	"MIB": 1 << 20,
+	"G":   1e9,
+	"GB":  1e9,
+	"GIB": 1 << 30,
+	"T":   1e12,
+	"TB":  1e12,
+	"TIB": 1 << 40,
+}
+
+var binaryUnits = []string{"KiB", "MiB", "GiB", "TiB"}
+
+// Parse a size such as 10485760, 10MiB, 500MB or 1.5G into a number of bytes
+func Parse(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	number, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, s[i:])
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	bytes := value * multiplier
+	if bytes > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(bytes), nil
+}
+
+// Format a number of bytes with the largest binary unit it is at least one of, e.g. 10485760 as 10MiB
+func Format(bytes int64) string {
+	if bytes < 1<<10 && bytes > -1<<10 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes)
+	unit := ""
+	for _, u := range binaryUnits {
+		if math.Abs(value) < 1<<10 {
+			break
+		}
+		value /= 1 << 10
+		unit = u
+	}
+	formatted := strings.TrimRight(strings.TrimRight(strconv.FormatFloat(value, 'f', 2, 64), "0"), ".")
+	return formatted + unit
+}
+
+// Value is a flag.Value holding a size in bytes
+type Value int64
+
+func (v *Value) String() string {
+	return Format(int64(*v))
+}
+
+func (v *Value) Set(s string) error {
+	bytes, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*v = Value(bytes)
+	return nil
+}
+
+// Flag defines a size flag with the given name, default value in bytes and usage
+func Flag(flags *flag.FlagSet, name string, value int64, usage string) *int64 {
+	flags.Var((*Value)(&value), name, usage)
+	return &value
+}
@@ -0,0 +1,48 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package size
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"10485760": 10485760,
+		"10MiB":    10 << 20,
+		"10mib":    10 << 20,
+		"500MB":    500_000_000,
+		"1G":       1_000_000_000,
+		"1.5GiB":   3 << 29,
+		"4 KiB":    4096,
+		"0":        0,
+	} {
+		bytes, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", s, err)
+		}
+		if bytes != expected {
+			t.Fatalf("Unexpected size of %q. Expected %d but got %d", s, expected, bytes)
+		}
+	}
+
+	for _, s := range []string{"", "MiB", "10XB", "1..5G", "-1G"} {
+		if _, err := Parse(s); err == nil {
+			t.Fatalf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for bytes, expected := range map[int64]string{
+		0:         "0B",
+		1023:      "1023B",
+		4096:      "4KiB",
+		10 << 20:  "10MiB",
+		3 << 29:   "1.5GiB",
+		123456789: "117.74MiB",
+	} {
+		if Format(bytes) != expected {
+			t.Fatalf("Unexpected format of %d. Expected %s but got %s", bytes, expected, Format(bytes))
+		}
+	}
+}
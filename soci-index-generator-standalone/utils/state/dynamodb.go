@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB backed state store.
+// The table must have a string partition key "ImageDigest" and a string sort key "UpdatedAt",
+// every build appends an item so the table is an auditable history of what has been indexed.
+type DynamoDBStore struct {
+	client    dynamodbiface.DynamoDBAPI
+	tableName string
+}
+
+type dynamoDBItem struct {
+	ImageDigest string
+	UpdatedAt   string
+	Repository  string
+	IndexDigest string `dynamodbav:",omitempty"`
+	Status      string
+	Message     string `dynamodbav:",omitempty"`
+	DurationMs  int64
+}
+
+// Create a state store using the given DynamoDB table
+func NewDynamoDBStore(tableName string) *DynamoDBStore {
+	return &DynamoDBStore{
+		client:    dynamodb.New(session.New()),
+		tableName: tableName,
+	}
+}
+
+func (s *DynamoDBStore) Get(ctx context.Context, imageDigest string) (*Record, error) {
+	output, err := s.client.QueryWithContext(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		KeyConditionExpression: aws.String("ImageDigest = :digest"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":digest": {S: aws.String(imageDigest)},
+		},
+		// newest record first
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+		ConsistentRead:   aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Items) == 0 {
+		return nil, nil
+	}
+
+	var item dynamoDBItem
+	err = dynamodbattribute.UnmarshalMap(output.Items[0], &item)
+	if err != nil {
+		return nil, err
+	}
+	updatedAt, err := time.Parse(timestampFormat, item.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Record{
+		ImageDigest: item.ImageDigest,
+		Repository:  item.Repository,
+		IndexDigest: item.IndexDigest,
+		Status:      item.Status,
+		Message:     item.Message,
+		UpdatedAt:   updatedAt,
+		Duration:    time.Duration(item.DurationMs) * time.Millisecond,
+	}, nil
+}
+
+func (s *DynamoDBStore) Put(ctx context.Context, record Record) error {
+	item, err := dynamodbattribute.MarshalMap(dynamoDBItem{
+		ImageDigest: record.ImageDigest,
+		UpdatedAt:   record.UpdatedAt.UTC().Format(timestampFormat),
+		Repository:  record.Repository,
+		IndexDigest: record.IndexDigest,
+		Status:      record.Status,
+		Message:     record.Message,
+		DurationMs:  record.Duration.Milliseconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package state
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB keeps the items of a table with the partition key ImageDigest and the string sort key UpdatedAt
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.items = append(f.items, input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	for _, item := range f.items {
+		if *item["ImageDigest"].S == *input.ExpressionAttributeValues[":digest"].S {
+			items = append(items, item)
+		}
+	}
+	// like DynamoDB, string sort keys are compared byte by byte
+	sort.Slice(items, func(i, j int) bool {
+		if input.ScanIndexForward == nil || *input.ScanIndexForward {
+			return *items[i]["UpdatedAt"].S < *items[j]["UpdatedAt"].S
+		}
+		return *items[i]["UpdatedAt"].S > *items[j]["UpdatedAt"].S
+	})
+	if input.Limit != nil && int64(len(items)) > *input.Limit {
+		items = items[:*input.Limit]
+	}
+	return &dynamodb.QueryOutput{Items: items}, nil
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	ctx := context.Background()
+	store := &DynamoDBStore{client: &fakeDynamoDB{}, tableName: "builds"}
+
+	record, err := store.Get(ctx, "sha256:1234")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if record != nil {
+		t.Fatalf("Expected no record for an unprocessed image, got %v", record)
+	}
+
+	// in RFC3339Nano .1Z sorts after .15Z
+	startedAt := time.Date(2024, 1, 1, 0, 0, 0, 100_000_000, time.UTC)
+	for i, status := range []string{StatusFailed, StatusPushed} {
+		err = store.Put(ctx, Record{
+			ImageDigest: "sha256:1234",
+			Repository:  "repository",
+			IndexDigest: "sha256:5678",
+			Status:      status,
+			UpdatedAt:   startedAt.Add(time.Duration(i) * 50 * time.Millisecond),
+			Duration:    1500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	store.Put(ctx, Record{ImageDigest: "sha256:9999", Status: StatusFailed, UpdatedAt: startedAt.Add(time.Hour)})
+
+	record, err = store.Get(ctx, "sha256:1234")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !IsProcessed(record) || !record.UpdatedAt.Equal(startedAt.Add(50*time.Millisecond)) {
+		t.Fatalf("Expected the latest record to be pushed, got %v", record)
+	}
+	if record.Repository != "repository" || record.IndexDigest != "sha256:5678" || record.Duration != 1500*time.Millisecond {
+		t.Fatalf("Unexpected record %+v", record)
+	}
+}
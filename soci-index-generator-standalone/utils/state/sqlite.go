@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package state
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS builds (
+	image_digest TEXT NOT NULL,
+	updated_at   TEXT NOT NULL,
+	repository   TEXT NOT NULL,
+	index_digest TEXT NOT NULL,
+	status       TEXT NOT NULL,
+	message      TEXT NOT NULL,
+	duration_ms  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS builds_image_digest ON builds (image_digest, updated_at);
+`
+
+// SQLite backed state store for standalone deployments on a single machine
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// Open (and create if needed) a SQLite state database file
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db}, nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, imageDigest string) (*Record, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT image_digest, updated_at, repository, index_digest, status, message, duration_ms
+		FROM builds WHERE image_digest = ? ORDER BY updated_at DESC LIMIT 1`, imageDigest)
+
+	var record Record
+	var updatedAt string
+	var durationMs int64
+	err := row.Scan(&record.ImageDigest, &updatedAt, &record.Repository, &record.IndexDigest, &record.Status, &record.Message, &durationMs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record.UpdatedAt, err = time.Parse(timestampFormat, updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	record.Duration = time.Duration(durationMs) * time.Millisecond
+	return &record, nil
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, record Record) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO builds (image_digest, updated_at, repository, index_digest, status, message, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		record.ImageDigest, record.UpdatedAt.UTC().Format(timestampFormat), record.Repository,
+		record.IndexDigest, record.Status, record.Message, record.Duration.Milliseconds())
+	return err
+}
+
+// Compact rebuilds the database file without the free pages left by deleted rows and indices
+func (s *SQLiteStore) Compact(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// Close the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
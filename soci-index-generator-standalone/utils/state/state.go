@@ -0,0 +1,62 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package state records which images have been indexed, so that already processed image digests are skipped
+package state
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Build outcomes recorded in the state store
+const (
+	StatusPushed  = "pushed"
+	StatusBuilt   = "built"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// Format of the UpdatedAt timestamps in the stores. It has a fixed width, so sorting the timestamps as strings
+// sorts them by time, which RFC3339Nano doesn't as it drops the trailing zeros of the fraction.
+const timestampFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Record of a single build of an image
+type Record struct {
+	ImageDigest string
+	Repository  string
+	IndexDigest string
+	Status      string
+	Message     string
+	UpdatedAt   time.Time
+	// how long the build took
+	Duration time.Duration
+}
+
+// Store keeps the history of builds keyed by image digest
+type Store interface {
+	// Get the latest record for an image digest, nil if the image was never processed
+	Get(ctx context.Context, imageDigest string) (*Record, error)
+	// Put appends a record to the history
+	Put(ctx context.Context, record Record) error
+}
+
+// Check if the latest record of an image means the image does not need to be processed again
+func IsProcessed(record *Record) bool {
+	return record != nil && record.Status == StatusPushed
+}
+
+// Describe what changed between the previous record of an image and the current one
+func DescribeChange(previous *Record, current Record) string {
+	switch {
+	case previous == nil:
+		return fmt.Sprintf("first build of the image: %s", current.Status)
+	case previous.Status != current.Status:
+		return fmt.Sprintf("status changed from %s (at %s) to %s", previous.Status, previous.UpdatedAt.Format(time.RFC3339), current.Status)
+	case previous.IndexDigest != current.IndexDigest:
+		return fmt.Sprintf("SOCI index changed from %s to %s", previous.IndexDigest, current.IndexDigest)
+	default:
+		return fmt.Sprintf("unchanged since %s: %s", previous.UpdatedAt.Format(time.RFC3339), current.Status)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package state
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLiteStore(path.Join(t.TempDir(), "state.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open the state database: %v", err)
+	}
+	defer store.Close()
+
+	record, err := store.Get(ctx, "sha256:1234")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if record != nil {
+		t.Fatalf("Expected no record for an unprocessed image, got %v", record)
+	}
+
+	startedAt := time.Now()
+	for _, status := range []string{StatusFailed, StatusPushed} {
+		err = store.Put(ctx, Record{
+			ImageDigest: "sha256:1234",
+			Repository:  "repository",
+			IndexDigest: "sha256:5678",
+			Status:      status,
+			UpdatedAt:   startedAt,
+			Duration:    1500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		startedAt = startedAt.Add(time.Second)
+	}
+
+	record, err = store.Get(ctx, "sha256:1234")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !IsProcessed(record) {
+		t.Fatalf("Expected the latest record to be pushed, got %v", record)
+	}
+	if record.Duration != 1500*time.Millisecond {
+		t.Fatalf("Unexpected duration. Expected 1.5s but got %s", record.Duration)
+	}
+
+	if err := store.Compact(ctx); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	record, err = store.Get(ctx, "sha256:1234")
+	if err != nil || !IsProcessed(record) {
+		t.Fatalf("Expected the record to be kept by the compaction, got %v, %v", record, err)
+	}
+}
+
+func TestSQLiteStoreOrder(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLiteStore(path.Join(t.TempDir(), "state.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to open the state database: %v", err)
+	}
+	defer store.Close()
+
+	// in RFC3339Nano .1Z sorts after .15Z
+	startedAt := time.Date(2024, 1, 1, 0, 0, 0, 100_000_000, time.UTC)
+	store.Put(ctx, Record{ImageDigest: "sha256:1234", Status: StatusFailed, UpdatedAt: startedAt})
+	store.Put(ctx, Record{ImageDigest: "sha256:1234", Status: StatusPushed, UpdatedAt: startedAt.Add(50 * time.Millisecond)})
+
+	record, err := store.Get(ctx, "sha256:1234")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !IsProcessed(record) || !record.UpdatedAt.Equal(startedAt.Add(50*time.Millisecond)) {
+		t.Fatalf("Expected the latest record to be pushed, got %v", record)
+	}
+}
+
+func TestDescribeChange(t *testing.T) {
+	previous := &Record{Status: StatusFailed, IndexDigest: "sha256:1234"}
+	current := Record{Status: StatusPushed, IndexDigest: "sha256:1234"}
+
+	if DescribeChange(nil, current) != "first build of the image: pushed" {
+		t.Fatalf("Unexpected change description for a new image: %s", DescribeChange(nil, current))
+	}
+	expected := "status changed from failed (at 0001-01-01T00:00:00Z) to pushed"
+	if DescribeChange(previous, current) != expected {
+		t.Fatalf("Unexpected change description. Expected %s but got %s", expected, DescribeChange(previous, current))
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package version contains the build metadata of the tool
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const toolName = "soci-index-builder"
+
+// The soci-snapshotter module, its version determines which snapshotters can read the built SOCI indices
+const SociModule = "github.com/awslabs/soci-snapshotter"
+
+// Set at build time with -ldflags "-X .../utils/version.Version=... -X .../utils/version.Commit=..."
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// The version of the embedded soci-snapshotter library, empty if the binary has no build info
+var SociVersion = ""
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == SociModule {
+			SociVersion = dep.Version
+		}
+	}
+	if Commit != "" {
+		return
+	}
+	// fall back to the VCS information embedded by the Go toolchain
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			Commit = setting.Value
+		}
+	}
+}
+
+// Build information of the tool
+type Info struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit,omitempty"`
+	GoVersion       string `json:"goVersion"`
+	SociSnapshotter string `json:"sociSnapshotter,omitempty"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, GoVersion: runtime.Version(), SociSnapshotter: SociVersion}
+}
+
+// User-Agent identifying the tool, its version and commit, with an optional custom suffix
+func UserAgent(suffix string) string {
+	userAgent := fmt.Sprintf("%s/%s", toolName, Version)
+	var details []string
+	if Commit != "" {
+		details = append(details, "commit "+shortCommit())
+	}
+	if SociVersion != "" {
+		details = append(details, "soci-snapshotter "+SociVersion)
+	}
+	if len(details) > 0 {
+		userAgent += fmt.Sprintf(" (%s)", strings.Join(details, "; "))
+	}
+	if suffix != "" {
+		userAgent += " " + suffix
+	}
+	return userAgent
+}
+
+func shortCommit() string {
+	if len(Commit) > 12 {
+		return Commit[:12]
+	}
+	return Commit
+}
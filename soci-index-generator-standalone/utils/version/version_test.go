@@ -0,0 +1,30 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package version
+
+import "testing"
+
+func TestUserAgent(t *testing.T) {
+	Version = "1.2.3"
+	Commit = "0123456789abcdef"
+	SociVersion = ""
+
+	expected := "soci-index-builder/1.2.3 (commit 0123456789ab) my-fleet"
+	if UserAgent("my-fleet") != expected {
+		t.Fatalf("Unexpected User-Agent. Expected %s but got %s", expected, UserAgent("my-fleet"))
+	}
+
+	SociVersion = "v0.6.1"
+	expected = "soci-index-builder/1.2.3 (commit 0123456789ab; soci-snapshotter v0.6.1)"
+	if UserAgent("") != expected {
+		t.Fatalf("Unexpected User-Agent. Expected %s but got %s", expected, UserAgent(""))
+	}
+
+	Commit = ""
+	SociVersion = ""
+	expected = "soci-index-builder/1.2.3"
+	if UserAgent("") != expected {
+		t.Fatalf("Unexpected User-Agent. Expected %s but got %s", expected, UserAgent(""))
+	}
+}